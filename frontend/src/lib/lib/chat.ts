@@ -4,7 +4,7 @@ export type Message = {
 	id: string;
 	role: 'user' | 'assistant';
 	text: string;
-	source?: 'CACHE' | 'CLOUD';
+	source?: 'CACHE' | 'CLOUD' | 'SUGGESTION';
 	showCard?: boolean;
 };
 
@@ -17,8 +17,21 @@ export type ChatSession = {
 };
 
 export type ChatApiResponse = {
+	id?: string;
+	cacheEntryId?: string;
+	sessionId?: string;
 	answer: string;
-	source: 'CACHE' | 'CLOUD';
+	source: 'CACHE' | 'CLOUD' | 'SUGGESTION';
+	suggestion?: ChatSuggestion;
+};
+
+// A near-miss cached answer. With source SUGGESTION it is served instead of a
+// fresh answer, and answer is empty.
+export type ChatSuggestion = {
+	entryId: string;
+	question: string;
+	answer: string;
+	similarity: number;
 };
 
 export type ExtractorOutput = {
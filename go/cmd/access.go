@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Entry-level access control. A shared entry is visible to the whole tenant
+// by default; POST /cache/{id}/access narrows it to the user who contributed
+// it ("owner") or opens it to the other tenants listed in
+// ECHO_PUBLIC_ENTRY_TENANTS ("public"), and "tenant" restores the default.
+// Private-tier entries are owner-only already.
+//
+// Access is enforced where entries are indexed: owner-only entries are
+// indexed with their contributor's private entries and public ones in a
+// partition the shared lookups of the listed tenants also search, so an entry
+// a caller may not see can neither match nor hide a match that caller may
+// see. Public entries of a tenant that is not listed stay in its own
+// partition. Only the contributor, or an admin with ECHO_ADMIN_TOKEN, may
+// change an entry's access, and only an admin may make it public: a public
+// entry answers other tenants' questions.
+
+const (
+	entryAccessPublic = "public"
+	entryAccessTenant = "tenant"
+	entryAccessOwner  = "owner"
+
+	// publicIndexTenant partitions public entries apart from every tenant.
+	publicIndexTenant = "\x00public"
+)
+
+type AccessRequest struct {
+	Access string `json:"access"`
+}
+
+// sharesPublicEntries reports whether tenant is listed in
+// ECHO_PUBLIC_ENTRY_TENANTS ("@default" for the default tenant), so that its
+// public entries are served to the other listed tenants and theirs to it.
+func sharesPublicEntries(tenant string) bool {
+	return slices.Contains(envList("ECHO_PUBLIC_ENTRY_TENANTS"), tenantName(tenant))
+}
+
+func entryAccess(entry VectorEntry) string {
+	if entry.Owner != sharedOwner {
+		return entryAccessOwner
+	}
+	if entry.Access == "" {
+		return entryAccessTenant
+	}
+	return entry.Access
+}
+
+// entryVisible reports whether caller may be served entry.
+func entryVisible(entry VectorEntry, caller Caller) bool {
+	if entry.Owner != sharedOwner {
+		return entry.Tenant == caller.Tenant && entry.Owner == caller.User
+	}
+	switch entryAccess(entry) {
+	case entryAccessPublic:
+		return entry.Tenant == caller.Tenant || sharesPublicEntries(entry.Tenant) && sharesPublicEntries(caller.Tenant)
+	case entryAccessOwner:
+		return entry.Tenant == caller.Tenant && entry.Contributor != "" && entry.Contributor == caller.User
+	}
+	return entry.Tenant == caller.Tenant
+}
+
+// indexPartition is the tenant and owner entry is indexed under.
+func indexPartition(entry VectorEntry) (string, string) {
+	if entry.Owner == sharedOwner && !entry.Authoritative {
+		switch entryAccess(entry) {
+		case entryAccessPublic:
+			if sharesPublicEntries(entry.Tenant) {
+				return publicIndexTenant, sharedOwner
+			}
+		case entryAccessOwner:
+			return entry.Tenant, entry.Contributor
+		}
+	}
+	return entry.Tenant, indexOwner(entry)
+}
+
+// callerPartitions lists the tenant and owner of every index partition
+// holding entries caller may be served.
+func callerPartitions(caller Caller) [][2]string {
+	partitions := [][2]string{{caller.Tenant, sharedOwner}, {caller.Tenant, faqIndexOwner}}
+	if sharesPublicEntries(caller.Tenant) {
+		partitions = append(partitions, [2]string{publicIndexTenant, sharedOwner})
+	}
+	if caller.User != "" {
+		partitions = append(partitions, [2]string{caller.Tenant, caller.User})
+	}
+	return partitions
+}
+
+// inLookupTier reports whether findBestMatch covers entry when it searches
+// tenant's entries owned by owner.
+func inLookupTier(entry VectorEntry, tenant, owner string) bool {
+	if entry.Authoritative {
+		return entry.Tenant == tenant && owner == sharedOwner
+	}
+	entryTenant, entryOwner := indexPartition(entry)
+	if entryTenant == publicIndexTenant {
+		return owner == sharedOwner && sharesPublicEntries(tenant)
+	}
+	return entryTenant == tenant && entryOwner == owner
+}
+
+// findTenantEntry returns a copy of tenant's hot-tier entry with id,
+// regardless of its access.
+func findTenantEntry(tenant, id string) (VectorEntry, bool) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+	for _, entry := range MockVectorDB {
+		if entry.ID == id && entry.Tenant == tenant {
+			return entry, true
+		}
+	}
+	return VectorEntry{}, false
+}
+
+// adminTokenValid reports whether r carries the admin token, without
+// answering it as requireAdmin does.
+func adminTokenValid(r *http.Request) bool {
+	token := envString("ECHO_ADMIN_TOKEN", "")
+	provided := strings.TrimSpace(r.Header.Get("X-Admin-Token"))
+	return token != "" && subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1
+}
+
+// entryForCurator returns the entry named by r's path, and the actor to
+// audit, when caller contributed it or r carries the admin token. Admins also
+// reach entries restricted to another user.
+func entryForCurator(w http.ResponseWriter, r *http.Request, caller Caller) (VectorEntry, string, bool) {
+	admin := adminTokenValid(r)
+	entry, found := findEntryForCaller(caller, r.PathValue("id"))
+	if !found && admin {
+		entry, found = findTenantEntry(caller.Tenant, r.PathValue("id"))
+	}
+	if !found {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "cache entry not found"})
+		return VectorEntry{}, "", false
+	}
+	if admin {
+		return entry, "admin", true
+	}
+	if entry.Contributor == "" || entry.Contributor != caller.User {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "only the contributor or an admin can change this entry"})
+		return VectorEntry{}, "", false
+	}
+	return entry, callerActor(caller), true
+}
+
+// setEntryAccess changes the access of the entry with id and reindexes it.
+func setEntryAccess(id, access string) (VectorEntry, bool) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	for i := range MockVectorDB {
+		if MockVectorDB[i].ID != id {
+			continue
+		}
+		// Callers who could see the entry only before the change see it
+		// deleted.
+		recordCacheChange(changeDeleted, MockVectorDB[i])
+		MockVectorDB[i].Access = access
+		if access == entryAccessTenant {
+			MockVectorDB[i].Access = ""
+		}
+		bloomAddLocked(MockVectorDB[i])
+		invalidateIndexLocked()
+		markCacheChanged()
+		recordCacheChange(changeUpdated, MockVectorDB[i])
+		return MockVectorDB[i], true
+	}
+	return VectorEntry{}, false
+}
+
+func handleEntryAccess(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if caller.Anonymous {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "access control is not available in demo mode"})
+		return
+	}
+
+	var req AccessRequest
+	if err := readJSON(r, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON payload"})
+		return
+	}
+	access := strings.ToLower(strings.TrimSpace(req.Access))
+	if access != entryAccessPublic && access != entryAccessTenant && access != entryAccessOwner {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "access must be public, tenant or owner"})
+		return
+	}
+
+	entry, actor, ok := entryForCurator(w, r, caller)
+	if !ok {
+		return
+	}
+	if entry.Owner != sharedOwner {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "private entries are owner-only"})
+		return
+	}
+	if entry.Authoritative {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "FAQ entries are visible to their tenant"})
+		return
+	}
+	if access == entryAccessPublic && !adminTokenValid(r) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "only an admin can make an entry public"})
+		return
+	}
+	if access == entryAccessPublic && !sharesPublicEntries(caller.Tenant) {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "tenant does not share public entries; see ECHO_PUBLIC_ENTRY_TENANTS"})
+		return
+	}
+	if access == entryAccessOwner && entry.Contributor == "" {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "entry has no recorded contributor"})
+		return
+	}
+
+	updated, found := setEntryAccess(entry.ID, access)
+	if !found {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "cache entry not found"})
+		return
+	}
+	recordAudit(AuditEvent{
+		Action:  "cache.access",
+		EntryID: entry.ID,
+		Tenant:  caller.Tenant,
+		Actor:   actor,
+		Details: map[string]string{"from": entryAccess(entry), "to": access},
+	})
+	writeJSON(w, http.StatusOK, entryView(updated))
+}
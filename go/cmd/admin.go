@@ -0,0 +1,24 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requireAdmin guards operator endpoints with the shared ECHO_ADMIN_TOKEN.
+// Admin endpoints stay disabled until a token is configured.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token := envString("ECHO_ADMIN_TOKEN", "")
+	if token == "" {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin API disabled"})
+		return false
+	}
+
+	provided := strings.TrimSpace(r.Header.Get("X-Admin-Token"))
+	if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid admin token"})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// The analytics export writes history and savings to S3 as Parquet every
+// ECHO_ANALYTICS_EXPORT_INTERVAL, for SQL over longer spans than the
+// in-memory history keeps. Each run writes the history items added since the
+// previous run under analytics/history/dt=YYYY-MM-DD/, partitioned by the
+// item's date, and a snapshot of every tenant's cumulative savings counters
+// under analytics/savings/dt=YYYY-MM-DD/. In log privacy mode question and
+// answer text are exported as hashes.
+
+const analyticsKeyPrefix = "analytics/"
+
+func analyticsObjectKey(table string, day time.Time) string {
+	return fmt.Sprintf("%s%s/dt=%s/%s-%s.parquet", analyticsKeyPrefix, table, day.Format("2006-01-02"), nodeID, newID())
+}
+
+// historyParquet encodes history items as one Parquet file.
+func historyParquet(items []HistoryItem) []byte {
+	id, timestamp := stringColumn("id"), timestampColumn("timestamp")
+	tenant, user, apiKey, session := stringColumn("tenant"), stringColumn("user"), stringColumn("api_key"), stringColumn("session_id")
+	question, answer := stringColumn("question"), stringColumn("answer")
+	saved, source, model, entryID := boolColumn("saved"), stringColumn("source"), stringColumn("model"), stringColumn("cache_entry_id")
+	tokens, energy, co2 := int64Column("tokens_saved"), doubleColumn("energy_saved_wh"), doubleColumn("co2_saved_g")
+	for _, item := range items {
+		id.appendString(item.ID)
+		timestamp.appendTime(item.Timestamp)
+		tenant.appendString(item.Tenant)
+		user.appendString(item.User)
+		apiKey.appendString(item.APIKey)
+		session.appendString(item.SessionID)
+		question.appendString(redactContent(item.Question))
+		answer.appendString(redactContent(item.Answer))
+		saved.appendBool(item.Saved)
+		source.appendString(item.Source)
+		model.appendString(item.Model)
+		entryID.appendString(item.CacheEntryID)
+		tokens.appendInt64(int64(item.Tokens))
+		energy.appendDouble(item.EnergyWh)
+		co2.appendDouble(item.CO2g)
+	}
+	columns := []*parquetColumn{id, timestamp, tenant, user, apiKey, session, question, answer, saved, source, model, entryID, tokens, energy, co2}
+	return encodeParquet(columns, len(items))
+}
+
+// savingsParquet encodes every tenant's savings counters as of at.
+func savingsParquet(at time.Time) ([]byte, int) {
+	snapshotAt, tenant := timestampColumn("snapshot_at"), stringColumn("tenant")
+	requests, hits, hitRate := int64Column("requests"), int64Column("cache_hits"), doubleColumn("hit_rate")
+	tokens, energy, co2, usd := int64Column("tokens_saved"), doubleColumn("energy_saved_wh"), doubleColumn("co2_saved_g"), doubleColumn("usd_saved")
+
+	savingsMutex.Lock()
+	for name, summary := range savingsByTenant {
+		snapshotAt.appendTime(at)
+		tenant.appendString(name)
+		requests.appendInt64(int64(summary.Requests))
+		hits.appendInt64(int64(summary.CacheHits))
+		hitRate.appendDouble(summary.HitRate)
+		tokens.appendInt64(int64(summary.TokensSaved))
+		energy.appendDouble(summary.EnergySavedWh)
+		co2.appendDouble(summary.CO2SavedG)
+		usd.appendDouble(summary.USDSaved)
+	}
+	rows := len(savingsByTenant)
+	savingsMutex.Unlock()
+
+	columns := []*parquetColumn{snapshotAt, tenant, requests, hits, hitRate, tokens, energy, co2, usd}
+	return encodeParquet(columns, rows), rows
+}
+
+// exportAnalytics writes history items from [start, end) and a savings
+// snapshot taken at end.
+func exportAnalytics(start, end time.Time) error {
+	target := activeS3Target()
+	if target == nil {
+		return fmt.Errorf("S3 is not configured")
+	}
+
+	byDay := make(map[time.Time][]HistoryItem)
+	dbMutex.RLock()
+	for _, item := range ChatHistory {
+		if !item.Timestamp.Before(start) && item.Timestamp.Before(end) {
+			day := item.Timestamp.UTC().Truncate(24 * time.Hour)
+			byDay[day] = append(byDay[day], item)
+		}
+	}
+	dbMutex.RUnlock()
+
+	exported := 0
+	for day, items := range byDay {
+		if err := putObject(target, analyticsObjectKey("history", day), historyParquet(items), "application/vnd.apache.parquet", ""); err != nil {
+			return fmt.Errorf("export history for %s: %w", day.Format("2006-01-02"), err)
+		}
+		exported += len(items)
+	}
+
+	body, tenants := savingsParquet(end)
+	if tenants > 0 {
+		if err := putObject(target, analyticsObjectKey("savings", end.UTC()), body, "application/vnd.apache.parquet", ""); err != nil {
+			return fmt.Errorf("export savings: %w", err)
+		}
+	}
+
+	log.Printf("Analytics: exported %d history items and savings for %d tenants", exported, tenants)
+	return nil
+}
+
+func startAnalyticsExport(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	periodStart := time.Now()
+
+	go func() {
+		defer ticker.Stop()
+		for range ticker.C {
+			periodEnd := time.Now()
+			if err := exportAnalytics(periodStart, periodEnd); err != nil {
+				log.Printf("Analytics export failed: %v", err)
+				continue
+			}
+			periodStart = periodEnd
+		}
+	}()
+}
+
+// handleHistoryParquet returns the whole history as Parquet, in the layout
+// the export writes, for one-off loads into a notebook or warehouse.
+func handleHistoryParquet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	dbMutex.RLock()
+	items := append([]HistoryItem(nil), ChatHistory...)
+	dbMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/vnd.apache.parquet")
+	w.Header().Set("Content-Disposition", `attachment; filename="history.parquet"`)
+	w.Write(historyParquet(items))
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Annotations let callers keep notes and labels on their history items, so
+// the history doubles as a knowledge log. PATCH /history/{id} sets them;
+// GET /history filters by ?label= and searches questions, answers and notes
+// with ?q=. Like pins, annotations live with the item in memory.
+
+const (
+	maxNoteRunes     = 4000
+	maxLabelsPerItem = 20
+)
+
+var labelPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.:-]{0,63}$`)
+
+// AnnotationRequest changes only the fields it sets; an empty note or label
+// list clears them.
+type AnnotationRequest struct {
+	Note   *string   `json:"note"`
+	Labels *[]string `json:"labels"`
+}
+
+// normalizeLabels lowercases, deduplicates and sorts labels.
+func normalizeLabels(labels []string) ([]string, error) {
+	if len(labels) > maxLabelsPerItem {
+		return nil, fmt.Errorf("at most %d labels are allowed", maxLabelsPerItem)
+	}
+	normalized := make([]string, 0, len(labels))
+	for _, label := range labels {
+		label = strings.ToLower(strings.TrimSpace(label))
+		if !labelPattern.MatchString(label) {
+			return nil, fmt.Errorf("invalid label %q", label)
+		}
+		normalized = append(normalized, label)
+	}
+	slices.Sort(normalized)
+	return slices.Compact(normalized), nil
+}
+
+// annotateHistory applies req to the caller's history item with id.
+func annotateHistory(caller Caller, id string, req AnnotationRequest) (HistoryItem, bool) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	for i := range ChatHistory {
+		if ChatHistory[i].ID != id || !historyVisible(ChatHistory[i], caller) {
+			continue
+		}
+		item := &ChatHistory[i]
+		if req.Note != nil {
+			item.Note = strings.TrimSpace(*req.Note)
+		}
+		if req.Labels != nil {
+			item.Labels = *req.Labels
+			if len(item.Labels) == 0 {
+				item.Labels = nil
+			}
+		}
+		item.AnnotatedAt = nil
+		if item.Note != "" || item.Labels != nil {
+			now := time.Now()
+			item.AnnotatedAt = &now
+		}
+		return *item, true
+	}
+	return HistoryItem{}, false
+}
+
+// historyMatches reports whether item carries label and contains query in
+// its question, answer or note. Empty filters match everything.
+func historyMatches(item HistoryItem, label, query string) bool {
+	if label != "" && !slices.Contains(item.Labels, label) {
+		return false
+	}
+	if query == "" {
+		return true
+	}
+	for _, text := range []string{item.Question, item.Answer, item.Note} {
+		if strings.Contains(strings.ToLower(text), query) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleHistoryItem returns (GET) or annotates (PATCH) a history item.
+func handleHistoryItem(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPatch {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if rejectAnonymous(w, caller, "history") {
+		return
+	}
+	id := r.PathValue("id")
+
+	if r.Method == http.MethodGet {
+		dbMutex.RLock()
+		defer dbMutex.RUnlock()
+		for _, item := range ChatHistory {
+			if item.ID == id && historyVisible(item, caller) {
+				writeJSON(w, http.StatusOK, item)
+				return
+			}
+		}
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "history item not found"})
+		return
+	}
+
+	var req AnnotationRequest
+	if err := readJSON(r, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON payload"})
+		return
+	}
+	if req.Note == nil && req.Labels == nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "note or labels is required"})
+		return
+	}
+	if req.Note != nil && utf8.RuneCountInString(*req.Note) > maxNoteRunes {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("note must be at most %d characters", maxNoteRunes)})
+		return
+	}
+	if req.Labels != nil {
+		labels, err := normalizeLabels(*req.Labels)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		req.Labels = &labels
+	}
+
+	item, found := annotateHistory(caller, id, req)
+	if !found {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "history item not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, item)
+}
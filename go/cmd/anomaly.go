@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Anomaly detection compares a fast moving average of hit rate and best-match
+// similarity against a slow baseline. A sudden gap between the two usually
+// means the client switched embedding models or the cache was corrupted.
+// Alerts are logged, counted in /stats/anomalies and, with
+// ECHO_ANOMALY_WEBHOOK_URL, posted as JSON. The detector watches all tenants'
+// traffic together, so only admins may read it.
+
+const (
+	anomalyFastAlpha     = 0.05
+	anomalyBaselineAlpha = 0.002
+)
+
+type AnomalySignal struct {
+	Name     string  `json:"name"`
+	Baseline float64 `json:"baseline"`
+	Recent   float64 `json:"recent"`
+	Band     float64 `json:"band"`
+	Alerting bool    `json:"alerting"`
+	Alerts   int     `json:"alerts"`
+}
+
+type AnomalyEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Signal    string    `json:"signal"`
+	Baseline  float64   `json:"baseline"`
+	Recent    float64   `json:"recent"`
+	Band      float64   `json:"band"`
+	Recovered bool      `json:"recovered"`
+}
+
+type AnomalyStats struct {
+	Samples    int             `json:"samples"`
+	MinSamples int             `json:"minSamples"`
+	Signals    []AnomalySignal `json:"signals"`
+	Recent     []AnomalyEvent  `json:"recent"`
+}
+
+const maxAnomalyEvents = 100
+
+var (
+	anomalyMutex   sync.Mutex
+	anomalySamples int
+	anomalyHitRate = AnomalySignal{Name: "hit_rate"}
+	anomalySim     = AnomalySignal{Name: "similarity"}
+	anomalyEvents  []AnomalyEvent
+)
+
+func (s *AnomalySignal) observe(value float64, samples int) {
+	if samples == 1 {
+		s.Baseline, s.Recent = value, value
+		return
+	}
+	s.Recent += anomalyFastAlpha * (value - s.Recent)
+	s.Baseline += anomalyBaselineAlpha * (value - s.Baseline)
+}
+
+// check flips the alerting state when the recent average leaves the band and
+// returns the event describing the change. An alert only clears once the gap
+// is back under half the band, so a signal on the edge does not flap.
+func (s *AnomalySignal) check(band float64) (AnomalyEvent, bool) {
+	s.Band = band
+	gap := math.Abs(s.Recent - s.Baseline)
+	outside := gap > band
+	if s.Alerting {
+		outside = gap > band/2
+	}
+	if outside == s.Alerting {
+		return AnomalyEvent{}, false
+	}
+	s.Alerting = outside
+	if outside {
+		s.Alerts++
+	}
+	return AnomalyEvent{
+		Timestamp: time.Now(),
+		Signal:    s.Name,
+		Baseline:  s.Baseline,
+		Recent:    s.Recent,
+		Band:      band,
+		Recovered: !outside,
+	}, true
+}
+
+// observeLookup feeds one cache lookup into the detectors.
+func observeLookup(score float64, hit bool) {
+	hitValue := 0.0
+	if hit {
+		hitValue = 1
+	}
+
+	anomalyMutex.Lock()
+	anomalySamples++
+	anomalyHitRate.observe(hitValue, anomalySamples)
+	anomalySim.observe(score, anomalySamples)
+
+	var events []AnomalyEvent
+	if anomalySamples >= envInt("ECHO_ANOMALY_MIN_SAMPLES", 500) {
+		if event, ok := anomalyHitRate.check(envFloat("ECHO_ANOMALY_HIT_RATE_BAND", 0.2)); ok {
+			events = append(events, event)
+		}
+		if event, ok := anomalySim.check(envFloat("ECHO_ANOMALY_SIMILARITY_BAND", 0.1)); ok {
+			events = append(events, event)
+		}
+	}
+	anomalyEvents = append(anomalyEvents, events...)
+	if excess := len(anomalyEvents) - maxAnomalyEvents; excess > 0 {
+		anomalyEvents = anomalyEvents[excess:]
+	}
+	anomalyMutex.Unlock()
+
+	for _, event := range events {
+		if event.Recovered {
+			log.Printf("Anomaly recovered: %s back to %.3f (baseline %.3f)", event.Signal, event.Recent, event.Baseline)
+		} else {
+			log.Printf("Warning: anomaly in %s: recent %.3f vs baseline %.3f (band %.3f)", event.Signal, event.Recent, event.Baseline, event.Band)
+		}
+		go notifyAnomaly(event)
+	}
+}
+
+func notifyAnomaly(event AnomalyEvent) {
+	postWebhook(envString("ECHO_ANOMALY_WEBHOOK_URL", ""), event, "Anomaly")
+}
+
+func handleAnomalies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	anomalyMutex.Lock()
+	stats := AnomalyStats{
+		Samples:    anomalySamples,
+		MinSamples: envInt("ECHO_ANOMALY_MIN_SAMPLES", 500),
+		Signals:    []AnomalySignal{anomalyHitRate, anomalySim},
+		Recent:     append([]AnomalyEvent(nil), anomalyEvents...),
+	}
+	anomalyMutex.Unlock()
+
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// POST /cache/{id}/compare generates a fresh answer for an entry without
+// storing it and compares it with the cached one: semantically, by the
+// cosine similarity of their embeddings, and textually, as a word diff. It
+// helps a curator decide whether POST /cache/{id}/refresh is worth it.
+
+// maxDiffCells bounds the word diff's table; longer answers that differ in
+// their middle are reported as replaced wholesale.
+const maxDiffCells = 1 << 22
+
+const (
+	diffEqual  = "equal"
+	diffInsert = "insert"
+	diffDelete = "delete"
+)
+
+// DiffSegment is a run of words the fresh answer keeps, inserts or deletes
+// relative to the cached one.
+type DiffSegment struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+type CompareResponse struct {
+	EntryID string `json:"entryId"`
+	Model   string `json:"model"`
+	Cached  string `json:"cached"`
+	Fresh   string `json:"fresh"`
+	// SemanticSimilarity is left out when the answers could not be embedded.
+	SemanticSimilarity *float64 `json:"semanticSimilarity,omitempty"`
+	// TextSimilarity is the share of words the answers have in common.
+	TextSimilarity float64 `json:"textSimilarity"`
+	// Drifted applies ECHO_CANARY_DRIFT_THRESHOLD to the semantic
+	// similarity, or to the text similarity when there is none.
+	Drifted bool          `json:"drifted"`
+	Diff    []DiffSegment `json:"diff"`
+}
+
+// wordDiff diffs the words of cached and fresh by longest common
+// subsequence and returns the segments and the number of common words.
+func wordDiff(cached, fresh string) ([]DiffSegment, int) {
+	a, b := strings.Fields(cached), strings.Fields(fresh)
+	segments := make([]DiffSegment, 0)
+	add := func(op, word string) {
+		if n := len(segments); n > 0 && segments[n-1].Op == op {
+			segments[n-1].Text += " " + word
+			return
+		}
+		segments = append(segments, DiffSegment{Op: op, Text: word})
+	}
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		add(diffEqual, a[prefix])
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	common := prefix + suffix
+
+	if (len(midA)+1)*(len(midB)+1) > maxDiffCells {
+		for _, word := range midA {
+			add(diffDelete, word)
+		}
+		for _, word := range midB {
+			add(diffInsert, word)
+		}
+	} else {
+		// lcs[i][j] is the common subsequence length of midA[i:] and midB[j:].
+		cols := len(midB) + 1
+		lcs := make([]int32, (len(midA)+1)*cols)
+		for i := len(midA) - 1; i >= 0; i-- {
+			for j := len(midB) - 1; j >= 0; j-- {
+				if midA[i] == midB[j] {
+					lcs[i*cols+j] = lcs[(i+1)*cols+j+1] + 1
+				} else {
+					lcs[i*cols+j] = max(lcs[(i+1)*cols+j], lcs[i*cols+j+1])
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(midA) && j < len(midB) {
+			switch {
+			case midA[i] == midB[j]:
+				add(diffEqual, midA[i])
+				common++
+				i, j = i+1, j+1
+			case lcs[(i+1)*cols+j] >= lcs[i*cols+j+1]:
+				add(diffDelete, midA[i])
+				i++
+			default:
+				add(diffInsert, midB[j])
+				j++
+			}
+		}
+		for ; i < len(midA); i++ {
+			add(diffDelete, midA[i])
+		}
+		for ; j < len(midB); j++ {
+			add(diffInsert, midB[j])
+		}
+	}
+
+	for _, word := range a[len(a)-suffix:] {
+		add(diffEqual, word)
+	}
+	return segments, common
+}
+
+func handleCompare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if caller.Anonymous {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "compare is not available in demo mode"})
+		return
+	}
+
+	var req RefreshRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON payload"})
+			return
+		}
+	}
+
+	entry, found := findEntryForCaller(caller, r.PathValue("id"))
+	if !found {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "cache entry not found"})
+		return
+	}
+
+	modelName, err := resolveModel(caller.Tenant, req.Model)
+	if err != nil {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+		return
+	}
+	reserved := estimateTokens(entry.Question)
+	if denial := reserveTokens(caller, reserved); denial != nil {
+		writeQuotaExceeded(w, denial)
+		return
+	}
+	defer releaseTokens(caller, reserved)
+	if budget, exhausted := budgetExhausted(caller.Tenant); exhausted {
+		writeBudgetExceeded(w, budget)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 20*time.Second)
+	defer cancel()
+
+	fresh, err := generateAnswer(ctx, styledPrompt(entry.Question, entryStyle(entry)), modelName)
+	if err != nil {
+		reportProviderError(r, caller, modelName, err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "failed to generate response"})
+		return
+	}
+	recordUsage(caller, modelName, "CLOUD", estimateTokens(entry.Question)+estimateTokens(fresh), 0)
+
+	cached := entryAnswer(entry)
+	resp := CompareResponse{EntryID: entry.ID, Model: modelName, Cached: cached, Fresh: fresh}
+	var common int
+	resp.Diff, common = wordDiff(cached, fresh)
+	if words := len(strings.Fields(cached)) + len(strings.Fields(fresh)); words > 0 {
+		resp.TextSimilarity = 2 * float64(common) / float64(words)
+	} else {
+		resp.TextSimilarity = 1
+	}
+	if similarity, err := compareAnswers(ctx, cached, fresh); err != nil {
+		log.Printf("Compare entry %s: embedding failed, textual diff only: %v", entry.ID, err)
+		resp.Drifted = resp.TextSimilarity < canaryDriftThreshold()
+	} else {
+		resp.SemanticSimilarity = &similarity
+		resp.Drifted = similarity < canaryDriftThreshold()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Archival moves entries that have not been hit for a while out of RAM and
+// out of cache.json into a separate archive object, so the working set stays
+// small while the history is preserved and can be restored on demand. Each
+// tenant has its own archive object next to its cache object, encrypted with
+// the tenant's KMS key, so archival never mixes tenants.
+
+const archiveObjectKey = "cache-archive.json"
+
+func tenantArchiveKey(tenant string) string {
+	if tenant == defaultTenant {
+		return archiveObjectKey
+	}
+	return tenantKeyPrefix + tenant + "/" + archiveObjectKey
+}
+
+type ArchivedEntryView struct {
+	Question  string    `json:"question"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastHitAt time.Time `json:"lastHitAt,omitempty"`
+	HitCount  int       `json:"hitCount"`
+}
+
+type RestoreRequest struct {
+	Questions []string `json:"questions"`
+}
+
+var (
+	archiveAfter time.Duration
+
+	// archiveMutex serializes read-modify-write cycles on the archive object
+	// and guards archivedQuestions.
+	archiveMutex      sync.Mutex
+	archivedQuestions = make(map[string]struct{})
+)
+
+func initArchive() {
+	days := envInt("ECHO_ARCHIVE_AFTER_DAYS", 0)
+	if days <= 0 || activeS3Target() == nil {
+		return
+	}
+	archiveAfter = time.Duration(days) * 24 * time.Hour
+
+	tenants, err := listTenants(activeS3Target())
+	if err != nil {
+		log.Printf("Load archive failed: list tenants: %v", err)
+		return
+	}
+
+	archiveMutex.Lock()
+	defer archiveMutex.Unlock()
+	archived := 0
+	for _, tenant := range tenants {
+		entries, err := fetchArchiveLocked(tenant)
+		if err != nil {
+			log.Printf("Load archive for tenant %q failed: %v", tenant, err)
+			continue
+		}
+		for _, entry := range entries {
+			archivedQuestions[entryKey(tenant, entry.Owner, entry.Question)] = struct{}{}
+		}
+		archived += len(entries)
+	}
+	log.Printf("Archival: entries idle for %d days are archived (%d archived)", days, archived)
+}
+
+func archiveEnabled() bool {
+	return archiveAfter > 0
+}
+
+func isArchivedQuestion(questionKey string) bool {
+	if !archiveEnabled() {
+		return false
+	}
+	archiveMutex.Lock()
+	defer archiveMutex.Unlock()
+	_, ok := archivedQuestions[questionKey]
+	return ok
+}
+
+// fetchArchiveLocked reads tenant's archive. Entries are stamped with tenant,
+// like cache objects, so a restore can only ever bring them back into it.
+func fetchArchiveLocked(tenant string) ([]VectorEntry, error) {
+	target := activeS3Target()
+	if target == nil {
+		return nil, fmt.Errorf("S3 is not configured")
+	}
+
+	key := tenantArchiveKey(tenant)
+	body, err := getObject(target, key)
+	if err != nil || len(body) == 0 {
+		return nil, err
+	}
+
+	var entries []VectorEntry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", key, err)
+	}
+	for i := range entries {
+		entries[i].Tenant = tenant
+	}
+	return entries, nil
+}
+
+func putArchiveLocked(tenant string, entries []VectorEntry) error {
+	target := activeS3Target()
+	if target == nil {
+		return fmt.Errorf("S3 is not configured")
+	}
+
+	jsonBody, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return putCacheObject(target, tenantArchiveKey(tenant), jsonBody, tenantKMSKey(tenant))
+}
+
+// archiveStaleEntries moves idle entries from the hot and cold tiers into the
+// archive object. Entries are only dropped locally after the archive write
+// succeeded.
+func archiveStaleEntries() {
+	if !archiveEnabled() {
+		return
+	}
+	cutoff := time.Now().Add(-archiveAfter)
+
+	dbMutex.RLock()
+	var stale []VectorEntry
+	for _, entry := range MockVectorDB {
+		if !entry.Pinned && entryHeat(entry).Before(cutoff) {
+			stale = append(stale, entry)
+		}
+	}
+	dbMutex.RUnlock()
+
+	if tieringEnabled() {
+		coldEntries, err := readColdEntries()
+		if err != nil {
+			log.Printf("Read cold tier for archival failed: %v", err)
+		}
+		for _, entry := range coldEntries {
+			if !entry.Pinned && entryHeat(entry).Before(cutoff) {
+				stale = append(stale, entry)
+			}
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+
+	byTenant := make(map[string][]VectorEntry)
+	for _, entry := range stale {
+		byTenant[entry.Tenant] = append(byTenant[entry.Tenant], entry)
+	}
+
+	// A tenant whose archive write fails keeps its entries for the next
+	// cycle; the others are archived regardless.
+	staleQuestions := make(map[string]struct{}, len(stale))
+	var moved []VectorEntry
+	archiveMutex.Lock()
+	for tenant, entries := range byTenant {
+		archived, err := fetchArchiveLocked(tenant)
+		if err == nil {
+			err = putArchiveLocked(tenant, append(archived, entries...))
+		}
+		if err != nil {
+			log.Printf("Archive stale entries for tenant %q failed: %v", tenant, err)
+			continue
+		}
+		for _, entry := range entries {
+			questionKey := entryKey(entry.Tenant, entry.Owner, entry.Question)
+			archivedQuestions[questionKey] = struct{}{}
+			staleQuestions[questionKey] = struct{}{}
+		}
+		moved = append(moved, entries...)
+	}
+	archiveMutex.Unlock()
+	if len(moved) == 0 {
+		return
+	}
+
+	removed := removeEntriesByQuestion(staleQuestions)
+	for _, entry := range moved {
+		recordEvent(Event{Type: eventCacheEvict, Tenant: entry.Tenant, EntryID: entry.ID, Reason: "archived"})
+	}
+	log.Printf("Archived %d stale entries.", removed)
+}
+
+// removeEntriesByQuestion drops matching entries from the hot and cold tiers
+// and returns how many were removed.
+func removeEntriesByQuestion(questions map[string]struct{}) (removed int) {
+	defer func() {
+		if removed > 0 {
+			markCacheChanged()
+		}
+	}()
+
+	dbMutex.Lock()
+	kept := MockVectorDB[:0]
+	for _, entry := range MockVectorDB {
+		if _, ok := questions[entryKey(entry.Tenant, entry.Owner, entry.Question)]; ok {
+			removed++
+			recordCacheChange(changeDeleted, entry)
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	MockVectorDB = kept
+	invalidateIndexLocked()
+	dbMutex.Unlock()
+
+	if !tieringEnabled() {
+		return removed
+	}
+
+	taken, err := takeColdEntries(func(entry VectorEntry) bool {
+		_, ok := questions[entryKey(entry.Tenant, entry.Owner, entry.Question)]
+		return ok
+	})
+	if err != nil {
+		log.Printf("Read cold tier failed: %v", err)
+	}
+	return removed + len(taken)
+}
+
+func handleArchive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if !archiveEnabled() {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "archival is not enabled"})
+		return
+	}
+
+	tenant, err := resolveTenant(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	archiveMutex.Lock()
+	entries, err := fetchArchiveLocked(tenant)
+	archiveMutex.Unlock()
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "failed to read archive"})
+		return
+	}
+
+	views := make([]ArchivedEntryView, 0, len(entries))
+	for _, entry := range entries {
+		views = append(views, ArchivedEntryView{
+			Question:  entry.Question,
+			CreatedAt: entry.CreatedAt,
+			LastHitAt: entry.LastHitAt,
+			HitCount:  entry.HitCount,
+		})
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// handleArchiveRestore moves the requested questions (or everything, when
+// none are given) from the archive back into the live cache.
+func handleArchiveRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if !archiveEnabled() {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "archival is not enabled"})
+		return
+	}
+
+	tenant, err := resolveTenant(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var req RestoreRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON payload"})
+			return
+		}
+	}
+	wanted := make(map[string]struct{}, len(req.Questions))
+	for _, question := range req.Questions {
+		wanted[entryKey(tenant, sharedOwner, question)] = struct{}{}
+	}
+
+	archiveMutex.Lock()
+	archived, err := fetchArchiveLocked(tenant)
+	if err != nil {
+		archiveMutex.Unlock()
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "failed to read archive"})
+		return
+	}
+
+	restore, keep := splitArchive(archived, tenant, wanted)
+	if len(restore) > 0 {
+		if err := putArchiveLocked(tenant, keep); err != nil {
+			archiveMutex.Unlock()
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "failed to update archive"})
+			return
+		}
+		for _, entry := range restore {
+			delete(archivedQuestions, entryKey(entry.Tenant, entry.Owner, entry.Question))
+		}
+	}
+	archiveMutex.Unlock()
+
+	// Restored entries count as fresh so they are not archived again on the
+	// next cycle.
+	now := time.Now()
+	for i := range restore {
+		restore[i].LastHitAt = now
+	}
+	restored := mergeEntries(restore, cacheSourceS3)
+	if restored > 0 {
+		go uploadToS3()
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"restored": restored, "archived": len(keep)})
+}
+
+// splitArchive separates the archived entries a restore for tenant brings
+// back (all of them when wanted is empty) from those that stay archived.
+func splitArchive(archived []VectorEntry, tenant string, wanted map[string]struct{}) (restore, keep []VectorEntry) {
+	for _, entry := range archived {
+		_, ok := wanted[entryKey(entry.Tenant, sharedOwner, entry.Question)]
+		if entry.Tenant == tenant && (len(wanted) == 0 || ok) {
+			restore = append(restore, entry)
+		} else {
+			keep = append(keep, entry)
+		}
+	}
+	return restore, keep
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// The audit trail records changes to cached knowledge (refreshes, restores,
+// deletions) so operators can see what changed, when, and by whom.
+//
+// Events are kept append-only outside the process too. In stateless mode
+// they go to the state store's audit stream, which every replica tails. With
+// S3 they are written as newline-delimited JSON under the tenant's
+// audit/dt=YYYY-MM-DD/ prefix, encrypted with its key, every
+// ECHO_AUDIT_FLUSH_INTERVAL (default 10s) and on shutdown; every batch is a
+// new object, so nothing written is ever replaced. /audit lists the last
+// maxAuditEvents events this process has seen.
+
+type AuditEvent struct {
+	ID        string            `json:"id"`
+	Timestamp time.Time         `json:"timestamp"`
+	Action    string            `json:"action"`
+	EntryID   string            `json:"entryId,omitempty"`
+	Tenant    string            `json:"tenant,omitempty"`
+	Actor     string            `json:"actor,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+const maxAuditEvents = 10000
+
+var (
+	// auditMutex guards auditEvents and auditPending.
+	auditMutex  sync.Mutex
+	auditEvents []AuditEvent
+	// auditPending holds the events not yet written to S3.
+	auditPending []AuditEvent
+	auditToS3    bool
+)
+
+func callerActor(caller Caller) string {
+	switch {
+	case caller.User != "":
+		return "user:" + caller.User
+	case caller.APIKey != "":
+		return "key:" + caller.APIKey
+	default:
+		return "anonymous"
+	}
+}
+
+func recordAudit(event AuditEvent) {
+	event.ID = newID()
+	event.Timestamp = time.Now()
+	log.Printf("Audit: %s entry=%s tenant=%q actor=%s", event.Action, event.EntryID, event.Tenant, event.Actor)
+
+	if stateless() {
+		storeAppend("audit", []storeRecord{{Audit: &event}}, 0)
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	appendAuditLocked(event)
+	if auditToS3 {
+		auditPending = append(auditPending, event)
+		if len(auditPending) > maxAuditEvents {
+			log.Printf("Audit: S3 is behind, dropping %d events", len(auditPending)-maxAuditEvents)
+			auditPending = append([]AuditEvent(nil), auditPending[len(auditPending)-maxAuditEvents:]...)
+		}
+	}
+}
+
+// appendAuditLocked adds event to the listed ones. The caller holds
+// auditMutex.
+func appendAuditLocked(event AuditEvent) {
+	auditEvents = append(auditEvents, event)
+	if len(auditEvents) > maxAuditEvents {
+		auditEvents = append([]AuditEvent(nil), auditEvents[len(auditEvents)-maxAuditEvents:]...)
+	}
+}
+
+func auditObjectKey(tenant string, at time.Time) string {
+	dir, _ := path.Split(tenantObjectKey(tenant))
+	return dir + "audit/dt=" + at.UTC().Format("2006-01-02") + "/" + nodeID + "-" + newID() + ".ndjson"
+}
+
+// startAuditLog starts writing audit events to S3. Stateless mode keeps them
+// in the state store instead.
+func startAuditLog() {
+	if stateless() {
+		return
+	}
+	auditMutex.Lock()
+	auditToS3 = true
+	auditMutex.Unlock()
+
+	ticker := time.NewTicker(envDuration("ECHO_AUDIT_FLUSH_INTERVAL", 10*time.Second))
+	go func() {
+		defer ticker.Stop()
+		for range ticker.C {
+			flushAudit()
+		}
+	}()
+}
+
+// flushAudit writes the pending events, one object per tenant. A failed
+// batch goes back to the front for the next flush.
+func flushAudit() {
+	target := activeS3Target()
+	auditMutex.Lock()
+	batch := auditPending
+	auditPending = nil
+	auditMutex.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	byTenant := make(map[string][]AuditEvent)
+	var tenants []string
+	for _, event := range batch {
+		if _, ok := byTenant[event.Tenant]; !ok {
+			tenants = append(tenants, event.Tenant)
+		}
+		byTenant[event.Tenant] = append(byTenant[event.Tenant], event)
+	}
+
+	var failed []AuditEvent
+	for _, tenant := range tenants {
+		events := byTenant[tenant]
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		for _, event := range events {
+			encoder.Encode(event)
+		}
+		if target == nil {
+			failed = append(failed, events...)
+		} else if err := putObject(target, auditObjectKey(tenant, events[0].Timestamp), buf.Bytes(), "application/x-ndjson", tenantKMSKey(tenant)); err != nil {
+			log.Printf("Audit: write of %d events of tenant %q failed: %v", len(events), tenant, err)
+			failed = append(failed, events...)
+		}
+	}
+
+	if len(failed) > 0 {
+		auditMutex.Lock()
+		auditPending = append(failed, auditPending...)
+		auditMutex.Unlock()
+	}
+}
+
+// handleAudit lists audit events, newest first, optionally for one entry.
+func handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	entryID := r.URL.Query().Get("entryId")
+
+	auditMutex.Lock()
+	events := make([]AuditEvent, 0, len(auditEvents))
+	for i := len(auditEvents) - 1; i >= 0; i-- {
+		if entryID == "" || auditEvents[i].EntryID == entryID {
+			events = append(events, auditEvents[i])
+		}
+	}
+	auditMutex.Unlock()
+
+	writeJSON(w, http.StatusOK, events)
+}
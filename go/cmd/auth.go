@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var userIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.@-]{1,128}$`)
+
+// Caller identifies who is making a request. APIKey holds the configured
+// key name, never the secret itself.
+type Caller struct {
+	APIKey    string
+	Tenant    string
+	User      string
+	Anonymous bool
+}
+
+type apiKey struct {
+	Name   string
+	Secret string
+	Tenant string
+}
+
+// configuredAPIKeys parses ECHO_API_KEYS ("name:secret[:tenant],..."). When no
+// keys are configured, the API stays open as before.
+func configuredAPIKeys() []apiKey {
+	var keys []apiKey
+	for _, spec := range envList("ECHO_API_KEYS") {
+		parts := strings.SplitN(spec, ":", 3)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+		key := apiKey{Name: parts[0], Secret: parts[1]}
+		if len(parts) == 3 && tenantIDPattern.MatchString(parts[2]) {
+			key.Tenant = parts[2]
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func requestAPIKey(r *http.Request) string {
+	if key := strings.TrimSpace(r.Header.Get("X-API-Key")); key != "" {
+		return key
+	}
+	auth := strings.TrimSpace(r.Header.Get("Authorization"))
+	if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// trustUserHeader reports whether X-User-ID may be taken from the request.
+// Nothing ties the header to the API key, so any key holder could claim
+// another user's history, saved prompts, budget and private cache tier with
+// it. It is only honoured when ECHO_TRUST_USER_HEADER=true, which is meant
+// for deployments behind a proxy that authenticates users and sets the header
+// itself; otherwise it is ignored and every caller is anonymous within its
+// tenant.
+func trustUserHeader() bool {
+	return envString("ECHO_TRUST_USER_HEADER", "false") == "true"
+}
+
+// authenticate resolves the caller and writes an error response when the
+// request cannot be attributed. A key bound to a tenant always wins over the
+// X-Tenant-ID header, and a key bound to none may not pick one with it: such
+// keys only reach the default tenant.
+func authenticate(w http.ResponseWriter, r *http.Request) (Caller, bool) {
+	tenant, err := resolveTenant(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return Caller{}, false
+	}
+
+	var user string
+	if trustUserHeader() {
+		user = strings.TrimSpace(r.Header.Get("X-User-ID"))
+		if user != "" && !userIDPattern.MatchString(user) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid user id"})
+			return Caller{}, false
+		}
+	}
+
+	keys := configuredAPIKeys()
+	provided := requestAPIKey(r)
+	if provided == "" && demoModeEnabled() {
+		return Caller{Tenant: demoTenant(), User: demoUser, Anonymous: true}, true
+	}
+	if len(keys) == 0 {
+		return Caller{Tenant: tenant, User: user}, true
+	}
+
+	if provided == "" {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "API key required"})
+		return Caller{}, false
+	}
+	for _, key := range keys {
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(key.Secret)) != 1 {
+			continue
+		}
+		if tenant != defaultTenant && tenant != key.Tenant {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "API key is not valid for this tenant"})
+			return Caller{}, false
+		}
+		if key.Tenant != "" {
+			tenant = key.Tenant
+		}
+		return Caller{APIKey: key.Name, Tenant: tenant, User: user}, true
+	}
+
+	writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid API key"})
+	return Caller{}, false
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// GET /cache/suggest?q=... completes a partially typed question with cached
+// questions the caller may be served, so a frontend can steer users towards
+// answers that already exist. Questions that start with the input, or have a
+// word that does, come first, most hit first. When they run short and the
+// input is at least ECHO_AUTOCOMPLETE_SEMANTIC_MIN_CHARS long (default 12),
+// the input is embedded server-side and questions within
+// ECHO_AUTOCOMPLETE_MIN_SIMILARITY of it (default 0.6) fill the remainder.
+// Paraphrases (see paraphrase.go) match too, suggesting their entry's
+// question.
+//
+// The embedding is billed to the caller and skipped once it is out of token
+// quota. Clients send a request per keystroke, so embeddings are remembered
+// per input for the last maxCompletionEmbeddings inputs.
+
+const (
+	defaultAutocompleteLimit = 5
+	maxAutocompleteLimit     = 20
+	maxCompletionEmbeddings  = 1000
+)
+
+type completionEmbedding struct {
+	vector []float32
+	model  string
+}
+
+var (
+	// completionMutex guards completionEmbeddings and completionOrder.
+	completionMutex      sync.Mutex
+	completionEmbeddings = make(map[string]completionEmbedding)
+	// completionOrder holds the inputs in completionEmbeddings, oldest first.
+	completionOrder []string
+)
+
+const (
+	completionPrefix   = "prefix"
+	completionWord     = "word"
+	completionSemantic = "semantic"
+)
+
+type QuestionCompletion struct {
+	EntryID  string `json:"entryId"`
+	Question string `json:"question"`
+	// Match is prefix, word or semantic; Similarity is set for semantic
+	// matches only.
+	Match      string  `json:"match"`
+	Similarity float64 `json:"similarity,omitempty"`
+	Hits       int     `json:"hits"`
+}
+
+func normalizeCompletionText(text string) string {
+	return strings.ToLower(strings.Join(strings.Fields(text), " "))
+}
+
+// completionMatch reports how input matches question: as its prefix, as the
+// prefix of one of its later words, or not at all.
+func completionMatch(question, input string) string {
+	question = normalizeCompletionText(question)
+	switch {
+	case strings.HasPrefix(question, input):
+		return completionPrefix
+	case strings.Contains(question, " "+input):
+		return completionWord
+	}
+	return ""
+}
+
+// servableEntries returns the hot-tier entries caller may be served.
+func servableEntries(caller Caller) []VectorEntry {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+	var entries []VectorEntry
+	for _, entry := range MockVectorDB {
+		if entryVisible(entry, caller) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// embedCompletionInput embeds input for caller, reusing the embedding of an
+// earlier request with the same input.
+func embedCompletionInput(ctx context.Context, caller Caller, input string) (completionEmbedding, error) {
+	completionMutex.Lock()
+	cached, ok := completionEmbeddings[input]
+	completionMutex.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	vectors, model, err := embedTextsFor(ctx, caller, []string{input})
+	if err != nil {
+		return completionEmbedding{}, err
+	}
+	embedding := completionEmbedding{vector: vectors[0], model: model}
+	completionMutex.Lock()
+	if _, exists := completionEmbeddings[input]; !exists {
+		completionEmbeddings[input] = embedding
+		completionOrder = append(completionOrder, input)
+		for len(completionOrder) > maxCompletionEmbeddings {
+			delete(completionEmbeddings, completionOrder[0])
+			completionOrder = completionOrder[1:]
+		}
+	}
+	completionMutex.Unlock()
+	return embedding, nil
+}
+
+// semanticCompletions embeds input and returns up to limit of the caller's
+// hot-tier entries close to it, skipping those already suggested. Only the
+// index partitions the caller may be served from are scanned.
+func semanticCompletions(ctx context.Context, caller Caller, input string, limit int, suggested map[string]bool) ([]QuestionCompletion, error) {
+	if !checkTokenQuota(caller) {
+		return nil, errors.New("token quota exhausted")
+	}
+	embedding, err := embedCompletionInput(ctx, caller, input)
+	if err != nil {
+		return nil, err
+	}
+	query := scoringVector(reduceVector(embedding.vector))
+	minSimilarity := envFloat("ECHO_AUTOCOMPLETE_MIN_SIMILARITY", 0.6)
+
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+	var completions []QuestionCompletion
+	for _, partition := range callerPartitions(caller) {
+		for _, pos := range partitionPositions(partition[0], partition[1], embedding.model) {
+			if completion, ok := semanticCompletion(MockVectorDB[pos], caller, query, minSimilarity, suggested); ok {
+				completions = append(completions, completion)
+			}
+		}
+	}
+	sort.Slice(completions, func(i, j int) bool { return completions[i].Similarity > completions[j].Similarity })
+	return completions[:min(len(completions), limit)], nil
+}
+
+// semanticCompletion scores entry against query, its question and each
+// paraphrase alike.
+func semanticCompletion(entry VectorEntry, caller Caller, query []float32, minSimilarity float64, suggested map[string]bool) (QuestionCompletion, bool) {
+	if suggested[entry.ID] || !entryVisible(entry, caller) {
+		return QuestionCompletion{}, false
+	}
+	similarity := cosineSimilarity(query, scoringVector(entry.Vector))
+	for _, paraphrase := range entry.Paraphrases {
+		similarity = max(similarity, cosineSimilarity(query, scoringVector(paraphrase.Vector)))
+	}
+	if similarity < minSimilarity {
+		return QuestionCompletion{}, false
+	}
+	return QuestionCompletion{
+		EntryID:    entry.ID,
+		Question:   entry.Question,
+		Match:      completionSemantic,
+		Similarity: similarity,
+		Hits:       entry.HitCount,
+	}, true
+}
+
+func handleAutocomplete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	input := normalizeCompletionText(r.URL.Query().Get("q"))
+	if input == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "q is required"})
+		return
+	}
+	limit := defaultAutocompleteLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 || parsed > maxAutocompleteLimit {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and 20"})
+			return
+		}
+		limit = parsed
+	}
+
+	completions := make([]QuestionCompletion, 0, limit)
+	for _, entry := range servableEntries(caller) {
+		match := completionMatch(entry.Question, input)
+		for _, paraphrase := range entry.Paraphrases {
+			if match == completionPrefix {
+				break
+			}
+			if paraphraseMatch := completionMatch(paraphrase.Question, input); paraphraseMatch != "" {
+				match = paraphraseMatch
+			}
+		}
+		if match != "" {
+			completions = append(completions, QuestionCompletion{EntryID: entry.ID, Question: entry.Question, Match: match, Hits: entry.HitCount})
+		}
+	}
+	sort.SliceStable(completions, func(i, j int) bool {
+		if completions[i].Match != completions[j].Match {
+			return completions[i].Match == completionPrefix
+		}
+		return completions[i].Hits > completions[j].Hits
+	})
+	completions = completions[:min(len(completions), limit)]
+
+	if len(completions) < limit && utf8.RuneCountInString(input) >= envInt("ECHO_AUTOCOMPLETE_SEMANTIC_MIN_CHARS", 12) {
+		suggested := make(map[string]bool, len(completions))
+		for _, completion := range completions {
+			suggested[completion.EntryID] = true
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		semantic, err := semanticCompletions(ctx, caller, input, limit-len(completions), suggested)
+		cancel()
+		if err != nil {
+			log.Printf("Autocomplete: no semantic matches, prefix matches only: %v", err)
+		}
+		completions = append(completions, semantic...)
+	}
+	writeJSON(w, http.StatusOK, completions)
+}
@@ -10,16 +10,38 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
+// s3Target is one bucket/region the cache can be synced with.
+type s3Target struct {
+	Name   string
+	Bucket string
+	Region string
+	client *s3.Client
+}
+
+type SyncTargetView struct {
+	Name   string `json:"name"`
+	Bucket string `json:"bucket"`
+	Region string `json:"region"`
+}
+
 var (
-	s3Client     *s3.Client
-	s3BucketName string
+	s3Primary   *s3Target
+	s3Secondary *s3Target
+	s3Active    *s3Target
+
+	s3ConsecutiveFailures int
+	s3FailoverThreshold   int
+	s3Failovers           int
 
 	s3Uploading      bool
 	lastS3UploadAt   time.Time
@@ -50,9 +72,61 @@ func markS3DownloadCompleted() {
 	hasLastS3Sync = true
 }
 
+func activeS3Target() *s3Target {
+	statusMutex.RLock()
+	defer statusMutex.RUnlock()
+	return s3Active
+}
+
+func currentSyncTarget() *SyncTargetView {
+	target := activeS3Target()
+	if target == nil {
+		return nil
+	}
+	return &SyncTargetView{Name: target.Name, Bucket: target.Bucket, Region: target.Region}
+}
+
+// recordS3Result tracks consecutive failures against the active target and
+// fails over to the secondary bucket once the threshold is reached.
+func recordS3Result(target *s3Target, err error) {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+
+	if target != s3Active {
+		return
+	}
+	if err == nil {
+		s3ConsecutiveFailures = 0
+		return
+	}
+
+	s3ConsecutiveFailures++
+	if s3Active == s3Primary && s3Secondary != nil && s3ConsecutiveFailures >= s3FailoverThreshold {
+		log.Printf("S3 primary failed %d times in a row; failing over to %s (%s)", s3ConsecutiveFailures, s3Secondary.Bucket, s3Secondary.Region)
+		s3Active = s3Secondary
+		s3ConsecutiveFailures = 0
+		s3Failovers++
+	}
+}
+
+func newS3Target(name, bucket, region string) (*s3Target, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("load AWS config: %w", err)
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.APIOptions = append(o.APIOptions, limitS3Concurrency)
+	})
+	return &s3Target{Name: name, Bucket: bucket, Region: region, client: client}, nil
+}
+
 func initS3Client() error {
-	s3BucketName = strings.TrimSpace(os.Getenv("S3_BUCKET_NAME"))
-	if s3BucketName == "" {
+	bucket := strings.TrimSpace(os.Getenv("S3_BUCKET_NAME"))
+	if bucket == "" {
 		return errors.New("S3_BUCKET_NAME is required")
 	}
 
@@ -61,88 +135,252 @@ func initS3Client() error {
 		return errors.New("AWS_REGION is required")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+	primary, err := newS3Target("primary", bucket, region)
 	if err != nil {
-		return fmt.Errorf("load AWS config: %w", err)
+		return err
 	}
 
-	s3Client = s3.NewFromConfig(cfg)
+	var secondary *s3Target
+	if secondaryBucket := envString("S3_SECONDARY_BUCKET_NAME", ""); secondaryBucket != "" {
+		secondary, err = newS3Target("secondary", secondaryBucket, envString("S3_SECONDARY_REGION", region))
+		if err != nil {
+			return fmt.Errorf("secondary: %w", err)
+		}
+	}
+
+	s3Slots = make(chan struct{}, envInt("ECHO_S3_MAX_CONCURRENCY", 4))
+	statusMutex.Lock()
+	s3Primary = primary
+	s3Secondary = secondary
+	s3Active = primary
+	s3FailoverThreshold = envInt("S3_FAILOVER_THRESHOLD", 3)
+	statusMutex.Unlock()
 	return nil
 }
 
-func downloadAndMergeFromS3() {
-	if s3Client == nil || s3BucketName == "" {
-		return
-	}
+func isS3NotFound(err error) bool {
+	return strings.Contains(err.Error(), "NoSuchKey") || strings.Contains(err.Error(), "NotFound")
+}
 
+// getObject returns the object's body, or nil when it does not exist.
+func getObject(target *s3Target, key string) ([]byte, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
 
-	resp, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(s3BucketName),
-		Key:    aws.String(cacheObjectKey),
+	resp, err := target.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(target.Bucket),
+		Key:    aws.String(key),
 	})
 	if err != nil {
-		if strings.Contains(err.Error(), "NoSuchKey") || strings.Contains(err.Error(), "NotFound") {
-			log.Println("S3 cache.json not found; starting with empty cache")
-			return
+		if isS3NotFound(err) {
+			return nil, nil
 		}
-		log.Printf("S3 download failed: %v", err)
-		return
+		return nil, fmt.Errorf("download: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Printf("Read S3 cache body failed: %v", err)
-		return
+		return nil, fmt.Errorf("read body: %w", err)
+	}
+	recordS3Transfer(directionDownload, len(body))
+	return body, nil
+}
+
+// fetchCacheObject downloads tenant's cache object at key from target and
+// decodes it after checking it against its manifest. A missing object is not
+// an error and yields no entries.
+func fetchCacheObject(target *s3Target, tenant, key string) ([]VectorEntry, error) {
+	body, err := getObject(target, key)
+	if err != nil {
+		return nil, err
 	}
+	if body == nil {
+		log.Printf("S3 %s %s not found; starting with empty cache", target.Name, key)
+		return nil, nil
+	}
+	return decodeCacheObject(target, tenant, key, body)
+}
 
+// decodeCacheObject checks body against its manifest and runs the integrity
+// checks, quarantining entries that fail them. Objects that fail the manifest
+// check or do not decode are reported as errCacheRejected.
+func decodeCacheObject(target *s3Target, tenant, key string, body []byte) ([]VectorEntry, error) {
 	if len(body) == 0 {
-		return
+		return nil, nil
+	}
+	manifest, err := verifyCacheManifest(target, tenant, key, body)
+	if err != nil {
+		return nil, err
 	}
 
 	var remoteEntries []VectorEntry
-	if err := json.Unmarshal(body, &remoteEntries); err != nil {
-		log.Printf("Decode S3 cache.json failed: %v", err)
-		return
+	var quarantined []QuarantinedEntry
+	if strings.HasSuffix(key, binaryObjectSuffix) {
+		entries, undecodable, err := decodeBinaryCache(body)
+		if err != nil {
+			return nil, fmt.Errorf("decode %s: %v: %w", key, err, errCacheRejected)
+		}
+		// Migrations work on JSON, so only objects from an older schema
+		// take the detour through it.
+		if manifest.SchemaVersion < currentCacheSchema {
+			raw := append(entriesJSON(entries), undecodable...)
+			remoteEntries, quarantined = verifyEntries("s3:"+key, migrateEntries("s3:"+key, tenant, raw, manifest.SchemaVersion))
+		} else {
+			remoteEntries, quarantined = checkEntries("s3:"+key, entries, undecodable)
+		}
+	} else {
+		var raw []json.RawMessage
+		if err := json.Unmarshal(body, &raw); err != nil {
+			return nil, fmt.Errorf("decode %s: %v: %w", key, err, errCacheRejected)
+		}
+		raw = migrateEntries("s3:"+key, tenant, raw, manifest.SchemaVersion)
+		remoteEntries, quarantined = verifyEntries("s3:"+key, raw)
+	}
+	if len(quarantined) > 0 {
+		quarantineToS3(target, key, quarantined)
 	}
+	return remoteEntries, nil
+}
+
+func putCacheObject(target *s3Target, key string, jsonBody []byte, kmsKeyID string) error {
+	return putObject(target, key, jsonBody, "application/json", kmsKeyID)
+}
+
+func putObject(target *s3Target, key string, body []byte, contentType, kmsKeyID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
 
-	dbMutex.Lock()
-	defer dbMutex.Unlock()
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(target.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+	}
+	if kmsKeyID != "" {
+		input.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = aws.String(kmsKeyID)
+	}
 
-	existingByQuestion := make(map[string]struct{}, len(MockVectorDB))
-	for _, entry := range MockVectorDB {
-		questionKey := strings.TrimSpace(entry.Question)
-		if questionKey != "" {
-			existingByQuestion[questionKey] = struct{}{}
+	if _, err := target.client.PutObject(ctx, input); err != nil {
+		return err
+	}
+	recordS3Transfer(directionUpload, len(body))
+	return nil
+}
+
+func deleteObject(target *s3Target, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	_, err := target.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(target.Bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// listTenants returns every tenant with a cache object under tenants/, plus
+// the default tenant.
+func listTenants(target *s3Target) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	tenants := []string{defaultTenant}
+	paginator := s3.NewListObjectsV2Paginator(target.client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(target.Bucket),
+		Prefix:    aws.String(tenantKeyPrefix),
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, prefix := range page.CommonPrefixes {
+			tenant := strings.TrimSuffix(strings.TrimPrefix(aws.ToString(prefix.Prefix), tenantKeyPrefix), "/")
+			if tenantIDPattern.MatchString(tenant) {
+				tenants = append(tenants, tenant)
+			}
 		}
 	}
+	return tenants, nil
+}
 
-	newEntries := 0
-	for _, entry := range remoteEntries {
-		questionKey := strings.TrimSpace(entry.Question)
-		if questionKey == "" {
-			continue
+// fetchTenantCaches downloads every tenant's cache object and, when
+// sharding, every member's share of it. Entries are stamped with the tenant
+// of the object they came from, so an object can never inject entries into
+// another tenant's cache. An object that fails verification is skipped on its
+// own; only read failures, which say something about the bucket, fail the
+// whole download.
+func fetchTenantCaches(target *s3Target) ([]VectorEntry, error) {
+	tenants, err := listTenants(target)
+	if err != nil {
+		return nil, fmt.Errorf("list tenants: %w", err)
+	}
+
+	var all []VectorEntry
+	for _, tenant := range tenants {
+		keys := []string{tenantObjectKey(tenant)}
+		for _, node := range shardMembers() {
+			keys = append(keys, shardObjectKey(tenant, node))
 		}
-		if _, exists := existingByQuestion[questionKey]; exists {
-			continue
+		for _, key := range keys {
+			entries, err := fetchTenantCache(target, tenant, key)
+			if errors.Is(err, errCacheRejected) {
+				log.Printf("S3 %s cache %s of tenant %q skipped: %v", target.Name, key, tenant, err)
+				reportError("s3", err, map[string]string{"operation": "verify", "target": target.Name, "bucket": target.Bucket, "tenant": tenant, "key": key})
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			for i := range entries {
+				entries[i].Tenant = tenant
+			}
+			all = append(all, entries...)
 		}
-		entry.Source = cacheSourceS3
-		MockVectorDB = append(MockVectorDB, entry)
-		existingByQuestion[questionKey] = struct{}{}
-		newEntries++
+	}
+	return all, nil
+}
+
+func downloadAndMergeFromS3() (int, error) {
+	target := activeS3Target()
+	if target == nil {
+		return 0, errors.New("no S3 target")
+	}
+
+	remoteEntries, err := fetchTenantCaches(target)
+	recordS3Result(target, err)
+	if err != nil {
+		log.Printf("S3 %s sync failed: %v", target.Name, err)
+		reportError("s3", err, map[string]string{"operation": "download", "target": target.Name, "bucket": target.Bucket})
+		return 0, err
 	}
 
+	recordSyncEntries(directionDownload, len(remoteEntries))
+	newEntries := mergeEntries(ownedEntries(remoteEntries), cacheSourceS3)
+
 	markS3DownloadCompleted()
 	log.Printf("Synced: %d new entries found.", newEntries)
+	return newEntries, nil
 }
 
-func uploadToS3() {
-	if s3Client == nil || s3BucketName == "" {
+// uploadCacheObjects writes every tenant's cache object, tenants in
+// parallel within the S3 concurrency limit. A shard writes the entries it
+// owns to its own object per tenant instead; see shardObjectKey. Callers go
+// through uploadToS3.
+func uploadCacheObjects() {
+	target := activeS3Target()
+	if target == nil {
+		return
+	}
+	self, sharded := localShard()
+
+	// Read before the snapshot: a change made while uploading leaves the
+	// generation ahead of what was uploaded, so the next cycle uploads again.
+	generation := cacheGeneration.Load()
+	if !uploadNeeded(target, generation) {
 		return
 	}
 
@@ -152,47 +390,119 @@ func uploadToS3() {
 	dbMutex.RLock()
 	payload := make([]VectorEntry, len(MockVectorDB))
 	copy(payload, MockVectorDB)
+	logged := walApplied
 	dbMutex.RUnlock()
 
-	jsonBody, err := json.MarshalIndent(payload, "", "  ")
-	if err != nil {
-		log.Printf("Marshal cache for S3 failed: %v", err)
-		return
+	if tieringEnabled() {
+		coldEntries, err := readColdEntries()
+		if err != nil {
+			log.Printf("Read cold tier for S3 failed: %v", err)
+			return
+		}
+		payload = append(payload, coldEntries...)
+	}
+	if sharded {
+		payload = ownedEntries(payload)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-	defer cancel()
+	byTenant := make(map[string][]VectorEntry)
+	for _, entry := range payload {
+		byTenant[entry.Tenant] = append(byTenant[entry.Tenant], entry)
+	}
 
-	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:      aws.String(s3BucketName),
-		Key:         aws.String(cacheObjectKey),
-		Body:        bytes.NewReader(jsonBody),
-		ContentType: aws.String("application/json"),
-	})
-	if err != nil {
-		log.Printf("S3 upload failed: %v", err)
-		return
+	// One cycle counts as one result towards failover, however many tenants
+	// it covers; uploadErr keeps the first S3 error.
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+	var errMutex sync.Mutex
+	var uploadErr error
+	for tenant, entries := range byTenant {
+		key, contentType := tenantObjectKey(tenant), "application/json"
+		if sharded {
+			key = shardObjectKey(tenant, self)
+		}
+		var body []byte
+		if cacheFormat() == cacheFormatBinary {
+			key, contentType = binaryObjectKey(key), "application/x-protobuf"
+			body = encodeBinaryCache(entries)
+		} else {
+			var err error
+			body, err = json.MarshalIndent(entries, "", "  ")
+			if err != nil {
+				log.Printf("Marshal cache of tenant %q for S3 failed: %v", tenant, err)
+				failed.Store(true)
+				continue
+			}
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The manifest follows the object so it only ever covers an
+			// upload that succeeded.
+			err := putObject(target, key, body, contentType, tenantKMSKey(tenant))
+			if err == nil {
+				err = putCacheManifest(target, tenant, key, body, tenantKMSKey(tenant))
+			}
+			if err != nil {
+				log.Printf("S3 %s upload of %s failed: %v", target.Name, key, err)
+				reportError("s3", err, map[string]string{"operation": "upload", "target": target.Name, "bucket": target.Bucket, "key": key, "tenant": tenant})
+				errMutex.Lock()
+				if uploadErr == nil {
+					uploadErr = err
+				}
+				errMutex.Unlock()
+				failed.Store(true)
+				return
+			}
+			recordSyncEntries(directionUpload, len(entries))
+			recordCacheObjectSize(tenant, len(body))
+		}()
 	}
+	wg.Wait()
+	recordS3Result(target, uploadErr)
 
-	markS3UploadCompleted()
+	if !failed.Load() {
+		markUploaded(target, generation)
+		markS3UploadCompleted()
+		truncateWAL(logged)
+	}
 }
 
-func startBackgroundSync() {
-	ticker := time.NewTicker(300 * time.Second)
+// tryFailback probes the primary while running on the secondary. Once the
+// primary answers again, both buckets are merged into RAM and the combined
+// cache is written back to the primary before switching over.
+func tryFailback() {
+	statusMutex.RLock()
+	primary, secondary, active := s3Primary, s3Secondary, s3Active
+	statusMutex.RUnlock()
+	if active == nil || active == primary || primary == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	_, err := primary.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(primary.Bucket)})
+	cancel()
+	if err != nil {
+		return
+	}
 
-	go func() {
-		defer ticker.Stop()
-		for range ticker.C {
-			downloadAndMergeFromS3()
+	primaryEntries, err := fetchTenantCaches(primary)
+	if err != nil {
+		log.Printf("S3 primary reachable but download failed: %v", err)
+		return
+	}
+	secondaryEntries, err := fetchTenantCaches(secondary)
+	if err != nil {
+		log.Printf("S3 secondary download during reconcile failed: %v", err)
+	}
+	merged := mergeEntries(ownedEntries(primaryEntries), cacheSourceS3) + mergeEntries(ownedEntries(secondaryEntries), cacheSourceS3)
 
-			dbMutex.RLock()
-			hasData := len(MockVectorDB) > 0
-			dbMutex.RUnlock()
+	statusMutex.Lock()
+	s3Active = primary
+	s3ConsecutiveFailures = 0
+	statusMutex.Unlock()
 
-			if hasData {
-				fmt.Println("Batching: Uploading memory to S3...")
-				uploadToS3()
-			}
-		}
-	}()
+	log.Printf("S3 primary recovered; reconciled %d entries and failed back", merged)
+	uploadToS3()
 }
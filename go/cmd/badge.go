@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// handleSavingsBadge renders a shields-style SVG with a tenant's cumulative
+// savings for READMEs and wikis. Badges are unauthenticated, so only tenants
+// listed in ECHO_PUBLIC_BADGES ("@default" for the default tenant) get one.
+//
+//	GET /badge/savings.svg?tenant=acme&metric=co2|tokens|usd
+func handleSavingsBadge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	query := r.URL.Query()
+	name := strings.TrimSpace(query.Get("tenant"))
+	if name == "" {
+		name = defaultTenantName
+	}
+	if !slices.Contains(envList("ECHO_PUBLIC_BADGES"), name) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "badge not found"})
+		return
+	}
+	tenant := tenantFromName(name)
+
+	summary := tenantSavings(tenant)
+	var label, value string
+	switch query.Get("metric") {
+	case "", "co2":
+		label, value = "CO2 saved", formatGrams(summary.CO2SavedG)
+	case "tokens":
+		label, value = "tokens saved", formatCount(summary.TokensSaved)
+	case "usd":
+		label, value = "saved", fmt.Sprintf("$%.2f", summary.USDSaved)
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "metric must be co2, tokens or usd"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "max-age=300")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(renderBadge(label, value)))
+}
+
+func formatGrams(grams float64) string {
+	switch {
+	case grams >= 1e6:
+		return fmt.Sprintf("%.2f t", grams/1e6)
+	case grams >= 1e3:
+		return fmt.Sprintf("%.2f kg", grams/1e3)
+	}
+	return fmt.Sprintf("%.1f g", grams)
+}
+
+func formatCount(n int) string {
+	switch {
+	case n >= 1e6:
+		return fmt.Sprintf("%.1fM", float64(n)/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.1fk", float64(n)/1e3)
+	}
+	return fmt.Sprintf("%d", n)
+}
+
+// renderBadge approximates text width at 7px per character, which is close
+// enough for Verdana at 11px.
+func renderBadge(label, value string) string {
+	labelWidth := 7*len(label) + 10
+	valueWidth := 7*len(value) + 10
+	width := labelWidth + valueWidth
+	label, value = html.EscapeString(label), html.EscapeString(value)
+
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[4]s: %[5]s">
+<title>%[4]s: %[5]s</title>
+<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)"><rect width="%[2]d" height="20" fill="#555"/><rect x="%[2]d" width="%[3]d" height="20" fill="#2e7d32"/><rect width="%[1]d" height="20" fill="url(#s)"/></g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%[6]d" y="14">%[4]s</text><text x="%[7]d" y="14">%[5]s</text>
+</g>
+</svg>
+`, width, labelWidth, valueWidth, label, value, labelWidth/2, labelWidth+valueWidth/2)
+}
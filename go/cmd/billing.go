@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Billing exports aggregate metering records into CSV line items, one per
+// tenant, API key, model and source, in a layout modeled on the AWS Cost and
+// Usage Report so it can be loaded into existing billing pipelines.
+
+const (
+	billingKeyPrefix      = "billing/"
+	defaultUSDPer1KTokens = 0.001
+)
+
+var modelUSDPer1KTokens = map[string]float64{
+	"gemini-2.5-flash-lite": 0.00025,
+	"gemini-2.5-flash":      0.0015,
+	"gpt-4o-mini":           0.0004,
+	"gpt-4o":                0.0063,
+	"gpt-4.1-mini":          0.0010,
+	"gpt-4.1-nano":          0.00025,
+}
+
+var billingCSVHeader = []string{
+	"bill_period_start",
+	"bill_period_end",
+	"tenant",
+	"api_key",
+	"model",
+	"line_item_type",
+	"requests",
+	"cache_hits",
+	"cloud_tokens",
+	"estimated_cost_usd",
+	"tokens_saved",
+	"savings_usd",
+	"energy_saved_wh",
+	"co2_saved_g",
+}
+
+type billingLineItem struct {
+	Tenant      string
+	APIKey      string
+	Model       string
+	Source      string
+	Requests    int
+	CacheHits   int
+	CloudTokens int
+	TokensSaved int
+}
+
+func usdPer1KTokens(model string) float64 {
+	if price, ok := modelUSDPer1KTokens[model]; ok && price > 0 {
+		return price
+	}
+	return defaultUSDPer1KTokens
+}
+
+// billingLineItems groups metering records in [start, end) by tenant, key,
+// model and source. Only records for tenant are included unless tenant is nil.
+func billingLineItems(start, end time.Time, tenant *string) []billingLineItem {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	byKey := make(map[string]*billingLineItem)
+	var order []string
+	for _, record := range meteringRecords {
+		if record.Timestamp.Before(start) || !record.Timestamp.Before(end) {
+			continue
+		}
+		if tenant != nil && record.Tenant != *tenant {
+			continue
+		}
+		key := record.Tenant + "\x00" + record.APIKey + "\x00" + record.Model + "\x00" + record.Source
+		item, ok := byKey[key]
+		if !ok {
+			item = &billingLineItem{Tenant: record.Tenant, APIKey: record.APIKey, Model: record.Model, Source: record.Source}
+			byKey[key] = item
+			order = append(order, key)
+		}
+		item.Requests++
+		if record.Source == "CACHE" {
+			item.CacheHits++
+		}
+		item.CloudTokens += record.CloudTokens
+		item.TokensSaved += record.TokensSaved
+	}
+
+	sort.Strings(order)
+	items := make([]billingLineItem, 0, len(order))
+	for _, key := range order {
+		items = append(items, *byKey[key])
+	}
+	return items
+}
+
+func writeBillingCSV(buf *bytes.Buffer, start, end time.Time, items []billingLineItem) error {
+	writer := csv.NewWriter(buf)
+	if err := writer.Write(billingCSVHeader); err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		price := usdPer1KTokens(item.Model)
+		savedKWh := float64(item.TokensSaved) / 1000.0 * kWhPer1KTokens(item.Model)
+		lineItemType := "Usage"
+		if item.Source == "CACHE" {
+			lineItemType = "CacheHit"
+		}
+		row := []string{
+			start.UTC().Format(time.RFC3339),
+			end.UTC().Format(time.RFC3339),
+			item.Tenant,
+			item.APIKey,
+			item.Model,
+			lineItemType,
+			strconv.Itoa(item.Requests),
+			strconv.Itoa(item.CacheHits),
+			strconv.Itoa(item.CloudTokens),
+			strconv.FormatFloat(float64(item.CloudTokens)/1000.0*price, 'f', 6, 64),
+			strconv.Itoa(item.TokensSaved),
+			strconv.FormatFloat(float64(item.TokensSaved)/1000.0*price, 'f', 6, 64),
+			strconv.FormatFloat(savedKWh*1000.0, 'f', 6, 64),
+			strconv.FormatFloat(savedKWh*gridCO2gPerKWh, 'f', 6, 64),
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func billingObjectKey(tenant string, start, end time.Time) string {
+	return fmt.Sprintf("%s%s/%s/usage-%s.csv", billingKeyPrefix, tenantName(tenant), start.UTC().Format("2006-01-02"), end.UTC().Format("20060102T150405Z"))
+}
+
+// exportBilling writes one CSV per tenant covering [start, end) to S3,
+// encrypted with the tenant's KMS key. Tenants in exported are skipped and
+// tenants uploaded are added to it, so retrying the same period after a
+// partial failure only exports the tenants that are still missing.
+func exportBilling(start, end time.Time, exported map[string]bool) error {
+	target := activeS3Target()
+	if target == nil {
+		return fmt.Errorf("S3 is not configured")
+	}
+
+	byTenant := make(map[string][]billingLineItem)
+	for _, item := range billingLineItems(start, end, nil) {
+		byTenant[item.Tenant] = append(byTenant[item.Tenant], item)
+	}
+
+	var failed []string
+	for tenant, items := range byTenant {
+		if exported[tenant] {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := writeBillingCSV(&buf, start, end, items); err != nil {
+			return err
+		}
+		if err := putObject(target, billingObjectKey(tenant, start, end), buf.Bytes(), "text/csv", tenantKMSKey(tenant)); err != nil {
+			log.Printf("Billing: upload for %q failed: %v", tenantName(tenant), err)
+			failed = append(failed, tenantName(tenant))
+			continue
+		}
+		exported[tenant] = true
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("billing export failed for %d of %d tenants: %s", len(failed), len(byTenant), strings.Join(failed, ", "))
+	}
+
+	log.Printf("Billing: exported %d tenants for %s - %s", len(byTenant), start.Format(time.RFC3339), end.Format(time.RFC3339))
+	return nil
+}
+
+func startBillingExport(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	periodStart := time.Now()
+
+	go func() {
+		defer ticker.Stop()
+		// A failed period is retried with the same end, so the tenants it
+		// already exported keep their object and are not billed twice.
+		var periodEnd time.Time
+		exported := make(map[string]bool)
+		for range ticker.C {
+			if periodEnd.IsZero() {
+				periodEnd = time.Now()
+			}
+			if err := exportBilling(periodStart, periodEnd, exported); err != nil {
+				log.Printf("Billing export failed: %v", err)
+				continue
+			}
+			periodStart, periodEnd = periodEnd, time.Time{}
+			clear(exported)
+		}
+	}()
+}
+
+// handleBillingExport returns the CSV for ?since=&until= (RFC3339) on demand.
+// Without a range it covers the last 24 hours.
+func handleBillingExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	end := time.Now()
+	start := end.Add(-24 * time.Hour)
+	query := r.URL.Query()
+	for name, dst := range map[string]*time.Time{"since": &start, "until": &end} {
+		raw := query.Get(name)
+		if raw == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": name + " must be RFC3339"})
+			return
+		}
+		*dst = parsed
+	}
+
+	var tenant *string
+	if query.Has("tenant") {
+		value := tenantFromName(query.Get("tenant"))
+		tenant = &value
+	}
+
+	var buf bytes.Buffer
+	if err := writeBillingCSV(&buf, start, end, billingLineItems(start, end, tenant)); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to build export"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(buf.Bytes())
+}
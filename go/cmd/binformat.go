@@ -0,0 +1,630 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// With ECHO_CACHE_FORMAT=binary, cache objects are written as cache.bin in
+// protobuf wire format instead of indented JSON, with vectors packed as
+// little-endian float32:
+//
+//	message CacheFile {
+//	  uint32 version = 1;
+//	  repeated Entry entries = 2;
+//	}
+//	message Entry {
+//	  string id = 1;
+//	  bytes vector = 2;
+//	  string answer = 3;
+//	  string question = 4;
+//	  int64 created_at_unix_nano = 5;
+//	  string source = 6;
+//	  string tenant = 7;
+//	  string owner = 8;
+//	  bool pinned = 9;
+//	  int64 hit_count = 10;
+//	  int64 last_hit_at_unix_nano = 11;
+//	  string embedding_model = 12;
+//	  string language = 13;
+//	  repeated Variant variants = 14;
+//	  repeated Citation citations = 15;
+//	  bytes compressed_answer = 16;
+//	  string style = 17;
+//	  bool time_sensitive = 18;
+//	  int64 helpful = 19;
+//	  int64 unhelpful = 20;
+//	  bool authoritative = 21;
+//	  string faq_pack = 22;
+//	  string model = 23;
+//	  repeated Paraphrase paraphrases = 24;
+//	  string access = 25;
+//	  string contributor = 26;
+//	  string provider = 27;
+//	  string license = 28;
+//	  int64 generated_tokens = 29;
+//	  repeated ExtraField extra = 30;
+//	  repeated Vote votes = 31;
+//	}
+//	message Vote {
+//	  string voter = 1;
+//	  bool helpful = 2;
+//	}
+//	message ExtraField {
+//	  string name = 1;
+//	  bytes json = 2;
+//	}
+//	message Variant {
+//	  string locale = 1;
+//	  string answer = 2;
+//	}
+//	message Paraphrase {
+//	  string question = 1;
+//	  bytes vector = 2;
+//	}
+//	message Citation {
+//	  string document_id = 1;
+//	  string chunk_id = 2;
+//	  string title = 3;
+//	  string source = 4;
+//	  double similarity = 5;
+//	}
+//
+// Fields added by newer schema versions (VectorEntry.Extra) travel as
+// ExtraField records holding their raw JSON, so they survive a round trip.
+//
+// Readers take whichever of cache.bin and cache.json has the newer manifest,
+// so a bucket can be migrated by switching writers one at a time, and nodes
+// writing different formats during a rollout never hide each other's writes.
+// Unknown fields are skipped, so older binaries can read files with new
+// fields.
+
+const (
+	cacheFormatJSON    = "json"
+	cacheFormatBinary  = "binary"
+	binaryCacheVersion = 1
+	binaryObjectSuffix = ".bin"
+)
+
+func cacheFormat() string {
+	if envString("ECHO_CACHE_FORMAT", cacheFormatJSON) == cacheFormatBinary {
+		return cacheFormatBinary
+	}
+	return cacheFormatJSON
+}
+
+func tenantBinaryObjectKey(tenant string) string {
+	return binaryObjectKey(tenantObjectKey(tenant))
+}
+
+// binaryObjectKey returns the binary counterpart of the JSON cache object at
+// jsonKey.
+func binaryObjectKey(jsonKey string) string {
+	return strings.TrimSuffix(jsonKey, ".json") + binaryObjectSuffix
+}
+
+func appendTimeField(b []byte, num protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(t.UnixNano()))
+}
+
+func appendStringField(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// packVector encodes vector as little-endian float32s.
+func packVector(vector []float32) []byte {
+	packed := make([]byte, 4*len(vector))
+	for i, v := range vector {
+		binary.LittleEndian.PutUint32(packed[4*i:], math.Float32bits(v))
+	}
+	return packed
+}
+
+func unpackVector(packed []byte) ([]float32, error) {
+	if len(packed)%4 != 0 {
+		return nil, errBinaryEntry
+	}
+	vector := make([]float32, len(packed)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(packed[4*i:]))
+	}
+	return vector, nil
+}
+
+func encodeBinaryEntry(entry VectorEntry) []byte {
+	var b []byte
+	b = appendStringField(b, 1, entry.ID)
+	if len(entry.Vector) > 0 {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, packVector(entry.Vector))
+	}
+	b = appendStringField(b, 3, entry.Answer)
+	b = appendStringField(b, 4, entry.Question)
+	b = appendTimeField(b, 5, entry.CreatedAt)
+	b = appendStringField(b, 6, entry.Source)
+	b = appendStringField(b, 7, entry.Tenant)
+	b = appendStringField(b, 8, entry.Owner)
+	if entry.Pinned {
+		b = protowire.AppendTag(b, 9, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	if entry.HitCount != 0 {
+		b = protowire.AppendTag(b, 10, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(entry.HitCount))
+	}
+	b = appendTimeField(b, 11, entry.LastHitAt)
+	b = appendStringField(b, 12, entry.EmbeddingModel)
+	b = appendStringField(b, 13, entry.Language)
+	for _, locale := range slices.Sorted(maps.Keys(entry.Variants)) {
+		var variant []byte
+		variant = appendStringField(variant, 1, locale)
+		variant = appendStringField(variant, 2, entry.Variants[locale])
+		b = protowire.AppendTag(b, 14, protowire.BytesType)
+		b = protowire.AppendBytes(b, variant)
+	}
+	for _, citation := range entry.Citations {
+		var c []byte
+		c = appendStringField(c, 1, citation.DocumentID)
+		c = appendStringField(c, 2, citation.ChunkID)
+		c = appendStringField(c, 3, citation.Title)
+		c = appendStringField(c, 4, citation.Source)
+		c = protowire.AppendTag(c, 5, protowire.Fixed64Type)
+		c = protowire.AppendFixed64(c, math.Float64bits(citation.Similarity))
+		b = protowire.AppendTag(b, 15, protowire.BytesType)
+		b = protowire.AppendBytes(b, c)
+	}
+	if entry.CompressedAnswer != nil {
+		b = protowire.AppendTag(b, 16, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry.CompressedAnswer)
+	}
+	b = appendStringField(b, 17, entry.Style)
+	if entry.TimeSensitive {
+		b = protowire.AppendTag(b, 18, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	if entry.Helpful != 0 {
+		b = protowire.AppendTag(b, 19, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(entry.Helpful))
+	}
+	if entry.Unhelpful != 0 {
+		b = protowire.AppendTag(b, 20, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(entry.Unhelpful))
+	}
+	if entry.Authoritative {
+		b = protowire.AppendTag(b, 21, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	b = appendStringField(b, 22, entry.FAQPack)
+	b = appendStringField(b, 23, entry.Model)
+	for _, paraphrase := range entry.Paraphrases {
+		message := appendStringField(nil, 1, paraphrase.Question)
+		message = protowire.AppendTag(message, 2, protowire.BytesType)
+		message = protowire.AppendBytes(message, packVector(paraphrase.Vector))
+		b = protowire.AppendTag(b, 24, protowire.BytesType)
+		b = protowire.AppendBytes(b, message)
+	}
+	b = appendStringField(b, 25, entry.Access)
+	b = appendStringField(b, 26, entry.Contributor)
+	b = appendStringField(b, 27, entry.Provider)
+	b = appendStringField(b, 28, entry.License)
+	if entry.GeneratedTokens > 0 {
+		b = protowire.AppendTag(b, 29, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(entry.GeneratedTokens))
+	}
+	for _, name := range slices.Sorted(maps.Keys(entry.Extra)) {
+		field := appendStringField(nil, 1, name)
+		field = protowire.AppendTag(field, 2, protowire.BytesType)
+		field = protowire.AppendBytes(field, entry.Extra[name])
+		b = protowire.AppendTag(b, 30, protowire.BytesType)
+		b = protowire.AppendBytes(b, field)
+	}
+	for _, voter := range slices.Sorted(maps.Keys(entry.Votes)) {
+		vote := appendStringField(nil, 1, voter)
+		if entry.Votes[voter] {
+			vote = protowire.AppendTag(vote, 2, protowire.VarintType)
+			vote = protowire.AppendVarint(vote, 1)
+		}
+		b = protowire.AppendTag(b, 31, protowire.BytesType)
+		b = protowire.AppendBytes(b, vote)
+	}
+	return b
+}
+
+func encodeBinaryCache(entries []VectorEntry) []byte {
+	b := protowire.AppendTag(nil, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, binaryCacheVersion)
+	for _, entry := range entries {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeBinaryEntry(entry))
+	}
+	return b
+}
+
+var errBinaryEntry = errors.New("malformed binary entry")
+
+func decodeBinaryEntry(b []byte) (VectorEntry, error) {
+	var entry VectorEntry
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return entry, errBinaryEntry
+		}
+		b = b[n:]
+
+		switch {
+		case typ == protowire.BytesType && (num <= 8 && num != 5 || num >= 12 && num <= 17 || num >= 22 && num <= 28 || num == 30 || num == 31):
+			value, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return entry, errBinaryEntry
+			}
+			b = b[n:]
+			switch num {
+			case 1:
+				entry.ID = string(value)
+			case 2:
+				vector, err := unpackVector(value)
+				if err != nil {
+					return entry, err
+				}
+				entry.Vector = vector
+			case 3:
+				entry.Answer = string(value)
+			case 4:
+				entry.Question = string(value)
+			case 6:
+				entry.Source = string(value)
+			case 7:
+				entry.Tenant = string(value)
+			case 8:
+				entry.Owner = string(value)
+			case 12:
+				entry.EmbeddingModel = string(value)
+			case 13:
+				entry.Language = string(value)
+			case 14:
+				locale, answer, err := decodeBinaryVariant(value)
+				if err != nil {
+					return entry, err
+				}
+				if entry.Variants == nil {
+					entry.Variants = make(map[string]string)
+				}
+				entry.Variants[locale] = answer
+			case 15:
+				citation, err := decodeBinaryCitation(value)
+				if err != nil {
+					return entry, err
+				}
+				entry.Citations = append(entry.Citations, citation)
+			case 16:
+				entry.CompressedAnswer = append([]byte(nil), value...)
+			case 17:
+				entry.Style = string(value)
+			case 22:
+				entry.FAQPack = string(value)
+			case 23:
+				entry.Model = string(value)
+			case 24:
+				paraphrase, err := decodeBinaryParaphrase(value)
+				if err != nil {
+					return entry, err
+				}
+				entry.Paraphrases = append(entry.Paraphrases, paraphrase)
+			case 25:
+				entry.Access = string(value)
+			case 26:
+				entry.Contributor = string(value)
+			case 27:
+				entry.Provider = string(value)
+			case 28:
+				entry.License = string(value)
+			case 30:
+				name, data, err := decodeBinaryExtra(value)
+				if err != nil {
+					return entry, err
+				}
+				if entry.Extra == nil {
+					entry.Extra = make(map[string]json.RawMessage)
+				}
+				entry.Extra[name] = data
+			case 31:
+				voter, helpful, err := decodeBinaryVote(value)
+				if err != nil {
+					return entry, err
+				}
+				if entry.Votes == nil {
+					entry.Votes = make(map[string]bool)
+				}
+				entry.Votes[voter] = helpful
+			}
+		case typ == protowire.VarintType && (num == 5 || num >= 9 && num <= 11 || num >= 18 && num <= 21 || num == 29):
+			value, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return entry, errBinaryEntry
+			}
+			b = b[n:]
+			switch num {
+			case 5:
+				entry.CreatedAt = time.Unix(0, int64(value)).UTC()
+			case 9:
+				entry.Pinned = value != 0
+			case 10:
+				entry.HitCount = int(value)
+			case 11:
+				entry.LastHitAt = time.Unix(0, int64(value)).UTC()
+			case 18:
+				entry.TimeSensitive = value != 0
+			case 19:
+				entry.Helpful = int(value)
+			case 20:
+				entry.Unhelpful = int(value)
+			case 21:
+				entry.Authoritative = value != 0
+			case 29:
+				entry.GeneratedTokens = int(value)
+			}
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return entry, errBinaryEntry
+			}
+			b = b[n:]
+		}
+	}
+	return entry, nil
+}
+
+func decodeBinaryVote(b []byte) (string, bool, error) {
+	var voter string
+	var helpful bool
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", false, errBinaryEntry
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			value, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return "", false, errBinaryEntry
+			}
+			voter = string(value)
+			b = b[n:]
+		case num == 2 && typ == protowire.VarintType:
+			value, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return "", false, errBinaryEntry
+			}
+			helpful = value != 0
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return "", false, errBinaryEntry
+			}
+			b = b[n:]
+		}
+	}
+	return voter, helpful, nil
+}
+
+func decodeBinaryVariant(b []byte) (string, string, error) {
+	var locale, answer string
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", "", errBinaryEntry
+		}
+		b = b[n:]
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return "", "", errBinaryEntry
+			}
+			b = b[n:]
+			continue
+		}
+		value, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return "", "", errBinaryEntry
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			locale = string(value)
+		case 2:
+			answer = string(value)
+		}
+	}
+	return locale, answer, nil
+}
+
+func decodeBinaryExtra(b []byte) (string, json.RawMessage, error) {
+	name, data, err := decodeBinaryVariant(b)
+	if err != nil || !json.Valid([]byte(data)) {
+		return "", nil, errBinaryEntry
+	}
+	return name, json.RawMessage(data), nil
+}
+
+func decodeBinaryParaphrase(b []byte) (Paraphrase, error) {
+	var paraphrase Paraphrase
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return paraphrase, errBinaryEntry
+		}
+		b = b[n:]
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return paraphrase, errBinaryEntry
+			}
+			b = b[n:]
+			continue
+		}
+		value, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return paraphrase, errBinaryEntry
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			paraphrase.Question = string(value)
+		case 2:
+			vector, err := unpackVector(value)
+			if err != nil {
+				return paraphrase, err
+			}
+			paraphrase.Vector = vector
+		}
+	}
+	return paraphrase, nil
+}
+
+func decodeBinaryCitation(b []byte) (Citation, error) {
+	var citation Citation
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return citation, errBinaryEntry
+		}
+		b = b[n:]
+		switch {
+		case typ == protowire.BytesType:
+			value, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return citation, errBinaryEntry
+			}
+			b = b[n:]
+			switch num {
+			case 1:
+				citation.DocumentID = string(value)
+			case 2:
+				citation.ChunkID = string(value)
+			case 3:
+				citation.Title = string(value)
+			case 4:
+				citation.Source = string(value)
+			}
+		case typ == protowire.Fixed64Type && num == 5:
+			value, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				return citation, errBinaryEntry
+			}
+			b = b[n:]
+			citation.Similarity = math.Float64frombits(value)
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return citation, errBinaryEntry
+			}
+			b = b[n:]
+		}
+	}
+	return citation, nil
+}
+
+// decodeBinaryCache decodes entries straight into VectorEntry. A record that
+// cannot be decoded is returned in undecodable as a base64 string, which the
+// integrity checks quarantine.
+func decodeBinaryCache(b []byte) (entries []VectorEntry, undecodable []json.RawMessage, err error) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, nil, fmt.Errorf("decode binary cache: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			version, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, nil, fmt.Errorf("decode binary cache version: %w", protowire.ParseError(n))
+			}
+			if version > binaryCacheVersion {
+				log.Printf("Binary cache version %d is newer than %d; unknown fields are ignored", version, binaryCacheVersion)
+			}
+			b = b[n:]
+		case num == 2 && typ == protowire.BytesType:
+			record, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, nil, fmt.Errorf("decode binary cache entry: %w", protowire.ParseError(n))
+			}
+			b = b[n:]
+
+			entry, err := decodeBinaryEntry(record)
+			if err != nil {
+				data, _ := json.Marshal(base64.StdEncoding.EncodeToString(record))
+				undecodable = append(undecodable, data)
+				continue
+			}
+			entries = append(entries, entry)
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, nil, fmt.Errorf("decode binary cache: %w", protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	return entries, undecodable, nil
+}
+
+// entriesJSON encodes entries one by one for the JSON-based migrations.
+func entriesJSON(entries []VectorEntry) []json.RawMessage {
+	raw := make([]json.RawMessage, 0, len(entries))
+	for _, entry := range entries {
+		if data, err := json.Marshal(entry); err == nil {
+			raw = append(raw, data)
+		}
+	}
+	return raw
+}
+
+// fetchTenantCache reads whichever of the binary and JSON objects of
+// tenant's cache at jsonKey has the newer manifest, falling back to the
+// legacy JSON object when neither has one.
+func fetchTenantCache(target *s3Target, tenant, jsonKey string) ([]VectorEntry, error) {
+	binaryKey := binaryObjectKey(jsonKey)
+	binaryManifest, err := readCacheManifest(target, binaryKey)
+	if err != nil {
+		return nil, err
+	}
+	jsonManifest, err := readCacheManifest(target, jsonKey)
+	if err != nil {
+		return nil, err
+	}
+	if binaryManifest == nil || (jsonManifest != nil && !binaryManifest.WrittenAt.After(jsonManifest.WrittenAt)) {
+		return fetchCacheObject(target, tenant, jsonKey)
+	}
+
+	body, err := getObject(target, binaryKey)
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		return fetchCacheObject(target, tenant, jsonKey)
+	}
+	return decodeCacheObject(target, tenant, binaryKey, body)
+}
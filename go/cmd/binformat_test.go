@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBinaryCacheRoundTrip(t *testing.T) {
+	created := time.Date(2026, 3, 1, 12, 30, 0, 123456789, time.UTC)
+	entries := []VectorEntry{
+		{
+			ID:               "01J0000000000000000000000A",
+			Vector:           []float32{0.25, -1, 3.5},
+			Answer:           "answer",
+			CompressedAnswer: []byte{1, 2, 3},
+			Question:         "question",
+			CreatedAt:        created,
+			Source:           cacheSourceLocal,
+			Tenant:           "acme",
+			Owner:            "alice",
+			EmbeddingModel:   "text-embedding-004",
+			Model:            "gemini-2.5-flash",
+			Provider:         "gemini",
+			GeneratedTokens:  42,
+			License:          "CC-BY-4.0",
+			Language:         "en",
+			Style:            "concise",
+			Variants:         map[string]string{"de": "Antwort", "fr": "réponse"},
+			Citations:        []Citation{{DocumentID: "doc", ChunkID: "chunk", Title: "Title", Source: "src", Similarity: 0.875}},
+			Paraphrases:      []Paraphrase{{Question: "other wording", Vector: []float32{1, 0}}},
+			Access:           "private",
+			Contributor:      "bob",
+			Pinned:           true,
+			Authoritative:    true,
+			FAQPack:          "pack",
+			TimeSensitive:    true,
+			Helpful:          3,
+			Unhelpful:        1,
+			Votes:            map[string]bool{"a1": true, "b2": false},
+			HitCount:         7,
+			LastHitAt:        created.Add(time.Hour),
+			Extra: map[string]json.RawMessage{
+				"FutureField": json.RawMessage(`{"nested":[1,2]}`),
+				"Rating":      json.RawMessage(`4.5`),
+			},
+		},
+		{Vector: []float32{1}, Answer: "minimal", Question: "minimal question"},
+	}
+
+	decoded, undecodable, err := decodeBinaryCache(encodeBinaryCache(entries))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(undecodable) != 0 {
+		t.Fatalf("%d records did not decode", len(undecodable))
+	}
+	if !reflect.DeepEqual(decoded, entries) {
+		t.Fatalf("round trip changed entries:\ngot  %+v\nwant %+v", decoded, entries)
+	}
+}
+
+func TestBinaryCacheKeepsUndecodableRecords(t *testing.T) {
+	body := encodeBinaryCache([]VectorEntry{{Vector: []float32{1}, Answer: "a", Question: "q"}})
+	// An entry whose vector is not a whole number of float32s.
+	body = append(body, 0x12, 0x03, 0x12, 0x01, 0xff)
+
+	decoded, undecodable, err := decodeBinaryCache(body)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(decoded) != 1 || len(undecodable) != 1 {
+		t.Fatalf("got %d decoded, %d undecodable; want 1, 1", len(decoded), len(undecodable))
+	}
+}
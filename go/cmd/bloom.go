@@ -0,0 +1,191 @@
+package main
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
+)
+
+// With ECHO_BLOOM_FILTER=true, each tenant keeps a Bloom filter over the
+// character trigrams of its cached questions. A query sharing fewer than
+// ECHO_BLOOM_MIN_OVERLAP of its trigrams with the cache cannot plausibly be a
+// paraphrase of anything in it, so the vector search is skipped and the
+// lookup is a miss at similarity 0. Removed entries stay in the filter; that
+// only costs the occasional search the filter could have skipped.
+
+const bloomHashes = 4
+
+type bloomFilter struct {
+	bits []uint64
+}
+
+func newBloomFilter(size int) *bloomFilter {
+	return &bloomFilter{bits: make([]uint64, (size+63)/64)}
+}
+
+func (f *bloomFilter) positions(gram string) [bloomHashes]uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(gram))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	size := uint64(len(f.bits) * 64)
+	var positions [bloomHashes]uint64
+	for i := range positions {
+		positions[i] = (h1 + uint64(i)*h2) % size
+	}
+	return positions
+}
+
+func (f *bloomFilter) add(gram string) {
+	for _, pos := range f.positions(gram) {
+		f.bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+func (f *bloomFilter) mayContain(gram string) bool {
+	for _, pos := range f.positions(gram) {
+		if f.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	// bloomMutex guards the filters and is taken after dbMutex.
+	bloomMutex   sync.Mutex
+	bloomFilters map[string]*bloomFilter
+	bloomSkips   atomic.Int64
+)
+
+func bloomEnabled() bool {
+	return envString("ECHO_BLOOM_FILTER", "false") == "true"
+}
+
+// questionTrigrams returns the distinct character trigrams of the words in
+// question, lowercased and padded so short words still yield one.
+func questionTrigrams(question string) []string {
+	seen := make(map[string]struct{})
+	var grams []string
+	words := strings.FieldsFunc(strings.ToLower(question), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		runes := []rune(" " + word + " ")
+		for i := 0; i+3 <= len(runes); i++ {
+			gram := string(runes[i : i+3])
+			if _, ok := seen[gram]; !ok {
+				seen[gram] = struct{}{}
+				grams = append(grams, gram)
+			}
+		}
+	}
+	return grams
+}
+
+// bloomAddLocked adds entry's question to its tenant's filter once the
+// filters are built. The caller holds dbMutex for writing.
+func bloomAddLocked(entry VectorEntry) {
+	bloomMutex.Lock()
+	defer bloomMutex.Unlock()
+	if bloomFilters != nil {
+		addEntryQuestionsLocked(entry)
+	}
+}
+
+// addEntryQuestionsLocked adds entry's question and its paraphrases, to the
+// public filter too when entry is indexed with the public entries.
+func addEntryQuestionsLocked(entry VectorEntry) {
+	tenants := []string{entry.Tenant}
+	if partition, _ := indexPartition(entry); partition == publicIndexTenant {
+		tenants = append(tenants, publicIndexTenant)
+	}
+	for _, tenant := range tenants {
+		addQuestionLocked(tenant, entry.Question)
+		for _, paraphrase := range entry.Paraphrases {
+			addQuestionLocked(tenant, paraphrase.Question)
+		}
+	}
+}
+
+func addQuestionLocked(tenant, question string) {
+	filter, ok := bloomFilters[tenant]
+	if !ok {
+		filter = newBloomFilter(max(envInt("ECHO_BLOOM_BITS", 1<<20), 64))
+		bloomFilters[tenant] = filter
+	}
+	for _, gram := range questionTrigrams(question) {
+		filter.add(gram)
+	}
+}
+
+// buildBloomFilters fills the filters from the hot and cold tiers.
+func buildBloomFilters() {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	var cold []VectorEntry
+	if tieringEnabled() {
+		cold = coldStubs()
+	}
+
+	bloomMutex.Lock()
+	defer bloomMutex.Unlock()
+	if bloomFilters != nil {
+		return
+	}
+	bloomFilters = make(map[string]*bloomFilter)
+	for _, entries := range [][]VectorEntry{MockVectorDB, cold} {
+		for _, entry := range entries {
+			addEntryQuestionsLocked(entry)
+		}
+	}
+}
+
+// bloomMayMatch reports whether question could match an entry of tenant or
+// a public entry.
+// It is always true when the filter is off or the question is empty.
+func bloomMayMatch(tenant, question string) bool {
+	if !bloomEnabled() {
+		return true
+	}
+	grams := questionTrigrams(question)
+	if len(grams) == 0 {
+		return true
+	}
+
+	bloomMutex.Lock()
+	built := bloomFilters != nil
+	bloomMutex.Unlock()
+	if !built {
+		buildBloomFilters()
+	}
+
+	bloomMutex.Lock()
+	filters := []*bloomFilter{bloomFilters[tenant]}
+	if sharesPublicEntries(tenant) {
+		filters = append(filters, bloomFilters[publicIndexTenant])
+	}
+	shared := 0
+	for _, filter := range filters {
+		if filter == nil {
+			continue
+		}
+		count := 0
+		for _, gram := range grams {
+			if filter.mayContain(gram) {
+				count++
+			}
+		}
+		shared = max(shared, count)
+	}
+	bloomMutex.Unlock()
+
+	if float64(shared) >= envFloat("ECHO_BLOOM_MIN_OVERLAP", 0.25)*float64(len(grams)) {
+		return true
+	}
+	bloomSkips.Add(1)
+	return false
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Every /chat request gets one deadline, ECHO_REQUEST_TIMEOUT by default or
+// the request's timeoutMs (capped at ECHO_MAX_REQUEST_TIMEOUT). Stages draw
+// from what is left of it: cache search may use at most
+// ECHO_CACHE_BUDGET_SHARE of the remainder, so a slow search still leaves
+// time for the provider. Embeddings are computed by the client and are not
+// part of the server-side budget.
+
+const (
+	defaultRequestTimeout    = 20 * time.Second
+	defaultMaxRequestTimeout = 60 * time.Second
+	defaultCacheBudgetShare  = 0.25
+)
+
+type requestBudget struct {
+	deadline time.Time
+}
+
+func newRequestBudget(start time.Time, requested time.Duration) requestBudget {
+	timeout := envDuration("ECHO_REQUEST_TIMEOUT", defaultRequestTimeout)
+	if requested > 0 {
+		timeout = min(requested, envDuration("ECHO_MAX_REQUEST_TIMEOUT", defaultMaxRequestTimeout))
+	}
+	return requestBudget{deadline: start.Add(timeout)}
+}
+
+func cacheBudgetShare() float64 {
+	share := envFloat("ECHO_CACHE_BUDGET_SHARE", defaultCacheBudgetShare)
+	if share <= 0 || share > 1 {
+		return defaultCacheBudgetShare
+	}
+	return share
+}
+
+// stage returns a context limited to share of the time remaining in the
+// budget. A share of 1 hands the stage everything that is left.
+func (b requestBudget) stage(parent context.Context, share float64) (context.Context, context.CancelFunc) {
+	remaining := time.Until(b.deadline)
+	if remaining <= 0 {
+		return context.WithDeadline(parent, b.deadline)
+	}
+	return context.WithTimeout(parent, time.Duration(float64(remaining)*share))
+}
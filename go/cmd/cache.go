@@ -1,24 +1,77 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 	"unicode/utf8"
 )
 
 type VectorEntry struct {
-	Vector     []float32
-	Answer     string
-	Question   string
-	CreatedAt  time.Time
-	Similarity float64
-	Source     string
+	ID     string
+	Vector []float32
+	Answer string
+	// CompressedAnswer replaces Answer when compressed; see compress.go.
+	CompressedAnswer []byte `json:",omitempty"`
+	Question         string
+	CreatedAt        time.Time
+	Similarity       float64
+	Source           string
+	Tenant           string
+	Owner            string
+	// EmbeddingModel names the model that produced Vector.
+	EmbeddingModel string
+	// Model and Provider name the chat model and provider that generated
+	// Answer; they are empty for entries cached before they were recorded.
+	Model    string `json:",omitempty"`
+	Provider string `json:",omitempty"`
+	// GeneratedTokens is the token usage the provider reported for Answer,
+	// or 0 when it reported none.
+	GeneratedTokens int `json:",omitempty"`
+	// License is the entry's license tag; see provenance.go.
+	License string `json:",omitempty"`
+	// Language is the detected language of Question.
+	Language string
+	// Style is the answer style the answer was written in; see style.go.
+	Style string
+	// Variants holds the answer per locale; see variants.go.
+	Variants map[string]string
+	// Citations lists the document chunks a grounded answer was based on.
+	Citations []Citation
+	// Paraphrases are other wordings of Question, indexed alongside it; see
+	// paraphrase.go.
+	Paraphrases []Paraphrase `json:",omitempty"`
+	// Access restricts who a shared entry is served to; see access.go.
+	// Contributor is the user whose question created the entry.
+	Access      string `json:",omitempty"`
+	Contributor string `json:",omitempty"`
+	Pinned      bool
+	// Authoritative marks an entry imported from the FAQ pack FAQPack; see
+	// faq.go.
+	Authoritative bool
+	FAQPack       string
+	// TimeSensitive marks the entry for scheduled refresh.
+	TimeSensitive bool
+	// Helpful and Unhelpful count caller feedback; Votes holds each voter's
+	// vote so it is counted once. See confidence.go.
+	Helpful   int
+	Unhelpful int
+	Votes     map[string]bool `json:",omitempty"`
+	HitCount  int
+	LastHitAt time.Time
+	Seq       uint64 `json:"-"`
+	// Extra holds fields written by newer versions; see schema.go.
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 type HistoryItem struct {
+	ID        string    `json:"id"`
 	Question  string    `json:"question"`
 	Answer    string    `json:"answer"`
 	Timestamp time.Time `json:"timestamp"`
@@ -28,23 +81,63 @@ type HistoryItem struct {
 	Tokens    int       `json:"tokensSaved,omitempty"`
 	EnergyWh  float64   `json:"energySavedWh,omitempty"`
 	CO2g      float64   `json:"co2SavedG,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	User      string    `json:"user,omitempty"`
+	APIKey    string    `json:"apiKey,omitempty"`
+	SessionID string    `json:"sessionId,omitempty"`
+	Pinned    bool      `json:"pinned,omitempty"`
+	// CacheEntryID is the entry that served a cache hit, or the entry a
+	// fresh answer was saved as.
+	CacheEntryID string `json:"cacheEntryId,omitempty"`
+	// PromptAction records how an overlong prompt was fitted to the model.
+	PromptAction string `json:"promptAction,omitempty"`
+	// LatencySavedMs is the provider wait a cache hit avoided; see latency.go.
+	LatencySavedMs int64 `json:"latencySavedMs,omitempty"`
+	// EnergyUncalibrated marks savings estimated from the static table
+	// rather than a measurement; see calibration.go.
+	EnergyUncalibrated bool `json:"energyUncalibrated,omitempty"`
+	// Note and Labels are the caller's annotations; see annotations.go.
+	Note        string     `json:"note,omitempty"`
+	Labels      []string   `json:"labels,omitempty"`
+	AnnotatedAt *time.Time `json:"annotatedAt,omitempty"`
+	// Vector is the query embedding, kept for replaying history against
+	// alternative cache settings. It is never returned by the API.
+	Vector []float32 `json:"-"`
 }
 
 type CacheEntryView struct {
-	Question  string    `json:"question"`
-	Answer    string    `json:"answer"`
-	Source    string    `json:"source"`
-	CreatedAt time.Time `json:"createdAt"`
+	ID             string            `json:"id"`
+	Question       string            `json:"question"`
+	Answer         string            `json:"answer"`
+	Source         string            `json:"source"`
+	EmbeddingModel string            `json:"embeddingModel"`
+	Model          string            `json:"model,omitempty"`
+	Provider       string            `json:"provider,omitempty"`
+	Contributor    string            `json:"contributor,omitempty"`
+	License        string            `json:"license,omitempty"`
+	Language       string            `json:"language"`
+	Style          string            `json:"style"`
+	Variants       map[string]string `json:"variants,omitempty"`
+	Paraphrases    []string          `json:"paraphrases,omitempty"`
+	Access         string            `json:"access"`
+	Citations      []Citation        `json:"citations,omitempty"`
+	TimeSensitive  bool              `json:"timeSensitive,omitempty"`
+	Authoritative  bool              `json:"authoritative,omitempty"`
+	FAQPack        string            `json:"faqPack,omitempty"`
+	Helpful        int               `json:"helpful"`
+	Unhelpful      int               `json:"unhelpful"`
+	CreatedAt      time.Time         `json:"createdAt"`
 }
 
 type CacheUseView struct {
-	Question  string    `json:"question"`
-	Answer    string    `json:"answer"`
-	Source    string    `json:"source"`
-	Timestamp time.Time `json:"timestamp"`
-	Tokens    int       `json:"tokensSaved"`
-	EnergyWh  float64   `json:"energySavedWh"`
-	CO2g      float64   `json:"co2SavedG"`
+	Question       string    `json:"question"`
+	Answer         string    `json:"answer"`
+	Source         string    `json:"source"`
+	Timestamp      time.Time `json:"timestamp"`
+	Tokens         int       `json:"tokensSaved"`
+	EnergyWh       float64   `json:"energySavedWh"`
+	CO2g           float64   `json:"co2SavedG"`
+	LatencySavedMs int64     `json:"latencySavedMs"`
 }
 
 type EnvironmentalStats struct {
@@ -54,22 +147,41 @@ type EnvironmentalStats struct {
 	EstimatedTokensSaved int     `json:"estimatedTokensSaved"`
 	EnergySavedWh        float64 `json:"energySavedWh"`
 	CO2SavedG            float64 `json:"co2SavedG"`
+	// LatencySavedHours is the provider wait cache hits avoided, in total
+	// and by the tier that served them.
+	LatencySavedHours      float64 `json:"latencySavedHours"`
+	LocalLatencySavedHours float64 `json:"localLatencySavedHours"`
+	S3LatencySavedHours    float64 `json:"s3LatencySavedHours"`
+	// UncalibratedCacheHits counts hits whose energy and CO2 savings rest on
+	// static estimates rather than measurements.
+	UncalibratedCacheHits int `json:"uncalibratedCacheHits"`
 }
 
 type EnergyConstants struct {
 	DefaultKWhPer1KTokens float64            `json:"defaultKWhPer1KTokens"`
 	GridCO2gPerKWh        float64            `json:"gridCO2gPerKWh"`
 	ModelKWhPer1KTokens   map[string]float64 `json:"modelKWhPer1KTokens"`
+	// ProviderLatencyMs is the observed latency each model's hits are
+	// credited with.
+	ProviderLatencyMs map[string]int64 `json:"providerLatencyMs"`
+	// Calibration holds the measurements that override ModelKWhPer1KTokens.
+	Calibration map[string]EnergyCalibration `json:"calibration,omitempty"`
 }
 
 type CacheStatsResponse struct {
 	Uploading      bool               `json:"uploading"`
 	LastUploadAt   *time.Time         `json:"lastUploadAt,omitempty"`
 	LastDownloadAt *time.Time         `json:"lastDownloadAt,omitempty"`
+	SyncTarget     *SyncTargetView    `json:"syncTarget,omitempty"`
+	SyncFailovers  int                `json:"syncFailovers"`
+	Sync           SyncStats          `json:"sync"`
 	Metrics        EnvironmentalStats `json:"metrics"`
 	Constants      EnergyConstants    `json:"constants"`
 	LocalRamCache  []CacheEntryView   `json:"localRamCache"`
 	S3CacheUsed    []CacheUseView     `json:"s3CacheUsed"`
+	Tiers          *TierStats         `json:"tiers,omitempty"`
+	Similarity     SimilarityStats    `json:"similarity"`
+	PromptCache    PromptCacheStats   `json:"promptCache"`
 }
 
 var (
@@ -77,6 +189,10 @@ var (
 	ChatHistory  []HistoryItem
 	dbMutex      sync.RWMutex
 	statusMutex  sync.RWMutex
+
+	// cacheSeq is a local, monotonically increasing sequence assigned to
+	// every entry added to MockVectorDB. Replication peers pull by it.
+	cacheSeq uint64
 )
 
 const similarityThreshold = 0.90
@@ -84,6 +200,12 @@ const (
 	cacheSourceLocal = "LOCAL"
 	cacheSourceS3    = "S3"
 
+	// sharedOwner marks entries in the tenant-wide shared tier; any other
+	// owner is the user whose private tier holds the entry.
+	sharedOwner      = ""
+	cacheTierShared  = "SHARED"
+	cacheTierPrivate = "PRIVATE"
+
 	estimatedKWhPer1KTokens = 0.00035
 	gridCO2gPerKWh          = 475.0
 )
@@ -91,6 +213,10 @@ const (
 var modelKWhPer1KTokens = map[string]float64{
 	"gemini-2.5-flash-lite": 0.00020,
 	"gemini-2.5-flash":      0.00035,
+	"gpt-4o-mini":           0.00025,
+	"gpt-4o":                0.00100,
+	"gpt-4.1-mini":          0.00030,
+	"gpt-4.1-nano":          0.00015,
 }
 
 func estimateTokens(text string) int {
@@ -102,16 +228,34 @@ func estimateTokens(text string) int {
 	return tokens
 }
 
-func estimateSavings(question, answer, model string) (int, float64, float64) {
-	tokens := estimateTokens(question) + estimateTokens(answer)
+// kWhPer1KTokens prefers model's measured energy use; see calibration.go.
+func kWhPer1KTokens(model string) float64 {
+	if kWhPer1K, ok := calibratedKWhPer1KTokens(model); ok {
+		return kWhPer1K
+	}
 	kWhPer1K, ok := modelKWhPer1KTokens[model]
 	if !ok || kWhPer1K <= 0 {
-		kWhPer1K = estimatedKWhPer1KTokens
+		return estimatedKWhPer1KTokens
+	}
+	return kWhPer1K
+}
+
+// entryTokens is what answering question from the provider instead of entry
+// would have cost: the usage reported when entry was generated, or an
+// estimate.
+func entryTokens(entry VectorEntry, question string) int {
+	if entry.GeneratedTokens > 0 {
+		return entry.GeneratedTokens
 	}
-	kWh := (float64(tokens) / 1000.0) * kWhPer1K
+	return estimateTokens(question) + estimateTokens(entryAnswer(entry))
+}
+
+// estimateSavings returns the energy and CO2 not spent on tokens.
+func estimateSavings(tokens int, model string) (float64, float64) {
+	kWh := (float64(tokens) / 1000.0) * kWhPer1KTokens(model)
 	energyWh := kWh * 1000.0
 	co2g := kWh * gridCO2gPerKWh
-	return tokens, energyWh, co2g
+	return energyWh, co2g
 }
 
 func cosineSimilarity(a, b []float32) float64 {
@@ -138,65 +282,196 @@ func cosineSimilarity(a, b []float32) float64 {
 	return dotProduct / (math.Sqrt(normA) * math.Sqrt(normB))
 }
 
-func findBestMatch(vector []float32) (VectorEntry, bool) {
+// cacheQuery is what a lookup matches besides tenant and owner. Entries only
+// match a query with the same embedding model and style; language is weighed
+// per ECHO_LANGUAGE_MATCH.
+type cacheQuery struct {
+	// Text is the question, checked against the Bloom filter if enabled.
+	Text           string
+	Vector         []float32
+	EmbeddingModel string
+	Language       string
+	Style          string
+	// Threshold overrides similarityThreshold for this query when set.
+	Threshold float64
+	// MinConfidence overrides ECHO_CONFIDENCE_MIN when set.
+	MinConfidence float64
+}
+
+func (q cacheQuery) threshold() float64 {
+	if q.Threshold > 0 {
+		return q.Threshold
+	}
+	return similarityThreshold
+}
+
+func (q cacheQuery) partitionMatches(entry VectorEntry) bool {
+	return entryEmbeddingModel(entry) == q.EmbeddingModel && entryStyle(entry) == q.Style
+}
+
+// findBestMatch searches one tenant's entries owned by owner for query;
+// sharedOwner selects the shared tier. On a miss the returned entry only
+// carries the best similarity seen. The search is abandoned with ctx's error
+// once ctx is done.
+func findBestMatch(ctx context.Context, tenant, owner string, query cacheQuery) (VectorEntry, bool, error) {
 	dbMutex.RLock()
 	defer dbMutex.RUnlock()
 
-	bestScore := 0.0
-	var best VectorEntry
+	pos, bestScore, err := searchIndex(ctx, tenant, owner, query)
+	if err != nil {
+		return VectorEntry{}, false, err
+	}
+	missScore := bestScore
+	if owner == sharedOwner {
+		if sharesPublicEntries(tenant) {
+			// So are the public entries of every tenant sharing them.
+			publicPos, publicScore, err := searchIndex(ctx, publicIndexTenant, sharedOwner, query)
+			if err != nil {
+				return VectorEntry{}, false, err
+			}
+			if publicPos >= 0 && publicScore > bestScore {
+				pos, bestScore = publicPos, publicScore
+			}
+			missScore = bestScore
+		}
 
-	for _, entry := range MockVectorDB {
-		score := cosineSimilarity(vector, entry.Vector)
-		if score > bestScore {
-			bestScore = score
-			best = entry
+		faqPos, faqScore, err := searchIndex(ctx, tenant, faqIndexOwner, query)
+		if err != nil {
+			return VectorEntry{}, false, err
+		}
+		if preferFAQ(faqPos, faqScore, bestScore) {
+			best := MockVectorDB[faqPos]
+			best.Similarity = faqScore
+			return best, true, nil
 		}
+		missScore = max(missScore, faqScore)
 	}
-
-	if bestScore >= similarityThreshold {
+	if pos >= 0 && bestScore >= query.threshold() {
+		best := MockVectorDB[pos]
 		best.Similarity = bestScore
-		return best, true
+		return best, true, nil
 	}
 
-	return VectorEntry{}, false
+	return VectorEntry{Similarity: missScore}, false, nil
 }
 
-func saveToMockVectorDB(vector []float32, answer string, question string) {
-	copyVector := make([]float32, len(vector))
-	copy(copyVector, vector)
+// saveToMockVectorDB caches answer and returns the new entry's ID.
+// tokens is the provider's reported usage for answer, 0 if unknown.
+func saveToMockVectorDB(tenant, owner, contributor string, query cacheQuery, answer, question, model string, tokens int, citations []Citation) string {
+	copyVector := make([]float32, len(query.Vector))
+	copy(copyVector, query.Vector)
+
+	entry := VectorEntry{
+		ID:              newID(),
+		Vector:          copyVector,
+		Answer:          answer,
+		Question:        question,
+		CreatedAt:       time.Now(),
+		Source:          cacheSourceLocal,
+		Tenant:          tenant,
+		Owner:           owner,
+		Contributor:     contributor,
+		EmbeddingModel:  query.EmbeddingModel,
+		Model:           model,
+		Provider:        modelProvider(model),
+		GeneratedTokens: tokens,
+		License:         defaultLicense(),
+		Language:        query.Language,
+		Style:           query.Style,
+		Citations:       citations,
+	}
+	compressEntryAnswer(&entry)
+	if node, remote := shardOwner(tenant, question, entry.Vector); remote {
+		go storeOnShard(node, entry)
+		return entry.ID
+	}
+	enqueueWrite(pendingWrite{entry: &entry})
+	return entry.ID
+}
 
+// mergeEntries appends remote entries whose question is not cached yet and
+// returns how many were added. Remote entries are tagged with source.
+func mergeEntries(remoteEntries []VectorEntry, source string) int {
 	dbMutex.Lock()
 	defer dbMutex.Unlock()
 
-	MockVectorDB = append(MockVectorDB, VectorEntry{
-		Vector:    copyVector,
-		Answer:    answer,
-		Question:  question,
-		CreatedAt: time.Now(),
-		Source:    cacheSourceLocal,
-	})
+	existingByQuestion := make(map[string]struct{}, len(MockVectorDB))
+	for _, entry := range MockVectorDB {
+		if strings.TrimSpace(entry.Question) != "" {
+			existingByQuestion[entryKey(entry.Tenant, entry.Owner, entry.Question)] = struct{}{}
+		}
+	}
+
+	newEntries := 0
+	for _, entry := range remoteEntries {
+		if strings.TrimSpace(entry.Question) == "" {
+			continue
+		}
+		questionKey := entryKey(entry.Tenant, entry.Owner, entry.Question)
+		if _, exists := existingByQuestion[questionKey]; exists {
+			continue
+		}
+		if isMergedAway(questionKey) || isWithdrawn(questionKey) || isColdQuestion(questionKey) || isArchivedQuestion(questionKey) || isTrashedQuestion(questionKey) {
+			continue
+		}
+		cacheSeq++
+		if entry.ID == "" {
+			entry.ID = newID()
+		}
+		entry.Source = source
+		entry.Seq = cacheSeq
+		entry.Vector = reduceVector(entry.Vector)
+		compressEntryAnswer(&entry)
+		MockVectorDB = append(MockVectorDB, entry)
+		indexAppendLocked(len(MockVectorDB) - 1)
+		recordCacheChange(changeCreated, entry)
+		existingByQuestion[questionKey] = struct{}{}
+		newEntries++
+	}
+	if newEntries > 0 {
+		markCacheChanged()
+	}
+	enforceHotTierLocked()
+
+	return newEntries
 }
 
-func appendHistory(question, answer string, saved bool, source string, model string) {
-	dbMutex.Lock()
-	defer dbMutex.Unlock()
+// appendHistory records an answered request and returns the history item's
+// ID. savedTokens and savedLatency are what a cache hit saved; they are 0 for
+// provider answers.
+func appendHistory(caller Caller, sessionID string, vector []float32, question, answer string, savedTokens int, savedLatency time.Duration, source string, model string, entryID string, promptAction string) string {
+	energyWh, co2g := estimateSavings(savedTokens, model)
+
+	item := HistoryItem{
+		ID:                 newID(),
+		Question:           question,
+		Answer:             answer,
+		Timestamp:          time.Now(),
+		Saved:              savedTokens > 0,
+		Source:             source,
+		Model:              model,
+		Tokens:             savedTokens,
+		EnergyWh:           energyWh,
+		CO2g:               co2g,
+		Tenant:             caller.Tenant,
+		User:               caller.User,
+		APIKey:             caller.APIKey,
+		SessionID:          sessionID,
+		Vector:             vector,
+		CacheEntryID:       entryID,
+		PromptAction:       promptAction,
+		LatencySavedMs:     savedLatency.Milliseconds(),
+		EnergyUncalibrated: savedTokens > 0 && !energyCalibrated(model),
+	}
+	enqueueWrite(pendingWrite{history: &item})
+	return item.ID
+}
 
-	tokens, energyWh, co2g := 0, 0.0, 0.0
-	if saved {
-		tokens, energyWh, co2g = estimateSavings(question, answer, model)
-	}
-
-	ChatHistory = append(ChatHistory, HistoryItem{
-		Question:  question,
-		Answer:    answer,
-		Timestamp: time.Now(),
-		Saved:     saved,
-		Source:    source,
-		Model:     model,
-		Tokens:    tokens,
-		EnergyWh:  energyWh,
-		CO2g:      co2g,
-	})
+// historyVisible reports whether caller may see item: same tenant and same
+// user. A caller without a user only sees items recorded without one, never
+// another user's history.
+func historyVisible(item HistoryItem, caller Caller) bool {
+	return item.Tenant == caller.Tenant && item.User == caller.User
 }
 
 func handleHistory(w http.ResponseWriter, r *http.Request) {
@@ -205,11 +480,32 @@ func handleHistory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if rejectAnonymous(w, caller, "history") {
+		return
+	}
+
+	entryID := strings.TrimSpace(r.URL.Query().Get("cacheEntryId"))
+	label := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("label")))
+	search := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+
 	dbMutex.RLock()
 	defer dbMutex.RUnlock()
 
 	history := make([]HistoryItem, 0, len(ChatHistory))
 	for i := len(ChatHistory) - 1; i >= 0; i-- {
+		if !historyVisible(ChatHistory[i], caller) {
+			continue
+		}
+		if entryID != "" && ChatHistory[i].CacheEntryID != entryID {
+			continue
+		}
+		if !historyMatches(ChatHistory[i], label, search) {
+			continue
+		}
 		history = append(history, ChatHistory[i])
 	}
 
@@ -222,11 +518,28 @@ func handleCacheStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if rejectAnonymous(w, caller, "cache stats") {
+		return
+	}
+	tenant := caller.Tenant
+
 	dbMutex.RLock()
-	entries := make([]VectorEntry, len(MockVectorDB))
-	copy(entries, MockVectorDB)
-	history := make([]HistoryItem, len(ChatHistory))
-	copy(history, ChatHistory)
+	entries := make([]VectorEntry, 0, len(MockVectorDB))
+	for _, entry := range MockVectorDB {
+		if entry.Tenant == tenant && entryVisible(entry, caller) {
+			entries = append(entries, entry)
+		}
+	}
+	history := make([]HistoryItem, 0, len(ChatHistory))
+	for _, item := range ChatHistory {
+		if historyVisible(item, caller) {
+			history = append(history, item)
+		}
+	}
 	dbMutex.RUnlock()
 
 	statusMutex.RLock()
@@ -241,6 +554,7 @@ func handleCacheStats(w http.ResponseWriter, r *http.Request) {
 		t := lastS3DownloadAt
 		lastDownloadAt = &t
 	}
+	failovers := s3Failovers
 	statusMutex.RUnlock()
 
 	localRamCache := make([]CacheEntryView, 0)
@@ -251,12 +565,7 @@ func handleCacheStats(w http.ResponseWriter, r *http.Request) {
 			source = cacheSourceLocal
 		}
 		if source == cacheSourceLocal {
-			localRamCache = append(localRamCache, CacheEntryView{
-				Question:  entry.Question,
-				Answer:    entry.Answer,
-				Source:    source,
-				CreatedAt: entry.CreatedAt,
-			})
+			localRamCache = append(localRamCache, entryView(entry))
 		}
 	}
 
@@ -266,6 +575,8 @@ func handleCacheStats(w http.ResponseWriter, r *http.Request) {
 		DefaultKWhPer1KTokens: estimatedKWhPer1KTokens,
 		GridCO2gPerKWh:        gridCO2gPerKWh,
 		ModelKWhPer1KTokens:   modelKWhPer1KTokens,
+		ProviderLatencyMs:     providerLatencyMs(),
+		Calibration:           currentEnergyCalibration(),
 	}
 
 	for i := len(history) - 1; i >= 0; i-- {
@@ -278,6 +589,10 @@ func handleCacheStats(w http.ResponseWriter, r *http.Request) {
 		metrics.EstimatedTokensSaved += item.Tokens
 		metrics.EnergySavedWh += item.EnergyWh
 		metrics.CO2SavedG += item.CO2g
+		metrics.LatencySavedHours += msToHours(item.LatencySavedMs)
+		if item.EnergyUncalibrated {
+			metrics.UncalibratedCacheHits++
+		}
 
 		source := item.Source
 		if source == "" {
@@ -286,16 +601,19 @@ func handleCacheStats(w http.ResponseWriter, r *http.Request) {
 		if source == cacheSourceS3 {
 			metrics.S3CacheHits++
 			s3CacheUsed = append(s3CacheUsed, CacheUseView{
-				Question:  item.Question,
-				Answer:    item.Answer,
-				Source:    source,
-				Timestamp: item.Timestamp,
-				Tokens:    item.Tokens,
-				EnergyWh:  item.EnergyWh,
-				CO2g:      item.CO2g,
+				Question:       item.Question,
+				Answer:         item.Answer,
+				Source:         source,
+				Timestamp:      item.Timestamp,
+				Tokens:         item.Tokens,
+				EnergyWh:       item.EnergyWh,
+				CO2g:           item.CO2g,
+				LatencySavedMs: item.LatencySavedMs,
 			})
+			metrics.S3LatencySavedHours += msToHours(item.LatencySavedMs)
 		} else {
 			metrics.LocalCacheHits++
+			metrics.LocalLatencySavedHours += msToHours(item.LatencySavedMs)
 		}
 	}
 
@@ -303,17 +621,59 @@ func handleCacheStats(w http.ResponseWriter, r *http.Request) {
 		Uploading:      uploading,
 		LastUploadAt:   lastUploadAt,
 		LastDownloadAt: lastDownloadAt,
+		SyncTarget:     currentSyncTarget(),
+		SyncFailovers:  failovers,
+		Sync:           currentSyncStats(),
 		Metrics:        metrics,
 		Constants:      constants,
 		LocalRamCache:  localRamCache,
 		S3CacheUsed:    s3CacheUsed,
+		Tiers:          currentTierStats(),
+		Similarity:     currentSimilarityStats(),
+		PromptCache:    currentPromptCacheStats(),
 	})
 }
 
+// jsonBuffers recycles the buffers requests are read into and responses
+// encoded into. Buffers that grew past maxPooledBuffer, say for an export,
+// are left to the garbage collector rather than pinned in the pool.
+var jsonBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+const maxPooledBuffer = 64 << 10
+
+func getBuffer() *bytes.Buffer {
+	buf := jsonBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		jsonBuffers.Put(buf)
+	}
+}
+
+// readJSON decodes the request body into v through a pooled buffer.
+func readJSON(r *http.Request, v any) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := buf.ReadFrom(r.Body); err != nil {
+		return err
+	}
+	return json.Unmarshal(buf.Bytes(), v)
+}
+
+// writeJSON encodes payload before writing the header, so an encoding
+// failure still gets a proper 500 and the response a Content-Length.
 func writeJSON(w http.ResponseWriter, status int, payload any) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	if err := json.NewEncoder(w).Encode(payload); err != nil {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := json.NewEncoder(buf).Encode(payload); err != nil {
 		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ECHO_ENERGY_CALIBRATION_PATH names a JSON array of measured energy figures
+// that override the static per-model estimates in cache.go:
+//
+//	[{"model": "gemini-2.5-flash", "hardware": "tpu-v5e", "joulesPerToken": 0.42, "source": "bench-2026-09"}]
+//
+// When a model was measured on several hardware types, ECHO_ENERGY_HARDWARE
+// picks which applies; a measurement without hardware applies to any. Savings
+// for a model without a measurement still use the static table and are
+// flagged as uncalibrated.
+
+const joulesPerKWh = 3.6e6
+
+type EnergyCalibration struct {
+	Model          string  `json:"model"`
+	Hardware       string  `json:"hardware,omitempty"`
+	JoulesPerToken float64 `json:"joulesPerToken"`
+	Source         string  `json:"source,omitempty"`
+}
+
+var (
+	calibrationMutex  sync.RWMutex
+	energyCalibration map[string]EnergyCalibration
+)
+
+// parseEnergyCalibration returns the measurement that applies to each model
+// on hardware.
+func parseEnergyCalibration(data []byte, hardware string) (map[string]EnergyCalibration, error) {
+	var measurements []EnergyCalibration
+	if err := json.Unmarshal(data, &measurements); err != nil {
+		return nil, err
+	}
+	calibration := make(map[string]EnergyCalibration)
+	for i, measurement := range measurements {
+		if measurement.Model == "" {
+			return nil, fmt.Errorf("measurement %d has no model", i)
+		}
+		if measurement.JoulesPerToken <= 0 {
+			return nil, fmt.Errorf("measurement %d for %q: joulesPerToken must be positive", i, measurement.Model)
+		}
+		if measurement.Hardware != "" && hardware != "" && !strings.EqualFold(measurement.Hardware, hardware) {
+			continue
+		}
+		existing, ok := calibration[measurement.Model]
+		switch {
+		case !ok:
+			calibration[measurement.Model] = measurement
+		case existing.Hardware == "" && measurement.Hardware != "":
+			calibration[measurement.Model] = measurement
+		case hardware == "" && existing.Hardware != measurement.Hardware && measurement.Hardware != "":
+			return nil, fmt.Errorf("%q was measured on several hardware types; set ECHO_ENERGY_HARDWARE", measurement.Model)
+		}
+	}
+	return calibration, nil
+}
+
+func readEnergyCalibration() (map[string]EnergyCalibration, error) {
+	data, err := os.ReadFile(envString("ECHO_ENERGY_CALIBRATION_PATH", ""))
+	if err != nil {
+		return nil, err
+	}
+	return parseEnergyCalibration(data, envString("ECHO_ENERGY_HARDWARE", ""))
+}
+
+func loadEnergyCalibration() {
+	if envString("ECHO_ENERGY_CALIBRATION_PATH", "") == "" {
+		return
+	}
+	calibration, err := readEnergyCalibration()
+	if err != nil {
+		log.Printf("Load energy calibration failed, using static estimates: %v", err)
+		return
+	}
+	calibrationMutex.Lock()
+	energyCalibration = calibration
+	calibrationMutex.Unlock()
+	log.Printf("Loaded energy calibration for %d models", len(calibration))
+}
+
+// calibratedKWhPer1KTokens returns model's measured energy use, and false
+// when it has none.
+func calibratedKWhPer1KTokens(model string) (float64, bool) {
+	calibrationMutex.RLock()
+	defer calibrationMutex.RUnlock()
+	measurement, ok := energyCalibration[model]
+	if !ok {
+		return 0, false
+	}
+	return measurement.JoulesPerToken * 1000 / joulesPerKWh, true
+}
+
+func energyCalibrated(model string) bool {
+	_, ok := calibratedKWhPer1KTokens(model)
+	return ok
+}
+
+func currentEnergyCalibration() map[string]EnergyCalibration {
+	calibrationMutex.RLock()
+	defer calibrationMutex.RUnlock()
+	return energyCalibration
+}
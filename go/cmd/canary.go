@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Canary comparison regenerates a random sample of cached answers every
+// ECHO_CANARY_INTERVAL and compares old and new answers by embedding
+// similarity. Cached answers are left untouched; the drift report only tells
+// operators which content has likely gone out of date. Answers whose
+// similarity falls below ECHO_CANARY_DRIFT_THRESHOLD count as drifted.
+//
+// The calls are metered to operatorCaller, not the entries' tenants, and only
+// one replica runs each interval. The report keeps the latest
+// ECHO_CANARY_MAX_RESULTS results (1000).
+
+type CanaryResult struct {
+	EntryID    string    `json:"entryId"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Question   string    `json:"question"`
+	Cached     string    `json:"cachedAnswer"`
+	Fresh      string    `json:"freshAnswer"`
+	Similarity float64   `json:"similarity"`
+	Drifted    bool      `json:"drifted"`
+	Model      string    `json:"model"`
+	CheckedAt  time.Time `json:"checkedAt"`
+}
+
+type CanaryReport struct {
+	LastRun        time.Time      `json:"lastRun,omitempty"`
+	Checked        int            `json:"checked"`
+	Drifted        int            `json:"drifted"`
+	MeanSimilarity float64        `json:"meanSimilarity"`
+	Threshold      float64        `json:"threshold"`
+	Results        []CanaryResult `json:"results"`
+}
+
+var (
+	// canaryMutex guards canaryResults, canaryOrder and canaryLastRun;
+	// canaryRunMutex serializes runs.
+	canaryMutex    sync.Mutex
+	canaryRunMutex sync.Mutex
+	canaryResults  = make(map[string]CanaryResult)
+	// canaryOrder holds the IDs in canaryResults, oldest first.
+	canaryOrder   []string
+	canaryLastRun time.Time
+)
+
+func canaryDriftThreshold() float64 {
+	return envFloat("ECHO_CANARY_DRIFT_THRESHOLD", 0.85)
+}
+
+func startCanary(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for range ticker.C {
+			if claimJobRun("canary", interval) {
+				runCanary(envInt("ECHO_CANARY_SAMPLE_SIZE", 10))
+			}
+		}
+	}()
+}
+
+func sampleEntries(n int) []VectorEntry {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	indexes := rand.Perm(len(MockVectorDB))
+	if len(indexes) > n {
+		indexes = indexes[:n]
+	}
+	sample := make([]VectorEntry, len(indexes))
+	for i, idx := range indexes {
+		sample[i] = MockVectorDB[idx]
+	}
+	return sample
+}
+
+// compareAnswers returns the cosine similarity of the two answers' embeddings.
+func compareAnswers(ctx context.Context, cached, fresh string) (float64, error) {
+	vectors, _, err := embedTextsFor(ctx, operatorCaller, []string{cached, fresh})
+	if err != nil {
+		return 0, err
+	}
+	return cosineSimilarity(vectors[0], vectors[1]), nil
+}
+
+func runCanary(sampleSize int) {
+	canaryRunMutex.Lock()
+	defer canaryRunMutex.Unlock()
+	if currentMaintenance().Enabled {
+		return
+	}
+
+	threshold := canaryDriftThreshold()
+	checked := 0
+	for _, entry := range sampleEntries(sampleSize) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		fresh, model, err := regenerateEntry(ctx, entry, operatorCaller)
+		var similarity float64
+		cached := entryAnswer(entry)
+		if err == nil {
+			similarity, err = compareAnswers(ctx, cached, fresh)
+		}
+		cancel()
+		if err != nil {
+			log.Printf("Canary for entry %s failed: %v", entry.ID, err)
+			continue
+		}
+
+		checked++
+		canaryMutex.Lock()
+		storeCanaryResultLocked(CanaryResult{
+			EntryID:    entry.ID,
+			Tenant:     entry.Tenant,
+			Question:   entry.Question,
+			Cached:     cached,
+			Fresh:      fresh,
+			Similarity: similarity,
+			Drifted:    similarity < threshold,
+			Model:      model,
+			CheckedAt:  time.Now(),
+		})
+		canaryMutex.Unlock()
+	}
+
+	canaryMutex.Lock()
+	canaryLastRun = time.Now()
+	canaryMutex.Unlock()
+	log.Printf("Canary: compared %d cached answers", checked)
+}
+
+// storeCanaryResultLocked records result, dropping the oldest results beyond
+// the cap. Callers must hold canaryMutex.
+func storeCanaryResultLocked(result CanaryResult) {
+	if _, exists := canaryResults[result.EntryID]; !exists {
+		canaryOrder = append(canaryOrder, result.EntryID)
+	}
+	canaryResults[result.EntryID] = result
+	for limit := max(envInt("ECHO_CANARY_MAX_RESULTS", 1000), 1); len(canaryOrder) > limit; {
+		delete(canaryResults, canaryOrder[0])
+		canaryOrder = canaryOrder[1:]
+	}
+}
+
+// canaryReport returns the latest result per entry still in the hot tier,
+// most drifted first.
+func canaryReport() CanaryReport {
+	dbMutex.RLock()
+	live := make(map[string]struct{}, len(MockVectorDB))
+	for _, entry := range MockVectorDB {
+		live[entry.ID] = struct{}{}
+	}
+	dbMutex.RUnlock()
+
+	canaryMutex.Lock()
+	defer canaryMutex.Unlock()
+	report := CanaryReport{LastRun: canaryLastRun, Threshold: canaryDriftThreshold(), Results: make([]CanaryResult, 0)}
+	total := 0.0
+	for id, result := range canaryResults {
+		if _, ok := live[id]; !ok {
+			delete(canaryResults, id)
+			continue
+		}
+		report.Results = append(report.Results, result)
+		total += result.Similarity
+		if result.Drifted {
+			report.Drifted++
+		}
+	}
+	canaryOrder = slices.DeleteFunc(canaryOrder, func(id string) bool {
+		_, ok := canaryResults[id]
+		return !ok
+	})
+	report.Checked = len(report.Results)
+	if report.Checked > 0 {
+		report.MeanSimilarity = total / float64(report.Checked)
+	}
+	sort.Slice(report.Results, func(i, j int) bool {
+		return report.Results[i].Similarity < report.Results[j].Similarity
+	})
+	return report
+}
+
+// handleCanary shows the drift report (GET) or runs a comparison now (POST).
+func handleCanary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method == http.MethodPost {
+		runCanary(envInt("ECHO_CANARY_SAMPLE_SIZE", 10))
+	}
+	writeJSON(w, http.StatusOK, canaryReport())
+}
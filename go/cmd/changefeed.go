@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GET /cache/changes?since=<cursor> lets a client mirror the entries it may
+// be served incrementally. Each response lists the entries created, updated
+// or deleted since the cursor, oldest first with one change per entry, and a
+// new cursor to pass next time; hasMore asks for another call right away.
+// Without since, only the current cursor is returned: take it, then read the
+// full state once, then follow the feed. Replayed changes are idempotent
+// upserts and deletes.
+//
+// Changes are journaled in memory, the last ECHO_CHANGE_FEED_SIZE (default
+// 10000) of them. A cursor older than the journal, or from before a restart,
+// gets 410 Gone and the client starts over. Only hot-tier content counts:
+// moving an entry between tiers or counting its hits is not a change, but
+// dropping it from the cache altogether is.
+
+const (
+	changeCreated = "created"
+	changeUpdated = "updated"
+	changeDeleted = "deleted"
+
+	defaultChangeFeedLimit = 100
+	maxChangeFeedLimit     = 1000
+)
+
+type CacheChange struct {
+	Type    string    `json:"type"`
+	EntryID string    `json:"entryId"`
+	At      time.Time `json:"at"`
+	// Entry is the entry as of the change; deletions leave it out.
+	Entry *CacheEntryView `json:"entry,omitempty"`
+}
+
+type ChangeFeedResponse struct {
+	Cursor  string        `json:"cursor"`
+	Changes []CacheChange `json:"changes"`
+	HasMore bool          `json:"hasMore"`
+}
+
+// journaledChange is a change with the fields entryVisible needs.
+type journaledChange struct {
+	seq    uint64
+	scope  VectorEntry
+	change CacheChange
+}
+
+var (
+	// changeFeedMutex guards the fields below.
+	changeFeedMutex sync.Mutex
+	changeJournal   []journaledChange
+	changeSeq       uint64
+)
+
+// recordCacheChange journals a change to entry. It may be called with
+// dbMutex held.
+func recordCacheChange(kind string, entry VectorEntry) {
+	change := CacheChange{Type: kind, EntryID: entry.ID, At: time.Now()}
+	if kind != changeDeleted {
+		view := entryView(entry)
+		change.Entry = &view
+	}
+	scope := VectorEntry{Tenant: entry.Tenant, Owner: entry.Owner, Access: entry.Access, Contributor: entry.Contributor}
+
+	changeFeedMutex.Lock()
+	defer changeFeedMutex.Unlock()
+	changeSeq++
+	changeJournal = append(changeJournal, journaledChange{seq: changeSeq, scope: scope, change: change})
+	if keep := max(envInt("ECHO_CHANGE_FEED_SIZE", 10000), 1); len(changeJournal) > keep {
+		changeJournal = append([]journaledChange(nil), changeJournal[len(changeJournal)-keep:]...)
+	}
+}
+
+func formatChangeCursor(seq uint64) string {
+	return strconv.FormatInt(nodeEpoch, 36) + "." + strconv.FormatUint(seq, 36)
+}
+
+// parseChangeCursor returns the sequence a cursor stands for, and false
+// when it was issued before this process started.
+func parseChangeCursor(cursor string) (uint64, bool, error) {
+	epoch, seq, found := strings.Cut(cursor, ".")
+	if !found {
+		return 0, false, fmt.Errorf("invalid cursor")
+	}
+	n, err := strconv.ParseUint(seq, 36, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid cursor")
+	}
+	return n, epoch == strconv.FormatInt(nodeEpoch, 36), nil
+}
+
+// changesSince returns up to limit of caller's changes after seq, one per
+// entry, with the cursor to continue from. It fails when the journal no
+// longer reaches back to seq.
+func changesSince(caller Caller, seq uint64, limit int) (ChangeFeedResponse, bool) {
+	changeFeedMutex.Lock()
+	defer changeFeedMutex.Unlock()
+
+	if len(changeJournal) > 0 && seq+1 < changeJournal[0].seq {
+		return ChangeFeedResponse{}, false
+	}
+	resp := ChangeFeedResponse{Changes: make([]CacheChange, 0)}
+	latest := make(map[string]int)
+	taken, last := 0, changeSeq
+	for _, journaled := range changeJournal {
+		if journaled.seq <= seq || !entryVisible(journaled.scope, caller) {
+			continue
+		}
+		if taken == limit {
+			resp.HasMore = true
+			break
+		}
+		taken++
+		last = journaled.seq
+		if i, ok := latest[journaled.change.EntryID]; ok {
+			// Keep the entry's place in the order, with its newest state.
+			resp.Changes[i] = journaled.change
+			continue
+		}
+		latest[journaled.change.EntryID] = len(resp.Changes)
+		resp.Changes = append(resp.Changes, journaled.change)
+	}
+	if !resp.HasMore {
+		// Skip past the trailing changes caller cannot see.
+		last = changeSeq
+	}
+	resp.Cursor = formatChangeCursor(last)
+	return resp, true
+}
+
+func handleChangeFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if rejectAnonymous(w, caller, "the change feed") {
+		return
+	}
+
+	limit := defaultChangeFeedLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 || parsed > maxChangeFeedLimit {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and 1000"})
+			return
+		}
+		limit = parsed
+	}
+
+	since := r.URL.Query().Get("since")
+	if since == "" {
+		changeFeedMutex.Lock()
+		cursor := formatChangeCursor(changeSeq)
+		changeFeedMutex.Unlock()
+		writeJSON(w, http.StatusOK, ChangeFeedResponse{Cursor: cursor, Changes: make([]CacheChange, 0)})
+		return
+	}
+	seq, current, err := parseChangeCursor(since)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if !current {
+		writeJSON(w, http.StatusGone, map[string]string{"error": "cursor is from before a restart; read the full state again"})
+		return
+	}
+	resp, ok := changesSince(caller, seq, limit)
+	if !ok {
+		writeJSON(w, http.StatusGone, map[string]string{"error": "cursor is older than the change journal; read the full state again"})
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -2,32 +2,119 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 	"time"
 )
 
+// typicalVectorDims is the size of the browser's MiniLM embeddings.
+const typicalVectorDims = 384
+
 type Request struct {
 	Text   string    `json:"text"`
 	Vector []float32 `json:"vector"`
 	Model  string    `json:"model,omitempty"`
+	// EmbeddingModel names the model that produced Vector. Defaults to
+	// ECHO_DEFAULT_EMBEDDING_MODEL.
+	EmbeddingModel string `json:"embeddingModel,omitempty"`
+	// Share lets a user keep a fresh answer in their private tier instead of
+	// contributing it to the shared cache. Defaults to ECHO_SHARE_BY_DEFAULT.
+	Share *bool `json:"share,omitempty"`
+	// SessionID groups requests into a conversation thread in history.
+	SessionID string `json:"sessionId,omitempty"`
+	// DryRun reports the cache decision without calling the provider,
+	// writing history, or touching the cache.
+	DryRun bool `json:"dryRun,omitempty"`
+	// TimeoutMs overrides the total time budget for this request.
+	TimeoutMs int `json:"timeoutMs,omitempty"`
+	// Locale asks for the answer in this locale, e.g. "pt-BR". Defaults to
+	// the detected language of Text.
+	Locale string `json:"locale,omitempty"`
+	// Rag grounds a fresh answer in the tenant's uploaded documents.
+	// Defaults to ECHO_RAG_BY_DEFAULT.
+	Rag *bool `json:"rag,omitempty"`
+	// Style asks for a full (default), concise or bullet answer. Each style
+	// has its own cache slots.
+	Style string `json:"style,omitempty"`
+	// SuggestionPolicy decides what a near miss does: generate, ask or off.
+	// Defaults to ECHO_SUGGESTION_POLICY; see suggestion.go.
+	SuggestionPolicy string `json:"suggestionPolicy,omitempty"`
+	// Temperature is passed to the provider for a fresh answer. Defaults to
+	// the API key's profile, then the provider's own default.
+	Temperature *float64 `json:"temperature,omitempty"`
+	// SimilarityThreshold is the score a cached answer needs to be served.
+	// Defaults to the API key's profile, then similarityThreshold.
+	SimilarityThreshold float64 `json:"similarityThreshold,omitempty"`
 }
 
 type Response struct {
-	Answer string `json:"answer"`
-	Source string `json:"source"`
+	// ID is the history item recording this answer; CacheEntryID and
+	// SessionID link it to its cache entry and thread.
+	ID           string `json:"id,omitempty"`
+	CacheEntryID string `json:"cacheEntryId,omitempty"`
+	SessionID    string `json:"sessionId,omitempty"`
+	Answer       string `json:"answer"`
+	Source       string `json:"source"`
+	Tier         string `json:"tier,omitempty"`
+	Locale       string `json:"locale,omitempty"`
+	// Citations lists the documents a grounded answer was based on.
+	Citations []Citation `json:"citations,omitempty"`
+	// Stale marks a cached answer past ECHO_SOFT_TTL that is being
+	// regenerated in the background.
+	Stale bool `json:"stale,omitempty"`
+	// Confidence scores a cached answer; Verify hints that it should be
+	// checked before relying on it. See confidence.go.
+	Confidence float64 `json:"confidence,omitempty"`
+	Verify     bool    `json:"verify,omitempty"`
+	// Authoritative marks an answer from an FAQ pack.
+	Authoritative bool `json:"authoritative,omitempty"`
+	// Suggestion is a near-miss cached answer, shown alongside a fresh
+	// answer or, with source SUGGESTION, instead of one.
+	Suggestion *Suggestion `json:"suggestion,omitempty"`
+	// PromptAction says how an overlong prompt was fitted to the model:
+	// truncated or summarized. See tokenguard.go.
+	PromptAction string `json:"promptAction,omitempty"`
+	// Experiment names the experiment and arm whose cache policy applied,
+	// as experiment:arm. See experiments.go.
+	Experiment string `json:"experiment,omitempty"`
+	// ServedFrom describes where the answer came from; see servedfrom.go.
+	ServedFrom *ServedFrom `json:"servedFrom,omitempty"`
 }
 
 func handleChat(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 	if r.Method != http.MethodPost {
 		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
 		return
 	}
 
-	var req Request
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	maintenanceState := currentMaintenance()
+	if maintenanceState.Enabled && !maintenanceState.CacheOnly {
+		writeMaintenance(w, maintenanceState)
+		return
+	}
+
+	if caller.Anonymous && !allowDemoRequest(r) {
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "demo rate limit exceeded"})
+		return
+	}
+
+	if denial := reserveRequest(caller); denial != nil {
+		writeQuotaExceeded(w, denial)
+		return
+	}
+
+	// Decoding appends into Vector, so a typical embedding fits without
+	// the slice growing.
+	req := Request{Vector: make([]float32, 0, typicalVectorDims)}
+	if err := readJSON(r, &req); err != nil {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON payload"})
 		return
 	}
@@ -37,39 +124,314 @@ func handleChat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	req.SessionID = strings.TrimSpace(req.SessionID)
+	if req.SessionID != "" && !userIDPattern.MatchString(req.SessionID) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid sessionId"})
+		return
+	}
+	if req.TimeoutMs < 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "timeoutMs must not be negative"})
+		return
+	}
+	profile := keyProfile(caller)
+	applyProfile(&req, profile)
+	if req.Temperature != nil && (*req.Temperature < 0 || *req.Temperature > 2) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "temperature must be between 0 and 2"})
+		return
+	}
+	if req.SimilarityThreshold < 0 || req.SimilarityThreshold > 1 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "similarityThreshold must be between 0 and 1"})
+		return
+	}
+
 	fmt.Printf("Received Vector from Browser! Length: %d\n", len(req.Vector))
 
-	modelName := resolveGeminiModel(req.Model)
+	modelName, err := resolveModel(caller.Tenant, req.Model)
+	if err != nil {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+		return
+	}
+	if caller.Anonymous {
+		modelName = cheapestModel()
+	}
+	embeddingModel, ok := resolveEmbeddingModel(req.EmbeddingModel)
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid embedding model"})
+		return
+	}
+	style, ok := normalizeStyle(req.Style)
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "style must be full, concise or bullet"})
+		return
+	}
+	suggestionPolicy, ok := normalizeSuggestionPolicy(req.SuggestionPolicy)
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "suggestionPolicy must be generate, ask or off"})
+		return
+	}
+	language := detectLanguage(req.Text)
+	query := cacheQuery{
+		Text:           req.Text,
+		Vector:         reduceVector(req.Vector),
+		EmbeddingModel: embeddingModel,
+		Language:       language,
+		Style:          style,
+		Threshold:      req.SimilarityThreshold,
+	}
+	experiment := assignExperiment(caller, req.Text)
+	experiment.apply(&query)
+	locale, ok := normalizeLocale(req.Locale)
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid locale"})
+		return
+	}
+	if locale == "" && language != languageUnknown {
+		locale = language
+	}
+
+	budget := newRequestBudget(start, time.Duration(req.TimeoutMs)*time.Millisecond)
+	searchCtx, cancelSearch := budget.stage(r.Context(), cacheBudgetShare())
+	defer cancelSearch()
+
+	if req.DryRun {
+		decision, err := dryRunDecision(searchCtx, caller, query, modelName, suggestionPolicy)
+		if err != nil {
+			fmt.Printf("Cache search aborted: %v\n", err)
+			if r.Context().Err() == nil {
+				writeJSON(w, http.StatusGatewayTimeout, map[string]string{"error": "cache search timed out"})
+			}
+			return
+		}
+		writeJSON(w, http.StatusOK, decision)
+		return
+	}
+	noteThreadActivity(caller, req.SessionID, req.Text)
 
-	if match, ok := findBestMatch(req.Vector); ok {
-		fmt.Printf("Cache hit! similarity=%.4f\n", match.Similarity)
+	prompt := promptCacheKey(caller, query, modelName, locale, useRAG(req.Rag), req.Temperature)
+	// A key without cache access always asks the provider.
+	match, ok := VectorEntry{}, false
+	searchTimedOut := false
+	if profile.CacheAccess != cacheAccessNone {
+		match, ok = lookupPrompt(caller, prompt)
+		if !ok {
+			match, ok, err = lookupForCaller(searchCtx, caller, query)
+		}
+	}
+	if err != nil {
+		if r.Context().Err() != nil {
+			// The client went away mid-search; there is nobody to answer.
+			fmt.Printf("Cache search aborted: %v\n", err)
+			return
+		}
+		// The search ran out of its share of the budget; treat it as a miss
+		// so the provider still gets the rest. It says nothing about how
+		// well the cache matches, so it stays out of the similarity and
+		// experiment stats.
+		fmt.Printf("Cache search timed out, falling back to provider: %v\n", err)
+		match, ok = VectorEntry{}, false
+		searchTimedOut = true
+	}
+	var confidence float64
+	var verify bool
+	if ok {
+		confidence = entryConfidence(match, match.Similarity, time.Now())
+		if ok, verify = confidentMatch(match, confidence, query.MinConfidence); !ok {
+			fmt.Printf("Low-confidence match (%.4f), asking the provider\n", confidence)
+		}
+	}
+	if !searchTimedOut {
+		recordSimilarity(match.Similarity, ok)
+	}
+	if ok {
+		fmt.Printf("Cache hit! similarity=%.4f question=%s\n", match.Similarity, logContent(req.Text))
+		if match.Question == req.Text {
+			rememberPrompt(caller, prompt, match.ID, match.Similarity)
+		}
 		source := match.Source
 		if source == "" {
 			source = cacheSourceLocal
 		}
-		appendHistory(req.Text, match.Answer, true, source, modelName)
-		writeJSON(w, http.StatusOK, Response{
-			Answer: match.Answer,
-			Source: "CACHE",
+		cachedAnswer := entryAnswer(match)
+		answer := cachedAnswer
+		variantTokens := 0
+		if !maintenanceState.Enabled {
+			variantCtx, cancelVariant := budget.stage(r.Context(), 1)
+			answer, variantTokens = answerForLocale(variantCtx, caller, match, locale, modelName)
+			cancelVariant()
+		}
+		savedTokens := entryTokens(match, req.Text)
+		historyID := appendHistory(caller, req.SessionID, req.Vector, req.Text, answer, savedTokens, latencySaved(modelName, time.Since(start)), source, modelName, match.ID, "")
+		recordUsage(caller, modelName, "CACHE", variantTokens, savedTokens)
+		recordExperimentOutcome(experiment, true, match.ID, match.Similarity, savedTokens)
+		resp := Response{
+			ID:            historyID,
+			CacheEntryID:  match.ID,
+			SessionID:     req.SessionID,
+			Answer:        answer,
+			Source:        "CACHE",
+			Tier:          entryTier(match),
+			Citations:     match.Citations,
+			Confidence:    confidence,
+			Verify:        verify,
+			Authoritative: match.Authoritative,
+			Experiment:    experiment.label(),
+			ServedFrom:    entryServedFrom("CACHE", match, confidence, time.Now()),
+		}
+		if answer != cachedAnswer {
+			resp.Locale = locale
+		}
+		if isStale(match, time.Now()) {
+			resp.Stale = true
+			revalidateAsync(caller, match)
+		}
+		fmt.Printf("Served from cache: entry=%s answer=%s latency=%v\n", match.ID, logContent(answer), time.Since(start))
+		recordEvent(Event{
+			Type:       eventChatServed,
+			Tenant:     caller.Tenant,
+			EntryID:    match.ID,
+			Outcome:    "hit",
+			Source:     source,
+			Model:      modelName,
+			Similarity: match.Similarity,
+			LatencyMs:  time.Since(start).Milliseconds(),
+			Tokens:     variantTokens,
 		})
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	var suggestion *Suggestion
+	if suggestionPolicy != suggestionPolicyOff {
+		suggestion = nearMiss(searchCtx, caller, query, match)
+	}
+	if suggestion != nil && suggestionPolicy == suggestionPolicyAsk {
+		servedFrom := &ServedFrom{Source: "SUGGESTION", Similarity: suggestion.Similarity}
+		if entry, found := findEntryForCaller(caller, suggestion.EntryID); found {
+			entry.Similarity = suggestion.Similarity
+			servedFrom = entryServedFrom("SUGGESTION", entry, 0, time.Now())
+		}
+		writeJSON(w, http.StatusOK, Response{Source: "SUGGESTION", Suggestion: suggestion, ServedFrom: servedFrom})
+		return
+	}
+
+	if maintenanceState.Enabled {
+		writeMaintenance(w, maintenanceState)
+		return
+	}
+
+	reserved := estimateTokens(req.Text)
+	if denial := reserveTokens(caller, reserved); denial != nil {
+		writeQuotaExceeded(w, denial)
+		return
+	}
+	defer releaseTokens(caller, reserved)
+	if budget, exhausted := budgetExhausted(caller.Tenant); exhausted {
+		writeBudgetExceeded(w, budget)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 20*time.Second)
+	ctx, cancel := budget.stage(r.Context(), 1)
 	defer cancel()
+	ctx = withTemperature(ctx, req.Temperature)
+
+	providerPrompt := req.Text
+	var citations []Citation
+	if useRAG(req.Rag) {
+		chunks, err := retrieveChunks(ctx, caller, req.Text)
+		if err != nil {
+			fmt.Printf("Retrieval failed, answering without documents: %v\n", err)
+		} else if len(chunks) > 0 {
+			providerPrompt = groundedPrompt(req.Text, chunks)
+			citations = chunkCitations(chunks)
+		}
+	}
 
-	answer, err := callGemini(ctx, req.Text, modelName)
+	providerPrompt = styledPrompt(providerPrompt, style)
+	providerPrompt, promptAction, err := guardPrompt(ctx, caller, providerPrompt, modelName)
 	if err != nil {
-		fmt.Printf("Gemini error: %v\n", err)
-		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "failed to generate response from Gemini"})
+		var tooLong *promptTooLongError
+		if errors.As(err, &tooLong) {
+			writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": tooLong.Error()})
+			return
+		}
+		fmt.Printf("Prompt guard error: %v\n", err)
+		reportProviderError(r, caller, modelName, err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "failed to summarize overlong prompt"})
+		return
+	}
+	answer, usage, err := generateAnswerUsage(ctx, caller, providerPrompt, modelName)
+	if err != nil {
+		fmt.Printf("Provider error: %v\n", err)
+		reportProviderError(r, caller, modelName, err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			writeJSON(w, http.StatusGatewayTimeout, map[string]string{"error": "request time budget exhausted"})
+			return
+		}
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "failed to generate response"})
 		return
 	}
 
-	saveToMockVectorDB(req.Vector, answer, req.Text)
-	appendHistory(req.Text, answer, false, "CLOUD", modelName)
+	cloudTokens := usage.tokens(providerPrompt, answer)
+	entryID, answerTier := "", ""
+	if !caller.Anonymous && profile.CacheAccess == cacheAccessAll {
+		owner := sharedOwner
+		if caller.User != "" && !shareAnswer(req.Share) {
+			owner = caller.User
+		}
+		answerTier = entryTier(VectorEntry{Owner: owner})
+		entryID = saveToMockVectorDB(caller.Tenant, owner, caller.User, query, answer, req.Text, modelName, cloudTokens, citations)
+		// The new entry's vector is the query's own.
+		rememberPrompt(caller, prompt, entryID, 1)
+	}
+	historyID := appendHistory(caller, req.SessionID, req.Vector, req.Text, answer, 0, 0, "CLOUD", modelName, entryID, promptAction)
+	recordUsage(caller, modelName, "CLOUD", cloudTokens, 0)
+	recordHedgeUsage(caller, modelName, usage)
+	if !searchTimedOut {
+		recordExperimentOutcome(experiment, false, entryID, 0, 0)
+	}
+	recordEvent(Event{
+		Type:       eventChatServed,
+		Tenant:     caller.Tenant,
+		EntryID:    entryID,
+		Outcome:    "miss",
+		Source:     "CLOUD",
+		Model:      modelName,
+		Similarity: match.Similarity,
+		LatencyMs:  time.Since(start).Milliseconds(),
+		Tokens:     cloudTokens,
+	})
+	fmt.Printf("Served from provider: similarity=%.4f question=%s answer=%s latency=%v\n", match.Similarity, logContent(req.Text), logContent(answer), time.Since(start))
 
 	writeJSON(w, http.StatusOK, Response{
-		Answer: answer,
-		Source: "CLOUD",
+		ID:           historyID,
+		CacheEntryID: entryID,
+		SessionID:    req.SessionID,
+		Answer:       answer,
+		Source:       "CLOUD",
+		Citations:    citations,
+		Suggestion:   suggestion,
+		PromptAction: promptAction,
+		Experiment:   experiment.label(),
+		ServedFrom: &ServedFrom{
+			Source:     "CLOUD",
+			Tier:       answerTier,
+			CreatedAt:  time.Now(),
+			Similarity: match.Similarity,
+			Model:      modelName,
+		},
 	})
 }
+
+func shareAnswer(requested *bool) bool {
+	if requested != nil {
+		return *requested
+	}
+	return envString("ECHO_SHARE_BY_DEFAULT", "true") != "false"
+}
+
+func entryTier(entry VectorEntry) string {
+	if entry.Owner != sharedOwner {
+		return cacheTierPrivate
+	}
+	return cacheTierShared
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+// The chat benchmarks run the /chat handler in-process against a seeded
+// cache of 10000 entries of 384 dims under the flat index, and
+// BenchmarkSearchIndexPartition looks up a small partition the way every
+// chat search does. Run them before and after touching the hot path:
+//
+//	go test -run '^$' -bench 'Chat|Partition' -benchmem ./cmd
+
+const (
+	benchChatSize = 10000
+	benchChatDims = typicalVectorDims
+)
+
+var benchChatQuestion = "What is question number 0?"
+
+// seedBenchChat fills MockVectorDB once and returns the vector of the entry
+// asked about by benchChatQuestion.
+var seedBenchChat = sync.OnceValue(func() []float32 {
+	rng := rand.New(rand.NewPCG(1, 2))
+	var probe []float32
+	for i := 0; i < benchChatSize; i++ {
+		vector := randomUnitVector(rng, benchChatDims)
+		if i == 0 {
+			probe = vector
+		}
+		question := fmt.Sprintf("What is question number %d?", i)
+		query := cacheQuery{Vector: vector, EmbeddingModel: defaultEmbeddingModel(), Language: detectLanguage(question), Style: answerStyleFull}
+		saveToMockVectorDB(defaultTenant, sharedOwner, "", query, fmt.Sprintf("Answer %d.", i), question, "", 0, nil)
+	}
+	return probe
+})
+
+func benchmarkChat(b *testing.B, req Request) {
+	req.Vector = seedBenchChat()
+	body, err := json.Marshal(req)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// The handler logs every request to stdout.
+	stdout := os.Stdout
+	if devNull, err := os.Open(os.DevNull); err == nil {
+		os.Stdout = devNull
+		defer func() { os.Stdout = stdout; devNull.Close() }()
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		r := httptest.NewRequest(http.MethodPost, "/chat", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		handleChat(w, r)
+		if w.Code != http.StatusOK {
+			b.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+	}
+}
+
+func BenchmarkChatHit(b *testing.B) {
+	benchmarkChat(b, Request{Text: benchChatQuestion})
+}
+
+func BenchmarkChatDryRun(b *testing.B) {
+	benchmarkChat(b, Request{Text: benchChatQuestion, DryRun: true})
+}
+
+// seedBenchPartition adds a small private partition next to the chat seed
+// and returns a query for it.
+var seedBenchPartition = sync.OnceValue(func() cacheQuery {
+	seedBenchChat()
+	rng := rand.New(rand.NewPCG(3, 4))
+	var probe []float32
+	for i := 0; i < 16; i++ {
+		vector := randomUnitVector(rng, benchChatDims)
+		if i == 0 {
+			probe = vector
+		}
+		question := fmt.Sprintf("What is partition question %d?", i)
+		query := cacheQuery{Vector: vector, EmbeddingModel: defaultEmbeddingModel(), Language: detectLanguage(question), Style: answerStyleFull}
+		saveToMockVectorDB(defaultTenant, benchPartitionOwner, benchPartitionOwner, query, fmt.Sprintf("Answer %d.", i), question, "", 0, nil)
+	}
+	return cacheQuery{Vector: probe, EmbeddingModel: defaultEmbeddingModel(), Language: detectLanguage(benchChatQuestion), Style: answerStyleFull}
+})
+
+const benchPartitionOwner = "bench-partition"
+
+func BenchmarkSearchIndexPartition(b *testing.B) {
+	query := seedBenchPartition()
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	for b.Loop() {
+		dbMutex.RLock()
+		_, _, err := searchIndex(ctx, defaultTenant, benchPartitionOwner, query)
+		dbMutex.RUnlock()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Compaction of the in-memory cache. Deletions, evictions and history trims
+// shrink MockVectorDB and ChatHistory without releasing their backing arrays,
+// the vector indexes keep the capacity of their largest size, and the Bloom
+// filters keep the trigrams of deleted questions. POST /admin/cache/compact
+// copies the slices into right-sized arrays, rebuilds the indexes and
+// filters, runs the garbage collector and reports the heap reclaimed;
+// GET reports the current slack and the last compaction.
+
+type CompactionReport struct {
+	StartedAt  time.Time `json:"startedAt"`
+	DurationMs int64     `json:"durationMs"`
+	Entries    int       `json:"entries"`
+	// EntrySlotsFreed and HistorySlotsFreed are the unused capacity dropped.
+	EntrySlotsFreed   int   `json:"entrySlotsFreed"`
+	History           int   `json:"history"`
+	HistorySlotsFreed int   `json:"historySlotsFreed"`
+	Partitions        int   `json:"partitions"`
+	HeapInuseBefore   int64 `json:"heapInuseBefore"`
+	HeapInuseAfter    int64 `json:"heapInuseAfter"`
+	ReclaimedBytes    int64 `json:"reclaimedBytes"`
+	ReleasedToOSBytes int64 `json:"releasedToOsBytes"`
+}
+
+type CacheMemory struct {
+	Entries         int               `json:"entries"`
+	EntryCapacity   int               `json:"entryCapacity"`
+	History         int               `json:"history"`
+	HistoryCapacity int               `json:"historyCapacity"`
+	IndexBuilt      bool              `json:"indexBuilt"`
+	Partitions      int               `json:"partitions"`
+	HeapAllocBytes  uint64            `json:"heapAllocBytes"`
+	HeapInuseBytes  uint64            `json:"heapInuseBytes"`
+	HeapIdleBytes   uint64            `json:"heapIdleBytes"`
+	ReleasedBytes   uint64            `json:"heapReleasedBytes"`
+	NumGC           uint32            `json:"numGC"`
+	LastCompaction  *CompactionReport `json:"lastCompaction,omitempty"`
+	// Watermark is set when memory watermark monitoring is on; see memwatch.go.
+	Watermark *MemoryStatus `json:"watermark,omitempty"`
+}
+
+var (
+	// compactMutex serializes compactions and guards lastCompaction.
+	compactMutex   sync.Mutex
+	lastCompaction *CompactionReport
+)
+
+// partitionCountLocked requires indexMutex held.
+func partitionCountLocked() int {
+	count := 0
+	for _, languages := range partitionIndexes {
+		count += len(languages)
+	}
+	return count
+}
+
+func cacheMemory() CacheMemory {
+	var mem CacheMemory
+	dbMutex.RLock()
+	mem.Entries, mem.EntryCapacity = len(MockVectorDB), cap(MockVectorDB)
+	mem.History, mem.HistoryCapacity = len(ChatHistory), cap(ChatHistory)
+	indexMutex.RLock()
+	mem.IndexBuilt = partitionIndexes != nil
+	mem.Partitions = partitionCountLocked()
+	indexMutex.RUnlock()
+	dbMutex.RUnlock()
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	mem.HeapAllocBytes = stats.HeapAlloc
+	mem.HeapInuseBytes = stats.HeapInuse
+	mem.HeapIdleBytes = stats.HeapIdle
+	mem.ReleasedBytes = stats.HeapReleased
+	mem.NumGC = stats.NumGC
+
+	compactMutex.Lock()
+	mem.LastCompaction = lastCompaction
+	compactMutex.Unlock()
+	mem.Watermark = currentMemoryStatus()
+	return mem
+}
+
+// compactCache rebuilds the cache's backing arrays, indexes and Bloom filters.
+func compactCache() CompactionReport {
+	compactMutex.Lock()
+	defer compactMutex.Unlock()
+
+	report := CompactionReport{StartedAt: time.Now()}
+	// Collect first so garbage that was already unreachable is not counted.
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	dbMutex.Lock()
+	report.EntrySlotsFreed = cap(MockVectorDB) - len(MockVectorDB)
+	report.HistorySlotsFreed = cap(ChatHistory) - len(ChatHistory)
+	MockVectorDB = append(make([]VectorEntry, 0, len(MockVectorDB)), MockVectorDB...)
+	ChatHistory = append(make([]HistoryItem, 0, len(ChatHistory)), ChatHistory...)
+	report.Entries, report.History = len(MockVectorDB), len(ChatHistory)
+	indexMutex.Lock()
+	rebuildIndexesLocked()
+	report.Partitions = partitionCountLocked()
+	indexMutex.Unlock()
+	bloomMutex.Lock()
+	built := bloomFilters != nil
+	bloomFilters = nil
+	bloomMutex.Unlock()
+	dbMutex.Unlock()
+	if built {
+		buildBloomFilters()
+	}
+
+	debug.FreeOSMemory()
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	report.HeapInuseBefore = int64(before.HeapInuse)
+	report.HeapInuseAfter = int64(after.HeapInuse)
+	report.ReclaimedBytes = report.HeapInuseBefore - report.HeapInuseAfter
+	report.ReleasedToOSBytes = int64(after.HeapReleased) - int64(before.HeapReleased)
+	report.DurationMs = time.Since(report.StartedAt).Milliseconds()
+	lastCompaction = &report
+	return report
+}
+
+func handleCompact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, cacheMemory())
+		return
+	}
+
+	report := compactCache()
+	recordAudit(AuditEvent{
+		Action: "cache.compact",
+		Actor:  "admin",
+		Details: map[string]string{
+			"entries":        strconv.Itoa(report.Entries),
+			"reclaimedBytes": strconv.FormatInt(report.ReclaimedBytes, 10),
+		},
+	})
+	writeJSON(w, http.StatusOK, report)
+}
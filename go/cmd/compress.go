@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// With ECHO_COMPRESS_ANSWERS=true, answers of at least ECHO_COMPRESS_MIN_BYTES
+// are kept zstd-compressed in CompressedAnswer, in RAM and in persisted cache
+// objects, and decompressed when served. Entries already compressed stay
+// readable when the setting is turned off again. Binaries from before this
+// change see such entries as answerless, so every node sharing a bucket must
+// be upgraded before compression is enabled.
+//
+// Answer is empty on a compressed entry: code that reads or compares an
+// entry's answer goes through entryAnswer, and code that looks an entry up
+// does so by ID rather than by answer text.
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+func answerCompressionEnabled() bool {
+	return envString("ECHO_COMPRESS_ANSWERS", "") == "true"
+}
+
+// compressEntryAnswer moves a long answer into CompressedAnswer when
+// compression is enabled.
+func compressEntryAnswer(entry *VectorEntry) {
+	if !answerCompressionEnabled() || entry.CompressedAnswer != nil {
+		return
+	}
+	if len(entry.Answer) < envInt("ECHO_COMPRESS_MIN_BYTES", 1024) {
+		return
+	}
+	entry.CompressedAnswer = zstdEncoder.EncodeAll([]byte(entry.Answer), nil)
+	entry.Answer = ""
+}
+
+func decompressAnswer(compressed []byte) (string, error) {
+	answer, err := zstdDecoder.DecodeAll(compressed, nil)
+	return string(answer), err
+}
+
+// entryAnswer returns the entry's answer, decompressing it if needed.
+func entryAnswer(entry VectorEntry) string {
+	if entry.CompressedAnswer == nil {
+		return entry.Answer
+	}
+	answer, err := decompressAnswer(entry.CompressedAnswer)
+	if err != nil {
+		log.Printf("Decompress answer of entry %s failed: %v", entry.ID, err)
+		return ""
+	}
+	return answer
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompressedEntryReaders(t *testing.T) {
+	t.Setenv("ECHO_COMPRESS_ANSWERS", "true")
+	t.Setenv("ECHO_COMPRESS_MIN_BYTES", "16")
+	answer := strings.Repeat("a long cached answer ", 8)
+	entry := VectorEntry{ID: "e1", Tenant: "acme", Owner: sharedOwner, Question: "q", Answer: answer}
+	compressEntryAnswer(&entry)
+	if entry.Answer != "" || entry.CompressedAnswer == nil {
+		t.Fatal("answer was not compressed")
+	}
+
+	if got := entryAnswer(entry); got != answer {
+		t.Fatalf("entryAnswer = %q; want %q", got, answer)
+	}
+	if got := entryView(entry).Answer; got != answer {
+		t.Fatalf("entryView answer = %q; want %q", got, answer)
+	}
+
+	withCache(t, []VectorEntry{entry}, []HistoryItem{{ID: "h1", Tenant: "acme", Answer: answer, CacheEntryID: "e1"}})
+	if _, entryPinned, _ := setPinned(Caller{Tenant: "acme"}, "h1", true); !entryPinned || !MockVectorDB[0].Pinned {
+		t.Fatal("pinning did not reach the compressed entry")
+	}
+}
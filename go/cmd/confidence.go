@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"maps"
+	"math"
+	"net/http"
+	"time"
+)
+
+// A cache match's confidence starts from its similarity, loses up to
+// ECHO_CONFIDENCE_AGE_WEIGHT as the entry ages (half of that after
+// ECHO_CONFIDENCE_HALF_LIFE) and moves by up to ECHO_CONFIDENCE_FEEDBACK_WEIGHT
+// either way with the share of helpful votes. Matches below
+// ECHO_CONFIDENCE_MIN go to the provider instead; matches below
+// ECHO_CONFIDENCE_VERIFY are served with a "verify this" hint.
+//
+// Each voter counts once per entry: voting again replaces the earlier vote.
+// A voter is the caller's user or, without one, its API key, within its
+// tenant; callers with neither share their tenant's vote.
+
+type FeedbackRequest struct {
+	Helpful bool `json:"helpful"`
+}
+
+type FeedbackResponse struct {
+	EntryID   string `json:"entryId"`
+	Helpful   int    `json:"helpful"`
+	Unhelpful int    `json:"unhelpful"`
+	// Confidence is that of an exact match to the entry.
+	Confidence float64 `json:"confidence"`
+}
+
+// entryConfidence scores entry matched at similarity, as of now.
+func entryConfidence(entry VectorEntry, similarity float64, now time.Time) float64 {
+	confidence := similarity
+
+	if halfLife := envDuration("ECHO_CONFIDENCE_HALF_LIFE", 30*24*time.Hour); !entry.CreatedAt.IsZero() && now.After(entry.CreatedAt) {
+		decay := 1 - math.Exp2(-float64(now.Sub(entry.CreatedAt))/float64(halfLife))
+		confidence -= envFloat("ECHO_CONFIDENCE_AGE_WEIGHT", 0.05) * decay
+	}
+
+	// With one imagined vote each way, an entry nobody rated is neutral and
+	// a single vote only moves it a little.
+	helpfulShare := float64(entry.Helpful+1) / float64(entry.Helpful+entry.Unhelpful+2)
+	confidence += envFloat("ECHO_CONFIDENCE_FEEDBACK_WEIGHT", 0.1) * 2 * (helpfulShare - 0.5)
+
+	return min(max(confidence, 0), 1)
+}
+
+// confidentMatch reports whether a similarity hit on match is confident
+// enough to serve, and whether it should carry a verify hint. Authoritative
+// FAQ answers are always served.
+func confidentMatch(match VectorEntry, confidence float64, minConfidence float64) (serve, verify bool) {
+	if match.Authoritative {
+		return true, false
+	}
+	if minConfidence == 0 {
+		minConfidence = envFloat("ECHO_CONFIDENCE_MIN", 0.85)
+	}
+	if confidence < minConfidence {
+		return false, false
+	}
+	return true, confidence < envFloat("ECHO_CONFIDENCE_VERIFY", 0.92)
+}
+
+// voterID identifies caller among an entry's voters. It is hashed so that
+// cache objects do not carry user IDs.
+func voterID(caller Caller) string {
+	sum := sha256.Sum256([]byte(caller.Tenant + "\x00" + caller.User + "\x00" + caller.APIKey))
+	return hex.EncodeToString(sum[:8])
+}
+
+// recordFeedback records voter's vote on the hot-tier entry with id,
+// replacing any earlier one, and reports whether it is the voter's first.
+func recordFeedback(id, voter string, helpful bool) (entry VectorEntry, first, found bool) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	for i := range MockVectorDB {
+		entry := &MockVectorDB[i]
+		if entry.ID != id {
+			continue
+		}
+		previous, voted := entry.Votes[voter]
+		if voted && previous == helpful {
+			return *entry, false, true
+		}
+		if voted {
+			if previous {
+				entry.Helpful--
+			} else {
+				entry.Unhelpful--
+			}
+		}
+		if helpful {
+			entry.Helpful++
+		} else {
+			entry.Unhelpful++
+		}
+		// Votes is shared with copies handed out earlier.
+		entry.Votes = maps.Clone(entry.Votes)
+		if entry.Votes == nil {
+			entry.Votes = make(map[string]bool)
+		}
+		entry.Votes[voter] = helpful
+		markCacheChanged()
+		recordCacheChange(changeUpdated, *entry)
+		return *entry, !voted, true
+	}
+	return VectorEntry{}, false, false
+}
+
+// handleFeedback records whether a cached answer helped the caller.
+func handleFeedback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if caller.Anonymous {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "feedback is not available in demo mode"})
+		return
+	}
+
+	var req FeedbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON payload"})
+		return
+	}
+
+	entry, found := findEntryForCaller(caller, r.PathValue("id"))
+	first := false
+	if found {
+		entry, first, found = recordFeedback(entry.ID, voterID(caller), req.Helpful)
+	}
+	if first {
+		recordExperimentFeedback(entry.ID, req.Helpful)
+	}
+	if !found {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "cache entry not found"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, FeedbackResponse{
+		EntryID:    entry.ID,
+		Helpful:    entry.Helpful,
+		Unhelpful:  entry.Unhelpful,
+		Confidence: entryConfidence(entry, 1, time.Now()),
+	})
+}
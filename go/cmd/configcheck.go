@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/joho/godotenv"
+)
+
+// validateConfig checks the whole configuration. The env helpers quietly fall
+// back to defaults on bad values; this is where those values are reported
+// instead. With online set, S3 buckets and the provider key are probed too.
+
+const (
+	findingError   = "error"
+	findingWarning = "warning"
+)
+
+type configFinding struct {
+	Level   string
+	Message string
+}
+
+var (
+	durationSettings = []string{
+		"ECHO_ANALYTICS_EXPORT_INTERVAL", "ECHO_BILLING_EXPORT_INTERVAL", "ECHO_CANARY_INTERVAL", "ECHO_CONFIDENCE_HALF_LIFE", "ECHO_EVENT_FLUSH_INTERVAL", "ECHO_FEATURE_FLAGS_REFRESH", "ECHO_FORECAST_WINDOW", "ECHO_GOSSIP_INTERVAL", "ECHO_HANDOFF_DRAIN", "ECHO_HANDOFF_TIMEOUT",
+		"ECHO_HISTORY_MAX_AGE", "ECHO_HISTORY_TRIM_INTERVAL", "ECHO_MAX_REQUEST_TIMEOUT", "ECHO_MEMORY_CHECK_INTERVAL",
+		"ECHO_MOCK_LATENCY", "ECHO_OUTBOX_RETRY_BASE", "ECHO_PROVIDER_LATENCY_DEFAULT", "ECHO_READINESS_RETRY", "ECHO_REQUEST_TIMEOUT", "ECHO_SAVINGS_PERSIST_INTERVAL", "ECHO_SHARD_PROBE_INTERVAL", "ECHO_SOFT_TTL", "ECHO_STATE_REFRESH", "ECHO_STATE_STORE_TIMEOUT", "ECHO_SYNC_INTERVAL",
+		"ECHO_SYNC_MAX_DURATION", "ECHO_SYNC_MAX_INTERVAL", "ECHO_SYNC_MIN_INTERVAL", "ECHO_TRASH_RETENTION",
+	}
+	intSettings = []string{
+		"ECHO_ANOMALY_MIN_SAMPLES", "ECHO_ARCHIVE_AFTER_DAYS", "ECHO_AUTOCOMPLETE_SEMANTIC_MIN_CHARS", "ECHO_CANARY_SAMPLE_SIZE", "ECHO_CHANGE_FEED_SIZE", "ECHO_DEMO_REQUESTS_PER_MINUTE", "ECHO_EVENT_BATCH_SIZE", "ECHO_EVENT_BUFFER",
+		"ECHO_HISTORY_MAX_ITEMS", "ECHO_HNSW_EF_CONSTRUCTION", "ECHO_HNSW_EF_SEARCH", "ECHO_HNSW_M",
+		"ECHO_HOT_TIER_SIZE", "ECHO_LATENCY_WINDOW", "ECHO_MAX_PROMPT_TOKENS", "ECHO_METERING_MAX_RECORDS", "ECHO_OUTBOX_MAX_ATTEMPTS", "ECHO_PARAPHRASE_COUNT", "ECHO_PARAPHRASE_MAX_ENTRIES", "ECHO_PARAPHRASE_MIN_HITS", "ECHO_PROMPT_CACHE_SIZE", "ECHO_QUOTA_DAILY_REQUESTS",
+		"ECHO_QUOTA_DAILY_TOKENS", "ECHO_QUOTA_MONTHLY_REQUESTS", "ECHO_QUOTA_MONTHLY_TOKENS",
+		"ECHO_RAG_CHUNK_OVERLAP", "ECHO_REFRESH_MAX_ENTRIES", "ECHO_REFRESH_MIN_HITS", "ECHO_RAG_CHUNK_SIZE", "ECHO_RAG_MAX_DOCUMENT_BYTES", "ECHO_RAG_TOP_K", "ECHO_VECTOR_DIMENSIONS", "ECHO_BLOOM_BITS", "ECHO_WRITE_QUEUE",
+		"ECHO_S3_MAX_CONCURRENCY", "ECHO_SAVED_PROMPTS_MAX", "ECHO_SENTRY_MAX_PER_MINUTE", "ECHO_SHARD_HASH_BITS", "ECHO_SHARD_VNODES", "ECHO_STATE_HISTORY_LIMIT", "ECHO_SYNC_CHANGE_THRESHOLD", "ECHO_SYNC_HISTORY", "S3_FAILOVER_THRESHOLD",
+	}
+	// Fractions must be in (0, 1].
+	fractionSettings = []string{
+		"ECHO_ANOMALY_HIT_RATE_BAND", "ECHO_ANOMALY_SIMILARITY_BAND", "ECHO_AUTOCOMPLETE_MIN_SIMILARITY", "ECHO_BLOOM_MIN_OVERLAP", "ECHO_CACHE_BUDGET_SHARE",
+		"ECHO_CANARY_DRIFT_THRESHOLD", "ECHO_CONFIDENCE_AGE_WEIGHT", "ECHO_CONFIDENCE_FEEDBACK_WEIGHT",
+		"ECHO_CONFIDENCE_MIN", "ECHO_CONFIDENCE_VERIFY", "ECHO_FAQ_THRESHOLD", "ECHO_FAQ_TIE_MARGIN", "ECHO_HEDGE_AFTER_MEDIANS", "ECHO_MEMORY_HIGH_WATERMARK", "ECHO_MEMORY_TARGET", "ECHO_SENTRY_SAMPLE_RATE", "ECHO_RAG_MIN_SIMILARITY", "ECHO_SUGGESTION_THRESHOLD",
+	}
+)
+
+func validateConfig(online bool) []configFinding {
+	var findings []configFinding
+	report := func(level, format string, args ...any) {
+		findings = append(findings, configFinding{Level: level, Message: fmt.Sprintf(format, args...)})
+	}
+
+	for _, key := range durationSettings {
+		if raw := envString(key, ""); raw != "" {
+			if d, err := time.ParseDuration(raw); err != nil || d <= 0 {
+				report(findingError, "%s: %q is not a positive duration", key, raw)
+			}
+		}
+	}
+	for _, key := range intSettings {
+		if raw := envString(key, ""); raw != "" {
+			if n, err := strconv.Atoi(raw); err != nil || n < 0 {
+				report(findingError, "%s: %q is not a non-negative integer", key, raw)
+			}
+		}
+	}
+	for _, key := range fractionSettings {
+		if raw := envString(key, ""); raw != "" {
+			if f, err := strconv.ParseFloat(raw, 64); err != nil || f <= 0 || f > 1 {
+				report(findingError, "%s: %q must be a number in (0, 1]", key, raw)
+			}
+		}
+	}
+
+	if kind := strings.ToLower(envString("ECHO_VECTOR_INDEX", "flat")); indexBuilders[kind] == nil {
+		report(findingError, "ECHO_VECTOR_INDEX: unknown index %q", kind)
+	}
+	switch mode := strings.ToLower(envString("ECHO_LANGUAGE_MATCH", languageMatchPrefer)); mode {
+	case languageMatchPrefer, languageMatchRequire, languageMatchOff:
+	default:
+		report(findingError, "ECHO_LANGUAGE_MATCH: unknown mode %q", mode)
+	}
+	switch mode := strings.ToLower(envString("ECHO_VECTOR_REDUCTION", reductionTruncate)); mode {
+	case reductionTruncate, reductionPCA:
+	default:
+		report(findingError, "ECHO_VECTOR_REDUCTION: unknown mode %q", mode)
+	}
+	switch policy := promptOverflowPolicy(); policy {
+	case overflowReject, overflowTruncate, overflowSummarize:
+	default:
+		report(findingError, "ECHO_PROMPT_OVERFLOW: unknown policy %q", policy)
+	}
+	if policy, ok := normalizeSuggestionPolicy(""); !ok {
+		report(findingError, "ECHO_SUGGESTION_POLICY: unknown policy %q", policy)
+	}
+	if threshold := suggestionThreshold(); threshold >= similarityThreshold {
+		report(findingWarning, "ECHO_SUGGESTION_THRESHOLD: %.2f is not below the hit threshold %.2f; no near miss will be suggested", threshold, similarityThreshold)
+	}
+	if _, err := parseCron(envString("ECHO_REFRESH_SCHEDULE", "0 3 * * *")); err != nil {
+		report(findingError, "ECHO_REFRESH_SCHEDULE: %v", err)
+	}
+	if raw := envString("ECHO_PARAPHRASE_SCHEDULE", ""); raw != "" {
+		if _, err := parseCron(raw); err != nil {
+			report(findingError, "ECHO_PARAPHRASE_SCHEDULE: %v", err)
+		}
+	}
+	if license := defaultLicense(); license != "" && !licensePattern.MatchString(license) {
+		report(findingError, "ECHO_DEFAULT_LICENSE: invalid license tag %q", license)
+	}
+	if adaptiveSyncEnabled() && envDuration("ECHO_SYNC_MAX_INTERVAL", 30*time.Minute) < envDuration("ECHO_SYNC_MIN_INTERVAL", 30*time.Second) {
+		report(findingWarning, "ECHO_SYNC_MAX_INTERVAL is below ECHO_SYNC_MIN_INTERVAL; syncing every ECHO_SYNC_MIN_INTERVAL")
+	}
+	if raw := envString("ECHO_TIME_SENSITIVE_PATTERNS", ""); raw != "" {
+		var patterns []string
+		if err := json.Unmarshal([]byte(raw), &patterns); err != nil {
+			report(findingError, "ECHO_TIME_SENSITIVE_PATTERNS: %v", err)
+		} else if _, err := compilePatterns(patterns); err != nil {
+			report(findingError, "ECHO_TIME_SENSITIVE_PATTERNS: %v", err)
+		}
+	}
+	if logPrivacy() && envString("ECHO_LOG_HASH_SALT", "") == "" {
+		report(findingWarning, "ECHO_LOG_PRIVACY is on without ECHO_LOG_HASH_SALT; content hashes will not match across restarts")
+	}
+	provider := activeProvider()
+	if provider != providerGemini && provider != providerOpenAI && provider != providerMock {
+		report(findingError, "PROVIDER: unknown provider %q", provider)
+	}
+
+	if raw := envString("ECHO_TENANT_MODEL_POLICIES", ""); raw != "" {
+		var policies map[string]ModelPolicy
+		if err := json.Unmarshal([]byte(raw), &policies); err != nil {
+			report(findingError, "ECHO_TENANT_MODEL_POLICIES: %v", err)
+		}
+		for tenant, policy := range policies {
+			for _, model := range append([]string{policy.Default}, policy.Allowed...) {
+				if _, ok := supportedModels[model]; model != "" && !ok {
+					report(findingError, "ECHO_TENANT_MODEL_POLICIES: tenant %q uses unknown model %q", tenant, model)
+				}
+			}
+		}
+	}
+	if raw := envString("ECHO_API_KEY_PROFILES", ""); raw != "" {
+		profiles, err := parseKeyProfiles(raw)
+		if err != nil {
+			report(findingError, "ECHO_API_KEY_PROFILES: %v", err)
+		}
+		for name, profile := range profiles {
+			if _, ok := supportedModels[profile.Model]; profile.Model != "" && !ok {
+				report(findingError, "ECHO_API_KEY_PROFILES: key %q uses unknown model %q", name, profile.Model)
+			}
+			if t := profile.Temperature; t != nil && (*t < 0 || *t > 2) {
+				report(findingError, "ECHO_API_KEY_PROFILES: key %q temperature %v is not in [0, 2]", name, *t)
+			}
+			if profile.SimilarityThreshold < 0 || profile.SimilarityThreshold > 1 {
+				report(findingError, "ECHO_API_KEY_PROFILES: key %q similarityThreshold %v is not in (0, 1]", name, profile.SimilarityThreshold)
+			}
+			switch profile.CacheAccess {
+			case cacheAccessAll, cacheAccessRead, cacheAccessNone:
+			default:
+				report(findingError, "ECHO_API_KEY_PROFILES: key %q has unknown cacheAccess %q", name, profile.CacheAccess)
+			}
+		}
+	}
+	if envString("ECHO_ENERGY_CALIBRATION_PATH", "") != "" {
+		calibration, err := readEnergyCalibration()
+		if err != nil {
+			report(findingError, "ECHO_ENERGY_CALIBRATION_PATH: %v", err)
+		} else {
+			for _, model := range slices.Sorted(maps.Keys(supportedModels)) {
+				if _, ok := calibration[model]; !ok {
+					report(findingWarning, "ECHO_ENERGY_CALIBRATION_PATH: no measurement for %s; its savings use the static estimate", model)
+				}
+			}
+		}
+	}
+	if raw := envString("ECHO_EXPERIMENTS", ""); raw != "" {
+		if _, err := parseExperiments([]byte(raw)); err != nil {
+			report(findingError, "ECHO_EXPERIMENTS: %v", err)
+		}
+	}
+	if raw := envString("ECHO_FEATURE_FLAGS", ""); raw != "" {
+		if _, err := parseFeatureFlags([]byte(raw)); err != nil {
+			report(findingError, "ECHO_FEATURE_FLAGS: %v", err)
+		}
+	}
+	for _, spec := range envList("ECHO_API_KEYS") {
+		parts := strings.SplitN(spec, ":", 3)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			report(findingError, "ECHO_API_KEYS: entry %q is not name:secret[:tenant]", parts[0])
+		} else if len(parts) == 3 && !tenantIDPattern.MatchString(parts[2]) {
+			report(findingError, "ECHO_API_KEYS: key %q has invalid tenant %q", parts[0], parts[2])
+		}
+	}
+	for _, pair := range envList("S3_TENANT_KMS_KEYS") {
+		if _, _, ok := strings.Cut(pair, "="); !ok {
+			report(findingError, "S3_TENANT_KMS_KEYS: entry %q is not tenant=keyId", pair)
+		}
+	}
+
+	if peerToken() == "" && (envString("ECHO_GOSSIP_ADDR", "") != "" || len(envList("ECHO_GOSSIP_PEERS")) > 0 || len(envList("ECHO_SHARD_NODES")) > 0) {
+		report(findingError, "ECHO_GOSSIP_TOKEN is not set; peers will neither serve nor accept replication calls")
+	}
+
+	bucket := strings.TrimSpace(os.Getenv("S3_BUCKET_NAME"))
+	region := strings.TrimSpace(os.Getenv("AWS_REGION"))
+	switch {
+	case bucket == "":
+		report(findingWarning, "S3_BUCKET_NAME is not set; S3 sync is disabled")
+	case region == "":
+		report(findingError, "AWS_REGION is required when S3_BUCKET_NAME is set")
+	case online:
+		targets := [][2]string{{bucket, region}}
+		if secondary := envString("S3_SECONDARY_BUCKET_NAME", ""); secondary != "" {
+			targets = append(targets, [2]string{secondary, envString("S3_SECONDARY_REGION", region)})
+		}
+		for _, t := range targets {
+			if err := probeBucket(t[0], t[1]); err != nil {
+				report(findingError, "S3 bucket %s (%s) is not reachable: %v", t[0], t[1], err)
+			}
+		}
+	}
+
+	if nodes := envList("ECHO_SHARD_NODES"); len(nodes) > 0 {
+		self := envString("ECHO_SHARD_SELF", envString("ECHO_GOSSIP_ADDR", ""))
+		if !slices.Contains(nodes, self) {
+			report(findingError, "ECHO_SHARD_SELF: %q is not listed in ECHO_SHARD_NODES", self)
+		}
+		if key := envString("ECHO_SHARD_KEY", "vector"); key != "vector" && key != "question" {
+			report(findingError, "ECHO_SHARD_KEY: %q must be vector or question", key)
+		}
+		if bits := envInt("ECHO_SHARD_HASH_BITS", 4); bits > 16 {
+			report(findingWarning, "ECHO_SHARD_HASH_BITS: %d bits split similar questions across shards too often", bits)
+		}
+		if os.Getenv("S3_BUCKET_NAME") != "" {
+			report(findingWarning, "ECHO_SHARD_NODES is set; shards read S3 but never upload to it")
+		}
+	}
+	if dsn := envString("ECHO_SENTRY_DSN", ""); dsn != "" {
+		if _, _, err := parseSentryDSN(dsn); err != nil {
+			report(findingError, "ECHO_SENTRY_DSN: %v", err)
+		}
+	}
+	if raw := envString("ECHO_MEMORY_LIMIT", ""); raw != "" {
+		if _, err := parseByteSize(raw); err != nil {
+			report(findingError, "ECHO_MEMORY_LIMIT: %v", err)
+		}
+	}
+	if envFloat("ECHO_MEMORY_TARGET", 0.7) >= envFloat("ECHO_MEMORY_HIGH_WATERMARK", 0.85) {
+		report(findingWarning, "ECHO_MEMORY_TARGET should be below ECHO_MEMORY_HIGH_WATERMARK; using 80%% of the watermark")
+	}
+	if raw := envString("ECHO_STATE_STORE", ""); raw != "" {
+		client, err := newRedisClient(raw, envDuration("ECHO_STATE_STORE_TIMEOUT", 2*time.Second))
+		switch {
+		case err != nil:
+			report(findingError, "ECHO_STATE_STORE: %v", err)
+		case online:
+			if _, err := client.do("PING"); err != nil {
+				report(findingError, "State store %s is not reachable: %v", client.addr, err)
+			}
+		}
+	}
+
+	if provider != providerMock {
+		keyName := "GEMINI_API_KEY"
+		if provider == providerOpenAI {
+			keyName = "OPENAI_API_KEY"
+		}
+		if !modelAvailable(defaultModel()) {
+			report(findingError, "%s is not set; every cache miss will fail", keyName)
+		} else if online {
+			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			if err := checkProviderModel(ctx, defaultModel()); err != nil {
+				report(findingError, "%s", scrubSecrets(err.Error()))
+			}
+			cancel()
+		}
+	}
+
+	return findings
+}
+
+func probeBucket(bucket, region string) error {
+	target, err := newS3Target("check", bucket, region)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = target.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	return err
+}
+
+func printFindings(findings []configFinding) (errors, warnings int) {
+	for _, finding := range findings {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", finding.Level, finding.Message)
+		if finding.Level == findingError {
+			errors++
+		} else {
+			warnings++
+		}
+	}
+	return errors, warnings
+}
+
+// runCheckConfig implements `echo check-config`. It exits non-zero on errors,
+// and on warnings too with -strict.
+func runCheckConfig(args []string) int {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	strict := fs.Bool("strict", false, "treat warnings as failures")
+	offline := fs.Bool("offline", false, "skip S3 and provider reachability checks")
+	_ = fs.Parse(args)
+
+	_ = godotenv.Load()
+	errors, warnings := printFindings(validateConfig(!*offline))
+	fmt.Printf("%d errors, %d warnings\n", errors, warnings)
+	if errors > 0 || (*strict && warnings > 0) {
+		return 1
+	}
+	return 0
+}
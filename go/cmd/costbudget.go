@@ -0,0 +1,229 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Cost budgets cap each tenant's estimated provider spend per billing period
+// (the calendar month, UTC), priced at usdPer1KTokens. Crossing the soft
+// limit logs a warning, records an audit event and posts the budget status
+// to ECHO_BUDGET_WEBHOOK_URL once per period. At the hard limit the tenant
+// goes cache-only: hits are still served, and anything that would call the
+// provider is refused with 402. Budgets are set through /admin/budgets; a
+// zero limit means none.
+
+type CostBudget struct {
+	SoftLimitUSD float64 `json:"softLimitUsd,omitempty"`
+	HardLimitUSD float64 `json:"hardLimitUsd,omitempty"`
+}
+
+type BudgetStatus struct {
+	Tenant       string    `json:"tenant"`
+	Period       string    `json:"period"`
+	SpentUSD     float64   `json:"spentUsd"`
+	SoftLimitUSD float64   `json:"softLimitUsd,omitempty"`
+	HardLimitUSD float64   `json:"hardLimitUsd,omitempty"`
+	SoftExceeded bool      `json:"softExceeded"`
+	HardExceeded bool      `json:"hardExceeded"`
+	ResetAt      time.Time `json:"resetAt"`
+}
+
+// BudgetEvent is posted to ECHO_BUDGET_WEBHOOK_URL when a limit is crossed.
+type BudgetEvent struct {
+	Timestamp time.Time    `json:"timestamp"`
+	Limit     string       `json:"limit"`
+	Status    BudgetStatus `json:"status"`
+}
+
+type tenantSpend struct {
+	period   string
+	spentUSD float64
+	// notified holds the limits already reported this period.
+	notified map[string]bool
+}
+
+var (
+	// budgetMutex guards the maps below.
+	budgetMutex   sync.Mutex
+	costBudgets   = make(map[string]CostBudget)
+	spendByTenant = make(map[string]*tenantSpend)
+)
+
+func billingPeriod(now time.Time) string {
+	return now.UTC().Format("2006-01")
+}
+
+// spendLocked returns the tenant's spend, starting over in a new period.
+// Callers must hold budgetMutex.
+func spendLocked(tenant string, now time.Time) *tenantSpend {
+	period := billingPeriod(now)
+	spend, ok := spendByTenant[tenant]
+	if !ok || spend.period != period {
+		spend = &tenantSpend{period: period, notified: make(map[string]bool)}
+		spendByTenant[tenant] = spend
+	}
+	return spend
+}
+
+func budgetStatusLocked(tenant string, now time.Time) BudgetStatus {
+	spend := spendLocked(tenant, now)
+	budget := costBudgets[tenant]
+	return BudgetStatus{
+		Tenant:       tenant,
+		Period:       spend.period,
+		SpentUSD:     spend.spentUSD,
+		SoftLimitUSD: budget.SoftLimitUSD,
+		HardLimitUSD: budget.HardLimitUSD,
+		SoftExceeded: budget.SoftLimitUSD > 0 && spend.spentUSD >= budget.SoftLimitUSD,
+		HardExceeded: budget.HardLimitUSD > 0 && spend.spentUSD >= budget.HardLimitUSD,
+		ResetAt:      nextMonth(now),
+	}
+}
+
+// recordSpend adds the cost of cloudTokens on model to the tenant's spend and
+// reports any limit crossed for the first time this period.
+func recordSpend(tenant, model string, cloudTokens int) {
+	if cloudTokens <= 0 {
+		return
+	}
+	now := time.Now()
+	usd := float64(cloudTokens) / 1000 * usdPer1KTokens(model)
+	var total float64
+	storedOK := false
+	if stateless() {
+		total, storedOK = storeSpend(tenant, now, usd)
+	}
+
+	budgetMutex.Lock()
+	spend := spendLocked(tenant, now)
+	spend.spentUSD += usd
+	if storedOK {
+		spend.spentUSD = total
+	}
+	status := budgetStatusLocked(tenant, now)
+	var crossed []string
+	if status.SoftExceeded && !spend.notified["soft"] {
+		spend.notified["soft"] = true
+		crossed = append(crossed, "soft")
+	}
+	if status.HardExceeded && !spend.notified["hard"] {
+		spend.notified["hard"] = true
+		crossed = append(crossed, "hard")
+	}
+	budgetMutex.Unlock()
+
+	for _, limit := range crossed {
+		if stateless() && !claimBudgetNotice(tenant, limit, now) {
+			continue
+		}
+		log.Printf("Warning: tenant %q spent $%.6f of its %s budget for %s", tenant, status.SpentUSD, limit, status.Period)
+		recordAudit(AuditEvent{
+			Action:  "budget." + limit + "_limit",
+			Tenant:  tenant,
+			Actor:   "system",
+			Details: map[string]string{"spentUsd": strconv.FormatFloat(status.SpentUSD, 'f', 6, 64)},
+		})
+		go postWebhook(envString("ECHO_BUDGET_WEBHOOK_URL", ""), BudgetEvent{Timestamp: now, Limit: limit, Status: status}, "Budget")
+	}
+}
+
+// budgetExhausted reports whether the tenant has reached its hard limit and
+// may only be served from the cache.
+func budgetExhausted(tenant string) (BudgetStatus, bool) {
+	budgetMutex.Lock()
+	defer budgetMutex.Unlock()
+	status := budgetStatusLocked(tenant, time.Now())
+	return status, status.HardExceeded
+}
+
+// writeBudgetExceeded refuses a provider call once the tenant's hard limit is
+// reached, with the same reset headers as a tripped quota.
+func writeBudgetExceeded(w http.ResponseWriter, status BudgetStatus) {
+	header := w.Header()
+	header.Set("X-Budget-Limit-USD", strconv.FormatFloat(status.HardLimitUSD, 'f', 6, 64))
+	header.Set("X-Budget-Spent-USD", strconv.FormatFloat(status.SpentUSD, 'f', 6, 64))
+	header.Set("X-Quota-Reset", strconv.FormatInt(status.ResetAt.Unix(), 10))
+	header.Set("Retry-After", strconv.Itoa(int(time.Until(status.ResetAt).Seconds())+1))
+	writeJSON(w, http.StatusPaymentRequired, map[string]string{
+		"error":   "tenant cost budget exhausted; only cached answers are served",
+		"resetAt": status.ResetAt.Format(time.RFC3339),
+	})
+}
+
+// handleBudgets lists every tenant's budget status (GET), or sets (PUT) or
+// removes (DELETE) the budget of the tenant named by X-Tenant-ID.
+func handleBudgets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		now := time.Now()
+		budgetMutex.Lock()
+		tenants := make(map[string]struct{})
+		for tenant := range costBudgets {
+			tenants[tenant] = struct{}{}
+		}
+		for tenant := range spendByTenant {
+			tenants[tenant] = struct{}{}
+		}
+		statuses := make([]BudgetStatus, 0, len(tenants))
+		for tenant := range tenants {
+			statuses = append(statuses, budgetStatusLocked(tenant, now))
+		}
+		budgetMutex.Unlock()
+		sort.Slice(statuses, func(i, j int) bool { return statuses[i].Tenant < statuses[j].Tenant })
+		writeJSON(w, http.StatusOK, statuses)
+		return
+	}
+
+	tenant, err := resolveTenant(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	var budget CostBudget
+	if r.Method == http.MethodPut {
+		if err := readJSON(r, &budget); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON payload"})
+			return
+		}
+		if budget.SoftLimitUSD < 0 || budget.HardLimitUSD < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limits must not be negative"})
+			return
+		}
+		if budget.HardLimitUSD > 0 && budget.SoftLimitUSD > budget.HardLimitUSD {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "softLimitUsd must not exceed hardLimitUsd"})
+			return
+		}
+	}
+
+	budgetMutex.Lock()
+	if r.Method == http.MethodDelete {
+		delete(costBudgets, tenant)
+	} else {
+		costBudgets[tenant] = budget
+	}
+	status := budgetStatusLocked(tenant, time.Now())
+	budgetMutex.Unlock()
+
+	recordAudit(AuditEvent{
+		Action: "budget.set",
+		Tenant: tenant,
+		Actor:  "admin",
+		Details: map[string]string{
+			"softLimitUsd": strconv.FormatFloat(budget.SoftLimitUSD, 'f', -1, 64),
+			"hardLimitUsd": strconv.FormatFloat(budget.HardLimitUSD, 'f', -1, 64),
+		},
+	})
+	writeJSON(w, http.StatusOK, status)
+}
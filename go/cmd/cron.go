@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a standard five-field cron expression: minute, hour, day of
+// month, month and day of week (0 is Sunday). Fields accept *, lists, ranges
+// and steps, e.g. "*/15 1-5 * * 1,3".
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays []bool
+	// anyDay and anyWeekday record unrestricted fields: when both day fields
+	// are restricted, a time matching either one matches, as in cron.
+	anyDay, anyWeekday bool
+}
+
+func parseCronField(field string, lo, hi int) ([]bool, error) {
+	allowed := make([]bool, hi+1)
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid step %q", part)
+			}
+			step = n
+		}
+
+		start, end := lo, hi
+		if rangePart != "*" {
+			first, last, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if start, err = strconv.Atoi(first); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			end = start
+			if isRange {
+				if end, err = strconv.Atoi(last); err != nil {
+					return nil, fmt.Errorf("invalid range %q", part)
+				}
+			} else if hasStep {
+				end = hi
+			}
+		}
+		if start < lo || end > hi || start > end {
+			return nil, fmt.Errorf("%q is outside %d-%d", part, lo, hi)
+		}
+		for v := start; v <= end; v += step {
+			allowed[v] = true
+		}
+	}
+	return allowed, nil
+}
+
+func parseCron(spec string) (cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("cron expression %q needs 5 fields", spec)
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+	var parsed [5][]bool
+	for i, field := range fields {
+		allowed, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return cronSchedule{}, fmt.Errorf("cron expression %q: %w", spec, err)
+		}
+		parsed[i] = allowed
+	}
+	return cronSchedule{
+		minutes:    parsed[0],
+		hours:      parsed[1],
+		days:       parsed[2],
+		months:     parsed[3],
+		weekdays:   parsed[4],
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+	}, nil
+}
+
+func (c cronSchedule) matches(t time.Time) bool {
+	if !c.minutes[t.Minute()] || !c.hours[t.Hour()] || !c.months[int(t.Month())] {
+		return false
+	}
+	day, weekday := c.days[t.Day()], c.weekdays[int(t.Weekday())]
+	switch {
+	case c.anyDay && c.anyWeekday:
+		return true
+	case c.anyDay:
+		return weekday
+	case c.anyWeekday:
+		return day
+	default:
+		return day || weekday
+	}
+}
+
+// next returns the first matching minute after t, or the zero time when none
+// falls within a year (e.g. "0 0 31 2 *").
+func (c cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for limit := t.AddDate(1, 0, 1); t.Before(limit); t = t.Add(time.Minute) {
+		if c.matches(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
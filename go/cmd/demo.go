@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Demo mode admits requests without an API key for public dashboard demos.
+// Anonymous callers are pinned to the demo tenant, rate limited per client
+// address, restricted to the cheapest model, and never write to the cache.
+// Their history is recorded under demoUser, which no X-User-ID can name, and
+// they may not read or export history, usage or cache listings.
+
+// demoUser holds anonymous callers' history apart from the tenant's users.
+const demoUser = "(demo)"
+
+type demoWindow struct {
+	start time.Time
+	count int
+}
+
+var (
+	demoMutex   sync.Mutex
+	demoWindows = make(map[string]*demoWindow)
+)
+
+func demoModeEnabled() bool {
+	return envString("ECHO_DEMO_MODE", "false") == "true"
+}
+
+func demoTenant() string {
+	tenant := envString("ECHO_DEMO_TENANT", defaultTenant)
+	if tenant != defaultTenant && !tenantIDPattern.MatchString(tenant) {
+		return defaultTenant
+	}
+	return tenant
+}
+
+// rejectAnonymous answers a demo caller with 403 and reports whether it did.
+func rejectAnonymous(w http.ResponseWriter, caller Caller, what string) bool {
+	if !caller.Anonymous {
+		return false
+	}
+	writeJSON(w, http.StatusForbidden, map[string]string{"error": what + " is not available in demo mode"})
+	return true
+}
+
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// allowDemoRequest applies a fixed one-minute window per client address.
+func allowDemoRequest(r *http.Request) bool {
+	limit := envInt("ECHO_DEMO_REQUESTS_PER_MINUTE", 10)
+	if limit <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	addr := clientAddress(r)
+
+	demoMutex.Lock()
+	defer demoMutex.Unlock()
+
+	window, ok := demoWindows[addr]
+	if !ok || now.Sub(window.start) >= time.Minute {
+		for key, w := range demoWindows {
+			if now.Sub(w.start) >= time.Minute {
+				delete(demoWindows, key)
+			}
+		}
+		window = &demoWindow{start: now}
+		demoWindows[addr] = window
+	}
+	if window.count >= limit {
+		return false
+	}
+	window.count++
+	return true
+}
+
+// cheapestModel returns the available model with the lowest token price.
+func cheapestModel() string {
+	cheapest := defaultModel()
+	for model := range supportedModels {
+		if modelAvailable(model) && usdPer1KTokens(model) < usdPer1KTokens(cheapest) {
+			cheapest = model
+		}
+	}
+	return cheapest
+}
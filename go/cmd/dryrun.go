@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+type DryRunResponse struct {
+	DryRun         bool            `json:"dryRun"`
+	Decision       string          `json:"decision"`
+	Similarity     float64         `json:"similarity"`
+	Confidence     float64         `json:"confidence,omitempty"`
+	Verify         bool            `json:"verify,omitempty"`
+	Threshold      float64         `json:"threshold"`
+	Tier           string          `json:"tier,omitempty"`
+	Match          *CacheEntryView `json:"match,omitempty"`
+	Suggestion     *Suggestion     `json:"suggestion,omitempty"`
+	Model          string          `json:"model"`
+	EmbeddingModel string          `json:"embeddingModel"`
+	Language       string          `json:"language"`
+	Style          string          `json:"style"`
+}
+
+// peekForCaller mirrors lookupForCaller without recording hits, promoting
+// cold entries, or updating tier stats. On a miss only the best similarity
+// seen is reported.
+func peekForCaller(ctx context.Context, caller Caller, query cacheQuery) (VectorEntry, bool, error) {
+	if !bloomMayMatch(caller.Tenant, query.Text) {
+		return VectorEntry{}, false, nil
+	}
+	owners := []string{sharedOwner}
+	if caller.User != "" {
+		owners = []string{caller.User, sharedOwner}
+	}
+
+	bestScore := 0.0
+	for _, owner := range owners {
+		match, ok, err := findBestMatch(ctx, caller.Tenant, owner, query)
+		if err == nil && !ok && tieringEnabled() {
+			bestScore = max(bestScore, match.Similarity)
+			match, ok, err = peekColdMatch(ctx, caller.Tenant, owner, query)
+		}
+		if err != nil || ok {
+			return match, ok, err
+		}
+		bestScore = max(bestScore, match.Similarity)
+	}
+	return VectorEntry{Similarity: bestScore}, false, nil
+}
+
+func dryRunDecision(ctx context.Context, caller Caller, query cacheQuery, model, suggestionPolicy string) (DryRunResponse, error) {
+	match, hit, err := peekForCaller(ctx, caller, query)
+	if err != nil {
+		return DryRunResponse{}, err
+	}
+
+	resp := DryRunResponse{
+		DryRun:         true,
+		Decision:       "MISS",
+		Similarity:     match.Similarity,
+		Threshold:      query.threshold(),
+		Model:          model,
+		EmbeddingModel: query.EmbeddingModel,
+		Language:       query.Language,
+		Style:          query.Style,
+	}
+	if hit {
+		resp.Confidence = entryConfidence(match, match.Similarity, time.Now())
+		hit, resp.Verify = confidentMatch(match, resp.Confidence, query.MinConfidence)
+	}
+	if hit {
+		resp.Decision = "HIT"
+		resp.Tier = entryTier(match)
+		view := entryView(match)
+		resp.Match = &view
+	} else if suggestionPolicy != suggestionPolicyOff {
+		resp.Suggestion = nearMiss(ctx, caller, query, match)
+		if resp.Suggestion != nil && suggestionPolicy == suggestionPolicyAsk {
+			resp.Decision = "SUGGESTION"
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Duplicate consolidation finds groups of entries whose vectors are nearly
+// identical and merges each group into one canonical entry, shrinking the
+// cache and the work done per lookup.
+
+const defaultDuplicateThreshold = 0.97
+
+type DuplicateGroup struct {
+	Tenant        string           `json:"tenant,omitempty"`
+	Owner         string           `json:"owner,omitempty"`
+	MinSimilarity float64          `json:"minSimilarity"`
+	Entries       []CacheEntryView `json:"entries"`
+}
+
+type MergeRequest struct {
+	EntryIDs    []string `json:"entryIds"`
+	CanonicalID string   `json:"canonicalId,omitempty"`
+}
+
+type MergeResponse struct {
+	Canonical CacheEntryView `json:"canonical"`
+	Removed   int            `json:"removed"`
+}
+
+// mergedAwayKeys remembers entries consolidated into another one, so the
+// next S3 or peer sync does not bring them back. Guarded by dbMutex.
+var mergedAwayKeys = make(map[string]struct{})
+
+func isMergedAway(questionKey string) bool {
+	_, ok := mergedAwayKeys[questionKey]
+	return ok
+}
+
+// findDuplicateGroups clusters hot-tier entries of the same tenant, owner,
+// embedding model, style and language whose pairwise similarity reaches
+// threshold (single linkage). Only entries in the same index partition are
+// compared.
+func findDuplicateGroups(threshold float64) []DuplicateGroup {
+	dbMutex.RLock()
+	entries := make([]VectorEntry, len(MockVectorDB))
+	copy(entries, MockVectorDB)
+	partitions := partitionMembers()
+	dbMutex.RUnlock()
+
+	parent := make([]int, len(entries))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	minScore := make(map[int]float64)
+	for _, positions := range partitions {
+		for a, i := range positions {
+			for _, j := range positions[a+1:] {
+				// Public entries of several tenants share a partition.
+				if entries[i].Tenant != entries[j].Tenant || entries[i].Owner != entries[j].Owner {
+					continue
+				}
+				score := cosineSimilarity(entries[i].Vector, entries[j].Vector)
+				if score < threshold {
+					continue
+				}
+				ri, rj := find(i), find(j)
+				merged := score
+				if s, ok := minScore[ri]; ok {
+					merged = min(merged, s)
+				}
+				if s, ok := minScore[rj]; ok {
+					merged = min(merged, s)
+				}
+				parent[rj] = ri
+				minScore[ri] = merged
+			}
+		}
+	}
+
+	members := make(map[int][]int)
+	for i := range entries {
+		root := find(i)
+		members[root] = append(members[root], i)
+	}
+
+	groups := make([]DuplicateGroup, 0)
+	for root, idxs := range members {
+		if len(idxs) < 2 {
+			continue
+		}
+		group := DuplicateGroup{
+			Tenant:        entries[root].Tenant,
+			Owner:         entries[root].Owner,
+			MinSimilarity: minScore[root],
+		}
+		for _, idx := range idxs {
+			group.Entries = append(group.Entries, entryView(entries[idx]))
+		}
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return len(groups[i].Entries) > len(groups[j].Entries)
+	})
+	return groups
+}
+
+func handleDuplicates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	threshold := defaultDuplicateThreshold
+	if raw := r.URL.Query().Get("threshold"); raw != "" {
+		parsed, err := strconv.ParseFloat(raw, 64)
+		if err != nil || parsed <= 0 || parsed > 1 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "threshold must be in (0, 1]"})
+			return
+		}
+		threshold = parsed
+	}
+
+	writeJSON(w, http.StatusOK, findDuplicateGroups(threshold))
+}
+
+// handleMerge consolidates the given entries into one canonical entry, which
+// defaults to the most hit entry. Hit counts are summed onto the canonical.
+func handleMerge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var req MergeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON payload"})
+		return
+	}
+	if len(req.EntryIDs) < 2 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "at least two entryIds are required"})
+		return
+	}
+	wanted := make(map[string]struct{}, len(req.EntryIDs))
+	for _, id := range req.EntryIDs {
+		wanted[strings.TrimSpace(id)] = struct{}{}
+	}
+
+	// Entries must share a tenant, so any of them names the one to snapshot.
+	tenant, found := "", false
+	dbMutex.RLock()
+	for _, entry := range MockVectorDB {
+		if _, ok := wanted[entry.ID]; ok {
+			tenant, found = entry.Tenant, true
+			break
+		}
+	}
+	dbMutex.RUnlock()
+	if !found {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "some entries were not found"})
+		return
+	}
+	snapshot, ok := snapshotBefore(w, tenant, "cache.merge")
+	if !ok {
+		return
+	}
+
+	dbMutex.Lock()
+	var group []int
+	for i, entry := range MockVectorDB {
+		if _, ok := wanted[entry.ID]; ok {
+			group = append(group, i)
+		}
+	}
+	if len(group) != len(wanted) {
+		dbMutex.Unlock()
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "some entries were not found"})
+		return
+	}
+
+	canonical := group[0]
+	for _, idx := range group {
+		entry := MockVectorDB[idx]
+		if entry.Tenant != MockVectorDB[canonical].Tenant || entry.Owner != MockVectorDB[canonical].Owner {
+			dbMutex.Unlock()
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "entries belong to different tenants or owners"})
+			return
+		}
+		if req.CanonicalID != "" {
+			if entry.ID == req.CanonicalID {
+				canonical = idx
+			}
+		} else if entry.HitCount > MockVectorDB[canonical].HitCount {
+			canonical = idx
+		}
+	}
+	if req.CanonicalID != "" && MockVectorDB[canonical].ID != req.CanonicalID {
+		dbMutex.Unlock()
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "canonicalId must be one of entryIds"})
+		return
+	}
+
+	merged := MockVectorDB[canonical]
+	removedIDs := make(map[string]struct{}, len(group)-1)
+	for _, idx := range group {
+		if idx == canonical {
+			continue
+		}
+		entry := MockVectorDB[idx]
+		merged.HitCount += entry.HitCount
+		merged.Helpful += entry.Helpful
+		merged.Unhelpful += entry.Unhelpful
+		if entry.LastHitAt.After(merged.LastHitAt) {
+			merged.LastHitAt = entry.LastHitAt
+		}
+		merged.Pinned = merged.Pinned || entry.Pinned
+		removedIDs[entry.ID] = struct{}{}
+		mergedAwayKeys[entryKey(entry.Tenant, entry.Owner, entry.Question)] = struct{}{}
+	}
+	MockVectorDB[canonical] = merged
+	markCacheChanged()
+	recordCacheChange(changeUpdated, merged)
+
+	kept := MockVectorDB[:0]
+	for _, entry := range MockVectorDB {
+		if _, ok := removedIDs[entry.ID]; !ok {
+			kept = append(kept, entry)
+			continue
+		}
+		recordCacheChange(changeDeleted, entry)
+	}
+	MockVectorDB = kept
+	invalidateIndexLocked()
+	for i := range ChatHistory {
+		if _, ok := removedIDs[ChatHistory[i].CacheEntryID]; ok {
+			ChatHistory[i].CacheEntryID = merged.ID
+		}
+	}
+	dbMutex.Unlock()
+
+	ids := make([]string, 0, len(removedIDs))
+	for id := range removedIDs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	recordAudit(AuditEvent{
+		Action:  "cache.merge",
+		EntryID: merged.ID,
+		Tenant:  merged.Tenant,
+		Actor:   "admin",
+		Details: withSnapshot(map[string]string{"mergedIds": strings.Join(ids, ",")}, snapshot),
+	})
+
+	writeJSON(w, http.StatusOK, MergeResponse{Canonical: entryView(merged), Removed: len(removedIDs)})
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestDuplicateGroupsStayWithinTenant(t *testing.T) {
+	vector := []float32{1, 0, 0}
+	withCache(t, []VectorEntry{
+		{ID: "a", Tenant: "acme", Question: "how do I reset my password", Vector: vector},
+		{ID: "b", Tenant: "acme", Question: "how can I reset my password", Vector: vector},
+		{ID: "c", Tenant: "globex", Question: "how do I reset my password", Vector: vector},
+		{ID: "d", Tenant: "acme", Question: "what is the refund policy", Vector: []float32{0, 1, 0}},
+	}, nil)
+
+	groups := findDuplicateGroups(defaultDuplicateThreshold)
+	if len(groups) != 1 {
+		t.Fatalf("got %d groups; want 1", len(groups))
+	}
+	group := groups[0]
+	if group.Tenant != "acme" || len(group.Entries) != 2 {
+		t.Errorf("group of tenant %q with %d entries; want acme with 2", group.Tenant, len(group.Entries))
+	}
+}
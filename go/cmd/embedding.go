@@ -0,0 +1,41 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Vectors come from the client, so the server cannot tell which embedding
+// model produced them. Clients name it per request; entries remember it, and
+// lookups only compare vectors from the same model.
+
+var embeddingModelPattern = regexp.MustCompile(`^[A-Za-z0-9_./:@-]{1,128}$`)
+
+// defaultEmbeddingModel is assumed for requests that do not name a model. It
+// matches the model the bundled frontend loads.
+func defaultEmbeddingModel() string {
+	return envString("ECHO_DEFAULT_EMBEDDING_MODEL", "Xenova/all-MiniLM-L6-v2")
+}
+
+// legacyEmbeddingModel is recorded on entries persisted before entries
+// carried a model.
+func legacyEmbeddingModel() string {
+	return envString("ECHO_LEGACY_EMBEDDING_MODEL", defaultEmbeddingModel())
+}
+
+// resolveEmbeddingModel validates the model a request names.
+func resolveEmbeddingModel(requested string) (string, bool) {
+	requested = strings.TrimSpace(requested)
+	if requested == "" {
+		return defaultEmbeddingModel(), true
+	}
+	return requested, embeddingModelPattern.MatchString(requested)
+}
+
+// entryEmbeddingModel treats entries without a model as legacy entries.
+func entryEmbeddingModel(entry VectorEntry) string {
+	if entry.EmbeddingModel == "" {
+		return legacyEmbeddingModel()
+	}
+	return entry.EmbeddingModel
+}
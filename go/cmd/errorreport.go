@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Error reporting to a Sentry-compatible tracker (Sentry, GlitchTip, ...)
+// through its store API. Set ECHO_SENTRY_DSN to the project DSN, of the form
+// https://<key>@<host>/<project>; ECHO_SENTRY_ENVIRONMENT tags the events.
+// Events are sent in the background from a small queue and dropped, with a
+// log line, when the queue is full, so a tracker outage never slows requests.
+//
+// Handler panics, provider failures and S3 sync failures are reported, each
+// tagged with what is known at the time: request ID, tenant, model, bucket.
+// Errors (not panics) are sampled at ECHO_SENTRY_SAMPLE_RATE (default 1) and
+// capped at ECHO_SENTRY_MAX_PER_MINUTE (default 30) per kind, so an outage
+// of the provider or S3 does not flood the tracker.
+
+const sentryQueueSize = 100
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Module   string `json:"module,omitempty"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+type sentryStacktrace struct {
+	Frames []sentryFrame `json:"frames"`
+}
+
+type sentryException struct {
+	Type       string            `json:"type"`
+	Value      string            `json:"value"`
+	Stacktrace *sentryStacktrace `json:"stacktrace,omitempty"`
+}
+
+type sentryExceptions struct {
+	Values []sentryException `json:"values"`
+}
+
+type sentryRequest struct {
+	URL    string `json:"url"`
+	Method string `json:"method"`
+}
+
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger"`
+	Release     string            `json:"release,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Message     string            `json:"message,omitempty"`
+	Exception   *sentryExceptions `json:"exception,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Extra       map[string]any    `json:"extra,omitempty"`
+	Request     *sentryRequest    `json:"request,omitempty"`
+}
+
+type sentryClient struct {
+	storeURL string
+	auth     string
+	queue    chan sentryEvent
+
+	// mu guards the per-kind rate limit window.
+	mu          sync.Mutex
+	windowStart time.Time
+	windowCount map[string]int
+}
+
+var (
+	sentryOnce sync.Once
+	sentry     *sentryClient
+)
+
+// parseSentryDSN returns the store URL and public key of dsn.
+func parseSentryDSN(dsn string) (string, string, error) {
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return "", "", fmt.Errorf("unsupported scheme %q", parsed.Scheme)
+	}
+	if parsed.User == nil || parsed.User.Username() == "" {
+		return "", "", fmt.Errorf("missing public key")
+	}
+	path := strings.Trim(parsed.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	project := path[slash+1:]
+	if project == "" {
+		return "", "", fmt.Errorf("missing project ID")
+	}
+	prefix := ""
+	if slash >= 0 {
+		prefix = "/" + path[:slash]
+	}
+	return fmt.Sprintf("%s://%s%s/api/%s/store/", parsed.Scheme, parsed.Host, prefix, project), parsed.User.Username(), nil
+}
+
+// errorTracker returns the client, or nil when ECHO_SENTRY_DSN is unset.
+func errorTracker() *sentryClient {
+	sentryOnce.Do(func() {
+		dsn := envString("ECHO_SENTRY_DSN", "")
+		if dsn == "" {
+			return
+		}
+		storeURL, key, err := parseSentryDSN(dsn)
+		if err != nil {
+			log.Printf("Warning: error reporting disabled: ECHO_SENTRY_DSN: %v", err)
+			return
+		}
+		client := &sentryClient{
+			storeURL: storeURL,
+			auth:     fmt.Sprintf("Sentry sentry_version=7, sentry_client=echo/%s, sentry_key=%s", version, key),
+			queue:    make(chan sentryEvent, sentryQueueSize),
+
+			windowCount: make(map[string]int),
+		}
+		go client.run()
+		sentry = client
+	})
+	return sentry
+}
+
+func (c *sentryClient) run() {
+	for event := range c.queue {
+		if err := c.send(event); err != nil {
+			log.Printf("Error report %s failed: %v", event.EventID, err)
+		}
+	}
+}
+
+func (c *sentryClient) send(event sentryEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.storeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", c.auth)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("tracker returned %s", resp.Status)
+	}
+	return nil
+}
+
+func newSentryEvent(level string) sentryEvent {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return sentryEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339Nano),
+		Level:       level,
+		Platform:    "go",
+		Logger:      "echo",
+		Release:     version,
+		Environment: envString("ECHO_SENTRY_ENVIRONMENT", ""),
+		ServerName:  nodeID,
+		Tags:        map[string]string{},
+	}
+}
+
+// stackFrames returns the caller's stack, skipping skip frames above it,
+// oldest frame first as trackers expect.
+func stackFrames(skip int) []sentryFrame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(skip+2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var out []sentryFrame
+	for {
+		frame, more := frames.Next()
+		// The package path ends at the first dot after its last slash.
+		module, function := "", frame.Function
+		slash := strings.LastIndex(function, "/")
+		if dot := strings.Index(function[slash+1:], "."); dot >= 0 {
+			module, function = function[:slash+1+dot], function[slash+2+dot:]
+		}
+		out = append(out, sentryFrame{
+			Function: function,
+			Module:   module,
+			AbsPath:  frame.File,
+			Lineno:   frame.Line,
+			InApp:    module == "main",
+		})
+		if !more {
+			break
+		}
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+func (c *sentryClient) enqueue(event sentryEvent) {
+	select {
+	case c.queue <- event:
+	default:
+		log.Printf("Error report %s dropped: queue full", event.EventID)
+	}
+}
+
+// reportPanic reports a panic recovered while serving r. It must be called
+// from the deferred function that recovered, so the stack still shows where
+// the panic happened.
+func reportPanic(recovered any, r *http.Request) {
+	client := errorTracker()
+	if client == nil {
+		return
+	}
+	err := panicError(recovered)
+	event := newSentryEvent("error")
+	// The stack skips this function, the deferred one and runtime.gopanic.
+	event.Exception = &sentryExceptions{Values: []sentryException{{
+		Type:       fmt.Sprintf("%T", recovered),
+		Value:      scrubSecrets(err.Error()),
+		Stacktrace: &sentryStacktrace{Frames: stackFrames(3)},
+	}}}
+	event.Tags["kind"] = "panic"
+	event.Tags["request_id"] = requestID(r)
+	if tenant, err := resolveTenant(r); err == nil {
+		event.Tags["tenant"] = tenant
+	}
+	if r.Pattern != "" {
+		event.Tags["route"] = r.Pattern
+	}
+	event.Request = &sentryRequest{URL: r.URL.Path, Method: r.Method}
+	client.enqueue(event)
+}
+
+// reportProviderError reports a failed provider call made for r. A client
+// that went away is not a provider failure.
+func reportProviderError(r *http.Request, caller Caller, model string, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	reportError("provider", err, map[string]string{
+		"provider":   modelProvider(model),
+		"model":      model,
+		"request_id": requestID(r),
+		"tenant":     caller.Tenant,
+	})
+}
+
+// scrubSecrets removes credentials from an error message before it leaves
+// the process; transport errors quote request URLs, which can carry the
+// provider key.
+func scrubSecrets(message string) string {
+	for _, name := range []string{"GEMINI_API_KEY", "OPENAI_API_KEY", "AWS_SECRET_ACCESS_KEY", "ECHO_ADMIN_TOKEN", "ECHO_GOSSIP_TOKEN"} {
+		if secret := os.Getenv(name); len(secret) >= 3 {
+			message = strings.ReplaceAll(message, secret, "REDACTED")
+		}
+	}
+	return message
+}
+
+// allow applies sampling and the per-kind rate limit.
+func (c *sentryClient) allow(kind string) bool {
+	if rate := envFloat("ECHO_SENTRY_SAMPLE_RATE", 1); rate < 1 && mathrand.Float64() >= rate {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := time.Now(); now.Sub(c.windowStart) >= time.Minute {
+		c.windowStart = now
+		clear(c.windowCount)
+	}
+	if c.windowCount[kind] >= envInt("ECHO_SENTRY_MAX_PER_MINUTE", 30) {
+		return false
+	}
+	c.windowCount[kind]++
+	return true
+}
+
+// reportError reports a failure of kind ("provider", "s3", ...) with tags
+// describing its context. Empty tags are left out.
+func reportError(kind string, err error, tags map[string]string) {
+	client := errorTracker()
+	if client == nil || err == nil || !client.allow(kind) {
+		return
+	}
+	event := newSentryEvent("error")
+	event.Exception = &sentryExceptions{Values: []sentryException{{
+		Type:       kind + " error",
+		Value:      scrubSecrets(err.Error()),
+		Stacktrace: &sentryStacktrace{Frames: stackFrames(1)},
+	}}}
+	event.Tags["kind"] = kind
+	for key, value := range tags {
+		if value != "" {
+			event.Tags[key] = value
+		}
+	}
+	client.enqueue(event)
+}
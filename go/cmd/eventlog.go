@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// The event log feeds offline analytics without a database. Structured
+// events (chats served, entries evicted, sync cycles) are buffered and
+// written to S3 as newline-delimited JSON batches under a Hive-style
+// date-partitioned prefix, events/dt=YYYY-MM-DD/hour=HH/, which Athena and
+// BigQuery external tables read directly. A batch is written every
+// ECHO_EVENT_FLUSH_INTERVAL (default 1m) or once ECHO_EVENT_BATCH_SIZE
+// (default 1000) events are waiting. At most ECHO_EVENT_BUFFER (default
+// 50000) events wait for S3; beyond that the oldest are dropped and counted.
+// Events carry no question or answer text. ECHO_EVENT_LOG=off disables it.
+
+const (
+	eventChatServed = "chat.served"
+	eventCacheEvict = "cache.evict"
+	eventSyncCycle  = "sync.cycle"
+
+	eventObjectDir = "events/"
+)
+
+// Event is one analytics record. Fields that do not apply to a type are
+// omitted.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	Node       string    `json:"node,omitempty"`
+	Tenant     string    `json:"tenant,omitempty"`
+	EntryID    string    `json:"entryId,omitempty"`
+	Outcome    string    `json:"outcome,omitempty"`
+	Source     string    `json:"source,omitempty"`
+	Model      string    `json:"model,omitempty"`
+	Similarity float64   `json:"similarity,omitempty"`
+	LatencyMs  int64     `json:"latencyMs,omitempty"`
+	Tokens     int       `json:"tokens,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+
+	BytesDownloaded   int64 `json:"bytesDownloaded,omitempty"`
+	BytesUploaded     int64 `json:"bytesUploaded,omitempty"`
+	EntriesDownloaded int64 `json:"entriesDownloaded,omitempty"`
+	EntriesUploaded   int64 `json:"entriesUploaded,omitempty"`
+}
+
+var (
+	// eventMutex guards the fields below.
+	eventMutex    sync.Mutex
+	eventBuffer   []Event
+	eventsDropped int
+	eventsOn      bool
+	// eventFlush wakes the writer when a batch is full.
+	eventFlush = make(chan struct{}, 1)
+)
+
+// startEventLog starts the batch writer; it needs S3.
+func startEventLog() {
+	if envString("ECHO_EVENT_LOG", "on") == "off" {
+		return
+	}
+	eventMutex.Lock()
+	eventsOn = true
+	eventMutex.Unlock()
+
+	ticker := time.NewTicker(envDuration("ECHO_EVENT_FLUSH_INTERVAL", time.Minute))
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-eventFlush:
+			}
+			flushEvents()
+		}
+	}()
+}
+
+func recordEvent(event Event) {
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+	if !eventsOn {
+		return
+	}
+	event.Time = time.Now().UTC()
+	event.Node = nodeID
+	eventBuffer = append(eventBuffer, event)
+	if limit := envInt("ECHO_EVENT_BUFFER", 50000); limit > 0 && len(eventBuffer) > limit {
+		dropped := len(eventBuffer) - limit
+		eventsDropped += dropped
+		eventBuffer = append([]Event(nil), eventBuffer[dropped:]...)
+	}
+	if len(eventBuffer) >= envInt("ECHO_EVENT_BATCH_SIZE", 1000) {
+		select {
+		case eventFlush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func eventObjectKey(at time.Time) string {
+	return eventObjectDir + "dt=" + at.Format("2006-01-02") + "/hour=" + at.Format("15") + "/" + nodeID + "-" + newID() + ".ndjson"
+}
+
+// flushEvents writes the buffered events, one object per hour partition. A
+// failed batch goes back to the front of the buffer for the next flush.
+func flushEvents() {
+	target := activeS3Target()
+	eventMutex.Lock()
+	batch := eventBuffer
+	eventBuffer = nil
+	if eventsDropped > 0 {
+		log.Printf("Event log: dropped %d events while S3 was behind", eventsDropped)
+		eventsDropped = 0
+	}
+	eventMutex.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	var failed []Event
+	for start := 0; start < len(batch); {
+		hour := batch[start].Time.Truncate(time.Hour)
+		end := start
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		for end < len(batch) && batch[end].Time.Truncate(time.Hour).Equal(hour) {
+			encoder.Encode(batch[end])
+			end++
+		}
+		if target == nil {
+			failed = append(failed, batch[start:end]...)
+		} else if err := putObject(target, eventObjectKey(hour), buf.Bytes(), "application/x-ndjson", ""); err != nil {
+			log.Printf("Event log: write of %d events failed: %v", end-start, err)
+			failed = append(failed, batch[start:end]...)
+		}
+		start = end
+	}
+
+	if len(failed) > 0 {
+		eventMutex.Lock()
+		eventBuffer = append(failed, eventBuffer...)
+		eventMutex.Unlock()
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A/B experiments between cache policies. ECHO_EXPERIMENTS (inline JSON)
+// defines experiments keyed by name, each splitting traffic between weighted
+// arms that override the similarity threshold and the minimum confidence:
+//
+//	{"threshold": {"enabled": true, "unit": "question", "arms": [
+//	  {"name": "control", "weight": 50},
+//	  {"name": "loose", "weight": 50, "threshold": 0.85, "minConfidence": 0.8}]}}
+//
+// Traffic is bucketed by a hash of the experiment name and the unit: the
+// question (default), so the same question always gets the same policy, or
+// the caller. Tenants, when listed, limit the experiment to them. At most one
+// experiment applies to a request, the first by name; an explicit
+// similarityThreshold in the request takes precedence over its arm.
+//
+// Each arm counts requests, hits and the feedback on the answers it served;
+// GET /admin/experiments compares every arm with the first one, the control,
+// using a two-proportion z-test on the hit rate. Counters are kept in memory
+// and start over on restart.
+
+type ExperimentArm struct {
+	Name          string  `json:"name"`
+	Weight        float64 `json:"weight"`
+	Threshold     float64 `json:"threshold,omitempty"`
+	MinConfidence float64 `json:"minConfidence,omitempty"`
+}
+
+type Experiment struct {
+	Enabled bool            `json:"enabled"`
+	Unit    string          `json:"unit,omitempty"`
+	Tenants []string        `json:"tenants,omitempty"`
+	Arms    []ExperimentArm `json:"arms"`
+}
+
+const (
+	experimentUnitQuestion = "question"
+	experimentUnitCaller   = "caller"
+	// maxServedArms bounds how many served entries remember their arm for
+	// attributing feedback.
+	maxServedArms = 10000
+)
+
+type armCounters struct {
+	requests, hits, helpful, unhelpful, tokensSaved int
+	similarity                                      float64
+}
+
+// experimentAssignment is the arm a request was bucketed into.
+type experimentAssignment struct {
+	Experiment string
+	Arm        ExperimentArm
+}
+
+func (a *experimentAssignment) label() string {
+	if a == nil {
+		return ""
+	}
+	return a.Experiment + ":" + a.Arm.Name
+}
+
+var (
+	// experimentMutex guards experiments, armStats and servedArms.
+	experimentMutex sync.Mutex
+	experiments     map[string]Experiment
+	experimentNames []string
+	armStats        = make(map[string]*armCounters)
+	servedArms      = make(map[string]string)
+	servedOrder     []string
+	experimentsFrom = time.Now()
+)
+
+func parseExperiments(data []byte) (map[string]Experiment, error) {
+	var parsed map[string]Experiment
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return nil, err
+	}
+	for name, experiment := range parsed {
+		if len(experiment.Arms) < 2 {
+			return nil, fmt.Errorf("experiment %s: needs at least two arms", name)
+		}
+		if experiment.Unit != "" && experiment.Unit != experimentUnitQuestion && experiment.Unit != experimentUnitCaller {
+			return nil, fmt.Errorf("experiment %s: unit must be question or caller", name)
+		}
+		total := 0.0
+		for _, arm := range experiment.Arms {
+			if arm.Name == "" || arm.Weight < 0 {
+				return nil, fmt.Errorf("experiment %s: every arm needs a name and a non-negative weight", name)
+			}
+			if arm.Threshold < 0 || arm.Threshold > 1 || arm.MinConfidence < 0 || arm.MinConfidence > 1 {
+				return nil, fmt.Errorf("experiment %s: threshold and minConfidence must be between 0 and 1", name)
+			}
+			total += arm.Weight
+		}
+		if total <= 0 {
+			return nil, fmt.Errorf("experiment %s: arm weights must add up to more than 0", name)
+		}
+	}
+	return parsed, nil
+}
+
+func initExperiments() {
+	raw := envString("ECHO_EXPERIMENTS", "")
+	if raw == "" {
+		return
+	}
+	parsed, err := parseExperiments([]byte(raw))
+	if err != nil {
+		log.Printf("Invalid ECHO_EXPERIMENTS: %v", err)
+		return
+	}
+	names := make([]string, 0, len(parsed))
+	for name := range parsed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	experimentMutex.Lock()
+	experiments, experimentNames = parsed, names
+	experimentMutex.Unlock()
+	log.Printf("Experiments: %s", strings.Join(names, ", "))
+}
+
+func experimentBucket(name, unit string) float64 {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(name + "\x00" + unit))
+	return float64(hash.Sum32()%10000) / 10000
+}
+
+// assignExperiment picks the arm of the first experiment that applies to
+// caller, or nil when none does.
+func assignExperiment(caller Caller, question string) *experimentAssignment {
+	experimentMutex.Lock()
+	defer experimentMutex.Unlock()
+	for _, name := range experimentNames {
+		experiment := experiments[name]
+		if !experiment.Enabled {
+			continue
+		}
+		if len(experiment.Tenants) > 0 && !slices.Contains(experiment.Tenants, caller.Tenant) {
+			continue
+		}
+		unit := caller.Tenant + "\x00" + strings.ToLower(strings.Join(strings.Fields(question), " "))
+		if experiment.Unit == experimentUnitCaller {
+			unit = caller.Tenant + "\x00" + caller.User + "\x00" + caller.APIKey
+		}
+
+		total := 0.0
+		for _, arm := range experiment.Arms {
+			total += arm.Weight
+		}
+		point := experimentBucket(name, unit) * total
+		for _, arm := range experiment.Arms {
+			if point < arm.Weight {
+				return &experimentAssignment{Experiment: name, Arm: arm}
+			}
+			point -= arm.Weight
+		}
+		return &experimentAssignment{Experiment: name, Arm: experiment.Arms[len(experiment.Arms)-1]}
+	}
+	return nil
+}
+
+// apply sets the arm's policy on query unless the request set its own.
+func (a *experimentAssignment) apply(query *cacheQuery) {
+	if a == nil {
+		return
+	}
+	if query.Threshold == 0 {
+		query.Threshold = a.Arm.Threshold
+	}
+	query.MinConfidence = a.Arm.MinConfidence
+}
+
+func armCountersLocked(label string) *armCounters {
+	counters, ok := armStats[label]
+	if !ok {
+		counters = &armCounters{}
+		armStats[label] = counters
+	}
+	return counters
+}
+
+// recordExperimentOutcome counts a request answered under a, remembering
+// which arm served entryID so feedback on it is attributed to the arm.
+func recordExperimentOutcome(a *experimentAssignment, hit bool, entryID string, similarity float64, tokensSaved int) {
+	if a == nil {
+		return
+	}
+	label := a.label()
+	experimentMutex.Lock()
+	defer experimentMutex.Unlock()
+	counters := armCountersLocked(label)
+	counters.requests++
+	if hit {
+		counters.hits++
+		counters.tokensSaved += tokensSaved
+		counters.similarity += similarity
+	}
+	if entryID == "" {
+		return
+	}
+	if _, ok := servedArms[entryID]; !ok {
+		servedOrder = append(servedOrder, entryID)
+		if len(servedOrder) > maxServedArms {
+			delete(servedArms, servedOrder[0])
+			servedOrder = servedOrder[1:]
+		}
+	}
+	servedArms[entryID] = label
+}
+
+// recordExperimentFeedback attributes feedback on entryID to the arm that
+// last served it.
+func recordExperimentFeedback(entryID string, helpful bool) {
+	experimentMutex.Lock()
+	defer experimentMutex.Unlock()
+	label, ok := servedArms[entryID]
+	if !ok {
+		return
+	}
+	counters := armCountersLocked(label)
+	if helpful {
+		counters.helpful++
+	} else {
+		counters.unhelpful++
+	}
+}
+
+type ArmReport struct {
+	ExperimentArm
+	Requests      int     `json:"requests"`
+	Hits          int     `json:"hits"`
+	HitRate       float64 `json:"hitRate"`
+	AvgSimilarity float64 `json:"avgSimilarity,omitempty"`
+	TokensSaved   int     `json:"tokensSaved"`
+	Helpful       int     `json:"helpful"`
+	Unhelpful     int     `json:"unhelpful"`
+	HelpfulRate   float64 `json:"helpfulRate,omitempty"`
+	// HitRateLift, ZScore and Significant compare the arm with the control;
+	// they are left out for the control itself.
+	HitRateLift float64 `json:"hitRateLift,omitempty"`
+	ZScore      float64 `json:"zScore,omitempty"`
+	Significant bool    `json:"significant,omitempty"`
+}
+
+type ExperimentReport struct {
+	Name    string      `json:"name"`
+	Enabled bool        `json:"enabled"`
+	Unit    string      `json:"unit"`
+	Tenants []string    `json:"tenants,omitempty"`
+	Since   time.Time   `json:"since"`
+	Arms    []ArmReport `json:"arms"`
+}
+
+// twoProportionZ is the z statistic for the difference between hit rates
+// hitsA/nA and hitsB/nB, or 0 when it is undefined.
+func twoProportionZ(hitsA, nA, hitsB, nB int) float64 {
+	if nA == 0 || nB == 0 {
+		return 0
+	}
+	pooled := float64(hitsA+hitsB) / float64(nA+nB)
+	se := math.Sqrt(pooled * (1 - pooled) * (1/float64(nA) + 1/float64(nB)))
+	if se == 0 {
+		return 0
+	}
+	return (float64(hitsB)/float64(nB) - float64(hitsA)/float64(nA)) / se
+}
+
+func experimentReports() []ExperimentReport {
+	experimentMutex.Lock()
+	defer experimentMutex.Unlock()
+
+	reports := make([]ExperimentReport, 0, len(experimentNames))
+	for _, name := range experimentNames {
+		experiment := experiments[name]
+		report := ExperimentReport{Name: name, Enabled: experiment.Enabled, Unit: experiment.Unit, Tenants: experiment.Tenants, Since: experimentsFrom}
+		if report.Unit == "" {
+			report.Unit = experimentUnitQuestion
+		}
+		for i, arm := range experiment.Arms {
+			counters := armStats[name+":"+arm.Name]
+			if counters == nil {
+				counters = &armCounters{}
+			}
+			view := ArmReport{
+				ExperimentArm: arm,
+				Requests:      counters.requests,
+				Hits:          counters.hits,
+				TokensSaved:   counters.tokensSaved,
+				Helpful:       counters.helpful,
+				Unhelpful:     counters.unhelpful,
+			}
+			if counters.requests > 0 {
+				view.HitRate = float64(counters.hits) / float64(counters.requests)
+			}
+			if counters.hits > 0 {
+				view.AvgSimilarity = counters.similarity / float64(counters.hits)
+			}
+			if votes := counters.helpful + counters.unhelpful; votes > 0 {
+				view.HelpfulRate = float64(counters.helpful) / float64(votes)
+			}
+			if i > 0 {
+				control := report.Arms[0]
+				view.HitRateLift = view.HitRate - control.HitRate
+				view.ZScore = twoProportionZ(control.Hits, control.Requests, view.Hits, view.Requests)
+				view.Significant = math.Abs(view.ZScore) >= 1.96
+			}
+			report.Arms = append(report.Arms, view)
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+func handleExperiments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, experimentReports())
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var historyCSVHeader = []string{
+	"timestamp",
+	"question",
+	"answer",
+	"source",
+	"model",
+	"cached",
+	"tokens_saved",
+	"energy_saved_wh",
+	"co2_saved_g",
+	"labels",
+	"note",
+}
+
+// csvCell keeps spreadsheets from running text as a formula: cells starting
+// with =, +, -, @, a tab or a carriage return get a leading quote.
+func csvCell(text string) string {
+	if text != "" && strings.ContainsRune("=+-@\t\r", rune(text[0])) {
+		return "'" + text
+	}
+	return text
+}
+
+func writeHistoryCSV(buf *bytes.Buffer, items []HistoryItem) error {
+	writer := csv.NewWriter(buf)
+	if err := writer.Write(historyCSVHeader); err != nil {
+		return err
+	}
+	for _, item := range items {
+		row := []string{
+			item.Timestamp.UTC().Format(time.RFC3339),
+			csvCell(item.Question),
+			csvCell(item.Answer),
+			csvCell(item.Source),
+			csvCell(item.Model),
+			strconv.FormatBool(item.Saved),
+			strconv.Itoa(item.Tokens),
+			strconv.FormatFloat(item.EnergyWh, 'f', 6, 64),
+			strconv.FormatFloat(item.CO2g, 'f', 6, 64),
+			csvCell(strings.Join(item.Labels, " ")),
+			csvCell(item.Note),
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func writeHistoryMarkdown(buf *bytes.Buffer, items []HistoryItem) {
+	buf.WriteString("# Echo history\n")
+	for _, item := range items {
+		fmt.Fprintf(buf, "\n## %s\n\n", strings.Join(strings.Fields(item.Question), " "))
+		fmt.Fprintf(buf, "- Time: %s\n", item.Timestamp.UTC().Format(time.RFC3339))
+		fmt.Fprintf(buf, "- Source: %s\n", item.Source)
+		if item.Model != "" {
+			fmt.Fprintf(buf, "- Model: %s\n", item.Model)
+		}
+		if item.Saved {
+			fmt.Fprintf(buf, "- Saved: %d tokens, %.4f Wh, %.4f g CO2\n", item.Tokens, item.EnergyWh, item.CO2g)
+		}
+		if len(item.Labels) > 0 {
+			fmt.Fprintf(buf, "- Labels: %s\n", strings.Join(item.Labels, ", "))
+		}
+		fmt.Fprintf(buf, "\n%s\n", strings.TrimSpace(item.Answer))
+		if item.Note != "" {
+			fmt.Fprintf(buf, "\n> Note: %s\n", strings.Join(strings.Fields(item.Note), " "))
+		}
+	}
+}
+
+// handleHistoryExport downloads the caller's history, oldest first, as CSV
+// (default) or Markdown (?format=md).
+func handleHistoryExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if rejectAnonymous(w, caller, "history export") {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "md" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format must be csv or md"})
+		return
+	}
+
+	dbMutex.RLock()
+	items := make([]HistoryItem, 0, len(ChatHistory))
+	for _, item := range ChatHistory {
+		if historyVisible(item, caller) {
+			items = append(items, item)
+		}
+	}
+	dbMutex.RUnlock()
+
+	var buf bytes.Buffer
+	contentType := "text/csv"
+	if format == "md" {
+		contentType = "text/markdown; charset=utf-8"
+		writeHistoryMarkdown(&buf, items)
+	} else if err := writeHistoryCSV(&buf, items); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to build export"})
+		return
+	}
+
+	filename := fmt.Sprintf("echo-history-%s.%s", time.Now().UTC().Format("20060102"), format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(buf.Bytes())
+}
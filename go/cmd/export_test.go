@@ -0,0 +1,25 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+)
+
+func TestHistoryCSVNeutralizesFormulas(t *testing.T) {
+	var buf bytes.Buffer
+	items := []HistoryItem{{Question: "=HYPERLINK(\"http://evil\")", Answer: "-1+2", Note: "@SUM(A1)", Labels: []string{"+x"}}}
+	if err := writeHistoryCSV(&buf, items); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := rows[1]
+	for _, cell := range []string{row[1], row[2], row[9], row[10]} {
+		if cell == "" || cell[0] != '\'' {
+			t.Errorf("cell %q is not neutralized", cell)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FAQ packs are curated question/answer sets with embeddings, imported by
+// support teams as authoritative answers. Their entries sit in the shared
+// tier of the tenant but are indexed in a partition of their own: a lookup
+// serves an FAQ entry at ECHO_FAQ_THRESHOLD (default 0.85) rather than the
+// usual hit threshold, and prefers it over an ordinary entry scoring up to
+// ECHO_FAQ_TIE_MARGIN higher. FAQ entries are pinned, skip confidence
+// scoring, and are replaced as a whole when their pack is imported again.
+
+const (
+	cacheSourceFAQ = "FAQ"
+
+	// faqIndexOwner is the index partition owner of authoritative entries.
+	faqIndexOwner = "\x01faq"
+)
+
+type FAQItem struct {
+	Question string    `json:"question"`
+	Answer   string    `json:"answer"`
+	Vector   []float32 `json:"vector"`
+	Language string    `json:"language,omitempty"`
+}
+
+type FAQPack struct {
+	Name           string    `json:"name"`
+	EmbeddingModel string    `json:"embeddingModel,omitempty"`
+	Style          string    `json:"style,omitempty"`
+	Items          []FAQItem `json:"items"`
+}
+
+type FAQPackSummary struct {
+	Name       string    `json:"name"`
+	Entries    int       `json:"entries"`
+	ImportedAt time.Time `json:"importedAt"`
+}
+
+func faqThreshold() float64 {
+	return envFloat("ECHO_FAQ_THRESHOLD", 0.85)
+}
+
+// indexOwner is the owner entry is indexed under.
+func indexOwner(entry VectorEntry) string {
+	if entry.Authoritative {
+		return faqIndexOwner
+	}
+	return entry.Owner
+}
+
+// preferFAQ reports whether an FAQ candidate beats the ordinary best match.
+func preferFAQ(faqPos int, faqScore, bestScore float64) bool {
+	return faqPos >= 0 && faqScore >= faqThreshold() && faqScore >= bestScore-envFloat("ECHO_FAQ_TIE_MARGIN", 0.02)
+}
+
+// faqEntries validates pack and turns it into entries for tenant.
+func faqEntries(tenant string, pack FAQPack) ([]VectorEntry, string) {
+	pack.Name = strings.TrimSpace(pack.Name)
+	if !userIDPattern.MatchString(pack.Name) {
+		return nil, "invalid pack name"
+	}
+	if len(pack.Items) == 0 {
+		return nil, "items are required"
+	}
+	embeddingModel, ok := resolveEmbeddingModel(pack.EmbeddingModel)
+	if !ok {
+		return nil, "invalid embedding model"
+	}
+	style, ok := normalizeStyle(pack.Style)
+	if !ok {
+		return nil, "style must be full, concise or bullet"
+	}
+
+	now := time.Now()
+	entries := make([]VectorEntry, 0, len(pack.Items))
+	for _, item := range pack.Items {
+		if strings.TrimSpace(item.Question) == "" || strings.TrimSpace(item.Answer) == "" || len(item.Vector) == 0 {
+			return nil, "every item needs a question, an answer and a vector"
+		}
+		if len(item.Vector) != len(pack.Items[0].Vector) {
+			return nil, "all vectors must have the same dimension"
+		}
+		language := item.Language
+		if language == "" {
+			language = detectLanguage(item.Question)
+		}
+		entry := VectorEntry{
+			ID:             newID(),
+			Vector:         reduceVector(item.Vector),
+			Answer:         item.Answer,
+			Question:       item.Question,
+			CreatedAt:      now,
+			Source:         cacheSourceFAQ,
+			Tenant:         tenant,
+			Owner:          sharedOwner,
+			EmbeddingModel: embeddingModel,
+			Language:       language,
+			Style:          style,
+			Pinned:         true,
+			Authoritative:  true,
+			FAQPack:        pack.Name,
+		}
+		compressEntryAnswer(&entry)
+		entries = append(entries, entry)
+	}
+	return entries, ""
+}
+
+// importFAQPack replaces the tenant's entries of the pack, and any ordinary
+// shared entries for the same questions, with entries. It returns how many
+// entries were replaced.
+func importFAQPack(tenant, name string, entries []VectorEntry) int {
+	questions := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		questions[entryKey(tenant, sharedOwner, entry.Question)] = struct{}{}
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	replaced := removeEntriesLocked(func(entry VectorEntry) bool {
+		if entry.Tenant != tenant {
+			return false
+		}
+		_, sameQuestion := questions[entryKey(entry.Tenant, entry.Owner, entry.Question)]
+		return entry.FAQPack == name || sameQuestion
+	})
+	for _, entry := range entries {
+		cacheSeq++
+		entry.Seq = cacheSeq
+		MockVectorDB = append(MockVectorDB, entry)
+		indexAppendLocked(len(MockVectorDB) - 1)
+		recordCacheChange(changeCreated, entry)
+	}
+	markCacheChanged()
+	enforceHotTierLocked()
+	return replaced
+}
+
+// removeEntriesLocked drops hot-tier entries matching remove and returns how
+// many were dropped. The caller holds dbMutex for writing.
+func removeEntriesLocked(remove func(VectorEntry) bool) int {
+	kept := MockVectorDB[:0]
+	for _, entry := range MockVectorDB {
+		if !remove(entry) {
+			kept = append(kept, entry)
+			continue
+		}
+		recordCacheChange(changeDeleted, entry)
+	}
+	removed := len(MockVectorDB) - len(kept)
+	MockVectorDB = kept
+	if removed > 0 {
+		invalidateIndexLocked()
+		markCacheChanged()
+	}
+	return removed
+}
+
+// handleFAQPacks lists the tenant's FAQ packs (GET) or imports one (POST).
+func handleFAQPacks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	tenant, err := resolveTenant(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var pack FAQPack
+		if err := json.NewDecoder(r.Body).Decode(&pack); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON payload"})
+			return
+		}
+		entries, problem := faqEntries(tenant, pack)
+		if problem != "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": problem})
+			return
+		}
+		name := entries[0].FAQPack
+		snapshot, ok := snapshotBefore(w, tenant, "faq.import")
+		if !ok {
+			return
+		}
+		replaced := importFAQPack(tenant, name, entries)
+		recordAudit(AuditEvent{
+			Action:  "faq.import",
+			Tenant:  tenant,
+			Actor:   "admin",
+			Details: withSnapshot(map[string]string{"pack": name, "entries": strconv.Itoa(len(entries)), "replaced": strconv.Itoa(replaced)}, snapshot),
+		})
+		writeJSON(w, http.StatusOK, FAQPackSummary{Name: name, Entries: len(entries), ImportedAt: entries[0].CreatedAt})
+		return
+	}
+
+	packs := make(map[string]*FAQPackSummary)
+	dbMutex.RLock()
+	for _, entry := range MockVectorDB {
+		if entry.Tenant != tenant || !entry.Authoritative {
+			continue
+		}
+		summary, ok := packs[entry.FAQPack]
+		if !ok {
+			summary = &FAQPackSummary{Name: entry.FAQPack, ImportedAt: entry.CreatedAt}
+			packs[entry.FAQPack] = summary
+		}
+		summary.Entries++
+	}
+	dbMutex.RUnlock()
+
+	summaries := make([]FAQPackSummary, 0, len(packs))
+	for _, summary := range packs {
+		summaries = append(summaries, *summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Name < summaries[j].Name })
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+// handleDeleteFAQPack removes every entry of a pack from the tenant's cache.
+func handleDeleteFAQPack(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	tenant, err := resolveTenant(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	name := r.PathValue("name")
+	inPack := func(entry VectorEntry) bool {
+		return entry.Tenant == tenant && entry.Authoritative && entry.FAQPack == name
+	}
+	dbMutex.RLock()
+	found := slices.ContainsFunc(MockVectorDB, inPack)
+	dbMutex.RUnlock()
+	if !found {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "FAQ pack not found"})
+		return
+	}
+	snapshot, ok := snapshotBefore(w, tenant, "faq.delete")
+	if !ok {
+		return
+	}
+	dbMutex.Lock()
+	removeEntriesLocked(inPack)
+	dbMutex.Unlock()
+	recordAudit(AuditEvent{Action: "faq.delete", Tenant: tenant, Actor: "admin", Details: withSnapshot(map[string]string{"pack": name}, snapshot)})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Feature flags gate risky cache behaviors so they can be rolled out per
+// tenant or to a percentage of traffic. Flags come from ECHO_FEATURE_FLAGS
+// (inline JSON) or ECHO_FEATURE_FLAGS_URL (remote JSON, refreshed every
+// ECHO_FEATURE_FLAGS_REFRESH), keyed by flag name:
+//
+//	{"rerank": {"enabled": true, "tenants": ["acme"], "percentage": 10}}
+//
+// A flag is on for a caller when it is enabled and either the caller's tenant
+// is listed or the caller falls inside the rollout percentage. Bucketing
+// hashes the flag name with the tenant and user, so a caller keeps the same
+// answer across requests.
+//
+// Flags in use:
+//
+//	hedging       re-sending slow provider calls (latency.go); on when unset
+//	prompt_cache  the exact-prompt layer (promptcache.go); on when unset
+
+type FeatureFlag struct {
+	Enabled    bool     `json:"enabled"`
+	Tenants    []string `json:"tenants,omitempty"`
+	Percentage float64  `json:"percentage"`
+}
+
+var (
+	flagsMutex sync.RWMutex
+	flags      map[string]FeatureFlag
+)
+
+func parseFeatureFlags(data []byte) (map[string]FeatureFlag, error) {
+	var parsed map[string]FeatureFlag
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+func setFeatureFlags(parsed map[string]FeatureFlag) {
+	flagsMutex.Lock()
+	flags = parsed
+	flagsMutex.Unlock()
+}
+
+func fetchFeatureFlags(url string) (map[string]FeatureFlag, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseFeatureFlags(data)
+}
+
+// initFeatureFlags loads the inline flags and, when a URL is configured,
+// keeps refreshing them from it. A failed refresh keeps the last good set.
+func initFeatureFlags() {
+	if raw := envString("ECHO_FEATURE_FLAGS", ""); raw != "" {
+		parsed, err := parseFeatureFlags([]byte(raw))
+		if err != nil {
+			log.Printf("Invalid ECHO_FEATURE_FLAGS: %v", err)
+		} else {
+			setFeatureFlags(parsed)
+		}
+	}
+
+	url := envString("ECHO_FEATURE_FLAGS_URL", "")
+	if url == "" {
+		return
+	}
+	refresh := func() {
+		parsed, err := fetchFeatureFlags(url)
+		if err != nil {
+			log.Printf("Feature flag refresh failed: %v", err)
+			return
+		}
+		setFeatureFlags(parsed)
+	}
+	refresh()
+
+	ticker := time.NewTicker(envDuration("ECHO_FEATURE_FLAGS_REFRESH", time.Minute))
+	go func() {
+		defer ticker.Stop()
+		for range ticker.C {
+			refresh()
+		}
+	}()
+}
+
+func rolloutBucket(name string, caller Caller) float64 {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(name + "\x00" + caller.Tenant + "\x00" + caller.User))
+	return float64(hash.Sum32()%10000) / 100
+}
+
+// featureEnabled reports whether flag name is on for caller. Unknown flags
+// are off.
+func featureEnabled(name string, caller Caller) bool {
+	flagsMutex.RLock()
+	flag, ok := flags[name]
+	flagsMutex.RUnlock()
+	if !ok || !flag.Enabled {
+		return false
+	}
+	if slices.Contains(flag.Tenants, caller.Tenant) {
+		return true
+	}
+	return rolloutBucket(name, caller) < flag.Percentage
+}
+
+// featureEnabledOr is featureEnabled for a flag gating behavior that already
+// exists: until a flag named name is configured, the behavior keeps fallback.
+func featureEnabledOr(name string, caller Caller, fallback bool) bool {
+	flagsMutex.RLock()
+	_, ok := flags[name]
+	flagsMutex.RUnlock()
+	if !ok {
+		return fallback
+	}
+	return featureEnabled(name, caller)
+}
+
+type FlagView struct {
+	Name string `json:"name"`
+	FeatureFlag
+	// Active is the flag's value for the tenant and user in the query.
+	Active bool `json:"active"`
+}
+
+// handleFeatureFlags lists flags and how they evaluate for ?tenant=&user=.
+func handleFeatureFlags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	caller := Caller{Tenant: r.URL.Query().Get("tenant"), User: r.URL.Query().Get("user")}
+	flagsMutex.RLock()
+	views := make([]FlagView, 0, len(flags))
+	for name, flag := range flags {
+		views = append(views, FlagView{Name: name, FeatureFlag: flag})
+	}
+	flagsMutex.RUnlock()
+
+	sort.Slice(views, func(i, j int) bool { return views[i].Name < views[j].Name })
+	for i := range views {
+		views[i].Active = featureEnabled(views[i].Name, caller)
+	}
+	writeJSON(w, http.StatusOK, views)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"time"
+)
+
+// The forecast projects a tenant's end-of-month spend and savings from its
+// metering records. Month-to-date totals are actual; the rest of the month
+// assumes the request rate seen over ECHO_FORECAST_WINDOW (default seven
+// days) and a hit rate that keeps following its daily trend over that window.
+// It only sees the records still retained (ECHO_METERING_MAX_RECORDS), so a
+// busy tenant's month-to-date figures can undercount.
+
+type ForecastTotals struct {
+	Requests      int     `json:"requests"`
+	CacheHits     int     `json:"cacheHits"`
+	CloudTokens   int     `json:"cloudTokens"`
+	CostUSD       float64 `json:"costUsd"`
+	TokensSaved   int     `json:"tokensSaved"`
+	USDSaved      float64 `json:"usdSaved"`
+	EnergySavedWh float64 `json:"energySavedWh"`
+	CO2SavedG     float64 `json:"co2SavedG"`
+}
+
+type Forecast struct {
+	Period      string    `json:"period"`
+	GeneratedAt time.Time `json:"generatedAt"`
+	PeriodEnd   time.Time `json:"periodEnd"`
+	WindowHours float64   `json:"windowHours"`
+	// RequestsPerDay and HitRate describe the window; HitRateTrendPerDay is
+	// the fitted daily change in hit rate, and ProjectedHitRate the hit rate
+	// assumed for the rest of the month.
+	RequestsPerDay     float64        `json:"requestsPerDay"`
+	HitRate            float64        `json:"hitRate"`
+	HitRateTrendPerDay float64        `json:"hitRateTrendPerDay"`
+	ProjectedHitRate   float64        `json:"projectedHitRate"`
+	MonthToDate        ForecastTotals `json:"monthToDate"`
+	EndOfMonth         ForecastTotals `json:"endOfMonth"`
+}
+
+func (t *ForecastTotals) add(record MeteringRecord) {
+	t.Requests++
+	t.CloudTokens += record.CloudTokens
+	t.CostUSD += float64(record.CloudTokens) / 1000 * usdPer1KTokens(record.Model)
+	if record.Source == "CACHE" {
+		t.CacheHits++
+		t.TokensSaved += record.TokensSaved
+		t.USDSaved += float64(record.TokensSaved) / 1000 * usdPer1KTokens(record.Model)
+		kWh := float64(record.TokensSaved) / 1000 * kWhPer1KTokens(record.Model)
+		t.EnergySavedWh += kWh * 1000
+		t.CO2SavedG += kWh * gridCO2gPerKWh
+	}
+}
+
+// hitRateTrend fits a least-squares line through the daily hit rates of the
+// days that saw traffic and returns its slope per day.
+func hitRateTrend(days []ForecastTotals) float64 {
+	var n, sumX, sumY, sumXY, sumXX float64
+	for x, day := range days {
+		if day.Requests == 0 {
+			continue
+		}
+		y := float64(day.CacheHits) / float64(day.Requests)
+		n++
+		sumX += float64(x)
+		sumY += y
+		sumXY += float64(x) * y
+		sumXX += float64(x) * float64(x)
+	}
+	denominator := n*sumXX - sumX*sumX
+	if n < 2 || denominator == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
+
+func tenantForecast(tenant string, now time.Time) Forecast {
+	window := envDuration("ECHO_FORECAST_WINDOW", 7*24*time.Hour)
+	monthStart := time.Date(now.UTC().Year(), now.UTC().Month(), 1, 0, 0, 0, 0, time.UTC)
+	periodEnd := nextMonth(now)
+	windowStart := now.Add(-window)
+
+	var monthToDate, recent ForecastTotals
+	days := make([]ForecastTotals, int(math.Ceil(window.Hours()/24)))
+	earliest := now
+	usageMutex.Lock()
+	for _, record := range meteringRecords {
+		if record.Tenant != tenant {
+			continue
+		}
+		if !record.Timestamp.Before(monthStart) {
+			monthToDate.add(record)
+		}
+		if record.Timestamp.After(windowStart) {
+			recent.add(record)
+			day := min(int(record.Timestamp.Sub(windowStart).Hours()/24), len(days)-1)
+			days[day].add(record)
+			if record.Timestamp.Before(earliest) {
+				earliest = record.Timestamp
+			}
+		}
+	}
+	usageMutex.Unlock()
+
+	forecast := Forecast{
+		Period:      billingPeriod(now),
+		GeneratedAt: now,
+		PeriodEnd:   periodEnd,
+		WindowHours: window.Hours(),
+		MonthToDate: monthToDate,
+		EndOfMonth:  monthToDate,
+	}
+	if recent.Requests == 0 {
+		return forecast
+	}
+
+	// A freshly started server has not seen the whole window; rate over
+	// what it has seen, but at least an hour so one burst does not dominate.
+	observed := max(now.Sub(earliest), time.Hour)
+	forecast.RequestsPerDay = float64(recent.Requests) / observed.Hours() * 24
+	forecast.HitRate = float64(recent.CacheHits) / float64(recent.Requests)
+	forecast.HitRateTrendPerDay = hitRateTrend(days)
+	remainingDays := periodEnd.Sub(now).Hours() / 24
+	forecast.ProjectedHitRate = min(max(forecast.HitRate+forecast.HitRateTrendPerDay*remainingDays/2, 0), 1)
+
+	requests := forecast.RequestsPerDay * remainingDays
+	hits := requests * forecast.ProjectedHitRate
+	misses := requests - hits
+	perHit := func(v float64) float64 { return v / float64(max(recent.CacheHits, 1)) }
+	perMiss := func(v float64) float64 { return v / float64(max(recent.Requests-recent.CacheHits, 1)) }
+
+	end := &forecast.EndOfMonth
+	end.Requests += int(math.Round(requests))
+	end.CacheHits += int(math.Round(hits))
+	end.CloudTokens += int(math.Round(misses * perMiss(float64(recent.CloudTokens))))
+	end.CostUSD += misses * perMiss(recent.CostUSD)
+	end.TokensSaved += int(math.Round(hits * perHit(float64(recent.TokensSaved))))
+	end.USDSaved += hits * perHit(recent.USDSaved)
+	end.EnergySavedWh += hits * perHit(recent.EnergySavedWh)
+	end.CO2SavedG += hits * perHit(recent.CO2SavedG)
+	return forecast
+}
+
+// handleForecast serves GET /stats/forecast for the caller's tenant.
+func handleForecast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if rejectAnonymous(w, caller, "the forecast") {
+		return
+	}
+	writeJSON(w, http.StatusOK, tenantForecast(caller.Tenant, time.Now()))
+}
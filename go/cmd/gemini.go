@@ -2,43 +2,117 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"os"
+	"slices"
 	"strings"
 
 	"github.com/google/generative-ai-go/genai"
 	"google.golang.org/api/option"
 )
 
-func resolveGeminiModel(requested string) string {
+const (
+	defaultGeminiModel          = "gemini-2.5-flash-lite"
+	defaultGeminiEmbeddingModel = "text-embedding-004"
+	// geminiEmbedBatchSize is the most texts one batch embed call accepts.
+	geminiEmbedBatchSize = 100
+)
+
+// supportedModels maps each model a request may name to the provider that
+// serves it.
+var supportedModels = map[string]string{
+	"gemini-2.5-flash-lite": providerGemini,
+	"gemini-2.5-flash":      providerGemini,
+	"gpt-4o-mini":           providerOpenAI,
+	"gpt-4o":                providerOpenAI,
+	"gpt-4.1-mini":          providerOpenAI,
+	"gpt-4.1-nano":          providerOpenAI,
+}
+
+// ModelPolicy restricts which models a tenant may use and which one is used
+// when a request does not name one.
+type ModelPolicy struct {
+	Allowed []string `json:"allowed"`
+	Default string   `json:"default"`
+}
+
+var errModelNotAllowed = errors.New("model not allowed for tenant")
+
+// modelPolicies holds ECHO_TENANT_MODEL_POLICIES by tenant, read once by
+// initModelPolicies.
+var modelPolicies map[string]ModelPolicy
+
+// initModelPolicies parses ECHO_TENANT_MODEL_POLICIES, a JSON object keyed by
+// tenant id ("@default" for the default tenant).
+func initModelPolicies() {
+	raw := envString("ECHO_TENANT_MODEL_POLICIES", "")
+	if raw == "" {
+		return
+	}
+	var parsed map[string]ModelPolicy
+	if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+		log.Printf("Invalid ECHO_TENANT_MODEL_POLICIES: %v", err)
+		return
+	}
+	modelPolicies = make(map[string]ModelPolicy, len(parsed))
+	for name, policy := range parsed {
+		modelPolicies[tenantFromName(name)] = policy
+	}
+}
+
+func tenantModelPolicy(tenant string) (ModelPolicy, bool) {
+	policy, ok := modelPolicies[tenant]
+	return policy, ok
+}
+
+// resolveModel picks the model for a request. Unknown model names fall back
+// to the default, while a known model outside the tenant's allowlist is
+// rejected so per-team cost controls cannot be bypassed.
+func resolveModel(tenant, requested string) (string, error) {
 	requested = strings.TrimSpace(requested)
-	allowed := map[string]struct{}{
-		"gemini-2.5-flash-lite": {},
-		"gemini-2.5-flash":      {},
+	policy, hasPolicy := tenantModelPolicy(tenant)
+
+	fallback := defaultModel()
+	if hasPolicy {
+		if _, ok := supportedModels[policy.Default]; ok {
+			fallback = policy.Default
+		} else if len(policy.Allowed) > 0 {
+			fallback = policy.Allowed[0]
+		}
+	}
+
+	model := fallback
+	if _, ok := supportedModels[requested]; ok {
+		model = requested
 	}
-	if _, ok := allowed[requested]; ok {
-		return requested
+	if hasPolicy && len(policy.Allowed) > 0 && !slices.Contains(policy.Allowed, model) {
+		return "", errModelNotAllowed
 	}
-	return "gemini-2.5-flash-lite"
+	return model, nil
 }
 
-func callGemini(ctx context.Context, prompt string, modelName string) (string, error) {
+func callGemini(ctx context.Context, prompt string, modelName string) (string, providerUsage, error) {
 	apiKey := os.Getenv("GEMINI_API_KEY")
 	if apiKey == "" {
-		return "", errors.New("GEMINI_API_KEY is not set")
+		return "", providerUsage{}, errors.New("GEMINI_API_KEY is not set")
 	}
 
 	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
 	if err != nil {
-		return "", fmt.Errorf("create Gemini client: %w", err)
+		return "", providerUsage{}, fmt.Errorf("create Gemini client: %w", err)
 	}
 	defer client.Close()
 
 	model := client.GenerativeModel(modelName)
+	if temperature, ok := temperatureFrom(ctx); ok {
+		model.SetTemperature(float32(temperature))
+	}
 	resp, err := model.GenerateContent(ctx, genai.Text(prompt))
 	if err != nil {
-		return "", fmt.Errorf("Gemini generate content: %w", err)
+		return "", providerUsage{}, fmt.Errorf("Gemini generate content: %w", err)
 	}
 
 	var answerBuilder strings.Builder
@@ -55,8 +129,65 @@ func callGemini(ctx context.Context, prompt string, modelName string) (string, e
 
 	answer := strings.TrimSpace(answerBuilder.String())
 	if answer == "" {
-		return "", errors.New("Gemini returned empty response")
+		return "", providerUsage{}, errors.New("Gemini returned empty response")
+	}
+
+	var usage providerUsage
+	if resp.UsageMetadata != nil {
+		usage = providerUsage{PromptTokens: int(resp.UsageMetadata.PromptTokenCount), AnswerTokens: int(resp.UsageMetadata.CandidatesTokenCount)}
 	}
+	return answer, usage, nil
+}
 
-	return answer, nil
+func embedGemini(ctx context.Context, texts []string, modelName string) ([][]float32, error) {
+	apiKey := os.Getenv("GEMINI_API_KEY")
+	if apiKey == "" {
+		return nil, errors.New("GEMINI_API_KEY is not set")
+	}
+
+	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
+	if err != nil {
+		return nil, fmt.Errorf("create Gemini client: %w", err)
+	}
+	defer client.Close()
+
+	model := client.EmbeddingModel(modelName)
+	vectors := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += geminiEmbedBatchSize {
+		batch := model.NewBatch()
+		for _, text := range texts[start:min(start+geminiEmbedBatchSize, len(texts))] {
+			batch.AddContent(genai.Text(text))
+		}
+		resp, err := model.BatchEmbedContents(ctx, batch)
+		if err != nil {
+			return nil, fmt.Errorf("Gemini batch embed: %w", err)
+		}
+		for _, embedding := range resp.Embeddings {
+			vectors = append(vectors, embedding.Values)
+		}
+	}
+	if len(vectors) != len(texts) {
+		return nil, fmt.Errorf("Gemini returned %d embeddings for %d texts", len(vectors), len(texts))
+	}
+	return vectors, nil
+}
+
+// checkGeminiModel confirms the API key is accepted and modelName exists.
+func checkGeminiModel(ctx context.Context, modelName string) error {
+	apiKey := os.Getenv("GEMINI_API_KEY")
+	if apiKey == "" {
+		return errors.New("GEMINI_API_KEY is not set")
+	}
+
+	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
+	if err != nil {
+		return fmt.Errorf("create Gemini client: %w", err)
+	}
+	defer client.Close()
+
+	if _, err := client.GenerativeModel(modelName).Info(ctx); err != nil {
+		// Transport errors quote the request URL, which carries the key.
+		return fmt.Errorf("Gemini model %s: %s", modelName, strings.ReplaceAll(err.Error(), apiKey, "REDACTED"))
+	}
+	return nil
 }
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"cmp"
+	"container/heap"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Replication lets echo replicas exchange newly cached entries directly,
+// without S3 in the path. Every node serves a small gRPC service and pulls
+// entries it has not seen yet from its configured peers on an interval. The
+// same service carries shard lookups and stores; see sharding.go.
+//
+// Every call carries ECHO_GOSSIP_TOKEN, a secret shared by all peers, and the
+// server rejects calls without it; a node without a token does not serve.
+
+const (
+	cacheSourcePeer       = "PEER"
+	replicationService    = "echo.Replication"
+	replicationPullMethod = "/echo.Replication/Pull"
+	replicationBatchSize  = 500
+	peerTokenMetadata     = "x-echo-peer-token"
+)
+
+var (
+	nodeID    string
+	nodeEpoch = time.Now().UnixNano()
+	// replicationGRPCServer is stopped when handing off to a new binary.
+	replicationGRPCServer *grpc.Server
+)
+
+type PullRequest struct {
+	Since uint64 `json:"since"`
+	Node  string `json:"node"`
+}
+
+type PullResponse struct {
+	Node    string        `json:"node"`
+	Epoch   int64         `json:"epoch"`
+	Cursor  uint64        `json:"cursor"`
+	Entries []VectorEntry `json:"entries"`
+}
+
+type replicationServer interface {
+	Pull(ctx context.Context, req *PullRequest) (*PullResponse, error)
+}
+
+// jsonCodec keeps the replication wire format in plain JSON, the same
+// encoding used for the S3 cache object, so no generated protobufs are needed.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                       { return "json" }
+
+var replicationServiceDesc = grpc.ServiceDesc{
+	ServiceName: replicationService,
+	HandlerType: (*replicationServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Pull", Handler: pullHandler},
+		{MethodName: "Lookup", Handler: unaryMethod(shardLookupMethod, replicationNode.Lookup)},
+		{MethodName: "Store", Handler: unaryMethod(shardStoreMethod, replicationNode.Store)},
+		{MethodName: "Ping", Handler: unaryMethod(shardPingMethod, replicationNode.Ping)},
+	},
+}
+
+func pullHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	req := new(PullRequest)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(replicationServer).Pull(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: replicationPullMethod}
+	handler := func(ctx context.Context, req any) (any, error) {
+		return srv.(replicationServer).Pull(ctx, req.(*PullRequest))
+	}
+	return interceptor(ctx, req, info, handler)
+}
+
+type replicationNode struct{}
+
+func (replicationNode) Pull(_ context.Context, req *PullRequest) (*PullResponse, error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	// Seq need not follow slice order, so the batch is the lowest Seqs past
+	// the cursor. A bounded heap finds them in one pass without copying or
+	// sorting the whole tail.
+	batch := make(seqHeap, 0, replicationBatchSize)
+	for pos := range MockVectorDB {
+		seq := MockVectorDB[pos].Seq
+		switch {
+		case seq <= req.Since:
+		case len(batch) < replicationBatchSize:
+			heap.Push(&batch, pos)
+		case seq < MockVectorDB[batch[0]].Seq:
+			batch[0] = pos
+			heap.Fix(&batch, 0)
+		}
+	}
+	slices.SortFunc(batch, func(a, b int) int { return cmp.Compare(MockVectorDB[a].Seq, MockVectorDB[b].Seq) })
+
+	resp := &PullResponse{Node: nodeID, Epoch: nodeEpoch, Cursor: req.Since}
+	resp.Entries = make([]VectorEntry, len(batch))
+	for i, pos := range batch {
+		resp.Entries[i] = MockVectorDB[pos]
+	}
+	if len(batch) > 0 {
+		resp.Cursor = resp.Entries[len(batch)-1].Seq
+	}
+	return resp, nil
+}
+
+// seqHeap is a max-heap of MockVectorDB positions ordered by Seq; callers hold
+// dbMutex.
+type seqHeap []int
+
+func (h seqHeap) Len() int           { return len(h) }
+func (h seqHeap) Less(i, j int) bool { return MockVectorDB[h[i]].Seq > MockVectorDB[h[j]].Seq }
+func (h seqHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *seqHeap) Push(x any)        { *h = append(*h, x.(int)) }
+func (h *seqHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func peerToken() string {
+	return os.Getenv("ECHO_GOSSIP_TOKEN")
+}
+
+// requirePeerToken rejects calls that do not carry the shared peer token.
+func requirePeerToken(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	provided := ""
+	if values := md.Get(peerTokenMetadata); len(values) > 0 {
+		provided = values[0]
+	}
+	token := peerToken()
+	if token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+		return nil, status.Error(codes.Unauthenticated, "invalid peer token")
+	}
+	return handler(ctx, req)
+}
+
+// attachPeerToken sends the shared peer token with every outgoing call.
+func attachPeerToken(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx = metadata.AppendToOutgoingContext(ctx, peerTokenMetadata, peerToken())
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// dialPeer opens a connection to another echo node.
+func dialPeer(addr string) (*grpc.ClientConn, error) {
+	return grpc.NewClient(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(attachPeerToken),
+	)
+}
+
+func defaultNodeID() string {
+	if id := envString("ECHO_NODE_ID", ""); id != "" {
+		return id
+	}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return host
+	}
+	return "echo"
+}
+
+func startReplicationServer(addr string) error {
+	if peerToken() == "" {
+		return errors.New("ECHO_GOSSIP_TOKEN is not set")
+	}
+	listener, err := handoffListen("replication", addr)
+	if err != nil {
+		return err
+	}
+
+	server := grpc.NewServer(grpc.ForceServerCodec(jsonCodec{}), grpc.UnaryInterceptor(requirePeerToken))
+	server.RegisterService(&replicationServiceDesc, replicationNode{})
+	replicationGRPCServer = server
+
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Printf("Replication server stopped: %v", err)
+		}
+	}()
+	log.Printf("Replication listening on %s (node %s)", addr, nodeID)
+	return nil
+}
+
+type peerCursor struct {
+	epoch  int64
+	cursor uint64
+}
+
+func startGossip(peers []string, interval time.Duration) {
+	conns := make(map[string]*grpc.ClientConn, len(peers))
+	for _, peer := range peers {
+		conn, err := dialPeer(peer)
+		if err != nil {
+			log.Printf("Replication peer %s skipped: %v", peer, err)
+			continue
+		}
+		conns[peer] = conn
+	}
+	if len(conns) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	cursors := make(map[string]peerCursor, len(conns))
+
+	go func() {
+		defer ticker.Stop()
+		for range ticker.C {
+			for peer, conn := range conns {
+				cursors[peer] = pullFromPeer(peer, conn, cursors[peer])
+			}
+		}
+	}()
+}
+
+// pullFromPeer drains every entry the peer added since the last cursor. A
+// changed epoch means the peer restarted and renumbered, so we start over.
+func pullFromPeer(peer string, conn *grpc.ClientConn, state peerCursor) peerCursor {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	newEntries := 0
+	for {
+		var resp PullResponse
+		err := conn.Invoke(ctx, replicationPullMethod, &PullRequest{Since: state.cursor, Node: nodeID}, &resp, grpc.ForceCodec(jsonCodec{}))
+		if err != nil {
+			log.Printf("Replication pull from %s failed: %v", peer, err)
+			break
+		}
+		if resp.Epoch != state.epoch {
+			restarted := state.cursor != 0
+			state = peerCursor{epoch: resp.Epoch}
+			if restarted {
+				log.Printf("Replication peer %s restarted; resyncing", peer)
+				continue
+			}
+		}
+
+		newEntries += mergeEntries(ownedEntries(resp.Entries), cacheSourcePeer)
+		state.cursor = resp.Cursor
+		if len(resp.Entries) < replicationBatchSize {
+			break
+		}
+	}
+
+	if newEntries > 0 {
+		log.Printf("Replicated: %d new entries from %s.", newEntries, peer)
+	}
+	return state
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Grafana's simple JSON datasource contract, served under /grafana/, charts
+// the caller's tenant history bucketed by the panel interval.
+
+var grafanaMetrics = []string{
+	"requests",
+	"cache_hits",
+	"hit_rate",
+	"tokens_saved",
+	"energy_saved_wh",
+	"co2_saved_g",
+	"usd_saved",
+}
+
+type GrafanaQueryRequest struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	IntervalMs int64 `json:"intervalMs"`
+	Targets    []struct {
+		Target string `json:"target"`
+	} `json:"targets"`
+}
+
+type GrafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+type grafanaBucket struct {
+	requests    int
+	hits        int
+	tokensSaved int
+	energyWh    float64
+	co2g        float64
+	usd         float64
+}
+
+func (b grafanaBucket) value(metric string) float64 {
+	switch metric {
+	case "requests":
+		return float64(b.requests)
+	case "cache_hits":
+		return float64(b.hits)
+	case "hit_rate":
+		if b.requests == 0 {
+			return 0
+		}
+		return float64(b.hits) / float64(b.requests)
+	case "tokens_saved":
+		return float64(b.tokensSaved)
+	case "energy_saved_wh":
+		return b.energyWh
+	case "co2_saved_g":
+		return b.co2g
+	case "usd_saved":
+		return b.usd
+	}
+	return 0
+}
+
+// handleGrafanaTest answers the datasource's connection test.
+func handleGrafanaTest(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authenticate(w, r); !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func handleGrafanaSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if _, ok := authenticate(w, r); !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, grafanaMetrics)
+}
+
+func handleGrafanaQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if rejectAnonymous(w, caller, "the Grafana datasource") {
+		return
+	}
+
+	var req GrafanaQueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return
+	}
+	if req.Range.To.IsZero() {
+		req.Range.To = time.Now()
+	}
+	if req.Range.From.IsZero() {
+		req.Range.From = req.Range.To.Add(-24 * time.Hour)
+	}
+	interval := time.Duration(req.IntervalMs) * time.Millisecond
+	if interval < time.Second {
+		interval = time.Minute
+	}
+
+	buckets := make(map[int64]*grafanaBucket)
+	dbMutex.RLock()
+	for _, item := range ChatHistory {
+		if !historyVisible(item, caller) || item.Timestamp.Before(req.Range.From) || item.Timestamp.After(req.Range.To) {
+			continue
+		}
+		start := item.Timestamp.Truncate(interval).UnixMilli()
+		bucket, ok := buckets[start]
+		if !ok {
+			bucket = &grafanaBucket{}
+			buckets[start] = bucket
+		}
+		bucket.requests++
+		if item.Saved {
+			bucket.hits++
+			bucket.tokensSaved += item.Tokens
+			bucket.energyWh += item.EnergyWh
+			bucket.co2g += item.CO2g
+			bucket.usd += float64(item.Tokens) / 1000.0 * usdPer1KTokens(item.Model)
+		}
+	}
+	dbMutex.RUnlock()
+
+	starts := make([]int64, 0, len(buckets))
+	for start := range buckets {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	series := make([]GrafanaSeries, 0, len(req.Targets))
+	for _, target := range req.Targets {
+		points := make([][2]float64, 0, len(starts))
+		for _, start := range starts {
+			points = append(points, [2]float64{buckets[start].value(target.Target), float64(start)})
+		}
+		series = append(series, GrafanaSeries{Target: target.Target, Datapoints: points})
+	}
+	writeJSON(w, http.StatusOK, series)
+}
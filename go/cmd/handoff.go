@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Zero-downtime binary reload. When ECHO_HANDOFF_SOCKET is set, a running
+// echo listens on that unix socket; it is off by default so that unrelated
+// instances on one host never take over each other's sockets, and each
+// deployment needs its own path. A new binary started with the same path
+// connects at startup and the old process passes over its listening sockets
+// (HTTP and replication) with SCM_RIGHTS, followed by a snapshot of the
+// cache, history and counters. The new process serves on the same sockets
+// without rebinding, skips the S3 download, and once it is ready tells the
+// old process, which stops accepting, drains in-flight requests for up to
+// ECHO_HANDOFF_DRAIN (default 30s), sends the entries and history it took in
+// since the snapshot and exits. The new process then listens on the handoff
+// socket for the next upgrade. If the new process dies before it is ready,
+// the old one keeps serving.
+//
+// Hit counts and feedback recorded by the old process after the snapshot
+// are not carried over.
+
+type handoffRequest struct {
+	PID int
+}
+
+type handoffSnapshot struct {
+	PID int
+	// Listeners names the sockets passed alongside, in order.
+	Listeners []string
+	Entries   []VectorEntry
+	History   []HistoryItem
+	Savings   map[string]*SavingsSummary
+	Usage     map[string]*UsageCounters
+}
+
+type handoffReady struct{}
+
+type handoffDelta struct {
+	Entries []VectorEntry
+	History []HistoryItem
+}
+
+var (
+	// handoffMutex guards handoffListeners and inheritedListeners.
+	handoffMutex       sync.Mutex
+	handoffListeners   = make(map[string]net.Listener)
+	inheritedListeners map[string]net.Listener
+	// handoffConn is the connection to the previous process while it drains.
+	handoffConn    *net.UnixConn
+	handoffEncoder *gob.Encoder
+	handoffDecoder *gob.Decoder
+	handoffFrom    int
+)
+
+func handoffSocket() string {
+	return envString("ECHO_HANDOFF_SOCKET", "")
+}
+
+// handedOff reports whether this process took over from a previous one.
+func handedOff() bool {
+	return handoffFrom != 0
+}
+
+// handoffListen returns the socket name inherited from the previous process,
+// or listens on addr, and registers the listener to be passed to the next.
+func handoffListen(name, addr string) (net.Listener, error) {
+	handoffMutex.Lock()
+	listener, ok := inheritedListeners[name]
+	delete(inheritedListeners, name)
+	handoffMutex.Unlock()
+	if !ok {
+		var err error
+		if listener, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	registerHandoffListener(name, listener)
+	return listener, nil
+}
+
+func registerHandoffListener(name string, listener net.Listener) {
+	handoffMutex.Lock()
+	handoffListeners[name] = listener
+	handoffMutex.Unlock()
+}
+
+// takeOver connects to a running echo and takes over its sockets and state.
+// It does nothing when none is running.
+func takeOver() {
+	path := handoffSocket()
+	if path == "" {
+		return
+	}
+	conn, err := net.DialTimeout("unix", path, 2*time.Second)
+	if err != nil {
+		return
+	}
+	step := beginStep("handoff")
+	uc := conn.(*net.UnixConn)
+	snapshot, err := receiveHandoff(uc)
+	if err != nil {
+		conn.Close()
+		step.failed(err, false)
+		return
+	}
+	handoffConn = uc
+	handoffEncoder = snapshot.encoder
+	handoffDecoder = snapshot.decoder
+	handoffFrom = snapshot.PID
+	adopted := adoptEntries(snapshot.Entries)
+
+	dbMutex.Lock()
+	ChatHistory = append(ChatHistory, snapshot.History...)
+	dbMutex.Unlock()
+	savingsMutex.Lock()
+	if snapshot.Savings != nil {
+		savingsByTenant = snapshot.Savings
+		for tenant := range snapshot.Savings {
+			savingsDirty[tenant]++
+		}
+	}
+	savingsMutex.Unlock()
+	usageMutex.Lock()
+	if snapshot.Usage != nil {
+		usageBySubject = snapshot.Usage
+		for subject := range snapshot.Usage {
+			usageDirty[subject]++
+		}
+	}
+	usageMutex.Unlock()
+
+	step.done("took over %s, %d entries and %d history items from pid %d", strings.Join(snapshot.Listeners, ", "), adopted, len(snapshot.History), snapshot.PID)
+}
+
+type receivedSnapshot struct {
+	handoffSnapshot
+	// The stream carries on after the snapshot, so the same encoder and
+	// decoder must be kept.
+	encoder *gob.Encoder
+	decoder *gob.Decoder
+}
+
+func receiveHandoff(conn *net.UnixConn) (*receivedSnapshot, error) {
+	conn.SetDeadline(time.Now().Add(envDuration("ECHO_HANDOFF_TIMEOUT", time.Minute)))
+	defer conn.SetDeadline(time.Time{})
+	encoder := gob.NewEncoder(conn)
+	if err := encoder.Encode(handoffRequest{PID: os.Getpid()}); err != nil {
+		return nil, fmt.Errorf("request handoff: %w", err)
+	}
+
+	// The sockets arrive attached to a single byte, read on its own so the
+	// snapshot that follows is not consumed with it.
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(8*4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, fmt.Errorf("receive sockets: %w", err)
+	}
+	var fds []int
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, fmt.Errorf("receive sockets: %w", err)
+	}
+	for _, message := range messages {
+		rights, err := syscall.ParseUnixRights(&message)
+		if err != nil {
+			return nil, fmt.Errorf("receive sockets: %w", err)
+		}
+		fds = append(fds, rights...)
+	}
+
+	decoder := gob.NewDecoder(conn)
+	var snapshot handoffSnapshot
+	if err := decoder.Decode(&snapshot); err != nil {
+		closeFds(fds)
+		return nil, fmt.Errorf("receive snapshot: %w", err)
+	}
+	if len(fds) != len(snapshot.Listeners) {
+		closeFds(fds)
+		return nil, fmt.Errorf("received %d sockets for %d listeners", len(fds), len(snapshot.Listeners))
+	}
+
+	inherited := make(map[string]net.Listener, len(fds))
+	for i, fd := range fds {
+		file := os.NewFile(uintptr(fd), "handoff-"+snapshot.Listeners[i])
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range inherited {
+				l.Close()
+			}
+			closeFds(fds[i+1:])
+			return nil, fmt.Errorf("inherit %s socket: %w", snapshot.Listeners[i], err)
+		}
+		inherited[snapshot.Listeners[i]] = listener
+	}
+	handoffMutex.Lock()
+	inheritedListeners = inherited
+	handoffMutex.Unlock()
+	return &receivedSnapshot{snapshot, encoder, decoder}, nil
+}
+
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
+
+// adoptEntries adds entries carried over from the previous process, keeping
+// their source, and skips questions already cached.
+func adoptEntries(entries []VectorEntry) int {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	existing := make(map[string]struct{}, len(MockVectorDB))
+	for _, entry := range MockVectorDB {
+		existing[entryKey(entry.Tenant, entry.Owner, entry.Question)] = struct{}{}
+	}
+	adopted := 0
+	for _, entry := range entries {
+		key := entryKey(entry.Tenant, entry.Owner, entry.Question)
+		if _, ok := existing[key]; ok {
+			continue
+		}
+		cacheSeq++
+		entry.Seq = cacheSeq
+		MockVectorDB = append(MockVectorDB, entry)
+		indexAppendLocked(len(MockVectorDB) - 1)
+		recordCacheChange(changeCreated, entry)
+		existing[key] = struct{}{}
+		adopted++
+	}
+	if adopted > 0 {
+		// The previous process may not have uploaded them yet.
+		markCacheChanged()
+	}
+	return adopted
+}
+
+// completeHandoff runs once this process is ready: it releases the previous
+// process, takes in what it wrote since the snapshot, then starts accepting
+// handoffs itself.
+func completeHandoff() {
+	if handoffConn == nil {
+		startHandoffServer()
+		return
+	}
+	go func() {
+		defer startHandoffServer()
+		defer handoffConn.Close()
+
+		if err := handoffEncoder.Encode(handoffReady{}); err != nil {
+			log.Printf("Handoff: releasing pid %d failed: %v", handoffFrom, err)
+			return
+		}
+		var delta handoffDelta
+		handoffConn.SetReadDeadline(time.Now().Add(envDuration("ECHO_HANDOFF_DRAIN", 30*time.Second) + time.Minute))
+		if err := handoffDecoder.Decode(&delta); err != nil {
+			log.Printf("Handoff: pid %d exited without its final writes: %v", handoffFrom, err)
+			return
+		}
+		adopted := adoptEntries(delta.Entries)
+		if !stateless() {
+			// The state store already holds them.
+			for i := range delta.History {
+				enqueueWrite(pendingWrite{history: &delta.History[i]})
+			}
+		}
+		log.Printf("Handoff: pid %d finished, %d more entries and %d history items", handoffFrom, adopted, len(delta.History))
+	}()
+}
+
+// startHandoffServer listens for a new binary taking over.
+func startHandoffServer() {
+	path := handoffSocket()
+	if path == "" {
+		return
+	}
+	// Nothing answered on the socket at startup, so a file left there is stale.
+	os.Remove(path)
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		log.Printf("Warning: handoff disabled: %v", err)
+		return
+	}
+	os.Chmod(path, 0o600)
+	log.Printf("Handoff socket listening on %s", path)
+	go func() {
+		for {
+			conn, err := listener.AcceptUnix()
+			if err != nil {
+				log.Printf("Handoff socket stopped: %v", err)
+				return
+			}
+			if err := handOff(conn); err != nil {
+				log.Printf("Handoff failed, still serving: %v", err)
+				conn.Close()
+				continue
+			}
+			listener.Close()
+			log.Printf("Handoff complete, exiting")
+			os.Exit(0)
+		}
+	}()
+}
+
+// handOff passes this process's sockets and state to the process on conn
+// and, once it is ready, drains and sends the writes made since.
+func handOff(conn *net.UnixConn) error {
+	conn.SetDeadline(time.Now().Add(envDuration("ECHO_HANDOFF_TIMEOUT", time.Minute)))
+	decoder := gob.NewDecoder(conn)
+	encoder := gob.NewEncoder(conn)
+	var request handoffRequest
+	if err := decoder.Decode(&request); err != nil {
+		return fmt.Errorf("read request: %w", err)
+	}
+	log.Printf("Handoff: pid %d is taking over", request.PID)
+
+	handoffMutex.Lock()
+	names := make([]string, 0, len(handoffListeners))
+	var fds []int
+	for name, listener := range handoffListeners {
+		filer, ok := listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+		file, err := filer.File()
+		if err != nil {
+			handoffMutex.Unlock()
+			return fmt.Errorf("pass %s socket: %w", name, err)
+		}
+		defer file.Close()
+		names = append(names, name)
+		fds = append(fds, int(file.Fd()))
+	}
+	handoffMutex.Unlock()
+	if _, _, err := conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(fds...), nil); err != nil {
+		return fmt.Errorf("pass sockets: %w", err)
+	}
+
+	flushWrites()
+	snapshot := handoffSnapshot{PID: os.Getpid(), Listeners: names}
+	dbMutex.RLock()
+	snapshot.Entries = append([]VectorEntry(nil), MockVectorDB...)
+	snapshot.History = append([]HistoryItem(nil), ChatHistory...)
+	snapshotSeq := cacheSeq
+	dbMutex.RUnlock()
+	snapshotHistory := make(map[string]struct{}, len(snapshot.History))
+	for _, item := range snapshot.History {
+		snapshotHistory[item.ID] = struct{}{}
+	}
+	savingsMutex.Lock()
+	snapshot.Savings = make(map[string]*SavingsSummary, len(savingsByTenant))
+	for tenant, summary := range savingsByTenant {
+		copied := *summary
+		snapshot.Savings[tenant] = &copied
+	}
+	savingsMutex.Unlock()
+	usageMutex.Lock()
+	snapshot.Usage = make(map[string]*UsageCounters, len(usageBySubject))
+	for subject, usage := range usageBySubject {
+		copied := *usage
+		snapshot.Usage[subject] = &copied
+	}
+	usageMutex.Unlock()
+	if err := encoder.Encode(snapshot); err != nil {
+		return fmt.Errorf("send snapshot: %w", err)
+	}
+
+	// The new process may take a while to become ready.
+	conn.SetDeadline(time.Time{})
+	var ready handoffReady
+	if err := decoder.Decode(&ready); err != nil {
+		return fmt.Errorf("pid %d did not become ready: %w", request.PID, err)
+	}
+
+	log.Printf("Handoff: pid %d is ready, draining", request.PID)
+	drainForHandoff(envDuration("ECHO_HANDOFF_DRAIN", 30*time.Second))
+	flushWrites()
+	flushEvents()
+	flushAudit()
+	flushColdTier()
+
+	var delta handoffDelta
+	dbMutex.RLock()
+	for _, entry := range MockVectorDB {
+		if entry.Seq > snapshotSeq {
+			delta.Entries = append(delta.Entries, entry)
+		}
+	}
+	for _, item := range ChatHistory {
+		if _, ok := snapshotHistory[item.ID]; !ok {
+			delta.History = append(delta.History, item)
+		}
+	}
+	dbMutex.RUnlock()
+	conn.SetDeadline(time.Now().Add(envDuration("ECHO_HANDOFF_TIMEOUT", time.Minute)))
+	if err := encoder.Encode(delta); err != nil {
+		// Past this point the new process serves all traffic.
+		log.Printf("Handoff: sending final writes failed: %v", err)
+	}
+	conn.Close()
+	return nil
+}
+
+// waitForShutdown blocks until SIGINT or SIGTERM, then drains in-flight
+// requests and applies the writes they queued before returning.
+func waitForShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("Received %v, shutting down", sig)
+	drainForHandoff(envDuration("ECHO_HANDOFF_DRAIN", 30*time.Second))
+	flushWrites()
+	flushEvents()
+	flushAudit()
+	flushColdTier()
+	if !stateless() {
+		if err := saveSavings(); err != nil {
+			log.Printf("Save savings counters failed: %v", err)
+		}
+		if err := saveUsage(); err != nil {
+			log.Printf("Save usage counters failed: %v", err)
+		}
+	}
+}
+
+// drainForHandoff stops accepting and waits for in-flight requests.
+func drainForHandoff(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	if replicationGRPCServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			replicationGRPCServer.GracefulStop()
+		}()
+	}
+	if httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			log.Printf("Handoff: HTTP shutdown: %v", err)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
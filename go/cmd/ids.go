@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IDs are ULIDs: a 48-bit millisecond timestamp and 80 random bits, written
+// as 26 characters of Crockford base32. They sort by creation time, so
+// clients can page and link objects by ID alone. IDs minted within the same
+// millisecond increment the random part to stay ordered. Objects created
+// before ULIDs keep their 24-character hex IDs.
+
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var (
+	idMutex      sync.Mutex
+	idLastMillis uint64
+	idLastRandom [10]byte
+)
+
+// newID returns a ULID for history items, cache entries, documents, audit
+// events and sessions.
+func newID() string {
+	millis := uint64(time.Now().UnixMilli())
+
+	idMutex.Lock()
+	switch {
+	case millis > idLastMillis:
+		fillRandom(&idLastRandom)
+	case incrementRandom(&idLastRandom):
+		millis = idLastMillis
+	default:
+		// The random part wrapped around: borrow the next millisecond.
+		millis = idLastMillis + 1
+		fillRandom(&idLastRandom)
+	}
+	idLastMillis = millis
+	random := idLastRandom
+	idMutex.Unlock()
+
+	var id [16]byte
+	for i := 0; i < 6; i++ {
+		id[i] = byte(millis >> (40 - 8*i))
+	}
+	copy(id[6:], random[:])
+	return encodeULID(id)
+}
+
+func fillRandom(b *[10]byte) {
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+}
+
+// incrementRandom adds one to b, reporting false when it wraps around.
+func incrementRandom(b *[10]byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeULID writes the 128 bits of id as 26 base32 digits, the first
+// holding only the top 3 bits.
+func encodeULID(id [16]byte) string {
+	var out [26]byte
+	var acc uint32
+	bits := 2 // 130 bits of output for 128 of input: pad two zero bits in front
+	pos := 0
+	for _, b := range id {
+		acc = acc<<8 | uint32(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out[pos] = crockfordAlphabet[(acc>>bits)&31]
+			pos++
+		}
+	}
+	return string(out[:])
+}
+
+// idTime returns when a ULID was minted, or false for any other ID.
+func idTime(id string) (time.Time, bool) {
+	if len(id) != 26 {
+		return time.Time{}, false
+	}
+	// The first 10 digits carry 50 bits: two zero pad bits and the 48-bit
+	// timestamp.
+	var millis uint64
+	for i := 0; i < 10; i++ {
+		digit := strings.IndexByte(crockfordAlphabet, id[i])
+		if digit < 0 {
+			return time.Time{}, false
+		}
+		millis = millis<<5 | uint64(digit)
+	}
+	return time.UnixMilli(int64(millis)).UTC(), true
+}
@@ -0,0 +1,590 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"log"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Similarity search goes through a vectorIndex per tenant, owner, embedding
+// model, answer style and question language so the search strategy can be
+// swapped with ECHO_VECTOR_INDEX:
+//
+//	flat           exact cosine scan (default, same results as before)
+//	flat-unrolled  exact scan over pre-normalized vectors with an unrolled
+//	               float32 dot product
+//	quantized      int8 scalar quantization, ~4x less memory, approximate
+//	hnsw           hierarchical navigable small world graph, approximate
+//
+// Indexes are built lazily from MockVectorDB. Appends are added in place;
+// anything that removes or reorders entries invalidates every index, which is
+// rebuilt on the next search.
+
+type vectorIndex interface {
+	// Add appends vector; its position is the number of vectors added before.
+	Add(vector []float32)
+	// Search returns the position of the most similar vector and its cosine
+	// similarity, or -1 when the index is empty. It stops early with the
+	// context's error once ctx is done.
+	Search(ctx context.Context, query []float32) (int, float64, error)
+}
+
+// cancelCheckInterval is how many vectors a scan compares between checks of
+// its context.
+const cancelCheckInterval = 1024
+
+var indexBuilders = map[string]func() vectorIndex{
+	"flat":          func() vectorIndex { return &flatIndex{} },
+	"flat-unrolled": func() vectorIndex { return &unrolledIndex{} },
+	"quantized":     func() vectorIndex { return &quantizedIndex{} },
+	"hnsw": func() vectorIndex {
+		return newHNSWIndex(envInt("ECHO_HNSW_M", 16), envInt("ECHO_HNSW_EF_CONSTRUCTION", 100), envInt("ECHO_HNSW_EF_SEARCH", 64))
+	},
+}
+
+type partitionIndex struct {
+	positions []int
+	index     vectorIndex
+	// projection reduces vectors under ECHO_VECTOR_REDUCTION=pca.
+	projection *pcaProjection
+}
+
+var (
+	// indexMutex guards partitionIndexes. dbMutex is always taken first, so
+	// MockVectorDB cannot change while an index is built or searched.
+	indexMutex sync.RWMutex
+	// partitionIndexes maps partitionKey to an index per language.
+	partitionIndexes map[partitionID]map[string]*partitionIndex
+	indexKind        string
+	// pcaProjections maps partitionKey to its fitted projection; they
+	// outlive index rebuilds.
+	pcaProjections map[partitionID]*pcaProjection
+)
+
+func vectorIndexKind() string {
+	kind := strings.ToLower(strings.TrimSpace(envString("ECHO_VECTOR_INDEX", "flat")))
+	if _, ok := indexBuilders[kind]; !ok {
+		log.Printf("Unknown ECHO_VECTOR_INDEX %q, using flat", kind)
+		return "flat"
+	}
+	return kind
+}
+
+// partitionID is a struct rather than a joined string so that looking a
+// partition up allocates nothing.
+type partitionID struct {
+	tenant, owner, model, style string
+}
+
+func partitionKey(tenant, owner, model, style string) partitionID {
+	return partitionID{tenant, owner, model, style}
+}
+
+// entryPartition is the partition entry is indexed in; see indexPartition.
+func entryPartition(entry VectorEntry) partitionID {
+	tenant, owner := indexPartition(entry)
+	return partitionKey(tenant, owner, entryEmbeddingModel(entry), entryStyle(entry))
+}
+
+// rebuildIndexesLocked requires indexMutex for writing and dbMutex held.
+func rebuildIndexesLocked() {
+	indexKind = vectorIndexKind()
+	partitionIndexes = make(map[partitionID]map[string]*partitionIndex)
+	fitProjectionsLocked()
+	for i := range MockVectorDB {
+		addToIndexLocked(i)
+	}
+}
+
+func addToIndexLocked(pos int) {
+	entry := MockVectorDB[pos]
+	key := entryPartition(entry)
+	languages, ok := partitionIndexes[key]
+	if !ok {
+		languages = make(map[string]*partitionIndex)
+		partitionIndexes[key] = languages
+	}
+	language := entryLanguage(entry)
+	partition, ok := languages[language]
+	if !ok {
+		partition = &partitionIndex{index: indexBuilders[indexKind](), projection: pcaProjections[key]}
+		languages[language] = partition
+	}
+	partition.positions = append(partition.positions, pos)
+	partition.index.Add(partition.projection.apply(entry.Vector))
+	// Paraphrases point at the same entry, so matching one is a hit on it.
+	for _, paraphrase := range entry.Paraphrases {
+		partition.positions = append(partition.positions, pos)
+		partition.index.Add(partition.projection.apply(paraphrase.Vector))
+	}
+}
+
+// fitProjectionsLocked fits a PCA projection for each partition that has
+// none yet or has doubled since its fit. It requires indexMutex for writing
+// and dbMutex held.
+func fitProjectionsLocked() {
+	if vectorReduction() != reductionPCA {
+		pcaProjections = nil
+		return
+	}
+	if pcaProjections == nil {
+		pcaProjections = make(map[partitionID]*pcaProjection)
+	}
+	vectors := make(map[partitionID][][]float32)
+	for _, entry := range MockVectorDB {
+		key := entryPartition(entry)
+		vectors[key] = append(vectors[key], entry.Vector)
+	}
+	for key, partition := range vectors {
+		if existing := pcaProjections[key]; existing == nil || len(partition) >= 2*existing.fittedOn {
+			if projection := fitPCA(partition, vectorDimensions()); projection != nil {
+				pcaProjections[key] = projection
+			}
+		}
+	}
+}
+
+// indexAppendLocked adds MockVectorDB[pos] to its index. The caller holds
+// dbMutex for writing.
+func indexAppendLocked(pos int) {
+	bloomAddLocked(MockVectorDB[pos])
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+	if partitionIndexes != nil {
+		addToIndexLocked(pos)
+		if projectionStaleLocked(pos) {
+			// Refit on the next search.
+			partitionIndexes = nil
+		}
+	}
+}
+
+// projectionStaleLocked reports whether the PCA projection of the partition
+// holding MockVectorDB[pos] is missing or was fitted on less than half of it.
+func projectionStaleLocked(pos int) bool {
+	if vectorReduction() != reductionPCA {
+		return false
+	}
+	entry := MockVectorDB[pos]
+	key := entryPartition(entry)
+	size := 0
+	for _, partition := range partitionIndexes[key] {
+		size += len(partition.positions)
+	}
+	projection := pcaProjections[key]
+	if projection == nil {
+		return size > 2*vectorDimensions()
+	}
+	return size >= 2*projection.fittedOn
+}
+
+// invalidateIndexLocked drops all indexes after entries were removed or
+// reordered. The caller holds dbMutex for writing.
+func invalidateIndexLocked() {
+	indexMutex.Lock()
+	partitionIndexes = nil
+	indexMutex.Unlock()
+}
+
+// readIndexes takes indexMutex for reading, building the indexes first when
+// they were invalidated. The caller holds dbMutex and releases indexMutex.
+func readIndexes() {
+	indexMutex.RLock()
+	if partitionIndexes == nil {
+		indexMutex.RUnlock()
+		indexMutex.Lock()
+		if partitionIndexes == nil {
+			rebuildIndexesLocked()
+		}
+		indexMutex.Unlock()
+		indexMutex.RLock()
+	}
+}
+
+// partitionPositions returns the MockVectorDB positions of tenant's entries
+// owned by owner and embedded with model, across styles and languages, each
+// once. The caller holds dbMutex.
+func partitionPositions(tenant, owner, model string) []int {
+	readIndexes()
+	defer indexMutex.RUnlock()
+
+	var positions []int
+	seen := make(map[int]bool)
+	for key, languages := range partitionIndexes {
+		if key.tenant != tenant || key.owner != owner || key.model != model {
+			continue
+		}
+		for _, partition := range languages {
+			for _, pos := range partition.positions {
+				if !seen[pos] {
+					seen[pos] = true
+					positions = append(positions, pos)
+				}
+			}
+		}
+	}
+	return positions
+}
+
+// partitionMembers returns the MockVectorDB positions in each partition and
+// language, each position once. The caller holds dbMutex.
+func partitionMembers() [][]int {
+	readIndexes()
+	defer indexMutex.RUnlock()
+
+	var members [][]int
+	for _, languages := range partitionIndexes {
+		for _, partition := range languages {
+			// A paraphrase is added right after its entry, at the same
+			// position.
+			positions := slices.Compact(slices.Clone(partition.positions))
+			members = append(members, positions)
+		}
+	}
+	return members
+}
+
+// searchIndex returns the MockVectorDB position of the best match for query
+// among tenant's entries owned by owner, or -1, weighing language per
+// pickLanguageMatch.
+// The caller holds dbMutex.
+func searchIndex(ctx context.Context, tenant, owner string, query cacheQuery) (int, float64, error) {
+	readIndexes()
+	defer indexMutex.RUnlock()
+
+	same := languageCandidate{pos: -1}
+	other := languageCandidate{pos: -1}
+	for partitionLanguage, partition := range partitionIndexes[partitionKey(tenant, owner, query.EmbeddingModel, query.Style)] {
+		idx, score, err := partition.index.Search(ctx, partition.projection.apply(query.Vector))
+		if err != nil {
+			return -1, 0, err
+		}
+		if idx < 0 {
+			continue
+		}
+		best := &other
+		if sameLanguage(query.Language, partitionLanguage) {
+			best = &same
+		}
+		if best.pos < 0 || score > best.score {
+			*best = languageCandidate{pos: partition.positions[idx], score: score}
+		}
+	}
+	match := pickLanguageMatch(same, other, query.threshold())
+	return match.pos, match.score, nil
+}
+
+type flatIndex struct {
+	vectors [][]float32
+}
+
+func (f *flatIndex) Add(vector []float32) {
+	f.vectors = append(f.vectors, vector)
+}
+
+func (f *flatIndex) Search(ctx context.Context, query []float32) (int, float64, error) {
+	bestIdx, bestScore := -1, 0.0
+	for i, vector := range f.vectors {
+		if i%cancelCheckInterval == 0 && ctx.Err() != nil {
+			return -1, 0, ctx.Err()
+		}
+		if score := cosineSimilarity(query, vector); score > bestScore {
+			bestIdx, bestScore = i, score
+		}
+	}
+	return bestIdx, bestScore, nil
+}
+
+func normalizeVector(vector []float32) []float32 {
+	var norm float64
+	for _, v := range vector {
+		norm += float64(v) * float64(v)
+	}
+	out := make([]float32, len(vector))
+	if norm == 0 {
+		return out
+	}
+	inv := 1 / math.Sqrt(norm)
+	for i, v := range vector {
+		out[i] = float32(float64(v) * inv)
+	}
+	return out
+}
+
+// dotUnrolled keeps four independent accumulators so the loop is not bound
+// by a single dependency chain.
+func dotUnrolled(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var s0, s1, s2, s3 float32
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		s0 += a[i] * b[i]
+		s1 += a[i+1] * b[i+1]
+		s2 += a[i+2] * b[i+2]
+		s3 += a[i+3] * b[i+3]
+	}
+	for ; i < len(a); i++ {
+		s0 += a[i] * b[i]
+	}
+	return float64(s0 + s1 + s2 + s3)
+}
+
+type unrolledIndex struct {
+	vectors [][]float32
+}
+
+func (u *unrolledIndex) Add(vector []float32) {
+	u.vectors = append(u.vectors, normalizeVector(vector))
+}
+
+func (u *unrolledIndex) Search(ctx context.Context, query []float32) (int, float64, error) {
+	q := normalizeVector(query)
+	bestIdx, bestScore := -1, 0.0
+	for i, vector := range u.vectors {
+		if i%cancelCheckInterval == 0 && ctx.Err() != nil {
+			return -1, 0, ctx.Err()
+		}
+		if score := dotUnrolled(q, vector); score > bestScore {
+			bestIdx, bestScore = i, score
+		}
+	}
+	return bestIdx, bestScore, nil
+}
+
+type quantizedIndex struct {
+	codes  [][]int8
+	scales []float32
+}
+
+func (q *quantizedIndex) Add(vector []float32) {
+	normalized := normalizeVector(vector)
+	var maxAbs float32
+	for _, v := range normalized {
+		maxAbs = max(maxAbs, float32(math.Abs(float64(v))))
+	}
+	scale := maxAbs / 127
+	code := make([]int8, len(normalized))
+	if scale > 0 {
+		for i, v := range normalized {
+			code[i] = int8(math.Round(float64(v / scale)))
+		}
+	}
+	q.codes = append(q.codes, code)
+	q.scales = append(q.scales, scale)
+}
+
+func (q *quantizedIndex) Search(ctx context.Context, query []float32) (int, float64, error) {
+	normalized := normalizeVector(query)
+	bestIdx, bestScore := -1, 0.0
+	for i, code := range q.codes {
+		if i%cancelCheckInterval == 0 && ctx.Err() != nil {
+			return -1, 0, ctx.Err()
+		}
+		if len(code) != len(normalized) {
+			continue
+		}
+		var dot float32
+		for j, c := range code {
+			dot += normalized[j] * float32(c)
+		}
+		if score := float64(dot * q.scales[i]); score > bestScore {
+			bestIdx, bestScore = i, score
+		}
+	}
+	return bestIdx, bestScore, nil
+}
+
+type scoredNode struct {
+	id    int
+	score float64
+}
+
+// scoredHeap is a heap of nodes, best-first when best is set and
+// worst-first otherwise.
+type scoredHeap struct {
+	items []scoredNode
+	best  bool
+}
+
+func (h *scoredHeap) Len() int { return len(h.items) }
+func (h *scoredHeap) Less(i, j int) bool {
+	if h.best {
+		return h.items[i].score > h.items[j].score
+	}
+	return h.items[i].score < h.items[j].score
+}
+func (h *scoredHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *scoredHeap) Push(x any)    { h.items = append(h.items, x.(scoredNode)) }
+func (h *scoredHeap) Pop() any {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
+
+type hnswIndex struct {
+	vectors        [][]float32
+	links          [][][]int
+	entry          int
+	maxLevel       int
+	m              int
+	efConstruction int
+	efSearch       int
+	levelMult      float64
+	rng            *rand.Rand
+}
+
+func newHNSWIndex(m, efConstruction, efSearch int) *hnswIndex {
+	m = max(m, 2)
+	return &hnswIndex{
+		entry:          -1,
+		m:              m,
+		efConstruction: max(efConstruction, m),
+		efSearch:       max(efSearch, 1),
+		levelMult:      1 / math.Log(float64(m)),
+		rng:            rand.New(rand.NewPCG(1, 2)),
+	}
+}
+
+func (h *hnswIndex) maxLinks(level int) int {
+	if level == 0 {
+		return 2 * h.m
+	}
+	return h.m
+}
+
+func (h *hnswIndex) similarity(query []float32, id int) float64 {
+	return dotUnrolled(query, h.vectors[id])
+}
+
+func (h *hnswIndex) greedy(query []float32, current, level int) int {
+	best := h.similarity(query, current)
+	for changed := true; changed; {
+		changed = false
+		for _, n := range h.links[current][level] {
+			if score := h.similarity(query, n); score > best {
+				best, current, changed = score, n, true
+			}
+		}
+	}
+	return current
+}
+
+// searchLayer returns up to ef nodes nearest to query on level, best first.
+// ctx is checked once per expanded candidate.
+func (h *hnswIndex) searchLayer(ctx context.Context, query []float32, entry, ef, level int) ([]scoredNode, error) {
+	visited := make([]bool, len(h.vectors))
+	visited[entry] = true
+	start := scoredNode{entry, h.similarity(query, entry)}
+	candidates := &scoredHeap{items: []scoredNode{start}, best: true}
+	results := &scoredHeap{items: []scoredNode{start}}
+
+	for candidates.Len() > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		current := heap.Pop(candidates).(scoredNode)
+		if results.Len() >= ef && current.score < results.items[0].score {
+			break
+		}
+		for _, n := range h.links[current.id][level] {
+			if visited[n] {
+				continue
+			}
+			visited[n] = true
+			node := scoredNode{n, h.similarity(query, n)}
+			if results.Len() < ef || node.score > results.items[0].score {
+				heap.Push(candidates, node)
+				heap.Push(results, node)
+				if results.Len() > ef {
+					heap.Pop(results)
+				}
+			}
+		}
+	}
+
+	slices.SortFunc(results.items, func(a, b scoredNode) int {
+		switch {
+		case a.score > b.score:
+			return -1
+		case a.score < b.score:
+			return 1
+		}
+		return 0
+	})
+	return results.items, nil
+}
+
+func (h *hnswIndex) Add(vector []float32) {
+	id := len(h.vectors)
+	h.vectors = append(h.vectors, normalizeVector(vector))
+	level := int(-math.Log(1-h.rng.Float64()) * h.levelMult)
+	h.links = append(h.links, make([][]int, level+1))
+
+	if h.entry < 0 {
+		h.entry, h.maxLevel = id, level
+		return
+	}
+
+	current := h.entry
+	for l := h.maxLevel; l > level; l-- {
+		current = h.greedy(h.vectors[id], current, l)
+	}
+	for l := min(level, h.maxLevel); l >= 0; l-- {
+		nearest, _ := h.searchLayer(context.Background(), h.vectors[id], current, h.efConstruction, l)
+		for _, node := range nearest[:min(h.m, len(nearest))] {
+			h.links[id][l] = append(h.links[id][l], node.id)
+			h.links[node.id][l] = append(h.links[node.id][l], id)
+			h.pruneLinks(node.id, l)
+		}
+		current = nearest[0].id
+	}
+	if level > h.maxLevel {
+		h.entry, h.maxLevel = id, level
+	}
+}
+
+// pruneLinks keeps only the closest neighbours of id on level.
+func (h *hnswIndex) pruneLinks(id, level int) {
+	links := h.links[id][level]
+	limit := h.maxLinks(level)
+	if len(links) <= limit {
+		return
+	}
+	slices.SortFunc(links, func(a, b int) int {
+		sa, sb := h.similarity(h.vectors[id], a), h.similarity(h.vectors[id], b)
+		switch {
+		case sa > sb:
+			return -1
+		case sa < sb:
+			return 1
+		}
+		return 0
+	})
+	h.links[id][level] = links[:limit]
+}
+
+func (h *hnswIndex) Search(ctx context.Context, query []float32) (int, float64, error) {
+	if h.entry < 0 {
+		return -1, 0, nil
+	}
+	q := normalizeVector(query)
+	current := h.entry
+	for l := h.maxLevel; l > 0; l-- {
+		current = h.greedy(q, current, l)
+	}
+	nearest, err := h.searchLayer(ctx, q, current, h.efSearch, 0)
+	if err != nil {
+		return -1, 0, err
+	}
+	if len(nearest) == 0 || nearest[0].score <= 0 {
+		return -1, 0, nil
+	}
+	return nearest[0].id, nearest[0].score, nil
+}
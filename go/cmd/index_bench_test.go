@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"testing"
+)
+
+// The index benchmarks run every vectorIndex over the same synthetic data:
+// 10000 unit vectors of 384 dimensions, queried with slightly perturbed
+// copies of them. Search benchmarks also report recall, the share of queries
+// on which the index agrees with the exact flat scan.
+//
+//	go test -run '^$' -bench 'Search|Build' ./cmd
+
+const (
+	benchIndexSize    = 10000
+	benchIndexDims    = 384
+	benchIndexQueries = 200
+	benchIndexNoise   = 0.01
+)
+
+type indexBenchData struct {
+	vectors [][]float32
+	probes  [][]float32
+	// want holds the exact flat-scan answer for each probe.
+	want []int
+}
+
+var indexBenchFixture = sync.OnceValue(func() indexBenchData {
+	rng := rand.New(rand.NewPCG(1, 2))
+	data := indexBenchData{
+		vectors: make([][]float32, benchIndexSize),
+		probes:  make([][]float32, benchIndexQueries),
+		want:    make([]int, benchIndexQueries),
+	}
+	for i := range data.vectors {
+		data.vectors[i] = randomUnitVector(rng, benchIndexDims)
+	}
+	for i := range data.probes {
+		data.probes[i] = perturbVector(rng, data.vectors[rng.IntN(len(data.vectors))], benchIndexNoise)
+	}
+
+	exact := buildBenchIndex("flat", data.vectors)
+	for i, q := range data.probes {
+		data.want[i], _, _ = exact.Search(context.Background(), q)
+	}
+	return data
+})
+
+func buildBenchIndex(kind string, vectors [][]float32) vectorIndex {
+	index := indexBuilders[kind]()
+	for _, v := range vectors {
+		index.Add(v)
+	}
+	return index
+}
+
+func benchmarkSearch(b *testing.B, kind string) {
+	data := indexBenchFixture()
+	index := buildBenchIndex(kind, data.vectors)
+	ctx := context.Background()
+
+	i := 0
+	for b.Loop() {
+		index.Search(ctx, data.probes[i%len(data.probes)])
+		i++
+	}
+
+	agree := 0
+	for i, q := range data.probes {
+		if got, _, _ := index.Search(ctx, q); got == data.want[i] {
+			agree++
+		}
+	}
+	b.ReportMetric(float64(agree)*100/float64(len(data.probes)), "recall%")
+}
+
+func BenchmarkSearchFlat(b *testing.B)         { benchmarkSearch(b, "flat") }
+func BenchmarkSearchFlatUnrolled(b *testing.B) { benchmarkSearch(b, "flat-unrolled") }
+func BenchmarkSearchQuantized(b *testing.B)    { benchmarkSearch(b, "quantized") }
+func BenchmarkSearchHNSW(b *testing.B)         { benchmarkSearch(b, "hnsw") }
+
+func BenchmarkBuild(b *testing.B) {
+	data := indexBenchFixture()
+	for _, kind := range []string{"flat", "flat-unrolled", "quantized", "hnsw"} {
+		b.Run(kind, func(b *testing.B) {
+			for b.Loop() {
+				buildBenchIndex(kind, data.vectors)
+			}
+		})
+	}
+}
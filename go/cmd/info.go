@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Build metadata, set with
+//
+//	-ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+//
+// Without them, commit and build date fall back to the VCS stamp Go embeds.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+
+	startedAt = time.Now()
+)
+
+type BackendInfo struct {
+	Provider        string   `json:"provider"`
+	S3Primary       string   `json:"s3Primary,omitempty"`
+	S3Secondary     string   `json:"s3Secondary,omitempty"`
+	S3Active        string   `json:"s3Active,omitempty"`
+	VectorIndex     string   `json:"vectorIndex"`
+	ColdTierPrefix  string   `json:"coldTierPrefix,omitempty"`
+	GossipAddr      string   `json:"gossipAddr,omitempty"`
+	GossipPeers     []string `json:"gossipPeers,omitempty"`
+	BillingExport   bool     `json:"billingExport"`
+	AnalyticsExport bool     `json:"analyticsExport"`
+	StateStore      string   `json:"stateStore,omitempty"`
+}
+
+type InfoResponse struct {
+	Version       string          `json:"version"`
+	Commit        string          `json:"commit,omitempty"`
+	BuildDate     string          `json:"buildDate,omitempty"`
+	GoVersion     string          `json:"goVersion"`
+	NodeID        string          `json:"nodeId"`
+	StartedAt     time.Time       `json:"startedAt"`
+	UptimeSeconds int64           `json:"uptimeSeconds"`
+	Backends      BackendInfo     `json:"backends"`
+	Features      map[string]bool `json:"features"`
+}
+
+func buildMetadata() (string, string) {
+	rev, date := commit, buildDate
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && rev == "":
+				rev = setting.Value
+			case setting.Key == "vcs.time" && date == "":
+				date = setting.Value
+			}
+		}
+	}
+	return rev, date
+}
+
+func s3TargetLabel(target *s3Target) string {
+	if target == nil {
+		return ""
+	}
+	return target.Bucket + " (" + target.Region + ")"
+}
+
+// handleInfo serves GET /info so operators and the dashboard can confirm what
+// is actually deployed. Where the data lives (buckets, gossip peers, the
+// state store and the cold tier) is only shown with the admin token.
+func handleInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if _, ok := authenticate(w, r); !ok {
+		return
+	}
+
+	rev, date := buildMetadata()
+	backends := BackendInfo{
+		Provider:        activeProvider(),
+		VectorIndex:     vectorIndexKind(),
+		BillingExport:   envDuration("ECHO_BILLING_EXPORT_INTERVAL", 0) > 0,
+		AnalyticsExport: envDuration("ECHO_ANALYTICS_EXPORT_INTERVAL", 0) > 0,
+	}
+	if adminTokenValid(r) {
+		backends.GossipAddr = envString("ECHO_GOSSIP_ADDR", "")
+		backends.GossipPeers = envList("ECHO_GOSSIP_PEERS")
+		statusMutex.RLock()
+		backends.S3Primary = s3TargetLabel(s3Primary)
+		backends.S3Secondary = s3TargetLabel(s3Secondary)
+		backends.S3Active = s3TargetLabel(s3Active)
+		statusMutex.RUnlock()
+		if stateless() {
+			backends.StateStore = stateStore.addr
+		}
+		if tieringEnabled() {
+			backends.ColdTierPrefix = coldKeyPrefix(defaultTenant)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, InfoResponse{
+		Version:       version,
+		Commit:        rev,
+		BuildDate:     date,
+		GoVersion:     runtime.Version(),
+		NodeID:        nodeID,
+		StartedAt:     startedAt,
+		UptimeSeconds: int64(time.Since(startedAt).Seconds()),
+		Backends:      backends,
+		Features: map[string]bool{
+			"apiKeys":          len(configuredAPIKeys()) > 0,
+			"demoMode":         demoModeEnabled(),
+			"tiering":          tieringEnabled(),
+			"archive":          archiveEnabled(),
+			"historyRetention": historyRetentionEnabled(),
+			"historyExport":    envString("ECHO_HISTORY_EXPORT", "") == "true",
+			"llmThreadTitles":  envString("ECHO_LLM_THREAD_TITLES", "") == "true",
+			"publicBadges":     len(envList("ECHO_PUBLIC_BADGES")) > 0,
+			"anomalyWebhook":   envString("ECHO_ANOMALY_WEBHOOK_URL", "") != "",
+			"memoryWatermark":  currentMemoryStatus() != nil,
+			"errorReporting":   errorTracker() != nil,
+			"paraphrases":      envString("ECHO_PARAPHRASE_SCHEDULE", "") != "",
+		},
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entries loaded from S3, including the cold tier, are checked before they
+// reach matching: question and answer must be non-empty, the vector finite
+// and of the dimension most entries of the same embedding model in the
+// object use, and the entry must decode, which rejects unparseable
+// timestamps. An object may mix embedding models, each with its own
+// dimension, so no model's entries are judged by another's. Failing entries
+// are quarantined to quarantine/ in S3 and counted in /admin/integrity.
+
+const quarantineKeyPrefix = "quarantine/"
+
+type QuarantinedEntry struct {
+	Reason string          `json:"reason"`
+	Entry  json.RawMessage `json:"entry"`
+}
+
+type IntegrityReport struct {
+	Source      string         `json:"source"`
+	CheckedAt   time.Time      `json:"checkedAt"`
+	Checked     int            `json:"checked"`
+	Quarantined int            `json:"quarantined"`
+	Reasons     map[string]int `json:"reasons,omitempty"`
+}
+
+var (
+	integrityMutex     sync.Mutex
+	integrityReports   = make(map[string]IntegrityReport)
+	lastQuarantineHash = make(map[string][32]byte)
+)
+
+func entryProblem(entry VectorEntry, dims int) string {
+	switch {
+	case strings.TrimSpace(entry.Question) == "":
+		return "empty question"
+	case strings.TrimSpace(entry.Answer) == "" && entry.CompressedAnswer == nil:
+		return "empty answer"
+	case len(entry.Vector) == 0:
+		return "empty vector"
+	case len(entry.Vector) != dims:
+		return "inconsistent vector dimension"
+	}
+	if entry.CompressedAnswer != nil {
+		if _, err := decompressAnswer(entry.CompressedAnswer); err != nil {
+			return "undecodable compressed answer"
+		}
+	}
+	for _, v := range entry.Vector {
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return "non-finite vector value"
+		}
+	}
+	return ""
+}
+
+// verifyEntries decodes raw entries one by one and splits them into valid
+// entries and quarantined ones, recording a report for source.
+func verifyEntries(source string, raw []json.RawMessage) ([]VectorEntry, []QuarantinedEntry) {
+	decoded := make([]VectorEntry, 0, len(raw))
+	var undecodable []json.RawMessage
+	for _, data := range raw {
+		var entry VectorEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			undecodable = append(undecodable, data)
+			continue
+		}
+		decoded = append(decoded, entry)
+	}
+	return checkEntries(source, decoded, undecodable)
+}
+
+// checkEntries splits already decoded entries into valid and quarantined
+// ones; undecodable holds the records that did not decode at all. It records
+// a report for source.
+func checkEntries(source string, decoded []VectorEntry, undecodable []json.RawMessage) ([]VectorEntry, []QuarantinedEntry) {
+	dimCounts := make(map[string]map[int]int)
+	for _, entry := range decoded {
+		model := entryEmbeddingModel(entry)
+		if dimCounts[model] == nil {
+			dimCounts[model] = make(map[int]int)
+		}
+		dimCounts[model][len(entry.Vector)]++
+	}
+	modelDims := make(map[string]int, len(dimCounts))
+	for model, counts := range dimCounts {
+		dims, best := 0, 0
+		for d, count := range counts {
+			if d > 0 && (count > best || (count == best && d < dims)) {
+				dims, best = d, count
+			}
+		}
+		modelDims[model] = dims
+	}
+
+	checked := len(decoded) + len(undecodable)
+	report := IntegrityReport{Source: source, CheckedAt: time.Now(), Checked: checked}
+	var valid []VectorEntry
+	var quarantined []QuarantinedEntry
+	quarantine := func(reason string, data json.RawMessage) {
+		quarantined = append(quarantined, QuarantinedEntry{Reason: reason, Entry: data})
+		if report.Reasons == nil {
+			report.Reasons = make(map[string]int)
+		}
+		report.Reasons[reason]++
+	}
+	for _, data := range undecodable {
+		quarantine("undecodable entry", data)
+	}
+	for _, entry := range decoded {
+		reason := entryProblem(entry, modelDims[entryEmbeddingModel(entry)])
+		if reason == "" {
+			valid = append(valid, entry)
+			continue
+		}
+		data, _ := json.Marshal(entry)
+		quarantine(reason, data)
+	}
+	report.Quarantined = len(quarantined)
+
+	integrityMutex.Lock()
+	integrityReports[source] = report
+	integrityMutex.Unlock()
+	if len(quarantined) > 0 {
+		log.Printf("Integrity: %s: quarantined %d of %d entries %v", source, len(quarantined), checked, report.Reasons)
+	}
+	return valid, quarantined
+}
+
+// quarantineChanged reports whether entries differ from what was last
+// quarantined for source, so periodic syncs do not rewrite the same object.
+func quarantineChanged(source string, body []byte) bool {
+	sum := sha256.Sum256(body)
+	integrityMutex.Lock()
+	defer integrityMutex.Unlock()
+	if lastQuarantineHash[source] == sum {
+		return false
+	}
+	lastQuarantineHash[source] = sum
+	return true
+}
+
+func quarantineToS3(target *s3Target, key string, quarantined []QuarantinedEntry) {
+	body, err := json.Marshal(quarantined)
+	if err != nil || !quarantineChanged(key, body) {
+		return
+	}
+	objectKey := fmt.Sprintf("%s%s.%s.json", quarantineKeyPrefix, key, time.Now().UTC().Format("20060102T150405Z"))
+	if err := putCacheObject(target, objectKey, body, ""); err != nil {
+		log.Printf("Integrity: write %s failed: %v", objectKey, err)
+		return
+	}
+	log.Printf("Integrity: wrote %d quarantined entries to %s", len(quarantined), objectKey)
+}
+
+func handleIntegrity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	integrityMutex.Lock()
+	reports := make([]IntegrityReport, 0, len(integrityReports))
+	for _, report := range integrityReports {
+		reports = append(reports, report)
+	}
+	integrityMutex.Unlock()
+
+	writeJSON(w, http.StatusOK, reports)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// A knowledge pack is an FAQ pack loaded at startup, so demo builds answer a
+// useful set of questions from cache with nothing else configured. Binaries
+// built with -tags knowledgepack carry knowledge/default.json, and
+// ECHO_KNOWLEDGE_PACK selects the pack: "embedded" (default), "off", or the
+// path of a pack file. The pack is imported into the default and demo
+// tenants. Items without a vector are embedded with the provider's embedding
+// model, which serves API clients using the same model; browser clients need
+// vectors from the frontend's model in the pack.
+
+func knowledgePackSource() ([]byte, string, error) {
+	switch source := envString("ECHO_KNOWLEDGE_PACK", "embedded"); strings.ToLower(source) {
+	case "off":
+		return nil, "", nil
+	case "embedded":
+		return embeddedKnowledgePack, "embedded pack", nil
+	default:
+		body, err := os.ReadFile(source)
+		return body, source, err
+	}
+}
+
+// embedPackItems fills in missing item vectors and sets the pack's
+// embedding model to the one used.
+func embedPackItems(pack *FAQPack) error {
+	var texts []string
+	for _, item := range pack.Items {
+		if len(item.Vector) == 0 {
+			texts = append(texts, item.Question)
+		}
+	}
+	if len(texts) == 0 {
+		return nil
+	}
+	if len(texts) != len(pack.Items) {
+		return fmt.Errorf("either every item or none needs a vector")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	vectors, model, err := embedTexts(ctx, texts)
+	if err != nil {
+		return err
+	}
+	for i := range pack.Items {
+		pack.Items[i].Vector = vectors[i]
+	}
+	pack.EmbeddingModel = model
+	return nil
+}
+
+func loadKnowledgePack() {
+	body, source, err := knowledgePackSource()
+	if err != nil {
+		log.Printf("Load knowledge pack failed: %v", err)
+		return
+	}
+	if len(body) == 0 {
+		return
+	}
+
+	var pack FAQPack
+	if err := json.Unmarshal(body, &pack); err != nil {
+		log.Printf("Decode knowledge pack %s failed: %v", source, err)
+		return
+	}
+	if err := embedPackItems(&pack); err != nil {
+		log.Printf("Embed knowledge pack %s failed: %v", source, err)
+		return
+	}
+
+	tenants := []string{defaultTenant}
+	if demo := demoTenant(); demo != defaultTenant {
+		tenants = append(tenants, demo)
+	}
+	for _, tenant := range tenants {
+		entries, problem := faqEntries(tenant, pack)
+		if problem != "" {
+			log.Printf("Invalid knowledge pack %s: %s", source, problem)
+			return
+		}
+		importFAQPack(tenant, entries[0].FAQPack, entries)
+	}
+	log.Printf("Knowledge pack: loaded %d questions from %s", len(pack.Items), source)
+}
@@ -0,0 +1,10 @@
+//go:build knowledgepack
+
+package main
+
+import _ "embed"
+
+// embeddedKnowledgePack is compiled in with -tags knowledgepack.
+//
+//go:embed knowledge/default.json
+var embeddedKnowledgePack []byte
@@ -0,0 +1,6 @@
+//go:build !knowledgepack
+
+package main
+
+// embeddedKnowledgePack is empty unless built with -tags knowledgepack.
+var embeddedKnowledgePack []byte
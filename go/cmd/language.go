@@ -0,0 +1,168 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Questions are tagged with a detected language so an answer written in one
+// language is not served for a question asked in another just because the
+// embeddings are close. ECHO_LANGUAGE_MATCH selects how strict lookups are:
+//
+//	prefer   same-language matches win; another language is used only when
+//	         nothing in the question's language clears the threshold (default)
+//	require  only same-language entries are considered
+//	off      language is ignored
+//
+// Detection is a cheap heuristic: the script decides for non-Latin text, and
+// stopword counts decide between common Latin-script languages. Text that is
+// too short or ambiguous is "und" and matches entries of any language.
+
+const (
+	languageUnknown = "und"
+
+	languageMatchPrefer  = "prefer"
+	languageMatchRequire = "require"
+	languageMatchOff     = "off"
+)
+
+func languageMatchMode() string {
+	switch mode := strings.ToLower(envString("ECHO_LANGUAGE_MATCH", languageMatchPrefer)); mode {
+	case languageMatchRequire, languageMatchOff:
+		return mode
+	default:
+		return languageMatchPrefer
+	}
+}
+
+var scriptLanguages = []struct {
+	table    *unicode.RangeTable
+	language string
+}{
+	{unicode.Hangul, "ko"},
+	{unicode.Hiragana, "ja"},
+	{unicode.Katakana, "ja"},
+	{unicode.Han, "zh"},
+	{unicode.Cyrillic, "ru"},
+	{unicode.Arabic, "ar"},
+	{unicode.Greek, "el"},
+	{unicode.Hebrew, "he"},
+	{unicode.Devanagari, "hi"},
+	{unicode.Thai, "th"},
+}
+
+var latinStopwords = map[string][]string{
+	"en": {"the", "is", "are", "what", "how", "why", "and", "of", "to", "in", "does", "can", "do", "you", "with", "for", "which", "when"},
+	"fr": {"le", "la", "les", "est", "de", "que", "qui", "quoi", "quel", "quelle", "comment", "pourquoi", "et", "des", "une", "un", "du", "dans", "pour", "avec", "je", "vous"},
+	"es": {"el", "la", "los", "las", "es", "que", "qué", "cómo", "por", "y", "de", "del", "una", "un", "en", "para", "con", "cuál", "está"},
+	"de": {"der", "die", "das", "ist", "und", "wie", "was", "warum", "ein", "eine", "nicht", "mit", "für", "ich", "sie", "den", "dem", "zu"},
+	"it": {"il", "lo", "gli", "è", "che", "come", "perché", "e", "di", "una", "un", "del", "della", "per", "con", "sono", "cosa", "non"},
+	"pt": {"o", "os", "as", "é", "que", "como", "por", "e", "de", "do", "da", "uma", "um", "em", "para", "com", "não", "qual", "você"},
+	"nl": {"de", "het", "een", "is", "en", "wat", "hoe", "waarom", "van", "niet", "met", "voor", "ik", "je", "zijn", "op", "dat"},
+}
+
+var latinStopwordIndex = func() map[string][]string {
+	index := make(map[string][]string)
+	for language, words := range latinStopwords {
+		for _, word := range words {
+			index[word] = append(index[word], language)
+		}
+	}
+	return index
+}()
+
+// detectLanguage returns an ISO 639-1 code for text, or languageUnknown.
+func detectLanguage(text string) string {
+	scriptCounts := make(map[string]int)
+	letters := 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		for _, script := range scriptLanguages {
+			if unicode.Is(script.table, r) {
+				scriptCounts[script.language]++
+				break
+			}
+		}
+	}
+	if letters == 0 {
+		return languageUnknown
+	}
+	// Japanese mixes kana with kanji, so any kana decides it.
+	if scriptCounts["ja"] > 0 {
+		return "ja"
+	}
+	best, bestCount := "", 0
+	for language, count := range scriptCounts {
+		if count > bestCount {
+			best, bestCount = language, count
+		}
+	}
+	if bestCount*2 >= letters {
+		if best == "ru" && strings.ContainsAny(strings.ToLower(text), "іїєґ") {
+			return "uk"
+		}
+		return best
+	}
+
+	scores := make(map[string]int)
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	})
+	for _, word := range words {
+		for _, language := range latinStopwordIndex[word] {
+			scores[language]++
+		}
+	}
+	best, bestScore, runnerUp := languageUnknown, 0, 0
+	for language, score := range scores {
+		switch {
+		case score > bestScore:
+			best, bestScore, runnerUp = language, score, bestScore
+		case score > runnerUp:
+			runnerUp = score
+		}
+	}
+	if bestScore == 0 || bestScore == runnerUp {
+		return languageUnknown
+	}
+	return best
+}
+
+func entryLanguage(entry VectorEntry) string {
+	if entry.Language == "" {
+		return languageUnknown
+	}
+	return entry.Language
+}
+
+// sameLanguage reports whether an entry in language b may answer a question
+// in language a without falling back; unknown languages match anything.
+func sameLanguage(a, b string) bool {
+	return a == b || a == languageUnknown || b == languageUnknown
+}
+
+// languageCandidate is the best match found among same-language or
+// other-language entries; pos is -1 when there is none.
+type languageCandidate struct {
+	pos   int
+	score float64
+}
+
+// pickLanguageMatch applies ECHO_LANGUAGE_MATCH to the best same-language and
+// other-language candidates, where a same-language candidate scoring at least
+// threshold is a hit. A miss still reports the best score considered.
+func pickLanguageMatch(same, other languageCandidate, threshold float64) languageCandidate {
+	switch mode := languageMatchMode(); {
+	case mode == languageMatchRequire:
+		return same
+	case mode == languageMatchPrefer && same.pos >= 0 && same.score >= threshold:
+		return same
+	case other.score > same.score:
+		return other
+	default:
+		return same
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Every successful provider call records how long it took, per model, in a
+// rolling window of the last ECHO_LATENCY_WINDOW calls (100). The window's
+// median is what a cache hit is credited with saving, and the basis for
+// hedging: with ECHO_HEDGE_AFTER_MEDIANS set (0, off), a call still pending
+// after that many medians is sent again and the first answer wins. Until a
+// model has been observed, ECHO_PROVIDER_LATENCY_DEFAULT (2s) stands in and
+// calls are not hedged.
+
+var (
+	providerLatencySeconds = newHistogram("echo_provider_latency_seconds", "Time for the provider to answer, by model.", defaultLatencyBuckets)
+	providerHedges         = newCounter("echo_provider_hedges", "Provider calls sent again after running past the hedge delay, by model.")
+)
+
+// latencyWindow is a ring of a model's most recent call latencies.
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+}
+
+var (
+	latencyMutex   sync.Mutex
+	latencyByModel = make(map[string]*latencyWindow)
+)
+
+func observeProviderLatency(model string, elapsed time.Duration) {
+	providerLatencySeconds.observe(metricLabels("model", model), elapsed.Seconds(), "")
+
+	latencyMutex.Lock()
+	defer latencyMutex.Unlock()
+	window, ok := latencyByModel[model]
+	if !ok {
+		window = &latencyWindow{}
+		latencyByModel[model] = window
+	}
+	if size := max(envInt("ECHO_LATENCY_WINDOW", 100), 1); len(window.samples) < size {
+		window.samples = append(window.samples, elapsed)
+	} else {
+		window.samples[window.next%len(window.samples)] = elapsed
+		window.next++
+	}
+}
+
+func (w *latencyWindow) median() time.Duration {
+	sorted := slices.Clone(w.samples)
+	slices.Sort(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// medianProviderLatency returns model's median latency over the window, and
+// false when it has not been observed.
+func medianProviderLatency(model string) (time.Duration, bool) {
+	latencyMutex.Lock()
+	defer latencyMutex.Unlock()
+	window, ok := latencyByModel[model]
+	if !ok || len(window.samples) == 0 {
+		return 0, false
+	}
+	return window.median(), true
+}
+
+// expectedProviderLatency is how long model usually takes to answer.
+func expectedProviderLatency(model string) time.Duration {
+	if median, ok := medianProviderLatency(model); ok {
+		return median
+	}
+	return envDuration("ECHO_PROVIDER_LATENCY_DEFAULT", 2*time.Second)
+}
+
+// latencySaved is the wait a cache hit for model avoided, given the hit
+// itself took served.
+func latencySaved(model string, served time.Duration) time.Duration {
+	return max(expectedProviderLatency(model)-served, 0)
+}
+
+// providerLatencyMs reports the median each observed model is credited with.
+func providerLatencyMs() map[string]int64 {
+	latencyMutex.Lock()
+	defer latencyMutex.Unlock()
+	latencies := make(map[string]int64, len(latencyByModel))
+	for model, window := range latencyByModel {
+		latencies[model] = window.median().Milliseconds()
+	}
+	return latencies
+}
+
+// hedgeDelay is how long a call to model may run before it is hedged, and
+// false when it should not be. The "hedging" feature flag can roll it out to
+// some callers only.
+func hedgeDelay(model string, caller Caller) (time.Duration, bool) {
+	factor := envFloat("ECHO_HEDGE_AFTER_MEDIANS", 0)
+	if factor <= 0 || !featureEnabledOr("hedging", caller, true) {
+		return 0, false
+	}
+	median, ok := medianProviderLatency(model)
+	if !ok {
+		return 0, false
+	}
+	return time.Duration(float64(median) * factor), true
+}
+
+type providerResult struct {
+	answer string
+	usage  providerUsage
+	err    error
+}
+
+// hedgeDrainWait is how long a hedged call waits for the cancelled loser to
+// report its usage.
+const hedgeDrainWait = 100 * time.Millisecond
+
+// hedgedCall calls the provider, sending the call again if it runs past
+// model's hedge delay, and returns the first success. Both calls fail only
+// if neither succeeds; the loser is cancelled. Both calls were billed, so
+// the returned usage carries the loser's in HedgeTokens: as reported if it
+// finished within hedgeDrainWait of the winner, otherwise estimated from the
+// prompt, with HedgeEstimated set.
+func hedgedCall(ctx context.Context, caller Caller, prompt string, modelName string) (string, providerUsage, error) {
+	delay, ok := hedgeDelay(modelName, caller)
+	if !ok {
+		return callProvider(ctx, prompt, modelName)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan providerResult, 2)
+	call := func() {
+		answer, usage, err := callProvider(ctx, prompt, modelName)
+		results <- providerResult{answer: answer, usage: usage, err: err}
+	}
+	go call()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case result := <-results:
+		return result.answer, result.usage, result.err
+	case <-timer.C:
+		providerHedges.add(metricLabels("model", modelName), 1)
+		go call()
+	}
+
+	result := <-results
+	if result.err != nil {
+		result = <-results
+		return result.answer, result.usage, result.err
+	}
+
+	cancel()
+	usage := result.usage
+	drain := time.NewTimer(hedgeDrainWait)
+	defer drain.Stop()
+	select {
+	case loser := <-results:
+		if loser.err == nil {
+			usage.HedgeTokens = loser.usage.tokens(prompt, loser.answer)
+		} else {
+			usage.HedgeTokens, usage.HedgeEstimated = estimateTokens(prompt), true
+		}
+	case <-drain.C:
+		usage.HedgeTokens, usage.HedgeEstimated = estimateTokens(prompt), true
+	}
+	return result.answer, usage, nil
+}
+
+func msToHours(ms int64) float64 {
+	return (time.Duration(ms) * time.Millisecond).Hours()
+}
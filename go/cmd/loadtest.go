@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// `echo loadtest` drives synthetic /chat traffic against a running instance.
+// Requests reuse a fixed pool of base questions whose vectors are randomly
+// perturbed, so a realistic share of them should hit the cache.
+
+type loadtestResult struct {
+	Latency time.Duration
+	Source  string
+	Err     bool
+}
+
+func randomUnitVector(rng *rand.Rand, dims int) []float32 {
+	vector := make([]float32, dims)
+	var norm float64
+	for i := range vector {
+		v := rng.NormFloat64()
+		vector[i] = float32(v)
+		norm += v * v
+	}
+	norm = math.Sqrt(norm)
+	for i := range vector {
+		vector[i] = float32(float64(vector[i]) / norm)
+	}
+	return vector
+}
+
+func perturbVector(rng *rand.Rand, base []float32, noise float64) []float32 {
+	vector := make([]float32, len(base))
+	for i, v := range base {
+		vector[i] = v + float32(rng.NormFloat64()*noise)
+	}
+	return vector
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	return sorted[max(idx, 0)]
+}
+
+func runLoadtest(args []string) int {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	target := fs.String("url", "http://localhost:8080", "base URL of the Echo instance")
+	total := fs.Int("n", 1000, "total number of requests")
+	concurrency := fs.Int("c", 10, "number of concurrent workers")
+	dims := fs.Int("dims", 384, "vector dimensions")
+	questions := fs.Int("questions", 100, "number of distinct base questions")
+	noise := fs.Float64("noise", 0.01, "standard deviation of per-request vector noise")
+	key := fs.String("api-key", "", "API key sent as X-API-Key")
+	tenant := fs.String("tenant", "", "tenant sent as X-Tenant-ID")
+	dryRun := fs.Bool("dry-run", false, "send dryRun requests so the provider is never called")
+	_ = fs.Parse(args)
+
+	if *total <= 0 || *concurrency <= 0 || *dims <= 0 || *questions <= 0 {
+		fmt.Fprintln(os.Stderr, "loadtest: -n, -c, -dims and -questions must be positive")
+		return 2
+	}
+
+	seed := rand.New(rand.NewPCG(1, 2))
+	bases := make([][]float32, *questions)
+	for i := range bases {
+		bases[i] = randomUnitVector(seed, *dims)
+	}
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	jobs := make(chan int)
+	results := make(chan loadtestResult, *total)
+
+	var wg sync.WaitGroup
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func(worker uint64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewPCG(worker, uint64(time.Now().UnixNano())))
+			for range jobs {
+				q := rng.IntN(len(bases))
+				body, _ := json.Marshal(Request{
+					Text:   fmt.Sprintf("synthetic question %d", q),
+					Vector: perturbVector(rng, bases[q], *noise),
+					DryRun: *dryRun,
+				})
+				req, err := http.NewRequest(http.MethodPost, *target+"/chat", bytes.NewReader(body))
+				if err != nil {
+					results <- loadtestResult{Err: true}
+					continue
+				}
+				req.Header.Set("Content-Type", "application/json")
+				if *key != "" {
+					req.Header.Set("X-API-Key", *key)
+				}
+				if *tenant != "" {
+					req.Header.Set("X-Tenant-ID", *tenant)
+				}
+
+				start := time.Now()
+				resp, err := client.Do(req)
+				latency := time.Since(start)
+				if err != nil {
+					results <- loadtestResult{Latency: latency, Err: true}
+					continue
+				}
+				var out struct {
+					Source   string `json:"source"`
+					Decision string `json:"decision"`
+				}
+				_ = json.NewDecoder(resp.Body).Decode(&out)
+				resp.Body.Close()
+
+				source := out.Source
+				if out.Decision == "HIT" {
+					source = "CACHE"
+				}
+				results <- loadtestResult{Latency: latency, Source: source, Err: resp.StatusCode != http.StatusOK}
+			}
+		}(uint64(w))
+	}
+
+	start := time.Now()
+	for i := 0; i < *total; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(results)
+
+	latencies := make([]time.Duration, 0, *total)
+	var hits, failed int
+	for result := range results {
+		if result.Err {
+			failed++
+			continue
+		}
+		latencies = append(latencies, result.Latency)
+		if result.Source == "CACHE" {
+			hits++
+		}
+	}
+	slices.Sort(latencies)
+
+	fmt.Printf("requests:   %d (%d errors)\n", *total, failed)
+	fmt.Printf("duration:   %s\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("throughput: %.1f req/s\n", float64(*total)/elapsed.Seconds())
+	if len(latencies) > 0 {
+		fmt.Printf("cache hits: %d (%.1f%%)\n", hits, float64(hits)*100/float64(len(latencies)))
+		fmt.Printf("latency:    p50=%s p90=%s p99=%s max=%s\n",
+			percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99), latencies[len(latencies)-1])
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// With ECHO_LOG_PRIVACY=true, logs and audit events never carry question or
+// answer text. Content is replaced by a salted hash and its length, enough to
+// tell whether two log lines are about the same question without revealing
+// it. ECHO_LOG_HASH_SALT sets the salt; without one a random salt is drawn at
+// startup, so hashes only correlate within one process's lifetime.
+
+const logExcerptRunes = 120
+
+var (
+	logSaltOnce sync.Once
+	logSalt     []byte
+)
+
+func logPrivacy() bool {
+	return envString("ECHO_LOG_PRIVACY", "false") == "true"
+}
+
+func logHashSalt() []byte {
+	logSaltOnce.Do(func() {
+		if salt := envString("ECHO_LOG_HASH_SALT", ""); salt != "" {
+			logSalt = []byte(salt)
+			return
+		}
+		logSalt = make([]byte, 32)
+		rand.Read(logSalt)
+	})
+	return logSalt
+}
+
+// hashContent returns the salted hash and length standing in for text.
+func hashContent(text string) string {
+	mac := hmac.New(sha256.New, logHashSalt())
+	mac.Write([]byte(text))
+	return fmt.Sprintf("sha256:%s len=%d", hex.EncodeToString(mac.Sum(nil)[:8]), utf8.RuneCountInString(text))
+}
+
+// redactContent returns text as it may be kept in audit details: unchanged,
+// or its hash in privacy mode.
+func redactContent(text string) string {
+	if logPrivacy() {
+		return hashContent(text)
+	}
+	return text
+}
+
+// logContent renders question or answer text for a log line: a quoted
+// excerpt, or its hash in privacy mode.
+func logContent(text string) string {
+	if logPrivacy() {
+		return "[" + hashContent(text) + "]"
+	}
+	if utf8.RuneCountInString(text) > logExcerptRunes {
+		text = string([]rune(text)[:logExcerptRunes]) + "..."
+	}
+	return strconv.Quote(text)
+}
@@ -1,41 +1,209 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/rs/cors"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "loadtest":
+			os.Exit(runLoadtest(os.Args[2:]))
+		case "check-config":
+			os.Exit(runCheckConfig(os.Args[2:]))
+		case "publish":
+			os.Exit(runPublish(os.Args[2:]))
+		}
+	}
+
+	strict := flag.Bool("strict", false, "refuse to start on configuration errors or warnings")
+	flag.Parse()
+
 	err := godotenv.Load()
 	if err != nil {
 		log.Println("Warning: Error loading .env file (ignoring if running in cloud/docker)")
 	}
 
+	if *strict {
+		if errors, warnings := printFindings(validateConfig(true)); errors+warnings > 0 {
+			log.Fatalf("Strict mode: refusing to start with %d configuration errors and %d warnings", errors, warnings)
+		}
+	}
+
+	nodeID = defaultNodeID()
+	serveHTTP(":8080")
+	initFeatureFlags()
+	initExperiments()
+	initQuotas()
+	initModelPolicies()
+	loadEnergyCalibration()
+	initTiering()
+	startWriteQueue()
+	loadKnowledgePack()
+	if stateStoreConfigured() {
+		step := beginStep("state store")
+		if err := initStateStore(); err != nil {
+			log.Fatalf("State store unavailable: %v", err)
+		}
+		step.done("loaded from %s", stateStore.addr)
+	} else {
+		startSavingsPersistence(envDuration("ECHO_SAVINGS_PERSIST_INTERVAL", 30*time.Second))
+	}
+	loadSavedPrompts()
+	startOutbox()
+
+	if nodes := envList("ECHO_SHARD_NODES"); len(nodes) > 0 {
+		if err := initSharding(nodes, envString("ECHO_SHARD_SELF", envString("ECHO_GOSSIP_ADDR", ""))); err != nil {
+			log.Fatalf("Sharding: %v", err)
+		}
+	}
+
 	if err := initS3Client(); err != nil {
+		if *strict {
+			log.Fatalf("Strict mode: S3 unavailable: %v", err)
+		}
 		log.Printf("Warning: S3 disabled: %v", err)
+		skipStep("s3 download", err.Error())
+		disableTiering("S3 is unavailable")
 	} else {
-		downloadAndMergeFromS3()
+		initArchive()
+		loadRAGCollection()
+		loadTrash()
+		loadColdTier()
+		if !stateStoreConfigured() && !handedOff() {
+			loadSavings()
+			loadUsage()
+		}
+		initWAL()
+		if handedOff() {
+			skipStep("s3 download", fmt.Sprintf("cache handed over by pid %d", handoffFrom))
+		} else {
+			step := beginStep("s3 download")
+			if merged, err := downloadAndMergeFromS3(); err != nil {
+				step.failed(err, false)
+			} else {
+				step.done("%d new entries", merged)
+			}
+		}
 		startBackgroundSync()
+		startEventLog()
+		startAuditLog()
+		if interval := envDuration("ECHO_BILLING_EXPORT_INTERVAL", 0); interval > 0 {
+			startBillingExport(interval)
+		}
+		if interval := envDuration("ECHO_ANALYTICS_EXPORT_INTERVAL", 0); interval > 0 {
+			startAnalyticsExport(interval)
+		}
 	}
 
+	startScheduledRefresh()
+	startParaphraseSchedule()
+	startMemoryWatch()
+	if interval := envDuration("ECHO_CANARY_INTERVAL", 0); interval > 0 {
+		startCanary(interval)
+	}
+
+	if historyRetentionEnabled() {
+		startHistoryRetention(envDuration("ECHO_HISTORY_TRIM_INTERVAL", time.Minute))
+	}
+
+	if addr := envString("ECHO_GOSSIP_ADDR", ""); addr != "" {
+		if err := startReplicationServer(addr); err != nil {
+			log.Printf("Warning: replication server disabled: %v", err)
+		}
+	}
+	if peers := envList("ECHO_GOSSIP_PEERS"); len(peers) > 0 {
+		startGossip(peers, envDuration("ECHO_GOSSIP_INTERVAL", 30*time.Second))
+	}
+
+	warmIndexes()
+	validateProviderKey()
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/chat", handleChat)
+	mux.HandleFunc("/info", handleInfo)
+	mux.HandleFunc("/metrics", handleMetrics)
 	mux.HandleFunc("/history", handleHistory)
+	mux.HandleFunc("/history/threads", handleThreads)
+	mux.HandleFunc("GET /history/threads/{id}", handleThread)
+	mux.HandleFunc("/history/export", handleHistoryExport)
+	mux.HandleFunc("/history/pinned", handlePinned)
+	mux.HandleFunc("/history/{id}", handleHistoryItem)
+	mux.HandleFunc("/prompts", handleSavedPrompts)
+	mux.HandleFunc("/prompts/{id}", handleSavedPrompt)
+	mux.HandleFunc("POST /prompts/{id}/run", handleRunPrompt)
+	mux.HandleFunc("POST /history/{id}/pin", handlePin)
+	mux.HandleFunc("DELETE /history/{id}/pin", handlePin)
 	mux.HandleFunc("/cache-stats", handleCacheStats)
+	mux.HandleFunc("/cache/suggest", handleAutocomplete)
+	mux.HandleFunc("/cache/changes", handleChangeFeed)
+	mux.HandleFunc("/cache/{id}/refresh", handleRefresh)
+	mux.HandleFunc("/cache/{id}/compare", handleCompare)
+	mux.HandleFunc("/cache/{id}/similar", handleSimilar)
+	mux.HandleFunc("/cache/{id}/access", handleEntryAccess)
+	mux.HandleFunc("/cache/{id}/license", handleEntryLicense)
+	mux.HandleFunc("/cache/{id}/feedback", handleFeedback)
+	mux.HandleFunc("/admin/cache/{id}/time-sensitive", handleTimeSensitive)
+	mux.HandleFunc("/admin/refresh-schedule", handleRefreshSchedule)
+	mux.HandleFunc("/admin/paraphrases", handleParaphrases)
+	mux.HandleFunc("/admin/canary", handleCanary)
+	mux.HandleFunc("/admin/audit", handleAudit)
+	mux.HandleFunc("/admin/maintenance", handleMaintenance)
+	mux.HandleFunc("/admin/flags", handleFeatureFlags)
+	mux.HandleFunc("/admin/experiments", handleExperiments)
+	mux.HandleFunc("/admin/integrity", handleIntegrity)
+	mux.HandleFunc("GET /admin/cache/duplicates", handleDuplicates)
+	mux.HandleFunc("GET /admin/cache/trash", handleTrash)
+	mux.HandleFunc("GET /admin/cache/publish", handlePublishFeed)
+	mux.HandleFunc("GET /admin/cache/compact", handleCompact)
+	mux.HandleFunc("POST /admin/cache/compact", handleCompact)
+	mux.HandleFunc("/admin/faq-packs", handleFAQPacks)
+	mux.HandleFunc("DELETE /admin/faq-packs/{name}", handleDeleteFAQPack)
+	mux.HandleFunc("DELETE /admin/cache/{id}", handleDeleteEntry)
+	mux.HandleFunc("POST /admin/cache/{id}/restore", handleRestoreEntry)
+	mux.HandleFunc("POST /admin/cache/merge", handleMerge)
+	mux.HandleFunc("GET /admin/snapshots", handleSnapshots)
+	mux.HandleFunc("POST /admin/snapshots/{id}/restore", handleRestoreSnapshot)
+	mux.HandleFunc("/admin/replay", handleReplay)
+	mux.HandleFunc("/stats/org", handleOrgStats)
+	mux.HandleFunc("/stats/similarity", handleSimilarityStats)
+	mux.HandleFunc("/stats/summary", handleSavingsSummary)
+	mux.HandleFunc("/stats/anomalies", handleAnomalies)
+	mux.HandleFunc("/stats/forecast", handleForecast)
+	mux.HandleFunc("/badge/savings.svg", handleSavingsBadge)
+	mux.HandleFunc("/grafana/{$}", handleGrafanaTest)
+	mux.HandleFunc("/grafana/search", handleGrafanaSearch)
+	mux.HandleFunc("/grafana/query", handleGrafanaQuery)
+	mux.HandleFunc("/rag/documents", handleDocuments)
+	mux.HandleFunc("DELETE /rag/documents/{id}", handleDeleteDocument)
+	mux.HandleFunc("/usage", handleUsage)
+	mux.HandleFunc("/admin/usage/records", handleUsageRecords)
+	mux.HandleFunc("/admin/billing/export", handleBillingExport)
+	mux.HandleFunc("/admin/analytics/history.parquet", handleHistoryParquet)
+	mux.HandleFunc("/admin/budgets", handleBudgets)
+	mux.HandleFunc("/admin/sync-status", handleSyncStatus)
+	mux.HandleFunc("/admin/outbox", handleOutbox)
+	mux.HandleFunc("POST /admin/outbox/{id}/retry", handleOutboxRetry)
+	mux.HandleFunc("/admin/shards", handleShards)
+	mux.HandleFunc("/admin/archive", handleArchive)
+	mux.HandleFunc("/admin/archive/restore", handleArchiveRestore)
 
 	handler := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodOptions},
-		AllowedHeaders:   []string{"Content-Type"},
+		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions},
+		AllowedHeaders:   []string{"Content-Type", "Authorization", "X-API-Key", "X-Admin-Token", "X-Tenant-ID", "X-User-ID", "traceparent"},
 		AllowCredentials: false,
-	}).Handler(mux)
+	}).Handler(instrumentHTTP(mux))
 
-	fmt.Println("Echo backend listening on :8080")
-	if err := http.ListenAndServe(":8080", handler); err != nil {
-		panic(err)
-	}
+	markReady(handler)
+	completeHandoff()
+	waitForShutdown()
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Maintenance mode makes /chat return 503 with Retry-After while admin and
+// stats endpoints keep working, so the cache can be migrated safely. With
+// cacheOnly, cache hits are still served and only misses are refused.
+
+type MaintenanceState struct {
+	Enabled           bool       `json:"enabled"`
+	CacheOnly         bool       `json:"cacheOnly"`
+	RetryAfterSeconds int        `json:"retryAfterSeconds"`
+	Message           string     `json:"message,omitempty"`
+	Since             *time.Time `json:"since,omitempty"`
+}
+
+const defaultMaintenanceRetryAfter = 60
+
+var (
+	maintenanceMutex sync.RWMutex
+	maintenance      MaintenanceState
+)
+
+func currentMaintenance() MaintenanceState {
+	maintenanceMutex.RLock()
+	defer maintenanceMutex.RUnlock()
+	return maintenance
+}
+
+func writeMaintenance(w http.ResponseWriter, state MaintenanceState) {
+	message := state.Message
+	if message == "" {
+		message = "service is in maintenance"
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(state.RetryAfterSeconds))
+	writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": message})
+}
+
+// handleMaintenance reports (GET) or changes (POST) maintenance mode.
+func handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, currentMaintenance())
+		return
+	}
+
+	var req MaintenanceState
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return
+	}
+	if req.RetryAfterSeconds <= 0 {
+		req.RetryAfterSeconds = defaultMaintenanceRetryAfter
+	}
+	req.Since = nil
+	if req.Enabled {
+		now := time.Now()
+		req.Since = &now
+	}
+
+	maintenanceMutex.Lock()
+	maintenance = req
+	maintenanceMutex.Unlock()
+
+	action := "maintenance.disable"
+	if req.Enabled {
+		action = "maintenance.enable"
+	}
+	recordAudit(AuditEvent{
+		Action:  action,
+		Actor:   "admin",
+		Details: map[string]string{"cacheOnly": strconv.FormatBool(req.CacheOnly)},
+	})
+	writeJSON(w, http.StatusOK, req)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Every cache object is written with a manifest next to it holding its
+// SHA-256 and size, HMAC-signed when ECHO_CACHE_SIGNING_KEY is set. Downloads
+// are checked against the manifest so truncated or tampered objects are
+// rejected instead of merged. Objects without a manifest (written by older
+// versions) are accepted unless ECHO_REQUIRE_CACHE_MANIFEST=true or a signing
+// key is configured.
+//
+// The signature covers the object key, tenant, schema version and digests,
+// so a manifest cannot be replayed against another tenant's object or a
+// different schema. The manifest is written only after its object has
+// landed, so it never vouches for an upload that failed; a reader that lands
+// between the two writes rejects the new object against the old manifest and
+// picks it up on the next sync.
+
+const manifestSuffix = ".manifest.json"
+
+type cacheManifest struct {
+	Key           string    `json:"key,omitempty"`
+	Tenant        string    `json:"tenant,omitempty"`
+	SchemaVersion int       `json:"schemaVersion,omitempty"`
+	SHA256        string    `json:"sha256"`
+	Size          int       `json:"size"`
+	WrittenAt     time.Time `json:"writtenAt"`
+	WrittenBy     string    `json:"writtenBy,omitempty"`
+	Signature     string    `json:"signature,omitempty"`
+}
+
+var (
+	errManifestMismatch = errors.New("cache object does not match its manifest")
+	// errCacheRejected marks objects that were read but failed verification,
+	// as opposed to objects that could not be read at all.
+	errCacheRejected = errors.New("cache object rejected")
+)
+
+func manifestKey(key string) string {
+	return key + manifestSuffix
+}
+
+func signManifest(manifest cacheManifest) string {
+	secret := envString("ECHO_CACHE_SIGNING_KEY", "")
+	if secret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\x00%s\x00%d\x00%s\x00%d",
+		manifest.Key, manifest.Tenant, manifest.SchemaVersion, manifest.SHA256, manifest.Size)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// putCacheManifest writes the manifest for body, which the caller has just
+// uploaded to key.
+func putCacheManifest(target *s3Target, tenant, key string, body []byte, kmsKeyID string) error {
+	sum := sha256.Sum256(body)
+	manifest := cacheManifest{
+		Key:           key,
+		Tenant:        tenant,
+		SchemaVersion: currentCacheSchema,
+		SHA256:        hex.EncodeToString(sum[:]),
+		Size:          len(body),
+		WrittenAt:     time.Now().UTC(),
+		WrittenBy:     nodeID,
+	}
+	manifest.Signature = signManifest(manifest)
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := putCacheObject(target, manifestKey(key), data, kmsKeyID); err != nil {
+		return fmt.Errorf("manifest: %w", err)
+	}
+	return nil
+}
+
+// readCacheManifest returns the manifest stored for key, or nil when there is
+// none or it does not decode; verifyCacheManifest decides what that means.
+func readCacheManifest(target *s3Target, key string) (*cacheManifest, error) {
+	data, err := getObject(target, manifestKey(key))
+	if err != nil {
+		return nil, fmt.Errorf("manifest: %w", err)
+	}
+	var manifest cacheManifest
+	if data == nil || json.Unmarshal(data, &manifest) != nil {
+		return nil, nil
+	}
+	return &manifest, nil
+}
+
+// verifyCacheManifest returns the object's manifest, or a zero manifest for
+// legacy objects written without one.
+func verifyCacheManifest(target *s3Target, tenant, key string, body []byte) (cacheManifest, error) {
+	var manifest cacheManifest
+	data, err := getObject(target, manifestKey(key))
+	if err != nil {
+		return manifest, fmt.Errorf("manifest: %w", err)
+	}
+	signing := envString("ECHO_CACHE_SIGNING_KEY", "") != ""
+	if data == nil {
+		if signing || envString("ECHO_REQUIRE_CACHE_MANIFEST", "") == "true" {
+			return manifest, fmt.Errorf("%s: manifest missing: %w", key, errCacheRejected)
+		}
+		return manifest, nil
+	}
+
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("%s: decode manifest: %v: %w", key, err, errCacheRejected)
+	}
+	if manifest.Key != key || manifest.Tenant != tenant {
+		return manifest, fmt.Errorf("%s: manifest belongs to %s: %w", key, manifest.Key, errCacheRejected)
+	}
+	if signing && !hmac.Equal([]byte(manifest.Signature), []byte(signManifest(manifest))) {
+		return manifest, fmt.Errorf("%s: manifest signature is invalid: %w", key, errCacheRejected)
+	}
+	digest := sha256.Sum256(body)
+	sum := hex.EncodeToString(digest[:])
+	if manifest.Size != len(body) || manifest.SHA256 != sum {
+		return manifest, fmt.Errorf("%s: %w (size %d, manifest %d): %w", key, errManifestMismatch, len(body), manifest.Size, errCacheRejected)
+	}
+	return manifest, nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory watermark. Every ECHO_MEMORY_CHECK_INTERVAL (default 5s) the
+// process RSS is compared with ECHO_MEMORY_LIMIT, which takes bytes or a
+// KiB/MiB/GiB suffix and defaults to the container's cgroup memory limit.
+// Above ECHO_MEMORY_HIGH_WATERMARK of the limit (default 0.85) the least
+// valuable entries, fewest hits first and then least recently hit, are
+// evicted until their estimated size brings usage down to
+// ECHO_MEMORY_TARGET (default 0.7), and ECHO_MEMORY_WEBHOOK_URL is notified.
+// Pinned and FAQ entries are never evicted. With a cold tier configured the
+// entries are demoted to it; otherwise they are dropped, which is better
+// than the container being OOM-killed with the whole cache lost.
+
+type MemoryEvent struct {
+	Timestamp       time.Time `json:"timestamp"`
+	LimitBytes      int64     `json:"limitBytes"`
+	UsageBytes      int64     `json:"usageBytes"`
+	UsageAfterBytes int64     `json:"usageAfterBytes"`
+	Watermark       float64   `json:"watermark"`
+	Evicted         int       `json:"evicted"`
+	Demoted         bool      `json:"demoted"`
+}
+
+type MemoryStatus struct {
+	LimitBytes     int64        `json:"limitBytes"`
+	LimitSource    string       `json:"limitSource"`
+	UsageBytes     int64        `json:"usageBytes"`
+	AboveWatermark bool         `json:"aboveWatermark"`
+	HighWatermark  float64      `json:"highWatermark"`
+	Target         float64      `json:"target"`
+	Evictions      int          `json:"evictions"`
+	EvictedEntries int          `json:"evictedEntries"`
+	LastEviction   *MemoryEvent `json:"lastEviction,omitempty"`
+}
+
+// entryOverheadBytes approximates an entry's fixed cost beyond its vector
+// and strings: the struct, index slots and map keys.
+const entryOverheadBytes = 512
+
+var (
+	memoryMutex  sync.Mutex
+	memoryStatus *MemoryStatus
+
+	memoryUsageBytes = newGauge("echo_memory_usage_bytes", "Process resident memory as checked against the memory limit.")
+	memoryEvictions  = newCounter("echo_memory_evicted_entries", "Entries evicted because memory crossed the high watermark.")
+)
+
+// parseByteSize parses a byte count with an optional binary or decimal suffix.
+func parseByteSize(raw string) (int64, error) {
+	raw = strings.TrimSpace(raw)
+	multipliers := []struct {
+		suffix string
+		factor int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+	}
+	for _, m := range multipliers {
+		if number, ok := strings.CutSuffix(raw, m.suffix); ok {
+			value, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+			if err != nil || value <= 0 {
+				return 0, fmt.Errorf("invalid size %q", raw)
+			}
+			return int64(value * float64(m.factor)), nil
+		}
+	}
+	value, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid size %q", raw)
+	}
+	return value, nil
+}
+
+// memoryLimit returns the configured limit, else the cgroup's, else 0.
+func memoryLimit() (int64, string) {
+	if raw := envString("ECHO_MEMORY_LIMIT", ""); raw != "" {
+		limit, err := parseByteSize(raw)
+		if err != nil {
+			log.Printf("Ignoring ECHO_MEMORY_LIMIT: %v", err)
+			return 0, ""
+		}
+		return limit, "ECHO_MEMORY_LIMIT"
+	}
+	// cgroup v2, then v1. v1 reports a huge number when unlimited.
+	for _, path := range []string{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		limit, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil || limit <= 0 || limit >= 1<<62 {
+			return 0, ""
+		}
+		return limit, "cgroup"
+	}
+	return 0, ""
+}
+
+// memoryUsage returns the resident set size, falling back to the memory the
+// Go runtime holds from the OS where /proc is unavailable.
+func memoryUsage() int64 {
+	if data, err := os.ReadFile("/proc/self/statm"); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) > 1 {
+			if pages, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				return pages * int64(os.Getpagesize())
+			}
+		}
+	}
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return int64(stats.Sys - stats.HeapReleased)
+}
+
+func estimatedEntryBytes(entry VectorEntry) int64 {
+	size := len(entry.Vector)*4 + len(entry.Question) + len(entry.Answer) + len(entry.CompressedAnswer) + entryOverheadBytes
+	for locale, answer := range entry.Variants {
+		size += len(locale) + len(answer)
+	}
+	for _, paraphrase := range entry.Paraphrases {
+		size += len(paraphrase.Question) + len(paraphrase.Vector)*4
+	}
+	return int64(size)
+}
+
+func startMemoryWatch() {
+	limit, source := memoryLimit()
+	if limit == 0 {
+		return
+	}
+	high := envFloat("ECHO_MEMORY_HIGH_WATERMARK", 0.85)
+	target := envFloat("ECHO_MEMORY_TARGET", 0.7)
+	if target >= high {
+		target = high * 0.8
+	}
+	memoryMutex.Lock()
+	memoryStatus = &MemoryStatus{LimitBytes: limit, LimitSource: source, HighWatermark: high, Target: target}
+	memoryMutex.Unlock()
+	log.Printf("Memory watermark: evicting above %.0f%% of %d bytes (%s)", high*100, limit, source)
+
+	ticker := time.NewTicker(envDuration("ECHO_MEMORY_CHECK_INTERVAL", 5*time.Second))
+	go func() {
+		defer ticker.Stop()
+		for range ticker.C {
+			checkMemory(limit, high, target)
+		}
+	}()
+}
+
+func checkMemory(limit int64, high, target float64) {
+	usage := memoryUsage()
+	memoryUsageBytes.set("", float64(usage))
+	memoryMutex.Lock()
+	memoryStatus.UsageBytes = usage
+	wasAbove := memoryStatus.AboveWatermark
+	memoryStatus.AboveWatermark = float64(usage) >= high*float64(limit)
+	memoryMutex.Unlock()
+	if float64(usage) < high*float64(limit) {
+		return
+	}
+
+	event := MemoryEvent{Timestamp: time.Now(), LimitBytes: limit, UsageBytes: usage, Watermark: high}
+	event.Evicted, event.Demoted = evictForMemory(usage - int64(target*float64(limit)))
+	if event.Evicted == 0 {
+		// Everything left is pinned; warn once rather than on every check.
+		if !wasAbove {
+			event.UsageAfterBytes = usage
+			log.Printf("Warning: memory at %d of %d bytes and no entries left to evict", usage, limit)
+			go postWebhook(envString("ECHO_MEMORY_WEBHOOK_URL", ""), event, "Memory")
+		}
+		return
+	}
+	runtime.GC()
+	debug.FreeOSMemory()
+	event.UsageAfterBytes = memoryUsage()
+	memoryUsageBytes.set("", float64(event.UsageAfterBytes))
+	memoryEvictions.add("", float64(event.Evicted))
+
+	memoryMutex.Lock()
+	memoryStatus.UsageBytes = event.UsageAfterBytes
+	memoryStatus.AboveWatermark = float64(event.UsageAfterBytes) >= high*float64(limit)
+	memoryStatus.Evictions++
+	memoryStatus.EvictedEntries += event.Evicted
+	memoryStatus.LastEviction = &event
+	memoryMutex.Unlock()
+
+	log.Printf("Warning: memory at %d of %d bytes, evicted %d entries, now %d bytes", usage, limit, event.Evicted, event.UsageAfterBytes)
+	go postWebhook(envString("ECHO_MEMORY_WEBHOOK_URL", ""), event, "Memory")
+}
+
+// evictForMemory evicts the least valuable entries until their estimated
+// size reaches excess bytes, and reports how many it evicted and whether to
+// the cold tier.
+func evictForMemory(excess int64) (int, bool) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	ranked := make([]int, 0, len(MockVectorDB))
+	for i, entry := range MockVectorDB {
+		if !entry.Pinned && !entry.Authoritative {
+			ranked = append(ranked, i)
+		}
+	}
+	sort.SliceStable(ranked, func(a, b int) bool {
+		ea, eb := MockVectorDB[ranked[a]], MockVectorDB[ranked[b]]
+		if ea.HitCount != eb.HitCount {
+			return ea.HitCount < eb.HitCount
+		}
+		return entryHeat(ea).Before(entryHeat(eb))
+	})
+
+	evict := make(map[int]struct{})
+	var freed int64
+	for _, idx := range ranked {
+		if freed >= excess {
+			break
+		}
+		evict[idx] = struct{}{}
+		freed += estimatedEntryBytes(MockVectorDB[idx])
+	}
+	if len(evict) == 0 {
+		return 0, false
+	}
+
+	// A fresh array, so the evicted entries' backing memory can be freed.
+	kept := make([]VectorEntry, 0, len(MockVectorDB)-len(evict))
+	evicted := make([]VectorEntry, 0, len(evict))
+	for i, entry := range MockVectorDB {
+		if _, ok := evict[i]; ok {
+			evicted = append(evicted, entry)
+			continue
+		}
+		kept = append(kept, entry)
+	}
+
+	demoted := false
+	if tieringEnabled() {
+		if err := appendColdEntries(evicted); err != nil {
+			log.Printf("Demote to cold tier failed, dropping entries instead: %v", err)
+		} else {
+			demoted = true
+			updateTierStats(func(s *TierStats) { s.Demotions += len(evicted) })
+		}
+	}
+	MockVectorDB = kept
+	invalidateIndexLocked()
+	if !demoted {
+		markCacheChanged()
+		for _, entry := range evicted {
+			recordCacheChange(changeDeleted, entry)
+		}
+	}
+	reason := "memory"
+	if demoted {
+		reason = "memory-demoted"
+	}
+	for _, entry := range evicted {
+		recordEvent(Event{Type: eventCacheEvict, Tenant: entry.Tenant, EntryID: entry.ID, Reason: reason})
+	}
+	return len(evicted), demoted
+}
+
+func currentMemoryStatus() *MemoryStatus {
+	memoryMutex.Lock()
+	defer memoryMutex.Unlock()
+	if memoryStatus == nil {
+		return nil
+	}
+	status := *memoryStatus
+	return &status
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// /metrics exposes Prometheus metrics. Every route gets a request latency
+// histogram labelled by route pattern, method and status class. When the
+// request carries a W3C traceparent header, its trace ID is kept as the
+// exemplar of the bucket the request landed in, so a slow bucket in Grafana
+// links straight to a trace of a request that filled it. Exemplars are only
+// part of the OpenMetrics format, which Prometheus asks for when exemplar
+// storage is enabled; the classic text format leaves them out.
+
+const (
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	textMetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// traceparentPattern matches a W3C trace context header and captures the
+// trace ID.
+var traceparentPattern = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-[0-9a-f]{16}-[0-9a-f]{2}$`)
+
+type exemplar struct {
+	traceID string
+	value   float64
+	at      time.Time
+}
+
+type histogramSeries struct {
+	// counts[i] counts observations in bucket i alone; the exposition sums
+	// them. The last bucket is +Inf.
+	counts    []uint64
+	exemplars []*exemplar
+	sum       float64
+	count     uint64
+}
+
+// metricFamily is one metric and all its series, written in the exposition
+// format.
+type metricFamily interface {
+	write(buf *bytes.Buffer, openMetrics bool)
+}
+
+// histogram is one metric family; series are keyed by their rendered labels.
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+// scalarMetric is a counter or gauge family: one value per series. Counter
+// names leave off the _total suffix, which the exposition adds.
+type scalarMetric struct {
+	name    string
+	help    string
+	counter bool
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+var (
+	metricsMutex   sync.Mutex
+	metricFamilies []metricFamily
+)
+
+func registerMetric(family metricFamily) {
+	metricsMutex.Lock()
+	metricFamilies = append(metricFamilies, family)
+	metricsMutex.Unlock()
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	h := &histogram{name: name, help: help, buckets: buckets, series: make(map[string]*histogramSeries)}
+	registerMetric(h)
+	return h
+}
+
+func newCounter(name, help string) *scalarMetric {
+	c := &scalarMetric{name: name, help: help, counter: true, values: make(map[string]float64)}
+	registerMetric(c)
+	return c
+}
+
+func newGauge(name, help string) *scalarMetric {
+	g := &scalarMetric{name: name, help: help, values: make(map[string]float64)}
+	registerMetric(g)
+	return g
+}
+
+func (m *scalarMetric) add(labels string, delta float64) {
+	m.mu.Lock()
+	m.values[labels] += delta
+	m.mu.Unlock()
+}
+
+func (m *scalarMetric) set(labels string, value float64) {
+	m.mu.Lock()
+	m.values[labels] = value
+	m.mu.Unlock()
+}
+
+func (m *scalarMetric) value(labels string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[labels]
+}
+
+func (m *scalarMetric) write(buf *bytes.Buffer, openMetrics bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kind, family, sample := "gauge", m.name, m.name
+	if m.counter {
+		kind, family, sample = "counter", m.name+"_total", m.name+"_total"
+		if openMetrics {
+			family = m.name
+		}
+	}
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", family, m.help, family, kind)
+
+	keys := make([]string, 0, len(m.values))
+	for labels := range m.values {
+		keys = append(keys, labels)
+	}
+	sort.Strings(keys)
+	for _, labels := range keys {
+		fmt.Fprintf(buf, "%s{%s} %s\n", sample, labels, formatMetricValue(m.values[labels]))
+	}
+}
+
+var httpRequestDuration = newHistogram(
+	"echo_http_request_duration_seconds",
+	"Time to serve an HTTP request, by route, method and status class.",
+	defaultLatencyBuckets,
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricLabels renders name/value pairs in the exposition syntax.
+func metricLabels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+// observe records value under labels, keeping traceID, if any, as the
+// exemplar of the bucket it falls in.
+func (h *histogram) observe(labels string, value float64, traceID string) {
+	bucket, _ := slices.BinarySearch(h.buckets, value)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	series, ok := h.series[labels]
+	if !ok {
+		series = &histogramSeries{
+			counts:    make([]uint64, len(h.buckets)+1),
+			exemplars: make([]*exemplar, len(h.buckets)+1),
+		}
+		h.series[labels] = series
+	}
+	series.counts[bucket]++
+	series.sum += value
+	series.count++
+	if traceID != "" {
+		series.exemplars[bucket] = &exemplar{traceID: traceID, value: value, at: time.Now()}
+	}
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (h *histogram) write(buf *bytes.Buffer, openMetrics bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	keys := make([]string, 0, len(h.series))
+	for labels := range h.series {
+		keys = append(keys, labels)
+	}
+	sort.Strings(keys)
+	for _, labels := range keys {
+		series := h.series[labels]
+		prefix, braced := labels, ""
+		if labels != "" {
+			prefix += ","
+			braced = "{" + labels + "}"
+		}
+		var cumulative uint64
+		for i, count := range series.counts {
+			cumulative += count
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			fmt.Fprintf(buf, "%s_bucket{%sle=%q} %d", h.name, prefix, formatMetricValue(le), cumulative)
+			if ex := series.exemplars[i]; openMetrics && ex != nil {
+				fmt.Fprintf(buf, " # {trace_id=%q} %s %.3f", ex.traceID, formatMetricValue(ex.value), float64(ex.at.UnixMilli())/1000)
+			}
+			buf.WriteByte('\n')
+		}
+		fmt.Fprintf(buf, "%s_sum%s %s\n", h.name, braced, formatMetricValue(series.sum))
+		fmt.Fprintf(buf, "%s_count%s %d\n", h.name, braced, series.count)
+	}
+}
+
+// requestTraceID returns the trace ID of r's traceparent header, or "".
+func requestTraceID(r *http.Request) string {
+	match := traceparentPattern.FindStringSubmatch(strings.TrimSpace(r.Header.Get("traceparent")))
+	if match == nil || strings.Trim(match[1], "0") == "" {
+		return ""
+	}
+	return match[1]
+}
+
+// statusRecorder remembers the status code a handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// instrumentHTTP times every request mux serves. Routes are labelled by the
+// pattern that matched, never the raw path, so IDs in paths cannot blow up
+// the number of series.
+func instrumentHTTP(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		serveRecovered(recorder, r, mux)
+
+		// ServeMux records the matched pattern on r.
+		route := r.Pattern
+		if _, path, ok := strings.Cut(route, " "); ok {
+			route = path
+		}
+		if route == "" {
+			route = "unmatched"
+		}
+		method := r.Method
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		default:
+			method = "OTHER"
+		}
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		labels := metricLabels("route", route, "method", method, "code", strconv.Itoa(status/100)+"xx")
+		httpRequestDuration.observe(labels, time.Since(start).Seconds(), requestTraceID(r))
+	})
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+
+	var buf bytes.Buffer
+	metricsMutex.Lock()
+	for _, family := range metricFamilies {
+		family.write(&buf, openMetrics)
+	}
+	metricsMutex.Unlock()
+
+	if openMetrics {
+		buf.WriteString("# EOF\n")
+		w.Header().Set("Content-Type", openMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", textMetricsContentType)
+	}
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// OpenAI models are called over the Chat Completions API with
+// OPENAI_API_KEY. OPENAI_BASE_URL points the calls at any OpenAI-compatible
+// server instead (default https://api.openai.com/v1).
+
+const (
+	defaultOpenAIModel          = "gpt-4o-mini"
+	defaultOpenAIEmbeddingModel = "text-embedding-3-small"
+	defaultOpenAIBaseURL        = "https://api.openai.com/v1"
+	// openAIEmbedBatchSize is how many texts are embedded per call.
+	openAIEmbedBatchSize = 100
+)
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openAIChatRequest struct {
+	Model       string          `json:"model"`
+	Messages    []openAIMessage `json:"messages"`
+	Temperature *float64        `json:"temperature,omitempty"`
+}
+
+type openAIChatResponse struct {
+	Choices []struct {
+		Message openAIMessage `json:"message"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+type openAIEmbeddingRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type openAIEmbeddingResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+}
+
+type openAIErrorResponse struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func openAIBaseURL() string {
+	return strings.TrimRight(envString("OPENAI_BASE_URL", defaultOpenAIBaseURL), "/")
+}
+
+// openAIRequest sends body (nil for a GET) to path and decodes the response
+// into out.
+func openAIRequest(ctx context.Context, method, path string, body, out any) error {
+	apiKey := os.Getenv("OPENAI_API_KEY")
+	if apiKey == "" {
+		return errors.New("OPENAI_API_KEY is not set")
+	}
+
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, openAIBaseURL()+path, reader)
+	if err != nil {
+		return fmt.Errorf("create OpenAI request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr openAIErrorResponse
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error.Message != "" {
+			return fmt.Errorf("%s: %s", resp.Status, apiErr.Error.Message)
+		}
+		return errors.New(resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func callOpenAI(ctx context.Context, prompt string, modelName string) (string, providerUsage, error) {
+	req := openAIChatRequest{
+		Model:    modelName,
+		Messages: []openAIMessage{{Role: "user", Content: prompt}},
+	}
+	if temperature, ok := temperatureFrom(ctx); ok {
+		req.Temperature = &temperature
+	}
+	var resp openAIChatResponse
+	if err := openAIRequest(ctx, http.MethodPost, "/chat/completions", req, &resp); err != nil {
+		return "", providerUsage{}, fmt.Errorf("OpenAI chat completion: %w", err)
+	}
+
+	var answerBuilder strings.Builder
+	for _, choice := range resp.Choices {
+		answerBuilder.WriteString(choice.Message.Content)
+	}
+	answer := strings.TrimSpace(answerBuilder.String())
+	if answer == "" {
+		return "", providerUsage{}, errors.New("OpenAI returned empty response")
+	}
+
+	return answer, providerUsage{PromptTokens: resp.Usage.PromptTokens, AnswerTokens: resp.Usage.CompletionTokens}, nil
+}
+
+func embedOpenAI(ctx context.Context, texts []string, modelName string) ([][]float32, error) {
+	vectors := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += openAIEmbedBatchSize {
+		batch := texts[start:min(start+openAIEmbedBatchSize, len(texts))]
+		var resp openAIEmbeddingResponse
+		if err := openAIRequest(ctx, http.MethodPost, "/embeddings", openAIEmbeddingRequest{Model: modelName, Input: batch}, &resp); err != nil {
+			return nil, fmt.Errorf("OpenAI embed: %w", err)
+		}
+		if len(resp.Data) != len(batch) {
+			return nil, fmt.Errorf("OpenAI returned %d embeddings for %d texts", len(resp.Data), len(batch))
+		}
+		embedded := make([][]float32, len(batch))
+		for _, item := range resp.Data {
+			if item.Index < 0 || item.Index >= len(batch) {
+				return nil, fmt.Errorf("OpenAI returned embedding %d for %d texts", item.Index, len(batch))
+			}
+			embedded[item.Index] = item.Embedding
+		}
+		vectors = append(vectors, embedded...)
+	}
+	return vectors, nil
+}
+
+// checkOpenAIModel confirms the API key is accepted and modelName exists.
+func checkOpenAIModel(ctx context.Context, modelName string) error {
+	if err := openAIRequest(ctx, http.MethodGet, "/models/"+url.PathEscape(modelName), nil, nil); err != nil {
+		return fmt.Errorf("OpenAI model %s: %w", modelName, err)
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Webhooks (anomaly, budget and memory alerts) go through an outbox, so a
+// consumer that is briefly down still gets them. postWebhook persists the
+// message to ECHO_OUTBOX_PATH before anything is sent, and a worker delivers
+// it, retrying failures after ECHO_OUTBOX_RETRY_BASE (default 30s), doubling
+// up to an hour, for up to ECHO_OUTBOX_MAX_ATTEMPTS attempts (default 10).
+// A 4xx other than 408 and 429 is not retried. Messages that still fail are
+// dead-lettered to S3 under outbox/dead-letter/, or kept locally when S3 is
+// unavailable; GET /admin/outbox lists them and POST
+// /admin/outbox/{id}/retry sends one again. Each delivery carries the
+// message's ID in X-Echo-Delivery, the same on every retry, so consumers can
+// drop duplicates.
+
+const outboxDeadLetterDir = "outbox/dead-letter/"
+
+type OutboxMessage struct {
+	ID            string          `json:"id"`
+	Name          string          `json:"name"`
+	URL           string          `json:"url"`
+	Payload       json.RawMessage `json:"payload"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt time.Time       `json:"nextAttemptAt"`
+	LastError     string          `json:"lastError,omitempty"`
+}
+
+type outboxState struct {
+	Pending []OutboxMessage `json:"pending"`
+	// Dead holds dead-lettered messages S3 could not take.
+	Dead []OutboxMessage `json:"dead"`
+}
+
+type OutboxView struct {
+	Pending      []OutboxMessage `json:"pending"`
+	DeadLettered []OutboxMessage `json:"deadLettered"`
+}
+
+var (
+	// outboxMutex guards outbox.
+	outboxMutex sync.Mutex
+	outbox      outboxState
+	outboxWake  = make(chan struct{}, 1)
+
+	webhookDeliveries = newCounter("echo_webhook_deliveries", "Webhook delivery attempts, by outcome.")
+)
+
+// errPermanent marks a delivery failure retrying cannot fix.
+var errPermanent = errors.New("rejected")
+
+func outboxPath() string {
+	return envString("ECHO_OUTBOX_PATH", filepath.Join(os.TempDir(), "echo-outbox.json"))
+}
+
+// saveOutboxLocked writes the outbox through; it requires outboxMutex.
+func saveOutboxLocked() {
+	data, err := json.Marshal(outbox)
+	if err == nil {
+		path := outboxPath()
+		tmpPath := path + ".tmp"
+		if err = os.WriteFile(tmpPath, data, 0o600); err == nil {
+			err = os.Rename(tmpPath, path)
+		}
+	}
+	if err != nil {
+		log.Printf("Save outbox failed: %v", err)
+	}
+}
+
+// startOutbox loads undelivered messages and starts delivering them.
+func startOutbox() {
+	data, err := os.ReadFile(outboxPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Load outbox failed: %v", err)
+	} else if err == nil {
+		outboxMutex.Lock()
+		if err := json.Unmarshal(data, &outbox); err != nil {
+			log.Printf("Load outbox failed: %v", err)
+		} else if len(outbox.Pending) > 0 {
+			log.Printf("Outbox: %d webhooks pending delivery", len(outbox.Pending))
+		}
+		outboxMutex.Unlock()
+	}
+	go runOutbox()
+}
+
+// postWebhook queues payload to be posted as JSON to url, if set; name
+// labels it in logs.
+func postWebhook(url string, payload any, name string) {
+	if url == "" {
+		return
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	outboxMutex.Lock()
+	outbox.Pending = append(outbox.Pending, OutboxMessage{ID: newID(), Name: name, URL: url, Payload: body, CreatedAt: now, NextAttemptAt: now})
+	saveOutboxLocked()
+	outboxMutex.Unlock()
+	wakeOutbox()
+}
+
+func wakeOutbox() {
+	select {
+	case outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+func runOutbox() {
+	for {
+		wait := deliverDueMessages()
+		select {
+		case <-outboxWake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// deliverDueMessages attempts every message that is due and returns how long
+// to wait for the next one.
+func deliverDueMessages() time.Duration {
+	outboxMutex.Lock()
+	var due []OutboxMessage
+	now := time.Now()
+	for _, message := range outbox.Pending {
+		if !message.NextAttemptAt.After(now) {
+			due = append(due, message)
+		}
+	}
+	outboxMutex.Unlock()
+
+	for _, message := range due {
+		err := deliverWebhook(message)
+		message.Attempts++
+		switch {
+		case err == nil:
+			webhookDeliveries.add(metricLabels("outcome", "delivered"), 1)
+			finishOutboxMessage(message.ID, nil)
+		case errors.Is(err, errPermanent) || message.Attempts >= max(envInt("ECHO_OUTBOX_MAX_ATTEMPTS", 10), 1):
+			log.Printf("%s webhook failed after %d attempts, dead-lettering: %v", message.Name, message.Attempts, err)
+			webhookDeliveries.add(metricLabels("outcome", "dead_lettered"), 1)
+			message.LastError = err.Error()
+			finishOutboxMessage(message.ID, &message)
+		default:
+			webhookDeliveries.add(metricLabels("outcome", "retried"), 1)
+			backoff := envDuration("ECHO_OUTBOX_RETRY_BASE", 30*time.Second) << min(message.Attempts-1, 16)
+			message.NextAttemptAt = time.Now().Add(min(backoff, time.Hour))
+			message.LastError = err.Error()
+			log.Printf("%s webhook failed, retrying at %s: %v", message.Name, message.NextAttemptAt.Format(time.RFC3339), err)
+			updateOutboxMessage(message)
+		}
+	}
+
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+	wait := time.Hour
+	for _, message := range outbox.Pending {
+		wait = min(wait, time.Until(message.NextAttemptAt))
+	}
+	return max(wait, 0)
+}
+
+func deliverWebhook(message OutboxMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, message.URL, bytes.NewReader(message.Payload))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Echo-Delivery", message.ID)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %s", errPermanent, resp.Status)
+	}
+	return fmt.Errorf("returned %s", resp.Status)
+}
+
+func updateOutboxMessage(message OutboxMessage) {
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+	for i := range outbox.Pending {
+		if outbox.Pending[i].ID == message.ID {
+			outbox.Pending[i] = message
+			saveOutboxLocked()
+			return
+		}
+	}
+}
+
+// finishOutboxMessage drops a message from the pending list, dead-lettering
+// dead if set.
+func finishOutboxMessage(id string, dead *OutboxMessage) {
+	if dead != nil && deadLetterToS3(*dead) {
+		dead = nil
+	}
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+	for i := range outbox.Pending {
+		if outbox.Pending[i].ID == id {
+			outbox.Pending = append(outbox.Pending[:i], outbox.Pending[i+1:]...)
+			break
+		}
+	}
+	if dead != nil {
+		outbox.Dead = append(outbox.Dead, *dead)
+	}
+	saveOutboxLocked()
+}
+
+// deadLetterToS3 writes message to S3 and reports whether it did.
+func deadLetterToS3(message OutboxMessage) bool {
+	target := activeS3Target()
+	if target == nil {
+		return false
+	}
+	body, err := json.Marshal(message)
+	if err != nil {
+		return false
+	}
+	key := outboxDeadLetterDir + "dt=" + time.Now().UTC().Format("2006-01-02") + "/" + message.ID + ".json"
+	if err := putObject(target, key, body, "application/json", ""); err != nil {
+		log.Printf("Dead-letter %s to S3 failed, keeping it locally: %v", message.ID, err)
+		return false
+	}
+	return true
+}
+
+func handleOutbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	outboxMutex.Lock()
+	view := OutboxView{
+		Pending:      append(make([]OutboxMessage, 0, len(outbox.Pending)), outbox.Pending...),
+		DeadLettered: append(make([]OutboxMessage, 0, len(outbox.Dead)), outbox.Dead...),
+	}
+	outboxMutex.Unlock()
+	writeJSON(w, http.StatusOK, view)
+}
+
+// handleOutboxRetry queues a locally dead-lettered message again.
+func handleOutboxRetry(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	id := r.PathValue("id")
+	outboxMutex.Lock()
+	var message *OutboxMessage
+	for i := range outbox.Dead {
+		if outbox.Dead[i].ID == id {
+			retry := outbox.Dead[i]
+			message = &retry
+			outbox.Dead = append(outbox.Dead[:i], outbox.Dead[i+1:]...)
+			break
+		}
+	}
+	if message != nil {
+		message.Attempts = 0
+		message.NextAttemptAt = time.Now()
+		outbox.Pending = append(outbox.Pending, *message)
+		saveOutboxLocked()
+	}
+	outboxMutex.Unlock()
+	if message == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "dead-lettered message not found"})
+		return
+	}
+	wakeOutbox()
+	recordAudit(AuditEvent{Action: "outbox.retry", Actor: "admin", Details: map[string]string{"id": id, "name": message.Name}})
+	writeJSON(w, http.StatusAccepted, message)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Paraphrase augmentation widens popular entries. On the cron schedule
+// ECHO_PARAPHRASE_SCHEDULE (off by default; pick an off-peak time such as
+// "0 4 * * *") the cheapest model rewrites the questions of the most hit
+// entries, ECHO_PARAPHRASE_MIN_HITS hits or more (default 5), into
+// ECHO_PARAPHRASE_COUNT other wordings (default 3). The wordings are embedded
+// and indexed alongside the entry, so a question phrased like any of them
+// is a hit on it. ECHO_PARAPHRASE_MAX_ENTRIES (default 20) caps the entries
+// per run.
+//
+// Paraphrases are embedded server-side, so only entries whose vectors come
+// from the server's embedding model (ECHO_RAG_EMBEDDING_MODEL, or the mock
+// embedder) can be augmented; vectors from another model would not be
+// comparable.
+
+const paraphrasePrompt = "Rewrite the question below in %d different ways a user might ask it, keeping its meaning. " +
+	"Reply with one question per line and nothing else.\n\nQuestion: %s"
+
+// Paraphrase is another wording of an entry's question with its embedding.
+type Paraphrase struct {
+	Question string
+	Vector   []float32
+}
+
+type ParaphraseRun struct {
+	StartedAt   time.Time `json:"startedAt"`
+	FinishedAt  time.Time `json:"finishedAt"`
+	Augmented   int       `json:"augmented"`
+	Paraphrases int       `json:"paraphrases"`
+	Failed      int       `json:"failed"`
+	Skipped     string    `json:"skipped,omitempty"`
+}
+
+type ParaphraseScheduleView struct {
+	Schedule   string         `json:"schedule"`
+	NextRun    time.Time      `json:"nextRun,omitempty"`
+	LastRun    *ParaphraseRun `json:"lastRun,omitempty"`
+	Candidates int            `json:"candidates"`
+}
+
+var (
+	// paraphraseRunMutex serializes runs; paraphraseMutex guards the fields
+	// below.
+	paraphraseRunMutex sync.Mutex
+	paraphraseMutex    sync.Mutex
+	paraphraseNextRun  time.Time
+	paraphraseLastRun  *ParaphraseRun
+)
+
+func startParaphraseSchedule() {
+	raw := envString("ECHO_PARAPHRASE_SCHEDULE", "")
+	if raw == "" {
+		return
+	}
+	schedule, err := parseCron(raw)
+	if err != nil {
+		log.Printf("Paraphrase augmentation disabled: %v", err)
+		return
+	}
+	go func() {
+		for {
+			next := schedule.next(time.Now())
+			if next.IsZero() {
+				log.Printf("Paraphrase augmentation: %q never matches; stopping", raw)
+				return
+			}
+			paraphraseMutex.Lock()
+			paraphraseNextRun = next
+			paraphraseMutex.Unlock()
+
+			time.Sleep(time.Until(next))
+			runParaphraseAugmentation()
+		}
+	}()
+}
+
+// paraphraseCandidates returns entries worth augmenting, most hit first.
+func paraphraseCandidates() []VectorEntry {
+	minHits := envInt("ECHO_PARAPHRASE_MIN_HITS", 5)
+	model := serverEmbeddingModel()
+
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+	var entries []VectorEntry
+	for _, entry := range MockVectorDB {
+		if entry.HitCount >= minHits && len(entry.Paraphrases) == 0 && entryEmbeddingModel(entry) == model {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].HitCount > entries[j].HitCount })
+	return entries
+}
+
+// parseParaphrases takes up to count distinct questions, one per line,
+// dropping list markers and restatements of question.
+func parseParaphrases(reply, question string, count int) []string {
+	seen := map[string]struct{}{strings.ToLower(strings.Join(strings.Fields(question), " ")): {}}
+	var paraphrases []string
+	for _, line := range strings.Split(reply, "\n") {
+		line = strings.TrimLeftFunc(line, func(r rune) bool {
+			return unicode.IsSpace(r) || unicode.IsDigit(r) || strings.ContainsRune("-*•.)", r)
+		})
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" {
+			continue
+		}
+		key := strings.ToLower(line)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		paraphrases = append(paraphrases, line)
+		if len(paraphrases) == count {
+			break
+		}
+	}
+	return paraphrases
+}
+
+// generateParaphrases asks the cheapest model for wordings of entry's
+// question and embeds them.
+func generateParaphrases(ctx context.Context, entry VectorEntry, count int) ([]Paraphrase, error) {
+	model := cheapestModel()
+	prompt := fmt.Sprintf(paraphrasePrompt, count, entry.Question)
+	reply, err := generateAnswer(ctx, prompt, model)
+	if err != nil {
+		return nil, err
+	}
+	recordUsage(Caller{Tenant: entry.Tenant}, model, "CLOUD", estimateTokens(prompt)+estimateTokens(reply), 0)
+
+	questions := parseParaphrases(reply, entry.Question, count)
+	if len(questions) == 0 {
+		return nil, fmt.Errorf("no paraphrases in reply")
+	}
+	vectors, embeddingModel, err := embedTexts(ctx, questions)
+	if err != nil {
+		return nil, err
+	}
+	if embeddingModel != entryEmbeddingModel(entry) {
+		return nil, fmt.Errorf("embedding model changed to %s", embeddingModel)
+	}
+	paraphrases := make([]Paraphrase, len(questions))
+	for i, question := range questions {
+		paraphrases[i] = Paraphrase{Question: question, Vector: reduceVector(vectors[i])}
+	}
+	return paraphrases, nil
+}
+
+func paraphraseQuestions(entry VectorEntry) []string {
+	var questions []string
+	for _, paraphrase := range entry.Paraphrases {
+		questions = append(questions, paraphrase.Question)
+	}
+	return questions
+}
+
+// attachParaphrases stores paraphrases on the entry with id, if it still
+// exists. The indexes pick them up when they are rebuilt.
+func attachParaphrases(id string, paraphrases []Paraphrase) bool {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	for i := range MockVectorDB {
+		if MockVectorDB[i].ID != id {
+			continue
+		}
+		MockVectorDB[i].Paraphrases = paraphrases
+		bloomAddLocked(MockVectorDB[i])
+		markCacheChanged()
+		recordCacheChange(changeUpdated, MockVectorDB[i])
+		return true
+	}
+	return false
+}
+
+func runParaphraseAugmentation() (run ParaphraseRun) {
+	paraphraseRunMutex.Lock()
+	defer paraphraseRunMutex.Unlock()
+
+	run.StartedAt = time.Now()
+	defer func() {
+		run.FinishedAt = time.Now()
+		paraphraseMutex.Lock()
+		paraphraseLastRun = &run
+		paraphraseMutex.Unlock()
+	}()
+
+	if currentMaintenance().Enabled {
+		run.Skipped = "maintenance"
+		return run
+	}
+
+	count := max(envInt("ECHO_PARAPHRASE_COUNT", 3), 1)
+	maxEntries := envInt("ECHO_PARAPHRASE_MAX_ENTRIES", 20)
+	for _, entry := range paraphraseCandidates() {
+		if run.Augmented+run.Failed >= maxEntries {
+			break
+		}
+		if _, exhausted := budgetExhausted(entry.Tenant); exhausted {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		paraphrases, err := generateParaphrases(ctx, entry, count)
+		cancel()
+		if err != nil {
+			log.Printf("Paraphrasing entry %s failed: %v", entry.ID, err)
+			run.Failed++
+			continue
+		}
+		if attachParaphrases(entry.ID, paraphrases) {
+			run.Augmented++
+			run.Paraphrases += len(paraphrases)
+		}
+	}
+	if run.Augmented > 0 {
+		dbMutex.Lock()
+		invalidateIndexLocked()
+		dbMutex.Unlock()
+	}
+	log.Printf("Paraphrase augmentation: %d entries augmented with %d paraphrases, %d failed", run.Augmented, run.Paraphrases, run.Failed)
+	return run
+}
+
+// handleParaphrases shows the schedule (GET) or runs augmentation now
+// (POST).
+func handleParaphrases(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method == http.MethodPost {
+		run := runParaphraseAugmentation()
+		recordAudit(AuditEvent{
+			Action:  "cache.paraphrase",
+			Actor:   "admin",
+			Details: map[string]string{"augmented": strconv.Itoa(run.Augmented), "paraphrases": strconv.Itoa(run.Paraphrases)},
+		})
+		writeJSON(w, http.StatusOK, run)
+		return
+	}
+
+	view := ParaphraseScheduleView{Schedule: envString("ECHO_PARAPHRASE_SCHEDULE", ""), Candidates: len(paraphraseCandidates())}
+	paraphraseMutex.Lock()
+	view.NextRun = paraphraseNextRun
+	view.LastRun = paraphraseLastRun
+	paraphraseMutex.Unlock()
+	writeJSON(w, http.StatusOK, view)
+}
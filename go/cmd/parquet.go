@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// A minimal Parquet writer for the analytics export: flat schemas of
+// required columns, one row group, one uncompressed PLAIN-encoded data page
+// per column. That is all Athena, BigQuery and DuckDB need to read a table,
+// and it saves pulling in a Parquet library for a few hundred lines of
+// format. Metadata is Thrift compact protocol, per parquet-format's
+// parquet.thrift; the field IDs below refer to it.
+
+const (
+	parquetBoolean   int32 = 0
+	parquetInt64     int32 = 2
+	parquetDouble    int32 = 5
+	parquetByteArray int32 = 6
+
+	parquetNoConversion    int32 = -1
+	parquetUTF8            int32 = 0
+	parquetTimestampMillis int32 = 9
+
+	parquetMagic = "PAR1"
+)
+
+// Thrift compact protocol type IDs.
+const (
+	thriftI32    byte = 5
+	thriftI64    byte = 6
+	thriftBinary byte = 8
+	thriftList   byte = 9
+	thriftStruct byte = 12
+)
+
+type parquetColumn struct {
+	name      string
+	physical  int32
+	converted int32
+	data      bytes.Buffer
+	bools     []bool
+	count     int
+}
+
+func newParquetColumn(name string, physical, converted int32) *parquetColumn {
+	return &parquetColumn{name: name, physical: physical, converted: converted}
+}
+
+func stringColumn(name string) *parquetColumn {
+	return newParquetColumn(name, parquetByteArray, parquetUTF8)
+}
+
+func int64Column(name string) *parquetColumn {
+	return newParquetColumn(name, parquetInt64, parquetNoConversion)
+}
+
+func timestampColumn(name string) *parquetColumn {
+	return newParquetColumn(name, parquetInt64, parquetTimestampMillis)
+}
+
+func doubleColumn(name string) *parquetColumn {
+	return newParquetColumn(name, parquetDouble, parquetNoConversion)
+}
+
+func boolColumn(name string) *parquetColumn {
+	return newParquetColumn(name, parquetBoolean, parquetNoConversion)
+}
+
+func (c *parquetColumn) appendString(s string) {
+	binary.Write(&c.data, binary.LittleEndian, uint32(len(s)))
+	c.data.WriteString(s)
+	c.count++
+}
+
+func (c *parquetColumn) appendInt64(v int64) {
+	binary.Write(&c.data, binary.LittleEndian, v)
+	c.count++
+}
+
+func (c *parquetColumn) appendTime(t time.Time) {
+	c.appendInt64(t.UnixMilli())
+}
+
+func (c *parquetColumn) appendDouble(v float64) {
+	binary.Write(&c.data, binary.LittleEndian, math.Float64bits(v))
+	c.count++
+}
+
+func (c *parquetColumn) appendBool(b bool) {
+	c.bools = append(c.bools, b)
+	c.count++
+}
+
+// values returns the column's PLAIN encoding; booleans are bit-packed, least
+// significant bit first.
+func (c *parquetColumn) values() []byte {
+	if c.physical != parquetBoolean {
+		return c.data.Bytes()
+	}
+	packed := make([]byte, (len(c.bools)+7)/8)
+	for i, b := range c.bools {
+		if b {
+			packed[i/8] |= 1 << (i % 8)
+		}
+	}
+	return packed
+}
+
+// thriftWriter encodes Thrift compact protocol structs.
+type thriftWriter struct {
+	buf bytes.Buffer
+	// lastField holds the previous field ID of each open struct.
+	lastField []int16
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	t.buf.Write(binary.AppendUvarint(nil, v))
+}
+
+func (t *thriftWriter) zigzag(v int64) {
+	t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) field(id int16, kind byte) {
+	last := &t.lastField[len(t.lastField)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | kind)
+	} else {
+		t.buf.WriteByte(kind)
+		t.zigzag(int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) beginStruct() {
+	t.lastField = append(t.lastField, 0)
+}
+
+func (t *thriftWriter) endStruct() {
+	t.buf.WriteByte(0)
+	t.lastField = t.lastField[:len(t.lastField)-1]
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.zigzag(v)
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.varint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+func (t *thriftWriter) list(id int16, kind byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | kind)
+		return
+	}
+	t.buf.WriteByte(0xf0 | kind)
+	t.varint(uint64(size))
+}
+
+// dataPageHeader encodes a PageHeader for a PLAIN data page of required
+// values.
+func dataPageHeader(numValues, size int) []byte {
+	var t thriftWriter
+	t.beginStruct()
+	t.i32(1, 0) // DATA_PAGE
+	t.i32(2, int32(size))
+	t.i32(3, int32(size))
+	t.field(5, thriftStruct)
+	t.beginStruct()
+	t.i32(1, int32(numValues))
+	t.i32(2, 0) // PLAIN
+	t.i32(3, 3) // RLE
+	t.i32(4, 3) // RLE
+	t.endStruct()
+	t.endStruct()
+	return t.buf.Bytes()
+}
+
+// encodeParquet writes columns, which must all hold rows values, as a
+// Parquet file.
+func encodeParquet(columns []*parquetColumn, rows int) []byte {
+	type chunk struct {
+		offset int64
+		size   int64
+	}
+	var out bytes.Buffer
+	out.WriteString(parquetMagic)
+	chunks := make([]chunk, len(columns))
+	var totalSize int64
+	for i, column := range columns {
+		values := column.values()
+		header := dataPageHeader(column.count, len(values))
+		chunks[i] = chunk{offset: int64(out.Len()), size: int64(len(header) + len(values))}
+		totalSize += chunks[i].size
+		out.Write(header)
+		out.Write(values)
+	}
+
+	var t thriftWriter
+	t.beginStruct()
+	t.i32(1, 1)
+	t.list(2, thriftStruct, len(columns)+1)
+	t.beginStruct()
+	t.binary(4, "schema")
+	t.i32(5, int32(len(columns)))
+	t.endStruct()
+	for _, column := range columns {
+		t.beginStruct()
+		t.i32(1, column.physical)
+		t.i32(3, 0) // REQUIRED
+		t.binary(4, column.name)
+		if column.converted != parquetNoConversion {
+			t.i32(6, column.converted)
+		}
+		t.endStruct()
+	}
+	t.i64(3, int64(rows))
+	t.list(4, thriftStruct, 1)
+	t.beginStruct()
+	t.list(1, thriftStruct, len(columns))
+	for i, column := range columns {
+		t.beginStruct()
+		t.i64(2, chunks[i].offset)
+		t.field(3, thriftStruct)
+		t.beginStruct()
+		t.i32(1, column.physical)
+		t.list(2, thriftI32, 1)
+		t.zigzag(0) // PLAIN
+		t.list(3, thriftBinary, 1)
+		t.varint(uint64(len(column.name)))
+		t.buf.WriteString(column.name)
+		t.i32(4, 0) // UNCOMPRESSED
+		t.i64(5, int64(column.count))
+		t.i64(6, chunks[i].size)
+		t.i64(7, chunks[i].size)
+		t.i64(9, chunks[i].offset)
+		t.endStruct()
+		t.endStruct()
+	}
+	t.i64(2, totalSize)
+	t.i64(3, int64(rows))
+	t.endStruct()
+	t.binary(6, "echo")
+	t.endStruct()
+
+	out.Write(t.buf.Bytes())
+	binary.Write(&out, binary.LittleEndian, uint32(t.buf.Len()))
+	out.WriteString(parquetMagic)
+	return out.Bytes()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Pinning marks a history item as important. The cache entry that served or
+// stored the item's answer (its CacheEntryID) is pinned too, which protects
+// it from demotion and archival, and stays pinned while any pinned item
+// refers to it.
+
+type PinResponse struct {
+	Item        HistoryItem `json:"item"`
+	EntryPinned bool        `json:"cacheEntryPinned"`
+}
+
+// setPinned updates the caller's history item and the hot-tier cache entry it
+// refers to, and reports whether that entry is pinned afterwards.
+func setPinned(caller Caller, id string, pinned bool) (HistoryItem, bool, bool) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	idx := -1
+	for i := range ChatHistory {
+		if ChatHistory[i].ID == id && historyVisible(ChatHistory[i], caller) {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return HistoryItem{}, false, false
+	}
+	ChatHistory[idx].Pinned = pinned
+	item := ChatHistory[idx]
+
+	if item.CacheEntryID == "" {
+		return item, false, true
+	}
+	if !pinned {
+		// Another pinned item still protects the entry.
+		for _, other := range ChatHistory {
+			if other.Pinned && other.CacheEntryID == item.CacheEntryID {
+				return item, true, true
+			}
+		}
+	}
+	for i := range MockVectorDB {
+		entry := &MockVectorDB[i]
+		if entry.ID != item.CacheEntryID || entry.Tenant != caller.Tenant || !entryVisible(*entry, caller) {
+			continue
+		}
+		if entry.Pinned != pinned {
+			entry.Pinned = pinned
+			recordCacheChange(changeUpdated, *entry)
+			markCacheChanged()
+		}
+		return item, pinned, true
+	}
+	return item, false, true
+}
+
+// handlePin pins (POST) or unpins (DELETE) a history item.
+func handlePin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if rejectAnonymous(w, caller, "pinning") {
+		return
+	}
+
+	item, entryPinned, found := setPinned(caller, r.PathValue("id"), r.Method == http.MethodPost)
+	if !found {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "history item not found"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, PinResponse{Item: item, EntryPinned: entryPinned})
+}
+
+func handlePinned(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if rejectAnonymous(w, caller, "history") {
+		return
+	}
+
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	pinned := make([]HistoryItem, 0)
+	for i := len(ChatHistory) - 1; i >= 0; i-- {
+		if ChatHistory[i].Pinned && historyVisible(ChatHistory[i], caller) {
+			pinned = append(pinned, ChatHistory[i])
+		}
+	}
+	writeJSON(w, http.StatusOK, pinned)
+}
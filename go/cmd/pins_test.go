@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+// withCache replaces the cache and history for the duration of a test.
+func withCache(t *testing.T, entries []VectorEntry, history []HistoryItem) {
+	t.Helper()
+	dbMutex.Lock()
+	savedEntries, savedHistory := MockVectorDB, ChatHistory
+	MockVectorDB, ChatHistory = entries, history
+	invalidateIndexLocked()
+	dbMutex.Unlock()
+	t.Cleanup(func() {
+		dbMutex.Lock()
+		MockVectorDB, ChatHistory = savedEntries, savedHistory
+		invalidateIndexLocked()
+		dbMutex.Unlock()
+	})
+}
+
+func TestPinFollowsCacheEntryID(t *testing.T) {
+	caller := Caller{Tenant: "acme"}
+	withCache(t,
+		[]VectorEntry{
+			{ID: "e1", Tenant: "acme", Owner: sharedOwner, Question: "q1", Answer: "same answer"},
+			{ID: "e2", Tenant: "acme", Owner: sharedOwner, Question: "q2", Answer: "same answer"},
+		},
+		[]HistoryItem{
+			{ID: "h1", Tenant: "acme", Answer: "same answer", CacheEntryID: "e1"},
+			{ID: "h2", Tenant: "acme", Answer: "same answer", CacheEntryID: "e1"},
+			{ID: "h3", Tenant: "acme", Answer: "gone", CacheEntryID: "e9"},
+		},
+	)
+	pinned := func(id string) bool {
+		for _, entry := range MockVectorDB {
+			if entry.ID == id {
+				return entry.Pinned
+			}
+		}
+		t.Fatalf("entry %s missing", id)
+		return false
+	}
+
+	if _, entryPinned, ok := setPinned(caller, "h1", true); !ok || !entryPinned {
+		t.Fatalf("pin h1: found %v, entry pinned %v", ok, entryPinned)
+	}
+	if !pinned("e1") || pinned("e2") {
+		t.Fatalf("pin h1 pinned e1=%v e2=%v; want only e1", pinned("e1"), pinned("e2"))
+	}
+
+	setPinned(caller, "h2", true)
+	if _, entryPinned, _ := setPinned(caller, "h1", false); !entryPinned || !pinned("e1") {
+		t.Fatal("unpinning h1 unpinned e1 while h2 is still pinned")
+	}
+	if _, entryPinned, _ := setPinned(caller, "h2", false); entryPinned || pinned("e1") {
+		t.Fatal("e1 still pinned after unpinning every item")
+	}
+
+	if _, entryPinned, ok := setPinned(caller, "h3", true); !ok || entryPinned {
+		t.Fatalf("pin h3 without an entry: found %v, entry pinned %v", ok, entryPinned)
+	}
+	if _, _, ok := setPinned(Caller{Tenant: "globex"}, "h1", true); ok {
+		t.Fatal("pinned another tenant's history item")
+	}
+}
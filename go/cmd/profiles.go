@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+)
+
+// API key profiles centralize client policy. ECHO_API_KEY_PROFILES is a JSON
+// object keyed by API key name; each profile supplies the model, temperature,
+// similarity threshold and sharing a request gets when it omits them, and
+// limits what the key may do with the cache: "all" (default) reads and
+// writes, "read" serves hits but never stores answers, "none" always asks the
+// provider. Tenant model policies still apply to a profile's model.
+
+const (
+	cacheAccessAll  = "all"
+	cacheAccessRead = "read"
+	cacheAccessNone = "none"
+)
+
+type KeyProfile struct {
+	Model               string   `json:"model,omitempty"`
+	Temperature         *float64 `json:"temperature,omitempty"`
+	SimilarityThreshold float64  `json:"similarityThreshold,omitempty"`
+	Share               *bool    `json:"share,omitempty"`
+	CacheAccess         string   `json:"cacheAccess,omitempty"`
+}
+
+func parseKeyProfiles(raw string) (map[string]KeyProfile, error) {
+	var profiles map[string]KeyProfile
+	if err := json.Unmarshal([]byte(raw), &profiles); err != nil {
+		return nil, err
+	}
+	for name, profile := range profiles {
+		profile.CacheAccess = strings.ToLower(profile.CacheAccess)
+		if profile.CacheAccess == "" {
+			profile.CacheAccess = cacheAccessAll
+		}
+		profiles[name] = profile
+	}
+	return profiles, nil
+}
+
+// keyProfile returns the caller's API key profile; callers without one get
+// the zero profile with full cache access.
+func keyProfile(caller Caller) KeyProfile {
+	fallback := KeyProfile{CacheAccess: cacheAccessAll}
+	raw := envString("ECHO_API_KEY_PROFILES", "")
+	if raw == "" || caller.APIKey == "" {
+		return fallback
+	}
+	profiles, err := parseKeyProfiles(raw)
+	if err != nil {
+		log.Printf("Invalid ECHO_API_KEY_PROFILES: %v", err)
+		return fallback
+	}
+	if profile, ok := profiles[caller.APIKey]; ok {
+		return profile
+	}
+	return fallback
+}
+
+// applyProfile fills the fields req left empty from profile.
+func applyProfile(req *Request, profile KeyProfile) {
+	if req.Model == "" {
+		req.Model = profile.Model
+	}
+	if req.Temperature == nil {
+		req.Temperature = profile.Temperature
+	}
+	if req.SimilarityThreshold == 0 {
+		req.SimilarityThreshold = profile.SimilarityThreshold
+	}
+	if req.Share == nil {
+		req.Share = profile.Share
+	}
+}
+
+type temperatureKey struct{}
+
+// withTemperature asks the provider to sample at temperature for calls made
+// with the returned context.
+func withTemperature(ctx context.Context, temperature *float64) context.Context {
+	if temperature == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, temperatureKey{}, *temperature)
+}
+
+func temperatureFrom(ctx context.Context) (float64, bool) {
+	temperature, ok := ctx.Value(temperatureKey{}).(float64)
+	return temperature, ok
+}
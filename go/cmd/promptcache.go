@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"strconv"
+	"sync"
+)
+
+// The prompt cache sits in front of the semantic cache. It maps a hash of
+// everything that shapes an answer (tenant, user, model, embedding model,
+// style instruction, locale, grounding, temperature, the effective similarity
+// threshold and the exact question) to the cache entry that answered it, so a
+// repeated request skips the vector search entirely. Only entries whose own
+// question is the prompt are remembered, with the similarity they matched at;
+// a paraphrase hit keeps going through the semantic layer. It stores entry
+// IDs, not answers: a refreshed entry serves its new answer, and a deleted or
+// merged one simply misses and falls through to the semantic layer.
+// ECHO_PROMPT_CACHE_SIZE bounds it (default 10000, 0 disables); the oldest
+// prompts are forgotten first. The "prompt_cache" feature flag can limit it to
+// some callers.
+
+type promptKey [sha256.Size]byte
+
+type promptHit struct {
+	ID         string
+	Similarity float64
+}
+
+type PromptCacheStats struct {
+	Size   int `json:"size"`
+	Hits   int `json:"hits"`
+	Misses int `json:"misses"`
+}
+
+var (
+	// promptMutex guards the fields below.
+	promptMutex   sync.Mutex
+	promptEntries = make(map[promptKey]promptHit)
+	// promptOrder holds keys oldest first, for eviction.
+	promptOrder []promptKey
+	promptStats PromptCacheStats
+)
+
+func promptCacheSize() int {
+	return envInt("ECHO_PROMPT_CACHE_SIZE", 10000)
+}
+
+func promptCacheEnabled(caller Caller) bool {
+	return promptCacheSize() > 0 && featureEnabledOr("prompt_cache", caller, true)
+}
+
+func promptCacheKey(caller Caller, query cacheQuery, model, locale string, rag bool, temperature *float64) promptKey {
+	h := sha256.New()
+	sampling := ""
+	if temperature != nil {
+		sampling = strconv.FormatFloat(*temperature, 'g', -1, 64)
+	}
+	// The threshold is the one left after the caller's profile and any
+	// experiment arm, so a stricter caller never replays a looser match.
+	threshold := strconv.FormatFloat(query.threshold(), 'g', -1, 64)
+	for _, part := range []string{caller.Tenant, caller.User, model, query.EmbeddingModel, styleInstructions[query.Style], locale, strconv.FormatBool(rag), sampling, threshold, query.Text} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	var key promptKey
+	h.Sum(key[:0])
+	return key
+}
+
+// lookupPrompt returns the hot-tier entry last served for key, if the caller
+// may still see it.
+func lookupPrompt(caller Caller, key promptKey) (VectorEntry, bool) {
+	if !promptCacheEnabled(caller) {
+		return VectorEntry{}, false
+	}
+	promptMutex.Lock()
+	hit, ok := promptEntries[key]
+	if !ok {
+		promptStats.Misses++
+	}
+	promptMutex.Unlock()
+	if !ok {
+		return VectorEntry{}, false
+	}
+
+	// The entry may not be written yet, or may be gone; either way the
+	// semantic layer gets the request.
+	entry, found := findEntryForCaller(caller, hit.ID)
+	promptMutex.Lock()
+	if found {
+		promptStats.Hits++
+	} else {
+		promptStats.Misses++
+	}
+	promptMutex.Unlock()
+	if !found {
+		return VectorEntry{}, false
+	}
+	touchEntry(entry.Seq)
+	entry.Similarity = hit.Similarity
+	return entry, true
+}
+
+// rememberPrompt records that entryID, matched at similarity, answered the
+// prompt behind key.
+func rememberPrompt(caller Caller, key promptKey, entryID string, similarity float64) {
+	if !promptCacheEnabled(caller) || entryID == "" {
+		return
+	}
+	size := promptCacheSize()
+	promptMutex.Lock()
+	defer promptMutex.Unlock()
+	if _, exists := promptEntries[key]; !exists {
+		promptOrder = append(promptOrder, key)
+	}
+	promptEntries[key] = promptHit{ID: entryID, Similarity: similarity}
+	for len(promptOrder) > size {
+		delete(promptEntries, promptOrder[0])
+		promptOrder = promptOrder[1:]
+	}
+}
+
+func currentPromptCacheStats() PromptCacheStats {
+	promptMutex.Lock()
+	defer promptMutex.Unlock()
+	stats := promptStats
+	stats.Size = len(promptEntries)
+	return stats
+}
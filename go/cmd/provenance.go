@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Provenance records who and what produced each cached answer, for
+// organizations that govern AI output: the contributing user, the chat model
+// and provider, when it was generated, and an optional license tag. New
+// entries take the tag ECHO_DEFAULT_LICENSE (empty by default); the
+// contributor or an admin changes it with POST /cache/{id}/license. Tags are
+// free-form but short, such as an SPDX identifier ("CC-BY-4.0") or an
+// internal classification ("internal-only").
+
+var licensePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:+-]{0,63}$`)
+
+type LicenseRequest struct {
+	// License is the new tag; an empty one clears it.
+	License string `json:"license"`
+}
+
+func defaultLicense() string {
+	return strings.TrimSpace(envString("ECHO_DEFAULT_LICENSE", ""))
+}
+
+// setEntryLicense changes the license tag of the entry with id.
+func setEntryLicense(id, license string) (VectorEntry, bool) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	for i := range MockVectorDB {
+		if MockVectorDB[i].ID != id {
+			continue
+		}
+		MockVectorDB[i].License = license
+		markCacheChanged()
+		recordCacheChange(changeUpdated, MockVectorDB[i])
+		return MockVectorDB[i], true
+	}
+	return VectorEntry{}, false
+}
+
+func handleEntryLicense(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if caller.Anonymous {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "licensing is not available in demo mode"})
+		return
+	}
+
+	var req LicenseRequest
+	if err := readJSON(r, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON payload"})
+		return
+	}
+	license := strings.TrimSpace(req.License)
+	if license != "" && !licensePattern.MatchString(license) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid license tag"})
+		return
+	}
+
+	entry, actor, ok := entryForCurator(w, r, caller)
+	if !ok {
+		return
+	}
+	updated, found := setEntryLicense(entry.ID, license)
+	if !found {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "cache entry not found"})
+		return
+	}
+	recordAudit(AuditEvent{
+		Action:  "cache.license",
+		EntryID: entry.ID,
+		Tenant:  caller.Tenant,
+		Actor:   actor,
+		Details: map[string]string{"from": entry.License, "to": license},
+	})
+	writeJSON(w, http.StatusOK, entryView(updated))
+}
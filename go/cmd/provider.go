@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// PROVIDER selects where cache misses are answered. "gemini" (the default)
+// calls the Gemini API; "mock" returns deterministic canned answers so the
+// whole pipeline can run without an API key. Each request's model picks the
+// provider that answers it, so with PROVIDER=gemini a request may still name
+// an OpenAI model; PROVIDER=openai makes an OpenAI model the default and
+// embeds server-side content with OpenAI as well.
+
+const (
+	providerGemini = "gemini"
+	providerOpenAI = "openai"
+	providerMock   = "mock"
+)
+
+// providerUsage is the token usage a provider reported for one answer; it is
+// zero when the provider reported none.
+type providerUsage struct {
+	PromptTokens int
+	AnswerTokens int
+	// HedgeTokens is what the losing call of a hedged answer cost, and
+	// HedgeEstimated whether that is an estimate; see hedgedCall.
+	HedgeTokens    int
+	HedgeEstimated bool
+}
+
+// tokens returns the reported usage of the answer itself, or an estimate
+// from prompt and answer when there is none.
+func (u providerUsage) tokens(prompt, answer string) int {
+	if total := u.PromptTokens + u.AnswerTokens; total > 0 {
+		return total
+	}
+	return estimateTokens(prompt) + estimateTokens(answer)
+}
+
+var mockAnswers = []string{
+	"This is a mock answer. Set PROVIDER=gemini to get real responses.",
+	"Mock provider: the answer to your question would appear here.",
+	"Mock provider: caching, history and stats work exactly as with a real model.",
+	"Mock provider: try asking a similar question to see a cache hit.",
+}
+
+func activeProvider() string {
+	return strings.ToLower(strings.TrimSpace(envString("PROVIDER", providerGemini)))
+}
+
+// defaultModel is the model used when neither the request nor the tenant's
+// policy names one.
+func defaultModel() string {
+	if activeProvider() == providerOpenAI {
+		return defaultOpenAIModel
+	}
+	return defaultGeminiModel
+}
+
+// modelProvider names the provider that answers with modelName.
+func modelProvider(modelName string) string {
+	if activeProvider() == providerMock {
+		return providerMock
+	}
+	if provider, ok := supportedModels[modelName]; ok {
+		return provider
+	}
+	return providerGemini
+}
+
+// modelAvailable reports whether modelName's provider is configured.
+func modelAvailable(modelName string) bool {
+	switch modelProvider(modelName) {
+	case providerGemini:
+		return os.Getenv("GEMINI_API_KEY") != ""
+	case providerOpenAI:
+		return os.Getenv("OPENAI_API_KEY") != ""
+	}
+	return true
+}
+
+// generateAnswer answers prompt with the provider serving modelName, for
+// work the server does on its own behalf.
+func generateAnswer(ctx context.Context, prompt string, modelName string) (string, error) {
+	answer, _, err := generateAnswerUsage(ctx, Caller{}, prompt, modelName)
+	return answer, err
+}
+
+// generateAnswerUsage is generateAnswer that also returns the provider's
+// token usage. Slow calls are hedged and successful ones feed the latency
+// observations; see latency.go.
+func generateAnswerUsage(ctx context.Context, caller Caller, prompt string, modelName string) (string, providerUsage, error) {
+	start := time.Now()
+	answer, usage, err := hedgedCall(ctx, caller, prompt, modelName)
+	if err == nil {
+		observeProviderLatency(modelName, time.Since(start))
+	}
+	return answer, usage, err
+}
+
+func callProvider(ctx context.Context, prompt string, modelName string) (string, providerUsage, error) {
+	switch modelProvider(modelName) {
+	case providerMock:
+		answer, err := callMock(ctx, prompt, modelName)
+		return answer, providerUsage{}, err
+	case providerOpenAI:
+		return callOpenAI(ctx, prompt, modelName)
+	}
+	return callGemini(ctx, prompt, modelName)
+}
+
+// checkProviderModel confirms modelName's provider accepts its API key.
+func checkProviderModel(ctx context.Context, modelName string) error {
+	if modelProvider(modelName) == providerOpenAI {
+		return checkOpenAIModel(ctx, modelName)
+	}
+	return checkGeminiModel(ctx, modelName)
+}
+
+// embedTexts embeds texts server-side with the configured provider and
+// returns the vectors with the embedding model's name. Chat vectors still come
+// from the client; this is for content the server ingests itself.
+func embedTexts(ctx context.Context, texts []string) ([][]float32, string, error) {
+	model := serverEmbeddingModel()
+	switch activeProvider() {
+	case providerMock:
+		return embedMock(texts), model, nil
+	case providerOpenAI:
+		vectors, err := embedOpenAI(ctx, texts, model)
+		return vectors, model, err
+	}
+	vectors, err := embedGemini(ctx, texts, model)
+	return vectors, model, err
+}
+
+// embedTextsFor embeds texts on behalf of caller and meters the call to it,
+// with source EMBED.
+func embedTextsFor(ctx context.Context, caller Caller, texts []string) ([][]float32, string, error) {
+	vectors, model, err := embedTexts(ctx, texts)
+	if err != nil {
+		return nil, "", err
+	}
+	tokens := 0
+	for _, text := range texts {
+		tokens += estimateTokens(text)
+	}
+	recordUsage(caller, model, "EMBED", tokens, 0)
+	return vectors, model, nil
+}
+
+// serverEmbeddingModel names the model embedTexts uses.
+func serverEmbeddingModel() string {
+	switch activeProvider() {
+	case providerMock:
+		return mockEmbeddingModel
+	case providerOpenAI:
+		return envString("ECHO_RAG_EMBEDDING_MODEL", defaultOpenAIEmbeddingModel)
+	}
+	return envString("ECHO_RAG_EMBEDDING_MODEL", defaultGeminiEmbeddingModel)
+}
+
+const (
+	mockEmbeddingModel = "mock-hashed-words"
+	mockEmbeddingDims  = 256
+)
+
+// embedMock hashes words into a fixed number of buckets, so texts sharing
+// words get similar vectors.
+func embedMock(texts []string) [][]float32 {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vector := make([]float32, mockEmbeddingDims)
+		for _, word := range strings.Fields(strings.ToLower(text)) {
+			word = strings.TrimFunc(word, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+			if word == "" {
+				continue
+			}
+			hash := fnv.New32a()
+			_, _ = hash.Write([]byte(word))
+			vector[hash.Sum32()%mockEmbeddingDims]++
+		}
+		vectors[i] = vector
+	}
+	return vectors
+}
+
+// callMock picks an answer by hashing the prompt, so the same prompt always
+// gets the same answer. ECHO_MOCK_ECHO_PROMPT=true echoes the prompt instead
+// and ECHO_MOCK_LATENCY simulates the provider's response time.
+func callMock(ctx context.Context, prompt string, modelName string) (string, error) {
+	if latency := envDuration("ECHO_MOCK_LATENCY", 0); latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	if envString("ECHO_MOCK_ECHO_PROMPT", "") == "true" {
+		return fmt.Sprintf("[mock %s] %s", modelName, strings.TrimSpace(prompt)), nil
+	}
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(prompt))
+	return mockAnswers[hash.Sum32()%uint32(len(mockAnswers))], nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// `echo publish` turns a tenant's curated answers into a static knowledge
+// base: one HTML page, one Markdown file, or the JSON feed itself. It reads
+// the feed from GET /admin/cache/publish on a running instance, which lists
+// the shared entries worth publishing: FAQ entries, pinned entries and public
+// entries (see access.go), or with ?all=true every shared entry the whole
+// tenant may see. Owner-only entries are never published.
+
+type PublishedEntry struct {
+	ID        string     `json:"id"`
+	Question  string     `json:"question"`
+	Answer    string     `json:"answer"`
+	Model     string     `json:"model,omitempty"`
+	License   string     `json:"license,omitempty"`
+	FAQPack   string     `json:"faqPack,omitempty"`
+	Citations []Citation `json:"citations,omitempty"`
+	Hits      int        `json:"hits"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+type PublishFeed struct {
+	Tenant      string           `json:"tenant"`
+	GeneratedAt time.Time        `json:"generatedAt"`
+	Entries     []PublishedEntry `json:"entries"`
+}
+
+// publishable reports whether entry belongs in the knowledge base; all
+// admits every shared entry visible to its whole tenant.
+func publishable(entry VectorEntry, all bool) bool {
+	if entry.Owner != sharedOwner || entryAccess(entry) == entryAccessOwner {
+		return false
+	}
+	return all || entry.Authoritative || entry.Pinned || entryAccess(entry) == entryAccessPublic
+}
+
+// publishFeed lists tenant's publishable entries, most hit first.
+func publishFeed(tenant string, all bool) (PublishFeed, error) {
+	entries, err := tenantEntries(tenant)
+	if err != nil {
+		return PublishFeed{}, err
+	}
+	feed := PublishFeed{Tenant: tenant, GeneratedAt: time.Now().UTC(), Entries: make([]PublishedEntry, 0)}
+	for _, entry := range entries {
+		if !publishable(entry, all) {
+			continue
+		}
+		feed.Entries = append(feed.Entries, PublishedEntry{
+			ID:        entry.ID,
+			Question:  entry.Question,
+			Answer:    entryAnswer(entry),
+			Model:     entry.Model,
+			License:   entry.License,
+			FAQPack:   entry.FAQPack,
+			Citations: entry.Citations,
+			Hits:      entry.HitCount,
+			CreatedAt: entry.CreatedAt,
+		})
+	}
+	sort.SliceStable(feed.Entries, func(i, j int) bool { return feed.Entries[i].Hits > feed.Entries[j].Hits })
+	return feed, nil
+}
+
+func handlePublishFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	tenant, err := resolveTenant(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	feed, err := publishFeed(tenant, r.URL.Query().Get("all") == "true")
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, feed)
+}
+
+var publishPage = template.Must(template.New("publish").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 48rem; margin: 2rem auto; padding: 0 1rem; line-height: 1.5; }
+.answer { white-space: pre-wrap; }
+.meta { color: #666; font-size: 0.85rem; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="meta">{{len .Feed.Entries}} questions, generated {{.Feed.GeneratedAt.Format "2006-01-02 15:04 MST"}}</p>
+<ul>
+{{- range .Feed.Entries}}
+<li><a href="#{{.ID}}">{{.Question}}</a></li>
+{{- end}}
+</ul>
+{{- range .Feed.Entries}}
+<section id="{{.ID}}">
+<h2>{{.Question}}</h2>
+<div class="answer">{{.Answer}}</div>
+{{- if .Citations}}
+<p class="meta">Sources: {{range $i, $c := .Citations}}{{if $i}}, {{end}}{{$c.Title}}{{end}}</p>
+{{- end}}
+<p class="meta">{{if .Model}}{{.Model}} · {{end}}{{.CreatedAt.Format "2006-01-02"}}{{if .License}} · {{.License}}{{end}}</p>
+</section>
+{{- end}}
+</body>
+</html>
+`))
+
+func writePublishHTML(w io.Writer, feed PublishFeed, title string) error {
+	return publishPage.Execute(w, struct {
+		Title string
+		Feed  PublishFeed
+	}{title, feed})
+}
+
+func writePublishMarkdown(w io.Writer, feed PublishFeed, title string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", title)
+	for _, entry := range feed.Entries {
+		fmt.Fprintf(&b, "## %s\n\n%s\n\n", strings.TrimSpace(entry.Question), strings.TrimSpace(entry.Answer))
+		if len(entry.Citations) > 0 {
+			titles := make([]string, len(entry.Citations))
+			for i, citation := range entry.Citations {
+				titles[i] = citation.Title
+			}
+			fmt.Fprintf(&b, "Sources: %s\n\n", strings.Join(titles, ", "))
+		}
+		meta := entry.CreatedAt.Format("2006-01-02")
+		if entry.Model != "" {
+			meta = entry.Model + " · " + meta
+		}
+		if entry.License != "" {
+			meta += " · " + entry.License
+		}
+		fmt.Fprintf(&b, "_%s_\n\n", meta)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func runPublish(args []string) int {
+	fs := flag.NewFlagSet("publish", flag.ExitOnError)
+	target := fs.String("url", "http://localhost:8080", "base URL of the Echo instance")
+	adminToken := fs.String("admin-token", envString("ECHO_ADMIN_TOKEN", ""), "admin token sent as X-Admin-Token")
+	tenant := fs.String("tenant", "", "tenant sent as X-Tenant-ID")
+	format := fs.String("format", "html", "output format: html, markdown or json")
+	out := fs.String("out", "-", "output file, or - for stdout")
+	title := fs.String("title", "Frequently asked questions", "page title")
+	all := fs.Bool("all", false, "publish every shared entry, not only FAQ, pinned and public ones")
+	_ = fs.Parse(args)
+
+	if *format != "html" && *format != "markdown" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "publish: unknown format %q\n", *format)
+		return 2
+	}
+
+	req, err := http.NewRequest(http.MethodGet, *target+"/admin/cache/publish", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "publish: %v\n", err)
+		return 2
+	}
+	if *all {
+		req.URL.RawQuery = "all=true"
+	}
+	req.Header.Set("X-Admin-Token", *adminToken)
+	if *tenant != "" {
+		req.Header.Set("X-Tenant-ID", *tenant)
+	}
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "publish: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "publish: %v\n", err)
+		return 1
+	}
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "publish: %s: %s\n", resp.Status, strings.TrimSpace(string(body)))
+		return 1
+	}
+	var feed PublishFeed
+	if err := json.Unmarshal(body, &feed); err != nil {
+		fmt.Fprintf(os.Stderr, "publish: decode feed: %v\n", err)
+		return 1
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		file, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "publish: %v\n", err)
+			return 1
+		}
+		defer file.Close()
+		w = file
+	}
+	switch *format {
+	case "html":
+		err = writePublishHTML(w, feed, *title)
+	case "markdown":
+		err = writePublishMarkdown(w, feed, *title)
+	default:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(feed)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "publish: %v\n", err)
+		return 1
+	}
+	if *out != "-" {
+		fmt.Printf("Published %d entries to %s\n", len(feed.Entries), *out)
+	}
+	return 0
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Quotas cap requests and cloud tokens per day and per month. The subject is
+// the API key when one was used, otherwise the tenant (ECHO_QUOTA_SCOPE=tenant
+// always meters per tenant). A zero limit means unlimited. The ECHO_QUOTA_*
+// limits apply to every tenant not listed in ECHO_TENANT_QUOTAS, a JSON
+// object of QuotaLimits keyed by tenant name ("@default" for the default
+// tenant).
+//
+// A chat request is counted when it is admitted, and a provider call sets an
+// estimate of its tokens aside when it is checked, both under the same lock
+// as the check, so concurrent requests cannot all slip under a limit only one
+// of them fits. Without a state store the counters are persisted to
+// usage.json beside each tenant's cache object in S3.
+//
+// A tripped daily limit answers 429 and a tripped monthly limit, which lasts
+// the rest of the billing period, answers 402. Both carry headers a client
+// can back off on:
+//
+//	X-Quota-Limit, X-Quota-Remaining  the tripped limit and what is left of it
+//	X-Quota-Requests-Remaining        requests left in the tighter window
+//	X-Quota-Tokens-Remaining          cloud tokens left in the tighter window
+//	X-Quota-Reset                     Unix time the tripped window resets
+//	X-Budget-Spent-USD                estimated spend this month
+//	Retry-After                       seconds until the reset
+
+type QuotaLimits struct {
+	DailyRequests   int `json:"dailyRequests,omitempty"`
+	MonthlyRequests int `json:"monthlyRequests,omitempty"`
+	DailyTokens     int `json:"dailyTokens,omitempty"`
+	MonthlyTokens   int `json:"monthlyTokens,omitempty"`
+}
+
+type UsageCounters struct {
+	Day             string `json:"day"`
+	DailyRequests   int    `json:"dailyRequests"`
+	DailyTokens     int    `json:"dailyTokens"`
+	Month           string `json:"month"`
+	MonthlyRequests int    `json:"monthlyRequests"`
+	MonthlyTokens   int    `json:"monthlyTokens"`
+	// MonthlySpentUSD estimates this month's provider spend at
+	// usdPer1KTokens.
+	MonthlySpentUSD float64 `json:"monthlySpentUsd"`
+}
+
+// QuotaDenial describes the limit that turned a request away.
+type QuotaDenial struct {
+	// Resource is "request" or "token"; Window is "daily" or "monthly".
+	Resource string
+	Window   string
+	Limit    int
+	Used     int
+	ResetAt  time.Time
+	Usage    UsageCounters
+	Limits   QuotaLimits
+}
+
+type UsageResponse struct {
+	Subject string        `json:"subject"`
+	Tenant  string        `json:"tenant,omitempty"`
+	APIKey  string        `json:"apiKey,omitempty"`
+	Usage   UsageCounters `json:"usage"`
+	Limits  QuotaLimits   `json:"limits"`
+}
+
+// MeteringRecord is one billable event, exported for chargeback.
+type MeteringRecord struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Subject     string    `json:"subject"`
+	Tenant      string    `json:"tenant,omitempty"`
+	APIKey      string    `json:"apiKey,omitempty"`
+	Model       string    `json:"model"`
+	Source      string    `json:"source"`
+	CloudTokens int       `json:"cloudTokens"`
+	TokensSaved int       `json:"tokensSaved,omitempty"`
+}
+
+var (
+	usageMutex      sync.Mutex
+	usageBySubject  = make(map[string]*UsageCounters)
+	meteringRecords []MeteringRecord
+	// reservedTokens holds the tokens set aside for each subject's calls in
+	// flight.
+	reservedTokens = make(map[string]int)
+	// usageDirty counts the updates to each subject's counters not yet
+	// persisted.
+	usageDirty = make(map[string]int)
+
+	// tenantQuotas holds the ECHO_TENANT_QUOTAS limits, read by initQuotas.
+	tenantQuotas map[string]QuotaLimits
+)
+
+func initQuotas() {
+	raw := envString("ECHO_TENANT_QUOTAS", "")
+	if raw == "" {
+		return
+	}
+	var parsed map[string]QuotaLimits
+	if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+		log.Printf("Invalid ECHO_TENANT_QUOTAS: %v", err)
+		return
+	}
+	tenantQuotas = make(map[string]QuotaLimits, len(parsed))
+	for name, limits := range parsed {
+		tenantQuotas[tenantFromName(name)] = limits
+	}
+}
+
+func quotaLimits(tenant string) QuotaLimits {
+	if limits, ok := tenantQuotas[tenant]; ok {
+		return limits
+	}
+	return QuotaLimits{
+		DailyRequests:   envInt("ECHO_QUOTA_DAILY_REQUESTS", 0),
+		MonthlyRequests: envInt("ECHO_QUOTA_MONTHLY_REQUESTS", 0),
+		DailyTokens:     envInt("ECHO_QUOTA_DAILY_TOKENS", 0),
+		MonthlyTokens:   envInt("ECHO_QUOTA_MONTHLY_TOKENS", 0),
+	}
+}
+
+func quotaSubject(caller Caller) string {
+	if caller.APIKey != "" && envString("ECHO_QUOTA_SCOPE", "key") != "tenant" {
+		return "key:" + caller.APIKey
+	}
+	return "tenant:" + caller.Tenant
+}
+
+// usageLocked returns the counters for subject, rolling over the daily and
+// monthly windows. Callers must hold usageMutex.
+func usageLocked(subject string, now time.Time) *UsageCounters {
+	usage, ok := usageBySubject[subject]
+	if !ok {
+		usage = &UsageCounters{}
+		usageBySubject[subject] = usage
+	}
+
+	day := now.UTC().Format("2006-01-02")
+	if usage.Day != day {
+		usage.Day = day
+		usage.DailyRequests = 0
+		usage.DailyTokens = 0
+	}
+	month := now.UTC().Format("2006-01")
+	if usage.Month != month {
+		usage.Month = month
+		usage.MonthlyRequests = 0
+		usage.MonthlyTokens = 0
+		usage.MonthlySpentUSD = 0
+	}
+	return usage
+}
+
+func nextDay(now time.Time) time.Time {
+	y, m, d := now.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+func nextMonth(now time.Time) time.Time {
+	y, m, _ := now.UTC().Date()
+	return time.Date(y, m+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// quotaDenialLocked checks the caller's request limits, or with tokens set
+// its cloud token limits counting those reserved, and describes the first one
+// reached; nil means the caller may go ahead. Callers must hold usageMutex.
+func quotaDenialLocked(caller Caller, tokens bool, now time.Time) *QuotaDenial {
+	limits := quotaLimits(caller.Tenant)
+	subject := quotaSubject(caller)
+	usage := *usageLocked(subject, now)
+
+	resource := "request"
+	dailyLimit, dailyUsed := limits.DailyRequests, usage.DailyRequests
+	monthlyLimit, monthlyUsed := limits.MonthlyRequests, usage.MonthlyRequests
+	if tokens {
+		resource = "token"
+		reserved := reservedTokens[subject]
+		dailyLimit, dailyUsed = limits.DailyTokens, usage.DailyTokens+reserved
+		monthlyLimit, monthlyUsed = limits.MonthlyTokens, usage.MonthlyTokens+reserved
+	}
+
+	denial := &QuotaDenial{Resource: resource, Usage: usage, Limits: limits}
+	switch {
+	case monthlyLimit > 0 && monthlyUsed >= monthlyLimit:
+		denial.Window, denial.Limit, denial.Used, denial.ResetAt = "monthly", monthlyLimit, monthlyUsed, nextMonth(now)
+	case dailyLimit > 0 && dailyUsed >= dailyLimit:
+		denial.Window, denial.Limit, denial.Used, denial.ResetAt = "daily", dailyLimit, dailyUsed, nextDay(now)
+	default:
+		return nil
+	}
+	return denial
+}
+
+// quotaDenial is quotaDenialLocked for a check that reserves nothing.
+func quotaDenial(caller Caller, tokens bool) *QuotaDenial {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	return quotaDenialLocked(caller, tokens, time.Now())
+}
+
+// reserveRequest admits a request and counts it, unless the caller's request
+// limits are reached. With a state store the count is taken there first, so
+// replicas share it.
+func reserveRequest(caller Caller) *QuotaDenial {
+	now := time.Now()
+	subject := quotaSubject(caller)
+	var stored UsageCounters
+	storedOK := false
+	if stateless() {
+		stored, storedOK = storeUsage(subject, now, 1, 0, 0)
+	}
+
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	usage := usageLocked(subject, now)
+	if storedOK {
+		// The store already counts this request.
+		*usage = stored
+		usage.DailyRequests--
+		usage.MonthlyRequests--
+	}
+	denial := quotaDenialLocked(caller, false, now)
+	if denial != nil {
+		if storedOK {
+			go storeUsage(subject, now, -1, 0, 0)
+		}
+		return denial
+	}
+	usage.DailyRequests++
+	usage.MonthlyRequests++
+	usageDirty[subject]++
+	return nil
+}
+
+// reserveTokens sets estimate tokens aside for a provider call, unless the
+// caller's token limits are reached. The caller hands them back with
+// releaseTokens once the call's usage is recorded or it failed.
+func reserveTokens(caller Caller, estimate int) *QuotaDenial {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	if denial := quotaDenialLocked(caller, true, time.Now()); denial != nil {
+		return denial
+	}
+	reservedTokens[quotaSubject(caller)] += estimate
+	return nil
+}
+
+func releaseTokens(caller Caller, estimate int) {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	subject := quotaSubject(caller)
+	if reservedTokens[subject] -= estimate; reservedTokens[subject] <= 0 {
+		delete(reservedTokens, subject)
+	}
+}
+
+// checkTokenQuota reports whether the caller may spend more cloud tokens,
+// under both its quota and its tenant's cost budget. Cache hits cost no
+// tokens and are not subject to it.
+func checkTokenQuota(caller Caller) bool {
+	if _, exhausted := budgetExhausted(caller.Tenant); exhausted {
+		return false
+	}
+	return quotaDenial(caller, true) == nil
+}
+
+// remainingQuota is what is left of the tighter of a daily and a monthly
+// limit, or -1 when neither is set.
+func remainingQuota(dailyLimit, dailyUsed, monthlyLimit, monthlyUsed int) int {
+	remaining := -1
+	for _, window := range [][2]int{{dailyLimit, dailyUsed}, {monthlyLimit, monthlyUsed}} {
+		if window[0] <= 0 {
+			continue
+		}
+		if left := max(window[0]-window[1], 0); remaining < 0 || left < remaining {
+			remaining = left
+		}
+	}
+	return remaining
+}
+
+// writeQuotaExceeded answers a request turned away by denial: 429 for a
+// daily limit, 402 for a monthly one.
+func writeQuotaExceeded(w http.ResponseWriter, denial *QuotaDenial) {
+	usage, limits := denial.Usage, denial.Limits
+	header := w.Header()
+	header.Set("X-Quota-Limit", strconv.Itoa(denial.Limit))
+	header.Set("X-Quota-Remaining", strconv.Itoa(max(denial.Limit-denial.Used, 0)))
+	if remaining := remainingQuota(limits.DailyRequests, usage.DailyRequests, limits.MonthlyRequests, usage.MonthlyRequests); remaining >= 0 {
+		header.Set("X-Quota-Requests-Remaining", strconv.Itoa(remaining))
+	}
+	if remaining := remainingQuota(limits.DailyTokens, usage.DailyTokens, limits.MonthlyTokens, usage.MonthlyTokens); remaining >= 0 {
+		header.Set("X-Quota-Tokens-Remaining", strconv.Itoa(remaining))
+	}
+	header.Set("X-Quota-Reset", strconv.FormatInt(denial.ResetAt.Unix(), 10))
+	header.Set("X-Budget-Spent-USD", strconv.FormatFloat(usage.MonthlySpentUSD, 'f', 6, 64))
+	header.Set("Retry-After", strconv.Itoa(int(time.Until(denial.ResetAt).Seconds())+1))
+
+	status := http.StatusTooManyRequests
+	if denial.Window == "monthly" {
+		status = http.StatusPaymentRequired
+	}
+	writeJSON(w, status, map[string]string{
+		"error":   denial.Window + " " + denial.Resource + " quota exceeded",
+		"resetAt": denial.ResetAt.Format(time.RFC3339),
+	})
+}
+
+// operatorCaller is who jobs run for the operator rather than a tenant, such
+// as the canary, are metered to. No request can name its tenant.
+var operatorCaller = Caller{APIKey: "(operator)", Tenant: "(operator)"}
+
+func recordUsage(caller Caller, model, source string, cloudTokens, tokensSaved int) {
+	now := time.Now()
+	subject := quotaSubject(caller)
+	recordSpend(caller.Tenant, model, cloudTokens)
+	spentUSD := float64(cloudTokens) / 1000 * usdPer1KTokens(model)
+	var stored UsageCounters
+	storedOK := false
+	if stateless() {
+		stored, storedOK = storeUsage(subject, now, 0, cloudTokens, spentUSD)
+	}
+
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	usage := usageLocked(subject, now)
+	usageDirty[subject]++
+	usage.DailyTokens += cloudTokens
+	usage.MonthlyTokens += cloudTokens
+	usage.MonthlySpentUSD += spentUSD
+	if storedOK {
+		*usage = stored
+	}
+
+	meteringRecords = append(meteringRecords, MeteringRecord{
+		Timestamp:   now,
+		Subject:     subject,
+		Tenant:      caller.Tenant,
+		APIKey:      caller.APIKey,
+		Model:       model,
+		Source:      source,
+		CloudTokens: cloudTokens,
+		TokensSaved: tokensSaved,
+	})
+	if maxRecords := envInt("ECHO_METERING_MAX_RECORDS", 100000); maxRecords > 0 && len(meteringRecords) > maxRecords {
+		meteringRecords = append([]MeteringRecord(nil), meteringRecords[len(meteringRecords)-maxRecords:]...)
+	}
+}
+
+// recordHedgeUsage meters the losing call of a hedged answer on its own, with
+// source HEDGE, or HEDGE_ESTIMATE when the loser was cancelled before it
+// reported its usage.
+func recordHedgeUsage(caller Caller, model string, usage providerUsage) {
+	if usage.HedgeTokens == 0 {
+		return
+	}
+	source := "HEDGE"
+	if usage.HedgeEstimated {
+		source = "HEDGE_ESTIMATE"
+	}
+	recordUsage(caller, model, source, usage.HedgeTokens, 0)
+}
+
+// subjectTenant is the tenant whose usage.json holds subject's counters.
+func subjectTenant(subject string) string {
+	if tenant, ok := strings.CutPrefix(subject, "tenant:"); ok {
+		return tenant
+	}
+	name := strings.TrimPrefix(subject, "key:")
+	for _, key := range configuredAPIKeys() {
+		if key.Name == name {
+			return key.Tenant
+		}
+	}
+	return defaultTenant
+}
+
+func usageObjectKey(tenant string) string {
+	dir, _ := path.Split(tenantObjectKey(tenant))
+	return dir + "usage.json"
+}
+
+// loadUsage adopts the counters persisted for every tenant.
+func loadUsage() {
+	target := activeS3Target()
+	if target == nil {
+		return
+	}
+	tenants, err := listTenants(target)
+	if err != nil {
+		log.Printf("Load usage counters failed: %v", err)
+		return
+	}
+	for _, tenant := range tenants {
+		data, err := getObject(target, usageObjectKey(tenant))
+		if err != nil || data == nil {
+			if err != nil {
+				log.Printf("Load usage counters for %q failed: %v", tenantName(tenant), err)
+			}
+			continue
+		}
+		var loaded map[string]*UsageCounters
+		if err := json.Unmarshal(data, &loaded); err != nil {
+			log.Printf("Ignoring invalid usage counters for %q: %v", tenantName(tenant), err)
+			continue
+		}
+		usageMutex.Lock()
+		for subject, usage := range loaded {
+			if usage != nil && subjectTenant(subject) == tenant {
+				usageBySubject[subject] = usage
+			}
+		}
+		usageMutex.Unlock()
+	}
+}
+
+// saveUsage writes the counters of every tenant with a subject updated since
+// they were last written. Subjects stay dirty until the write succeeds and no
+// update arrived meanwhile.
+func saveUsage() error {
+	target := activeS3Target()
+	if target == nil {
+		return nil
+	}
+
+	usageMutex.Lock()
+	byTenant := make(map[string]map[string]UsageCounters)
+	for subject := range usageDirty {
+		byTenant[subjectTenant(subject)] = make(map[string]UsageCounters)
+	}
+	for subject, usage := range usageBySubject {
+		if counters, ok := byTenant[subjectTenant(subject)]; ok {
+			counters[subject] = *usage
+		}
+	}
+	updates := maps.Clone(usageDirty)
+	usageMutex.Unlock()
+
+	var errs []error
+	for tenant, counters := range byTenant {
+		data, err := json.Marshal(counters)
+		if err == nil {
+			err = putObject(target, usageObjectKey(tenant), data, "application/json", tenantKMSKey(tenant))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", tenantName(tenant), err))
+			continue
+		}
+		usageMutex.Lock()
+		for subject := range counters {
+			if usageDirty[subject] == updates[subject] {
+				delete(usageDirty, subject)
+			}
+		}
+		usageMutex.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if rejectAnonymous(w, caller, "usage") {
+		return
+	}
+
+	subject := quotaSubject(caller)
+	usageMutex.Lock()
+	usage := *usageLocked(subject, time.Now())
+	usageMutex.Unlock()
+
+	writeJSON(w, http.StatusOK, UsageResponse{
+		Subject: subject,
+		Tenant:  caller.Tenant,
+		APIKey:  caller.APIKey,
+		Usage:   usage,
+		Limits:  quotaLimits(caller.Tenant),
+	})
+}
+
+// handleUsageRecords streams metering records as newline-delimited JSON,
+// optionally bounded by ?since=<RFC3339>.
+func handleUsageRecords(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var since time.Time
+	if raw := r.URL.Query().Get("since"); raw != "" {
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "since must be RFC3339"})
+			return
+		}
+		since = parsed
+	}
+
+	usageMutex.Lock()
+	records := make([]MeteringRecord, 0, len(meteringRecords))
+	for _, record := range meteringRecords {
+		if record.Timestamp.After(since) {
+			records = append(records, record)
+		}
+	}
+	usageMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Retrieval-augmented generation: documents uploaded per tenant are split
+// into chunks, embedded server-side with the provider's embedding model (see
+// embedTexts) and kept in a collection separate from the answer cache. A chat
+// request with rag set retrieves the closest chunks on a cache miss and passes
+// them to the provider as context. Each tenant's part of the collection is
+// persisted to S3 under its own prefix (see tenantRAGObjectKey), encrypted
+// with the tenant's KMS key, and embedding calls are metered to the caller.
+
+const ragObjectKey = "rag-collection.json"
+
+// tenantRAGObjectKey is where tenant's documents live, beside its cache
+// object.
+func tenantRAGObjectKey(tenant string) string {
+	if tenant == defaultTenant {
+		return ragObjectKey
+	}
+	return tenantKeyPrefix + tenant + "/" + ragObjectKey
+}
+
+type Document struct {
+	ID             string    `json:"id"`
+	Tenant         string    `json:"tenant,omitempty"`
+	Title          string    `json:"title"`
+	Source         string    `json:"source,omitempty"`
+	Chunks         int       `json:"chunks"`
+	EmbeddingModel string    `json:"embeddingModel"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+type DocumentChunk struct {
+	ID             string
+	DocumentID     string
+	Tenant         string
+	Index          int
+	Text           string
+	Vector         []float32
+	EmbeddingModel string
+}
+
+type DocumentUpload struct {
+	Title  string `json:"title"`
+	Source string `json:"source,omitempty"`
+	Text   string `json:"text"`
+}
+
+// ragCollection is the persisted form of the collection.
+type ragCollection struct {
+	Documents []Document
+	Chunks    []DocumentChunk
+}
+
+// Citation points from a grounded answer back to a chunk it was based on.
+type Citation struct {
+	DocumentID string  `json:"documentId"`
+	ChunkID    string  `json:"chunkId"`
+	Title      string  `json:"title"`
+	Source     string  `json:"source,omitempty"`
+	Similarity float64 `json:"similarity"`
+}
+
+// retrievedChunk is a chunk selected to ground an answer.
+type retrievedChunk struct {
+	Chunk      DocumentChunk
+	Title      string
+	Source     string
+	Similarity float64
+}
+
+func chunkCitations(chunks []retrievedChunk) []Citation {
+	if len(chunks) == 0 {
+		return nil
+	}
+	citations := make([]Citation, len(chunks))
+	for i, chunk := range chunks {
+		citations[i] = Citation{
+			DocumentID: chunk.Chunk.DocumentID,
+			ChunkID:    chunk.Chunk.ID,
+			Title:      chunk.Title,
+			Source:     chunk.Source,
+			Similarity: chunk.Similarity,
+		}
+	}
+	return citations
+}
+
+var (
+	// ragMutex guards ragDocuments and ragChunks.
+	ragMutex     sync.RWMutex
+	ragDocuments = make(map[string]Document)
+	ragChunks    []DocumentChunk
+
+	// ragPersistMutex serializes writes of the collection object.
+	ragPersistMutex sync.Mutex
+)
+
+func ragByDefault() bool {
+	return envString("ECHO_RAG_BY_DEFAULT", "") == "true"
+}
+
+func useRAG(requested *bool) bool {
+	if requested != nil {
+		return *requested
+	}
+	return ragByDefault()
+}
+
+// chunkText splits text into chunks of about size characters on paragraph,
+// then word boundaries. Consecutive chunks share about overlap characters.
+func chunkText(text string, size, overlap int) []string {
+	if size <= 0 {
+		size = 1200
+	}
+	if overlap < 0 || overlap >= size {
+		overlap = 0
+	}
+
+	var words []string
+	for _, paragraph := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+		fields := strings.Fields(paragraph)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(words) > 0 {
+			words = append(words, "\n\n")
+		}
+		words = append(words, fields...)
+	}
+
+	var chunks []string
+	var current []string
+	length := 0
+	flush := func() {
+		chunk := strings.TrimSpace(strings.ReplaceAll(strings.Join(current, " "), " \n\n ", "\n\n"))
+		if chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+		// Keep a tail of the chunk to start the next one with.
+		kept, keptLength := 0, 0
+		for i := len(current) - 1; i >= 0 && keptLength+utf8.RuneCountInString(current[i]) <= overlap; i-- {
+			keptLength += utf8.RuneCountInString(current[i]) + 1
+			kept++
+		}
+		current = append([]string(nil), current[len(current)-kept:]...)
+		length = keptLength
+	}
+	for _, word := range words {
+		wordLength := utf8.RuneCountInString(word) + 1
+		// Prefer ending a chunk at a paragraph once it is half full.
+		if word == "\n\n" && length >= size/2 {
+			flush()
+		}
+		if length+wordLength > size && length > 0 {
+			flush()
+		}
+		current = append(current, word)
+		length += wordLength
+	}
+	if len(current) > 0 && length > 0 {
+		flush()
+	}
+	return chunks
+}
+
+// ingestDocument chunks and embeds upload for caller's tenant and adds it to
+// the collection.
+func ingestDocument(ctx context.Context, caller Caller, upload DocumentUpload) (Document, error) {
+	tenant := caller.Tenant
+	texts := chunkText(upload.Text, envInt("ECHO_RAG_CHUNK_SIZE", 1200), envInt("ECHO_RAG_CHUNK_OVERLAP", 200))
+	if len(texts) == 0 {
+		return Document{}, errors.New("document has no text")
+	}
+	vectors, model, err := embedTextsFor(ctx, caller, texts)
+	if err != nil {
+		return Document{}, fmt.Errorf("embed chunks: %w", err)
+	}
+
+	doc := Document{
+		ID:             newID(),
+		Tenant:         tenant,
+		Title:          upload.Title,
+		Source:         upload.Source,
+		Chunks:         len(texts),
+		EmbeddingModel: model,
+		CreatedAt:      time.Now(),
+	}
+	chunks := make([]DocumentChunk, len(texts))
+	for i, text := range texts {
+		chunks[i] = DocumentChunk{
+			ID:             fmt.Sprintf("%s-%d", doc.ID, i),
+			DocumentID:     doc.ID,
+			Tenant:         tenant,
+			Index:          i,
+			Text:           text,
+			Vector:         vectors[i],
+			EmbeddingModel: model,
+		}
+	}
+
+	ragMutex.Lock()
+	ragDocuments[doc.ID] = doc
+	ragChunks = append(ragChunks, chunks...)
+	ragMutex.Unlock()
+	return doc, nil
+}
+
+func deleteDocument(tenant, id string) bool {
+	ragMutex.Lock()
+	defer ragMutex.Unlock()
+
+	doc, ok := ragDocuments[id]
+	if !ok || doc.Tenant != tenant {
+		return false
+	}
+	delete(ragDocuments, id)
+	kept := ragChunks[:0]
+	for _, chunk := range ragChunks {
+		if chunk.DocumentID != id {
+			kept = append(kept, chunk)
+		}
+	}
+	clear(ragChunks[len(kept):])
+	ragChunks = kept
+	return true
+}
+
+// withdrawnKeys remembers entries dropped because a document they cite was
+// deleted, so the next S3 or peer sync does not bring them back. Guarded by
+// dbMutex.
+var withdrawnKeys = make(map[string]struct{})
+
+func isWithdrawn(questionKey string) bool {
+	_, ok := withdrawnKeys[questionKey]
+	return ok
+}
+
+func citesDocument(entry VectorEntry, tenant, documentID string) bool {
+	if entry.Tenant != tenant {
+		return false
+	}
+	for _, citation := range entry.Citations {
+		if citation.DocumentID == documentID {
+			return true
+		}
+	}
+	return false
+}
+
+// withdrawCitingEntries drops tenant's cached answers grounded on the
+// document with documentID from the hot and cold tiers, since they may repeat
+// its content, and returns how many were dropped.
+func withdrawCitingEntries(tenant, documentID string) int {
+	dbMutex.Lock()
+	var withdrawn []VectorEntry
+	kept := MockVectorDB[:0]
+	for _, entry := range MockVectorDB {
+		if citesDocument(entry, tenant, documentID) {
+			withdrawn = append(withdrawn, entry)
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	clear(MockVectorDB[len(kept):])
+	MockVectorDB = kept
+	if len(withdrawn) > 0 {
+		invalidateIndexLocked()
+	}
+	dbMutex.Unlock()
+
+	if tieringEnabled() {
+		cold, err := takeColdEntries(func(entry VectorEntry) bool {
+			return citesDocument(entry, tenant, documentID)
+		})
+		if err != nil {
+			log.Printf("Withdraw cold entries citing %s failed: %v", documentID, err)
+		}
+		withdrawn = append(withdrawn, cold...)
+	}
+
+	dbMutex.Lock()
+	for _, entry := range withdrawn {
+		withdrawnKeys[entryKey(entry.Tenant, entry.Owner, entry.Question)] = struct{}{}
+		recordCacheChange(changeDeleted, entry)
+	}
+	dbMutex.Unlock()
+
+	if len(withdrawn) > 0 {
+		markCacheChanged()
+	}
+	return len(withdrawn)
+}
+
+func tenantHasDocuments(tenant string) bool {
+	ragMutex.RLock()
+	defer ragMutex.RUnlock()
+	for _, doc := range ragDocuments {
+		if doc.Tenant == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+// retrieveChunks returns up to ECHO_RAG_TOP_K of caller's tenant's chunks
+// closest to question that reach ECHO_RAG_MIN_SIMILARITY, best first.
+func retrieveChunks(ctx context.Context, caller Caller, question string) ([]retrievedChunk, error) {
+	tenant := caller.Tenant
+	if !tenantHasDocuments(tenant) {
+		return nil, nil
+	}
+	vectors, model, err := embedTextsFor(ctx, caller, []string{question})
+	if err != nil {
+		return nil, fmt.Errorf("embed question: %w", err)
+	}
+	query := vectors[0]
+	minSimilarity := envFloat("ECHO_RAG_MIN_SIMILARITY", 0.3)
+
+	ragMutex.RLock()
+	var found []retrievedChunk
+	for _, chunk := range ragChunks {
+		if chunk.Tenant != tenant || chunk.EmbeddingModel != model {
+			continue
+		}
+		if score := cosineSimilarity(query, chunk.Vector); score >= minSimilarity {
+			doc := ragDocuments[chunk.DocumentID]
+			found = append(found, retrievedChunk{Chunk: chunk, Title: doc.Title, Source: doc.Source, Similarity: score})
+		}
+	}
+	ragMutex.RUnlock()
+
+	sort.Slice(found, func(i, j int) bool { return found[i].Similarity > found[j].Similarity })
+	if topK := envInt("ECHO_RAG_TOP_K", 4); len(found) > topK {
+		found = found[:topK]
+	}
+	return found, nil
+}
+
+// groundedPrompt asks the provider to answer question from chunks, numbered
+// in the order of the answer's citations.
+func groundedPrompt(question string, chunks []retrievedChunk) string {
+	var b strings.Builder
+	b.WriteString("Answer the question using the context below. If the context does not contain the answer, say so.\n\n")
+	for i, chunk := range chunks {
+		fmt.Fprintf(&b, "[%d] %s\n%s\n\n", i+1, chunk.Title, chunk.Chunk.Text)
+	}
+	b.WriteString("Question: ")
+	b.WriteString(question)
+	return b.String()
+}
+
+// loadRAGCollection reads every tenant's documents. Like cache entries, they
+// are stamped with the tenant of the object they came from.
+func loadRAGCollection() {
+	target := activeS3Target()
+	if target == nil {
+		return
+	}
+	tenants, err := listTenants(target)
+	if err != nil {
+		log.Printf("Load RAG collection failed: list tenants: %v", err)
+		return
+	}
+
+	documents, chunks := 0, 0
+	for _, tenant := range tenants {
+		key := tenantRAGObjectKey(tenant)
+		body, err := getObject(target, key)
+		if err != nil || body == nil {
+			if err != nil {
+				log.Printf("Load RAG collection %s failed: %v", key, err)
+			}
+			continue
+		}
+		var collection ragCollection
+		if err := json.Unmarshal(body, &collection); err != nil {
+			log.Printf("Decode %s failed: %v", key, err)
+			continue
+		}
+
+		ragMutex.Lock()
+		for _, doc := range collection.Documents {
+			doc.Tenant = tenant
+			ragDocuments[doc.ID] = doc
+		}
+		for _, chunk := range collection.Chunks {
+			chunk.Tenant = tenant
+			ragChunks = append(ragChunks, chunk)
+		}
+		ragMutex.Unlock()
+		documents += len(collection.Documents)
+		chunks += len(collection.Chunks)
+	}
+	log.Printf("RAG: loaded %d documents (%d chunks)", documents, chunks)
+}
+
+// persistRAGCollection writes tenant's documents to S3, if configured.
+func persistRAGCollection(tenant string) {
+	target := activeS3Target()
+	if target == nil {
+		return
+	}
+	ragPersistMutex.Lock()
+	defer ragPersistMutex.Unlock()
+
+	ragMutex.RLock()
+	var collection ragCollection
+	for _, chunk := range ragChunks {
+		if chunk.Tenant == tenant {
+			collection.Chunks = append(collection.Chunks, chunk)
+		}
+	}
+	for _, doc := range ragDocuments {
+		if doc.Tenant == tenant {
+			collection.Documents = append(collection.Documents, doc)
+		}
+	}
+	ragMutex.RUnlock()
+	body, err := json.Marshal(collection)
+	if err != nil {
+		log.Printf("Encode RAG collection failed: %v", err)
+		return
+	}
+	key := tenantRAGObjectKey(tenant)
+	if err := putObject(target, key, body, "application/json", tenantKMSKey(tenant)); err != nil {
+		log.Printf("Persist RAG collection %s failed: %v", key, err)
+	}
+}
+
+func tenantDocuments(tenant string) []Document {
+	ragMutex.RLock()
+	defer ragMutex.RUnlock()
+
+	docs := make([]Document, 0)
+	for _, doc := range ragDocuments {
+		if doc.Tenant == tenant {
+			docs = append(docs, doc)
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].CreatedAt.After(docs[j].CreatedAt) })
+	return docs
+}
+
+// handleDocuments lists the caller's documents (GET) or ingests one (POST).
+func handleDocuments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, tenantDocuments(caller.Tenant))
+		return
+	}
+	if caller.Anonymous {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "document upload is not available in demo mode"})
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(envInt("ECHO_RAG_MAX_DOCUMENT_BYTES", 1<<20)))
+	var upload DocumentUpload
+	if err := json.NewDecoder(r.Body).Decode(&upload); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON payload"})
+		return
+	}
+	upload.Title = strings.TrimSpace(upload.Title)
+	if upload.Title == "" || strings.TrimSpace(upload.Text) == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "title and text are required"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	defer cancel()
+	doc, err := ingestDocument(ctx, caller, upload)
+	if err != nil {
+		log.Printf("Ingest document %q failed: %v", upload.Title, err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "failed to ingest document"})
+		return
+	}
+	go persistRAGCollection(caller.Tenant)
+
+	recordAudit(AuditEvent{
+		Action:  "rag.ingest",
+		Tenant:  caller.Tenant,
+		Actor:   callerActor(caller),
+		Details: map[string]string{"documentId": doc.ID, "title": doc.Title},
+	})
+	writeJSON(w, http.StatusCreated, doc)
+}
+
+func handleDeleteDocument(w http.ResponseWriter, r *http.Request) {
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if caller.Anonymous {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "document deletion is not available in demo mode"})
+		return
+	}
+	id := r.PathValue("id")
+	if !deleteDocument(caller.Tenant, id) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "document not found"})
+		return
+	}
+	go persistRAGCollection(caller.Tenant)
+	withdrawn := withdrawCitingEntries(caller.Tenant, id)
+
+	recordAudit(AuditEvent{
+		Action:  "rag.delete",
+		Tenant:  caller.Tenant,
+		Actor:   callerActor(caller),
+		Details: map[string]string{"documentId": id, "withdrawnEntries": strconv.Itoa(withdrawn)},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Readiness for Kubernetes-style probes. The listener opens as soon as the
+// process starts, so /healthz (liveness) answers even during a long initial
+// download, while /readyz answers 503 until every startup step has finished:
+// the initial S3 download, loading the state store, building the vector
+// indexes and validating the provider key. Until then every other route
+// answers 503 too, so a rolling update never routes traffic to an instance
+// with an empty cache. Each step's progress is logged and listed by /readyz.
+//
+// A failed S3 download does not hold readiness back, as echo has always
+// served without S3. A rejected provider key does: the check is retried every
+// ECHO_READINESS_RETRY (default 15s) until it passes.
+// ECHO_READINESS_PROVIDER_CHECK=false skips it.
+
+const (
+	stepRunning = "running"
+	stepDone    = "done"
+	stepFailed  = "failed"
+	stepSkipped = "skipped"
+)
+
+type StartupStep struct {
+	Name       string    `json:"name"`
+	State      string    `json:"state"`
+	Detail     string    `json:"detail,omitempty"`
+	Attempts   int       `json:"attempts,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+	DurationMs int64     `json:"durationMs"`
+}
+
+type ReadinessResponse struct {
+	Ready bool          `json:"ready"`
+	Node  string        `json:"node"`
+	Steps []StartupStep `json:"steps"`
+}
+
+var (
+	// startupMutex guards startupSteps.
+	startupMutex sync.Mutex
+	startupSteps []*StartupStep
+	// appHandler serves every route but the probes once startup is done.
+	appHandler atomic.Pointer[http.Handler]
+	// httpServer is shut down when handing off to a new binary.
+	httpServer *http.Server
+)
+
+// startupStep tracks one step of startup.
+type startupStep struct {
+	step *StartupStep
+}
+
+func beginStep(name string) startupStep {
+	step := &StartupStep{Name: name, State: stepRunning, StartedAt: time.Now()}
+	startupMutex.Lock()
+	startupSteps = append(startupSteps, step)
+	startupMutex.Unlock()
+	log.Printf("Startup: %s...", name)
+	sdNotify("STATUS=Starting: " + name)
+	return startupStep{step}
+}
+
+func (s startupStep) end(state, detail string) {
+	startupMutex.Lock()
+	s.step.State = state
+	s.step.Detail = detail
+	s.step.DurationMs = time.Since(s.step.StartedAt).Milliseconds()
+	startupMutex.Unlock()
+	log.Printf("Startup: %s %s after %v: %s", s.step.Name, state, time.Since(s.step.StartedAt).Round(time.Millisecond), detail)
+}
+
+func (s startupStep) done(format string, args ...any) {
+	s.end(stepDone, fmt.Sprintf(format, args...))
+}
+
+// failed records err. Unless retrying is set the step is over and does not
+// hold readiness back.
+func (s startupStep) failed(err error, retrying bool) {
+	if !retrying {
+		s.end(stepFailed, err.Error())
+		return
+	}
+	startupMutex.Lock()
+	s.step.Attempts++
+	s.step.Detail = err.Error()
+	attempts := s.step.Attempts
+	startupMutex.Unlock()
+	log.Printf("Startup: %s failed (attempt %d), retrying: %v", s.step.Name, attempts, err)
+}
+
+func skipStep(name, reason string) {
+	beginStep(name).end(stepSkipped, reason)
+}
+
+func isReady() bool {
+	return appHandler.Load() != nil
+}
+
+// markReady starts routing requests to handler.
+func markReady(handler http.Handler) {
+	appHandler.Store(&handler)
+	log.Printf("Startup: ready")
+	sdNotify("READY=1\nSTATUS=Ready")
+}
+
+// warmIndexes builds the vector indexes now rather than on the first search.
+func warmIndexes() {
+	step := beginStep("vector index")
+	dbMutex.RLock()
+	indexMutex.Lock()
+	if partitionIndexes == nil {
+		rebuildIndexesLocked()
+	}
+	entries, partitions := len(MockVectorDB), len(partitionIndexes)
+	indexMutex.Unlock()
+	dbMutex.RUnlock()
+	step.done("%d entries in %d partitions (%s)", entries, partitions, indexKind)
+}
+
+// validateProviderKey blocks until the provider accepts the API key.
+func validateProviderKey() {
+	if activeProvider() == providerMock {
+		skipStep("provider key", "provider "+activeProvider()+" needs no key")
+		return
+	}
+	if envString("ECHO_READINESS_PROVIDER_CHECK", "true") == "false" {
+		skipStep("provider key", "ECHO_READINESS_PROVIDER_CHECK=false")
+		return
+	}
+	step := beginStep("provider key")
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		err := checkProviderModel(ctx, defaultModel())
+		cancel()
+		if err == nil {
+			step.done("%s accepted the key", defaultModel())
+			return
+		}
+		step.failed(err, true)
+		time.Sleep(envDuration("ECHO_READINESS_RETRY", 15*time.Second))
+	}
+}
+
+func readiness() ReadinessResponse {
+	startupMutex.Lock()
+	defer startupMutex.Unlock()
+	resp := ReadinessResponse{Ready: isReady(), Node: nodeID, Steps: make([]StartupStep, 0, len(startupSteps))}
+	for _, step := range startupSteps {
+		snapshot := *step
+		if snapshot.State == stepRunning {
+			snapshot.DurationMs = time.Since(step.StartedAt).Milliseconds()
+		}
+		resp.Steps = append(resp.Steps, snapshot)
+	}
+	return resp
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	resp := readiness()
+	status := http.StatusOK
+	if !resp.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
+
+// serveHTTP listens on addr, or the socket systemd or a previous echo
+// passed in, right away, answering the probes itself and everything else
+// with 503 until markReady.
+func serveHTTP(addr string) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimSuffix(r.URL.Path, "/") {
+		case "/healthz":
+			handleHealthz(w, r)
+			return
+		case "/readyz":
+			handleReadyz(w, r)
+			return
+		}
+		if app := appHandler.Load(); app != nil {
+			(*app).ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", "5")
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "starting up"})
+	})
+
+	listener, err := systemdListener()
+	if err != nil {
+		log.Fatalf("HTTP server: %v", err)
+	}
+	if listener != nil {
+		addr = listener.Addr().String() + " (systemd socket)"
+		registerHandoffListener("http", listener)
+	} else {
+		takeOver()
+		if listener, err = handoffListen("http", addr); err != nil {
+			log.Fatalf("HTTP server: %v", err)
+		}
+	}
+	startWatchdog()
+
+	listening := addr
+	if handedOff() {
+		listening += fmt.Sprintf(" (from pid %d)", handoffFrom)
+	}
+	fmt.Println("Echo backend listening on " + listening)
+	httpServer = &http.Server{Handler: handler}
+	go func() {
+		if err := httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("HTTP server: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// Panic recovery. Every request gets an ID, taken from a well-formed
+// X-Request-ID header or generated, echoed in the response and readable by
+// handlers with requestID. A panicking handler is logged with its stack,
+// counted in echo_http_panics and reported to the error tracker (see
+// errorreport.go), and the client gets a 500 carrying the request ID
+// instead of the server going down with every other request in flight.
+
+const maxRequestIDLength = 128
+
+var httpPanics = newCounter("echo_http_panics", "Handler panics recovered, by route.")
+
+// requestID returns the ID assigned to r by serveRecovered.
+func requestID(r *http.Request) string {
+	return r.Header.Get("X-Request-ID")
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// serveRecovered assigns the request ID and serves r with next, turning a
+// panic into a 500 unless the response was already under way.
+func serveRecovered(w *statusRecorder, r *http.Request, next http.Handler) {
+	id := r.Header.Get("X-Request-ID")
+	if !validRequestID(id) {
+		id = newID()
+		r.Header.Set("X-Request-ID", id)
+	}
+	w.Header().Set("X-Request-ID", id)
+
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		if recovered == http.ErrAbortHandler {
+			// Deliberate abort of the response; let net/http handle it.
+			panic(recovered)
+		}
+		stack := debug.Stack()
+		log.Printf("Panic serving %s %s (request %s): %v\n%s", r.Method, r.URL.Path, id, recovered, stack)
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		httpPanics.add(metricLabels("route", route), 1)
+		reportPanic(recovered, r)
+
+		if w.status == 0 {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{
+				"error":     "internal error",
+				"requestId": id,
+			})
+		}
+	}()
+	next.ServeHTTP(w, r)
+}
+
+// panicError turns a recovered value into an error for reporting.
+func panicError(recovered any) error {
+	if err, ok := recovered.(error); ok {
+		return err
+	}
+	return fmt.Errorf("%v", recovered)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal Redis client speaking RESP2 over plain TCP, enough for the state
+// store: commands are sent as arrays of bulk strings and replies decoded into
+// string, int64, []any or nil. Connections are pooled; one that fails
+// mid-command is discarded rather than reused.
+
+const redisMaxIdle = 8
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+// newRedisClient parses a redis://[:password@]host:port[/db] URL.
+func newRedisClient(rawURL string, timeout time.Duration) (*redisClient, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported scheme %q, want redis://", parsed.Scheme)
+	}
+	client := &redisClient{addr: parsed.Host, timeout: timeout}
+	if parsed.Port() == "" {
+		client.addr = net.JoinHostPort(parsed.Hostname(), "6379")
+	}
+	if parsed.User != nil {
+		client.password, _ = parsed.User.Password()
+		if client.password == "" {
+			client.password = parsed.User.Username()
+		}
+	}
+	if db := strings.Trim(parsed.Path, "/"); db != "" {
+		if client.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid database %q", db)
+		}
+	}
+	return client, nil
+}
+
+func (c *redisClient) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if c.password != "" {
+		if _, err := rc.do(c.timeout, "AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := rc.do(c.timeout, "SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// do runs one command. Redis error replies come back as redisError and leave
+// the connection usable; transport errors close it.
+func (c *redisClient) do(args ...string) (any, error) {
+	c.mu.Lock()
+	var rc *redisConn
+	if n := len(c.idle); n > 0 {
+		rc, c.idle = c.idle[n-1], c.idle[:n-1]
+	}
+	c.mu.Unlock()
+
+	if rc == nil {
+		var err error
+		if rc, err = c.dial(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := rc.do(c.timeout, args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		rc.conn.Close()
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if len(c.idle) < redisMaxIdle {
+		c.idle = append(c.idle, rc)
+		rc = nil
+	}
+	c.mu.Unlock()
+	if rc != nil {
+		rc.conn.Close()
+	}
+	return reply, err
+}
+
+func (rc *redisConn) do(timeout time.Duration, args ...string) (any, error) {
+	rc.conn.SetDeadline(time.Now().Add(timeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := rc.conn.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+	return rc.read()
+}
+
+func (rc *redisConn) read() (any, error) {
+	line, err := rc.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(rc.reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]any, count)
+		for i := range items {
+			// Error replies inside an array (from MULTI/EXEC) are kept as
+			// values.
+			item, err := rc.read()
+			var replyErr redisError
+			if err != nil && !errors.As(err, &replyErr) {
+				return nil, err
+			}
+			if err != nil {
+				item = err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// redisFloat and redisStrings convert replies, treating a nil reply as zero
+// or empty.
+func redisFloat(reply any, err error) (float64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch v := reply.(type) {
+	case string:
+		return strconv.ParseFloat(v, 64)
+	case int64:
+		return float64(v), nil
+	case nil:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("redis: unexpected reply %T", reply)
+}
+
+func redisStrings(reply any, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]any)
+	if !ok {
+		if reply == nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("redis: unexpected reply %T", reply)
+	}
+	out := make([]string, 0, len(items))
+	for _, item := range items {
+		s, _ := item.(string)
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// redisHash converts an HGETALL reply to a map.
+func redisHash(reply any, err error) (map[string]string, error) {
+	fields, err := redisStrings(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	hash := make(map[string]string, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		hash[fields[i]] = fields[i+1]
+	}
+	return hash, nil
+}
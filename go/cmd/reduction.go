@@ -0,0 +1,169 @@
+package main
+
+import (
+	"log"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
+)
+
+// ECHO_VECTOR_DIMENSIONS reduces vectors to that many dimensions to cut
+// memory and search time; 0 (default) keeps them whole. ECHO_VECTOR_REDUCTION
+// picks how:
+//
+//	truncate  keep the first N components, as Matryoshka-trained embedding
+//	          models allow. Stored vectors shrink; queries and cold-tier
+//	          entries are truncated before scoring.
+//	pca       project onto the top N principal directions of each index
+//	          partition, refitted as the partition doubles. Stored vectors
+//	          stay whole and only the indexes hold projected copies, so this
+//	          saves search time, not memory.
+//
+// The replay harness reports the recall impact of either before it is
+// switched on.
+
+const (
+	reductionTruncate = "truncate"
+	reductionPCA      = "pca"
+
+	// pcaSampleSize caps the vectors a projection is fitted on.
+	pcaSampleSize = 1000
+	pcaIterations = 12
+)
+
+func vectorDimensions() int {
+	return envInt("ECHO_VECTOR_DIMENSIONS", 0)
+}
+
+func vectorReduction() string {
+	if vectorDimensions() <= 0 {
+		return ""
+	}
+	mode := strings.ToLower(envString("ECHO_VECTOR_REDUCTION", reductionTruncate))
+	if mode != reductionTruncate && mode != reductionPCA {
+		log.Printf("Unknown ECHO_VECTOR_REDUCTION %q, using truncate", mode)
+		return reductionTruncate
+	}
+	return mode
+}
+
+// reduceVector returns vector as stored and compared under truncation: a
+// copy of its first ECHO_VECTOR_DIMENSIONS components. Other modes return
+// vector unchanged.
+func reduceVector(vector []float32) []float32 {
+	dims := vectorDimensions()
+	if vectorReduction() != reductionTruncate || len(vector) <= dims {
+		return vector
+	}
+	return slices.Clone(vector[:dims])
+}
+
+// scoringVector is vector as scored under truncation, without copying it.
+func scoringVector(vector []float32) []float32 {
+	if vectorReduction() != reductionTruncate {
+		return vector
+	}
+	return truncateVector(vector, vectorDimensions())
+}
+
+// pcaProjection maps vectors onto the directions that carry most of their
+// energy. The vectors are not centered first (uncentered PCA, i.e. a
+// truncated SVD), so cosine similarity between projected vectors stays close
+// to the original and the hit threshold keeps its meaning.
+type pcaProjection struct {
+	components [][]float64
+	// fittedOn is the number of vectors in the partition when fitted.
+	fittedOn int
+}
+
+// apply projects vector; a nil projection or a vector of another dimension
+// passes through unchanged.
+func (p *pcaProjection) apply(vector []float32) []float32 {
+	if p == nil || len(p.components) == 0 || len(vector) != len(p.components[0]) {
+		return vector
+	}
+	out := make([]float32, len(p.components))
+	for i, component := range p.components {
+		var dot float64
+		for j, v := range vector {
+			dot += float64(v) * component[j]
+		}
+		out[i] = float32(dot)
+	}
+	return out
+}
+
+// fitPCA finds the top dims directions of vectors by power iteration with
+// deflation, on a sample of at most pcaSampleSize vectors. It returns nil when
+// there are too few vectors to fit dims directions or nothing to reduce.
+func fitPCA(vectors [][]float32, dims int) *pcaProjection {
+	if len(vectors) <= dims || dims <= 0 || dims >= len(vectors[0]) {
+		return nil
+	}
+	fittedOn := len(vectors)
+	width := len(vectors[0])
+	if len(vectors) > pcaSampleSize {
+		sample := make([][]float32, pcaSampleSize)
+		for i, idx := range rand.Perm(len(vectors))[:pcaSampleSize] {
+			sample[i] = vectors[idx]
+		}
+		vectors = sample
+	}
+
+	rows := make([][]float64, 0, len(vectors))
+	for _, vector := range vectors {
+		if len(vector) != width {
+			continue
+		}
+		row := make([]float64, width)
+		for j, v := range vector {
+			row[j] = float64(v)
+		}
+		rows = append(rows, row)
+	}
+
+	components := make([][]float64, 0, dims)
+	for len(components) < dims {
+		w := make([]float64, width)
+		for j := range w {
+			w[j] = rand.NormFloat64()
+		}
+		for range pcaIterations {
+			next := make([]float64, width)
+			for _, row := range rows {
+				var dot float64
+				for j, v := range row {
+					dot += v * w[j]
+				}
+				for j, v := range row {
+					next[j] += dot * v
+				}
+			}
+			for _, c := range components {
+				var dot float64
+				for j := range next {
+					dot += next[j] * c[j]
+				}
+				for j := range next {
+					next[j] -= dot * c[j]
+				}
+			}
+			var norm float64
+			for _, v := range next {
+				norm += v * v
+			}
+			if norm == 0 {
+				// The vectors span fewer than dims directions.
+				return &pcaProjection{components: components, fittedOn: fittedOn}
+			}
+			norm = math.Sqrt(norm)
+			for j := range next {
+				next[j] /= norm
+			}
+			w = next
+		}
+		components = append(components, w)
+	}
+	return &pcaProjection{components: components, fittedOn: fittedOn}
+}
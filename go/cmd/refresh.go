@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type RefreshRequest struct {
+	Model string `json:"model,omitempty"`
+}
+
+type RefreshResponse struct {
+	Entry          CacheEntryView `json:"entry"`
+	PreviousAnswer string         `json:"previousAnswer"`
+	Model          string         `json:"model"`
+}
+
+// findEntryForCaller returns a copy of the hot-tier entry with id, if it is
+// visible to caller.
+func findEntryForCaller(caller Caller, id string) (VectorEntry, bool) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	for _, entry := range MockVectorDB {
+		if entry.ID != id || entry.Tenant != caller.Tenant || !entryVisible(entry, caller) {
+			continue
+		}
+		return entry, true
+	}
+	return VectorEntry{}, false
+}
+
+// replaceEntryAnswer swaps in an answer regenerated by model, resets
+// CreatedAt and drops the locale variants, citations and feedback of the old
+// answer. It returns the replaced answer, or false when the entry disappeared
+// meanwhile.
+func replaceEntryAnswer(id, answer, model string) (VectorEntry, string, bool) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	for i := range MockVectorDB {
+		if MockVectorDB[i].ID != id {
+			continue
+		}
+		previous := entryAnswer(MockVectorDB[i])
+		cacheSeq++
+		MockVectorDB[i].Answer = answer
+		MockVectorDB[i].Model = model
+		MockVectorDB[i].Provider = modelProvider(model)
+		MockVectorDB[i].GeneratedTokens = 0
+		MockVectorDB[i].CompressedAnswer = nil
+		compressEntryAnswer(&MockVectorDB[i])
+		MockVectorDB[i].Variants = nil
+		MockVectorDB[i].Citations = nil
+		MockVectorDB[i].Helpful = 0
+		MockVectorDB[i].Unhelpful = 0
+		MockVectorDB[i].CreatedAt = time.Now()
+		MockVectorDB[i].Seq = cacheSeq
+		markCacheChanged()
+		recordCacheChange(changeUpdated, MockVectorDB[i])
+		return MockVectorDB[i], previous, true
+	}
+	return VectorEntry{}, "", false
+}
+
+func entryView(entry VectorEntry) CacheEntryView {
+	source := entry.Source
+	if source == "" {
+		source = cacheSourceLocal
+	}
+	return CacheEntryView{
+		ID:             entry.ID,
+		Question:       entry.Question,
+		Answer:         entryAnswer(entry),
+		Source:         source,
+		EmbeddingModel: entryEmbeddingModel(entry),
+		Model:          entry.Model,
+		Provider:       entry.Provider,
+		Contributor:    entry.Contributor,
+		License:        entry.License,
+		Language:       entryLanguage(entry),
+		Style:          entryStyle(entry),
+		Variants:       entry.Variants,
+		Paraphrases:    paraphraseQuestions(entry),
+		Access:         entryAccess(entry),
+		Citations:      entry.Citations,
+		TimeSensitive:  entry.TimeSensitive,
+		Authoritative:  entry.Authoritative,
+		FAQPack:        entry.FAQPack,
+		Helpful:        entry.Helpful,
+		Unhelpful:      entry.Unhelpful,
+		CreatedAt:      entry.CreatedAt,
+	}
+}
+
+// handleRefresh forces a fresh provider call for an existing entry and
+// replaces its stored answer, keeping the old one in the audit trail.
+func handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if caller.Anonymous {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "refresh is not available in demo mode"})
+		return
+	}
+
+	var req RefreshRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON payload"})
+			return
+		}
+	}
+
+	entry, found := findEntryForCaller(caller, r.PathValue("id"))
+	if !found {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "cache entry not found"})
+		return
+	}
+
+	modelName, err := resolveModel(caller.Tenant, req.Model)
+	if err != nil {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+		return
+	}
+	reserved := estimateTokens(entry.Question)
+	if denial := reserveTokens(caller, reserved); denial != nil {
+		writeQuotaExceeded(w, denial)
+		return
+	}
+	defer releaseTokens(caller, reserved)
+	if budget, exhausted := budgetExhausted(caller.Tenant); exhausted {
+		writeBudgetExceeded(w, budget)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 20*time.Second)
+	defer cancel()
+
+	answer, err := generateAnswer(ctx, styledPrompt(entry.Question, entryStyle(entry)), modelName)
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "failed to generate response"})
+		return
+	}
+	recordUsage(caller, modelName, "CLOUD", estimateTokens(entry.Question)+estimateTokens(answer), 0)
+
+	updated, previous, found := replaceEntryAnswer(entry.ID, answer, modelName)
+	if !found {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "cache entry not found"})
+		return
+	}
+
+	recordAudit(AuditEvent{
+		Action:  "cache.refresh",
+		EntryID: entry.ID,
+		Tenant:  caller.Tenant,
+		Actor:   callerActor(caller),
+		Details: map[string]string{"previousAnswer": redactContent(previous), "model": modelName},
+	})
+
+	writeJSON(w, http.StatusOK, RefreshResponse{
+		Entry:          entryView(updated),
+		PreviousAnswer: previous,
+		Model:          modelName,
+	})
+}
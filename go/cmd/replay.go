@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// Replay re-runs recorded history lookups against the current cache under a
+// hypothetical configuration, without calling the provider or changing
+// anything, and reports the hit rates each threshold would have produced.
+
+type ReplayRequest struct {
+	Thresholds []float64 `json:"thresholds"`
+	// Dimensions truncates history and cache vectors to their first N
+	// components before scoring (Matryoshka-style), 0 keeps them whole.
+	Dimensions int `json:"dimensions,omitempty"`
+	// Reduction is how Dimensions is reached: truncate (default) or pca,
+	// fitted on the tenant's cache vectors.
+	Reduction string `json:"reduction,omitempty"`
+	Tenant    string `json:"tenant,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+}
+
+type ReplayResult struct {
+	Threshold float64 `json:"threshold"`
+	Hits      int     `json:"hits"`
+	HitRate   float64 `json:"hitRate"`
+	NewHits   int     `json:"newHits"`
+	LostHits  int     `json:"lostHits"`
+}
+
+type ReplayResponse struct {
+	Replayed      int            `json:"replayed"`
+	Skipped       int            `json:"skipped"`
+	ActualHits    int            `json:"actualHits"`
+	ActualHitRate float64        `json:"actualHitRate"`
+	Dimensions    int            `json:"dimensions,omitempty"`
+	Reduction     string         `json:"reduction,omitempty"`
+	Results       []ReplayResult `json:"results"`
+}
+
+func truncateVector(vector []float32, dims int) []float32 {
+	if dims <= 0 || dims >= len(vector) {
+		return vector
+	}
+	return vector[:dims]
+}
+
+func handleReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var req ReplayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON payload"})
+		return
+	}
+	if len(req.Thresholds) == 0 {
+		req.Thresholds = []float64{similarityThreshold}
+	}
+	for _, threshold := range req.Thresholds {
+		if threshold <= 0 || threshold > 1 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "thresholds must be in (0, 1]"})
+			return
+		}
+	}
+	sort.Float64s(req.Thresholds)
+	if req.Reduction == "" {
+		req.Reduction = reductionTruncate
+	}
+	if req.Reduction != reductionTruncate && req.Reduction != reductionPCA {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "reduction must be truncate or pca"})
+		return
+	}
+
+	dbMutex.RLock()
+	entries := make([]VectorEntry, 0, len(MockVectorDB))
+	for _, entry := range MockVectorDB {
+		if entry.Tenant == req.Tenant || entryVisible(entry, Caller{Tenant: req.Tenant}) {
+			entries = append(entries, entry)
+		}
+	}
+	history := make([]HistoryItem, 0, len(ChatHistory))
+	for _, item := range ChatHistory {
+		if item.Tenant == req.Tenant {
+			history = append(history, item)
+		}
+	}
+	dbMutex.RUnlock()
+
+	if req.Limit > 0 && len(history) > req.Limit {
+		history = history[len(history)-req.Limit:]
+	}
+
+	reduce := func(vector []float32) []float32 { return truncateVector(vector, req.Dimensions) }
+	if req.Reduction == reductionPCA && req.Dimensions > 0 {
+		vectors := make([][]float32, len(entries))
+		for i, entry := range entries {
+			vectors[i] = entry.Vector
+		}
+		reduce = fitPCA(vectors, req.Dimensions).apply
+	}
+	reduced := make([][]float32, len(entries))
+	for i, entry := range entries {
+		reduced[i] = reduce(entry.Vector)
+	}
+
+	resp := ReplayResponse{Dimensions: req.Dimensions}
+	if req.Dimensions > 0 {
+		resp.Reduction = req.Reduction
+	}
+	results := make([]ReplayResult, len(req.Thresholds))
+	for i, threshold := range req.Thresholds {
+		results[i].Threshold = threshold
+	}
+
+	for _, item := range history {
+		if len(item.Vector) == 0 {
+			resp.Skipped++
+			continue
+		}
+		query := reduce(item.Vector)
+
+		// Only entries that existed before the original request count, so a
+		// miss does not replay as a hit against the answer it produced.
+		best := 0.0
+		for i, entry := range entries {
+			if !entry.CreatedAt.Before(item.Timestamp) {
+				continue
+			}
+			if !entryVisible(entry, Caller{Tenant: item.Tenant, User: item.User}) {
+				continue
+			}
+			best = max(best, cosineSimilarity(query, reduced[i]))
+		}
+
+		resp.Replayed++
+		if item.Saved {
+			resp.ActualHits++
+		}
+		for i := range results {
+			wouldHit := best >= results[i].Threshold
+			if wouldHit {
+				results[i].Hits++
+			}
+			if wouldHit && !item.Saved {
+				results[i].NewHits++
+			}
+			if !wouldHit && item.Saved {
+				results[i].LostHits++
+			}
+		}
+	}
+
+	if resp.Replayed > 0 {
+		resp.ActualHitRate = float64(resp.ActualHits) / float64(resp.Replayed)
+		for i := range results {
+			results[i].HitRate = float64(results[i].Hits) / float64(resp.Replayed)
+		}
+	}
+	resp.Results = results
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// History retention keeps long-lived instances from holding every
+// conversation in RAM. ECHO_HISTORY_MAX_ITEMS caps the number of items and
+// ECHO_HISTORY_MAX_AGE drops older ones; pinned items are always kept. With
+// ECHO_HISTORY_EXPORT=true, trimmed items are written to S3 under
+// history-archive/ first and only forgotten once the upload succeeded.
+
+const historyArchivePrefix = "history-archive/"
+
+func historyRetentionEnabled() bool {
+	return envInt("ECHO_HISTORY_MAX_ITEMS", 0) > 0 || envDuration("ECHO_HISTORY_MAX_AGE", 0) > 0
+}
+
+func historyExportEnabled() bool {
+	return envString("ECHO_HISTORY_EXPORT", "") == "true"
+}
+
+// expiredHistoryLocked returns the items the retention policy drops. Callers
+// must hold dbMutex.
+func expiredHistoryLocked(now time.Time) []HistoryItem {
+	maxItems := envInt("ECHO_HISTORY_MAX_ITEMS", 0)
+	maxAge := envDuration("ECHO_HISTORY_MAX_AGE", 0)
+	if maxItems <= 0 && maxAge <= 0 {
+		return nil
+	}
+
+	excess := 0
+	if maxItems > 0 {
+		excess = len(ChatHistory) - maxItems
+	}
+
+	// ChatHistory is in insertion order, so the oldest items come first.
+	var expired []HistoryItem
+	for _, item := range ChatHistory {
+		old := maxAge > 0 && now.Sub(item.Timestamp) > maxAge
+		if !item.Pinned && (old || len(expired) < excess) {
+			expired = append(expired, item)
+		}
+	}
+	return expired
+}
+
+// dropHistoryLocked removes items from ChatHistory by ID. Callers must hold
+// dbMutex for writing.
+func dropHistoryLocked(items []HistoryItem) {
+	if len(items) == 0 {
+		return
+	}
+	ids := make(map[string]bool, len(items))
+	for _, item := range items {
+		ids[item.ID] = true
+	}
+	kept := ChatHistory[:0]
+	for _, item := range ChatHistory {
+		if !ids[item.ID] {
+			kept = append(kept, item)
+		}
+	}
+	ChatHistory = kept
+}
+
+// trimHistoryLocked applies the retention policy. Without export the items
+// are dropped right away; with it they stay until they are written, and it
+// reports true so the caller runs trimExportedHistory once it has released
+// dbMutex. Callers must hold dbMutex for writing.
+func trimHistoryLocked(now time.Time) bool {
+	expired := expiredHistoryLocked(now)
+	if historyExportEnabled() {
+		return len(expired) > 0
+	}
+	dropHistoryLocked(expired)
+	return false
+}
+
+var historyExportMutex sync.Mutex
+
+// trimExportedHistory writes the expired items to S3 and drops those that
+// were written. Items whose upload failed stay in memory for the next try.
+// Only one export runs at a time; a call that finds one running leaves the
+// items to it or to the next append or tick.
+func trimExportedHistory() {
+	if !historyExportMutex.TryLock() {
+		return
+	}
+	defer historyExportMutex.Unlock()
+
+	dbMutex.RLock()
+	expired := expiredHistoryLocked(time.Now())
+	dbMutex.RUnlock()
+
+	exported := exportHistory(expired)
+	dbMutex.Lock()
+	dropHistoryLocked(exported)
+	dbMutex.Unlock()
+}
+
+// exportHistory writes items to S3, one object per tenant, and returns the
+// items that were written.
+func exportHistory(items []HistoryItem) []HistoryItem {
+	if len(items) == 0 {
+		return nil
+	}
+	target := activeS3Target()
+	if target == nil {
+		log.Printf("History export: S3 is not configured, keeping %d items", len(items))
+		return nil
+	}
+
+	byTenant := make(map[string][]HistoryItem)
+	for _, item := range items {
+		byTenant[item.Tenant] = append(byTenant[item.Tenant], item)
+	}
+
+	var exported []HistoryItem
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	for tenant, tenantItems := range byTenant {
+		body, err := json.Marshal(tenantItems)
+		if err != nil {
+			log.Printf("History export: marshal failed: %v", err)
+			continue
+		}
+		key := fmt.Sprintf("%s%s/%s-%s.json", historyArchivePrefix, tenantName(tenant), stamp, newID())
+		if err := putCacheObject(target, key, body, tenantKMSKey(tenant)); err != nil {
+			log.Printf("History export to %s failed: %v", key, err)
+			continue
+		}
+		log.Printf("History export: wrote %d items to %s", len(tenantItems), key)
+		exported = append(exported, tenantItems...)
+	}
+	return exported
+}
+
+// startHistoryRetention periodically trims items that aged out; the item cap
+// is also enforced on every append.
+func startHistoryRetention(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for range ticker.C {
+			dbMutex.Lock()
+			export := trimHistoryLocked(time.Now())
+			dbMutex.Unlock()
+			if export {
+				trimExportedHistory()
+			}
+		}
+	}()
+}
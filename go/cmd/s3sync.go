@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/smithy-go/middleware"
+)
+
+// S3 traffic is bounded two ways. ECHO_S3_MAX_CONCURRENCY (default 4, 0 for
+// no limit) caps the S3 requests in flight across sync, archive, billing and
+// everything else sharing the clients; a request waiting for a slot spends
+// its own timeout doing so. And the sync cycle run every ECHO_SYNC_INTERVAL
+// (default 5m) is single-flight: a tick that finds the previous cycle still
+// running is skipped and counted rather than queued behind it. A cycle past
+// ECHO_SYNC_MAX_DURATION (default 4m) skips its remaining steps; the step
+// already running finishes under its per-request timeouts. Uploads asked for
+// while one is running collapse into a single follow-up upload. With
+// ECHO_SYNC_ADAPTIVE the interval follows the rate of cache changes instead;
+// see syncschedule.go.
+//
+// An upload is skipped altogether when nothing changed since the last
+// successful upload to the same target. Every change to cached content, hot
+// or cold, calls markCacheChanged; hit counters and moves between tiers do
+// not, and reach S3 with the next real change.
+
+type SyncStats struct {
+	Running          bool       `json:"running"`
+	Cycles           int        `json:"cycles"`
+	SkippedTicks     int        `json:"skippedTicks"`
+	Overruns         int        `json:"overruns"`
+	CoalescedUploads int        `json:"coalescedUploads"`
+	UnchangedUploads int        `json:"unchangedUploads"`
+	LastStartedAt    *time.Time `json:"lastStartedAt,omitempty"`
+	LastDurationMs   int64      `json:"lastDurationMs"`
+	MaxDurationMs    int64      `json:"maxDurationMs"`
+	S3InFlight       int        `json:"s3InFlight"`
+	S3MaxConcurrency int        `json:"s3MaxConcurrency"`
+	// IntervalMs is the current sync interval and NextCycleAt, with
+	// ECHO_SYNC_ADAPTIVE, when the next cycle is due; see syncschedule.go.
+	IntervalMs  int64      `json:"intervalMs"`
+	NextCycleAt *time.Time `json:"nextCycleAt,omitempty"`
+}
+
+var (
+	// s3Slots is sized by initS3Client; until then S3 calls are unlimited.
+	s3Slots chan struct{}
+
+	// syncMutex guards the fields below.
+	syncMutex       sync.Mutex
+	syncStats       SyncStats
+	uploadRunning   bool
+	uploadRequested bool
+	// uploadedGeneration maps a target name to the cacheGeneration its
+	// last successful upload carried.
+	uploadedGeneration = make(map[string]uint64)
+
+	cacheGeneration atomic.Uint64
+)
+
+func markCacheChanged() {
+	cacheGeneration.Add(1)
+}
+
+// uploadNeeded reports whether target lacks changes up to generation.
+func uploadNeeded(target *s3Target, generation uint64) bool {
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+	uploaded, ok := uploadedGeneration[target.Name]
+	if ok && uploaded == generation {
+		syncStats.UnchangedUploads++
+		return false
+	}
+	return true
+}
+
+func markUploaded(target *s3Target, generation uint64) {
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+	uploadedGeneration[target.Name] = generation
+}
+
+// limitS3Concurrency is installed on every S3 client. It sits before the
+// retry middleware, so an operation holds one slot across its retries.
+func limitS3Concurrency(stack *middleware.Stack) error {
+	return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("EchoConcurrencyLimit",
+		func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			if cap(s3Slots) == 0 {
+				return next.HandleFinalize(ctx, in)
+			}
+			select {
+			case s3Slots <- struct{}{}:
+			case <-ctx.Done():
+				return middleware.FinalizeOutput{}, middleware.Metadata{}, fmt.Errorf("waiting for an S3 slot: %w", ctx.Err())
+			}
+			defer func() { <-s3Slots }()
+			return next.HandleFinalize(ctx, in)
+		}), middleware.Before)
+}
+
+func startBackgroundSync() {
+	interval := envDuration("ECHO_SYNC_INTERVAL", 300*time.Second)
+	maxDuration := envDuration("ECHO_SYNC_MAX_DURATION", 4*time.Minute)
+	if adaptiveSyncEnabled() {
+		go runAdaptiveSync(interval, maxDuration)
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	syncMutex.Lock()
+	syncStats.IntervalMs = interval.Milliseconds()
+	syncMutex.Unlock()
+
+	go func() {
+		defer ticker.Stop()
+		for range ticker.C {
+			go runSyncCycle(maxDuration)
+		}
+	}()
+}
+
+// runSyncCycle runs one sync cycle unless one is already running.
+func runSyncCycle(maxDuration time.Duration) {
+	syncMutex.Lock()
+	if syncStats.Running {
+		syncStats.SkippedTicks++
+		syncMutex.Unlock()
+		log.Printf("Sync cycle skipped: the previous cycle is still running")
+		return
+	}
+	start := time.Now()
+	syncStats.Running = true
+	syncStats.LastStartedAt = &start
+	syncMutex.Unlock()
+	recorder := newSyncCycleRecorder(start)
+
+	defer func() {
+		elapsed := time.Since(start)
+		recorder.finish(elapsed)
+		overrun := maxDuration > 0 && elapsed > maxDuration
+		syncMutex.Lock()
+		syncStats.Running = false
+		syncStats.Cycles++
+		syncStats.LastDurationMs = elapsed.Milliseconds()
+		syncStats.MaxDurationMs = max(syncStats.MaxDurationMs, elapsed.Milliseconds())
+		if overrun {
+			syncStats.Overruns++
+		}
+		syncMutex.Unlock()
+	}()
+
+	steps := []struct {
+		name string
+		run  func()
+	}{
+		{"failback", tryFailback},
+		{"download", func() { downloadAndMergeFromS3() }},
+		{"archive", archiveStaleEntries},
+		{"upload", func() {
+			dbMutex.RLock()
+			hasData := len(MockVectorDB) > 0
+			dbMutex.RUnlock()
+
+			if hasData {
+				fmt.Println("Batching: Uploading memory to S3...")
+				uploadToS3()
+			}
+		}},
+	}
+	for i, step := range steps {
+		if maxDuration > 0 && time.Since(start) > maxDuration {
+			log.Printf("Sync cycle exceeded %v; skipping %s and later steps", maxDuration, step.name)
+			for _, skipped := range steps[i:] {
+				recorder.skip(skipped.name)
+			}
+			return
+		}
+		stepStart := time.Now()
+		step.run()
+		recorder.step(step.name, time.Since(stepStart))
+	}
+}
+
+// uploadToS3 writes the cache to the active target. A call made while an
+// upload is running returns at once and has that upload run once more when
+// it finishes, so the newest state still reaches S3.
+func uploadToS3() {
+	syncMutex.Lock()
+	if uploadRunning {
+		uploadRequested = true
+		syncStats.CoalescedUploads++
+		syncMutex.Unlock()
+		return
+	}
+	uploadRunning = true
+	syncMutex.Unlock()
+
+	for {
+		uploadCacheObjects()
+
+		syncMutex.Lock()
+		if !uploadRequested {
+			uploadRunning = false
+			syncMutex.Unlock()
+			return
+		}
+		uploadRequested = false
+		syncMutex.Unlock()
+	}
+}
+
+func currentSyncStats() SyncStats {
+	syncMutex.Lock()
+	stats := syncStats
+	syncMutex.Unlock()
+	stats.S3InFlight = len(s3Slots)
+	stats.S3MaxConcurrency = cap(s3Slots)
+	return stats
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Saved prompts are canned questions a user keeps to fire with one click.
+// Each is embedded once when it is saved, server-side unless the client
+// sends its own vector, so every run sends /chat the same vector and text:
+// the first run caches the answer and every later run is an exact hit.
+//
+//	GET    /prompts            list the caller's prompts
+//	POST   /prompts            save one: {"title", "text", "model", "style", "locale"}
+//	GET    /prompts/{id}       fetch one
+//	PUT    /prompts/{id}       replace it; a changed text is embedded again
+//	DELETE /prompts/{id}       delete it
+//	POST   /prompts/{id}/run   answer it as /chat would, optionally in a session
+//
+// Prompts are kept per tenant and user and persisted to
+// ECHO_SAVED_PROMPTS_PATH; each user can keep up to ECHO_SAVED_PROMPTS_MAX
+// (default 100).
+
+const maxPromptTitleRunes = 120
+
+type SavedPrompt struct {
+	ID     string `json:"id"`
+	Tenant string `json:"tenant"`
+	User   string `json:"user,omitempty"`
+	Title  string `json:"title"`
+	Text   string `json:"text"`
+	// Model, Style and Locale are passed to /chat when set.
+	Model  string `json:"model,omitempty"`
+	Style  string `json:"style,omitempty"`
+	Locale string `json:"locale,omitempty"`
+	// Vector is the embedding of Text. It is persisted but never returned.
+	Vector         []float32  `json:"vector,omitempty"`
+	EmbeddingModel string     `json:"embeddingModel"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	UpdatedAt      time.Time  `json:"updatedAt"`
+	Runs           int        `json:"runs"`
+	LastRunAt      *time.Time `json:"lastRunAt,omitempty"`
+}
+
+// SavedPromptRequest creates or replaces a prompt. Vector and
+// EmbeddingModel are optional; without them the server embeds Text.
+type SavedPromptRequest struct {
+	Title          string    `json:"title"`
+	Text           string    `json:"text"`
+	Model          string    `json:"model,omitempty"`
+	Style          string    `json:"style,omitempty"`
+	Locale         string    `json:"locale,omitempty"`
+	Vector         []float32 `json:"vector,omitempty"`
+	EmbeddingModel string    `json:"embeddingModel,omitempty"`
+}
+
+type RunPromptRequest struct {
+	SessionID string `json:"sessionId,omitempty"`
+}
+
+var (
+	savedPromptMutex sync.Mutex
+	savedPrompts     = make(map[string]*SavedPrompt)
+)
+
+func savedPromptsPath() string {
+	return envString("ECHO_SAVED_PROMPTS_PATH", filepath.Join(os.TempDir(), "echo-saved-prompts.json"))
+}
+
+func loadSavedPrompts() {
+	data, err := os.ReadFile(savedPromptsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Printf("Load saved prompts failed: %v", err)
+		return
+	}
+
+	var loaded []*SavedPrompt
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		log.Printf("Load saved prompts failed: %v", err)
+		return
+	}
+	savedPromptMutex.Lock()
+	for _, prompt := range loaded {
+		savedPrompts[prompt.ID] = prompt
+	}
+	savedPromptMutex.Unlock()
+	log.Printf("Loaded %d saved prompts from %s", len(loaded), savedPromptsPath())
+}
+
+// saveSavedPromptsLocked writes every prompt; it requires savedPromptMutex.
+// Prompts change rarely, so each change is written through.
+func saveSavedPromptsLocked() {
+	prompts := make([]*SavedPrompt, 0, len(savedPrompts))
+	for _, prompt := range savedPrompts {
+		prompts = append(prompts, prompt)
+	}
+	sort.Slice(prompts, func(i, j int) bool { return prompts[i].ID < prompts[j].ID })
+	data, err := json.Marshal(prompts)
+	if err == nil {
+		path := savedPromptsPath()
+		tmpPath := path + ".tmp"
+		if err = os.WriteFile(tmpPath, data, 0o600); err == nil {
+			err = os.Rename(tmpPath, path)
+		}
+	}
+	if err != nil {
+		log.Printf("Save saved prompts failed: %v", err)
+	}
+}
+
+// view returns a copy safe to encode: without the vector.
+func (p *SavedPrompt) view() SavedPrompt {
+	view := *p
+	view.Vector = nil
+	return view
+}
+
+func promptVisible(prompt *SavedPrompt, caller Caller) bool {
+	return prompt.Tenant == caller.Tenant && prompt.User == caller.User
+}
+
+// validateSavedPrompt normalizes req and embeds its text unless the client
+// sent a vector.
+func validateSavedPrompt(ctx context.Context, caller Caller, req *SavedPromptRequest) (int, string) {
+	req.Text = strings.TrimSpace(req.Text)
+	req.Title = strings.Join(strings.Fields(req.Title), " ")
+	if req.Text == "" {
+		return http.StatusBadRequest, "text is required"
+	}
+	if req.Title == "" {
+		req.Title = truncateTitle(req.Text)
+	}
+	if len([]rune(req.Title)) > maxPromptTitleRunes {
+		return http.StatusBadRequest, "title is too long"
+	}
+	if _, err := resolveModel(caller.Tenant, req.Model); err != nil {
+		return http.StatusForbidden, err.Error()
+	}
+	style, ok := normalizeStyle(req.Style)
+	if !ok {
+		return http.StatusBadRequest, "style must be full, concise or bullet"
+	}
+	req.Style = style
+	if req.Locale, ok = normalizeLocale(req.Locale); !ok {
+		return http.StatusBadRequest, "invalid locale"
+	}
+
+	if len(req.Vector) > 0 {
+		if req.EmbeddingModel, ok = resolveEmbeddingModel(req.EmbeddingModel); !ok {
+			return http.StatusBadRequest, "invalid embedding model"
+		}
+		return 0, ""
+	}
+	embedCtx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+	vectors, model, err := embedTexts(embedCtx, []string{req.Text})
+	if err != nil {
+		log.Printf("Embed saved prompt failed: %v", err)
+		return http.StatusBadGateway, "failed to embed prompt"
+	}
+	req.Vector, req.EmbeddingModel = vectors[0], model
+	return 0, ""
+}
+
+func handleSavedPrompts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if caller.Anonymous {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "saved prompts require an API key"})
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		savedPromptMutex.Lock()
+		prompts := make([]SavedPrompt, 0)
+		for _, prompt := range savedPrompts {
+			if promptVisible(prompt, caller) {
+				prompts = append(prompts, prompt.view())
+			}
+		}
+		savedPromptMutex.Unlock()
+		sort.Slice(prompts, func(i, j int) bool { return prompts[i].CreatedAt.Before(prompts[j].CreatedAt) })
+		writeJSON(w, http.StatusOK, prompts)
+		return
+	}
+
+	var req SavedPromptRequest
+	if err := readJSON(r, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON payload"})
+		return
+	}
+	if status, message := validateSavedPrompt(r.Context(), caller, &req); status != 0 {
+		writeJSON(w, status, map[string]string{"error": message})
+		return
+	}
+
+	now := time.Now()
+	prompt := &SavedPrompt{
+		ID:             newID(),
+		Tenant:         caller.Tenant,
+		User:           caller.User,
+		Title:          req.Title,
+		Text:           req.Text,
+		Model:          req.Model,
+		Style:          req.Style,
+		Locale:         req.Locale,
+		Vector:         req.Vector,
+		EmbeddingModel: req.EmbeddingModel,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+
+	savedPromptMutex.Lock()
+	defer savedPromptMutex.Unlock()
+	count := 0
+	for _, existing := range savedPrompts {
+		if promptVisible(existing, caller) {
+			count++
+		}
+	}
+	if count >= envInt("ECHO_SAVED_PROMPTS_MAX", 100) {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "saved prompt limit reached"})
+		return
+	}
+	savedPrompts[prompt.ID] = prompt
+	saveSavedPromptsLocked()
+	writeJSON(w, http.StatusCreated, prompt.view())
+}
+
+func handleSavedPrompt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if rejectAnonymous(w, caller, "saved prompts") {
+		return
+	}
+	id := r.PathValue("id")
+
+	var req SavedPromptRequest
+	if r.Method == http.MethodPut {
+		if err := readJSON(r, &req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON payload"})
+			return
+		}
+		// Keep the old embedding when the text is unchanged.
+		savedPromptMutex.Lock()
+		if prompt, ok := savedPrompts[id]; ok && promptVisible(prompt, caller) && len(req.Vector) == 0 && strings.TrimSpace(req.Text) == prompt.Text {
+			req.Vector, req.EmbeddingModel = prompt.Vector, prompt.EmbeddingModel
+		}
+		savedPromptMutex.Unlock()
+		if status, message := validateSavedPrompt(r.Context(), caller, &req); status != 0 {
+			writeJSON(w, status, map[string]string{"error": message})
+			return
+		}
+	}
+
+	savedPromptMutex.Lock()
+	defer savedPromptMutex.Unlock()
+	prompt, ok := savedPrompts[id]
+	if !ok || !promptVisible(prompt, caller) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "saved prompt not found"})
+		return
+	}
+	switch r.Method {
+	case http.MethodDelete:
+		delete(savedPrompts, id)
+		saveSavedPromptsLocked()
+		writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+	case http.MethodPut:
+		prompt.Title, prompt.Text = req.Title, req.Text
+		prompt.Model, prompt.Style, prompt.Locale = req.Model, req.Style, req.Locale
+		prompt.Vector, prompt.EmbeddingModel = req.Vector, req.EmbeddingModel
+		prompt.UpdatedAt = time.Now()
+		saveSavedPromptsLocked()
+		writeJSON(w, http.StatusOK, prompt.view())
+	default:
+		writeJSON(w, http.StatusOK, prompt.view())
+	}
+}
+
+// handleRunPrompt answers a saved prompt by handing /chat its stored text
+// and vector, so quotas, caching and history apply as for any chat.
+func handleRunPrompt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if rejectAnonymous(w, caller, "saved prompts") {
+		return
+	}
+	var run RunPromptRequest
+	if r.ContentLength != 0 {
+		if err := readJSON(r, &run); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON payload"})
+			return
+		}
+	}
+
+	savedPromptMutex.Lock()
+	prompt, ok := savedPrompts[r.PathValue("id")]
+	if !ok || !promptVisible(prompt, caller) {
+		savedPromptMutex.Unlock()
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "saved prompt not found"})
+		return
+	}
+	body, err := json.Marshal(Request{
+		Text:           prompt.Text,
+		Vector:         prompt.Vector,
+		Model:          prompt.Model,
+		EmbeddingModel: prompt.EmbeddingModel,
+		Style:          prompt.Style,
+		Locale:         prompt.Locale,
+		SessionID:      run.SessionID,
+	})
+	now := time.Now()
+	prompt.Runs++
+	prompt.LastRunAt = &now
+	saveSavedPromptsLocked()
+	savedPromptMutex.Unlock()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to build chat request"})
+		return
+	}
+
+	chat := r.Clone(r.Context())
+	chat.Body = io.NopCloser(bytes.NewReader(body))
+	chat.ContentLength = int64(len(body))
+	handleChat(w, chat)
+}
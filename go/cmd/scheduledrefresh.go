@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Scheduled refresh keeps time-sensitive answers current. Operators tag
+// entries, or set question patterns, as time-sensitive; on the cron schedule
+// ECHO_REFRESH_SCHEDULE (default 03:00 daily, server time) the most hit of
+// those entries are regenerated. ECHO_REFRESH_MIN_HITS skips entries nobody
+// asks for and ECHO_REFRESH_MAX_ENTRIES caps provider calls per run, trading
+// freshness against savings.
+
+type RefreshRun struct {
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Refreshed  int       `json:"refreshed"`
+	Failed     int       `json:"failed"`
+	Skipped    string    `json:"skipped,omitempty"`
+}
+
+type RefreshScheduleView struct {
+	Schedule      string           `json:"schedule"`
+	NextRun       time.Time        `json:"nextRun,omitempty"`
+	LastRun       *RefreshRun      `json:"lastRun,omitempty"`
+	Patterns      []string         `json:"patterns"`
+	TimeSensitive []CacheEntryView `json:"timeSensitive"`
+}
+
+type TimeSensitivePatterns struct {
+	Patterns []string `json:"patterns"`
+}
+
+type TimeSensitiveRequest struct {
+	TimeSensitive bool `json:"timeSensitive"`
+}
+
+var (
+	// refreshRunMutex serializes runs; refreshMutex guards the fields below.
+	refreshRunMutex    sync.Mutex
+	refreshMutex       sync.Mutex
+	refreshPatterns    []*regexp.Regexp
+	refreshNextRun     time.Time
+	refreshLastRun     *RefreshRun
+	refreshScheduleRaw string
+)
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// startScheduledRefresh loads ECHO_TIME_SENSITIVE_PATTERNS (a JSON array of
+// regular expressions) and runs refreshes on schedule.
+func startScheduledRefresh() {
+	if raw := envString("ECHO_TIME_SENSITIVE_PATTERNS", ""); raw != "" {
+		var patterns []string
+		if err := json.Unmarshal([]byte(raw), &patterns); err != nil {
+			log.Printf("Invalid ECHO_TIME_SENSITIVE_PATTERNS: %v", err)
+		} else if compiled, err := compilePatterns(patterns); err != nil {
+			log.Printf("Invalid ECHO_TIME_SENSITIVE_PATTERNS: %v", err)
+		} else {
+			refreshPatterns = compiled
+		}
+	}
+
+	refreshScheduleRaw = envString("ECHO_REFRESH_SCHEDULE", "0 3 * * *")
+	schedule, err := parseCron(refreshScheduleRaw)
+	if err != nil {
+		log.Printf("Scheduled refresh disabled: %v", err)
+		return
+	}
+
+	go func() {
+		for {
+			next := schedule.next(time.Now())
+			if next.IsZero() {
+				log.Printf("Scheduled refresh: %q never matches; stopping", refreshScheduleRaw)
+				return
+			}
+			refreshMutex.Lock()
+			refreshNextRun = next
+			refreshMutex.Unlock()
+
+			time.Sleep(time.Until(next))
+			runScheduledRefresh()
+		}
+	}()
+}
+
+func isTimeSensitive(entry VectorEntry, patterns []*regexp.Regexp) bool {
+	if entry.TimeSensitive {
+		return true
+	}
+	for _, re := range patterns {
+		if re.MatchString(entry.Question) {
+			return true
+		}
+	}
+	return false
+}
+
+func timeSensitiveEntries() []VectorEntry {
+	refreshMutex.Lock()
+	patterns := refreshPatterns
+	refreshMutex.Unlock()
+
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+	var entries []VectorEntry
+	for _, entry := range MockVectorDB {
+		if isTimeSensitive(entry, patterns) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].HitCount > entries[j].HitCount })
+	return entries
+}
+
+// regenerateEntry asks the provider for a fresh answer to entry, grounding it
+// again when the cached answer was grounded, and meters the call to billTo.
+func regenerateEntry(ctx context.Context, entry VectorEntry, billTo Caller) (string, string, error) {
+	model, err := resolveModel(entry.Tenant, "")
+	if err != nil {
+		return "", "", err
+	}
+	prompt := entry.Question
+	if len(entry.Citations) > 0 {
+		if chunks, err := retrieveChunks(ctx, Caller{Tenant: entry.Tenant}, entry.Question); err == nil && len(chunks) > 0 {
+			prompt = groundedPrompt(entry.Question, chunks)
+		}
+	}
+	prompt = styledPrompt(prompt, entryStyle(entry))
+	answer, err := generateAnswer(ctx, prompt, model)
+	if err != nil {
+		return "", "", err
+	}
+	recordUsage(billTo, model, "CLOUD", estimateTokens(prompt)+estimateTokens(answer), 0)
+	return answer, model, nil
+}
+
+func runScheduledRefresh() (run RefreshRun) {
+	refreshRunMutex.Lock()
+	defer refreshRunMutex.Unlock()
+
+	run.StartedAt = time.Now()
+	defer func() {
+		run.FinishedAt = time.Now()
+		refreshMutex.Lock()
+		refreshLastRun = &run
+		refreshMutex.Unlock()
+	}()
+
+	if currentMaintenance().Enabled {
+		run.Skipped = "maintenance"
+		return run
+	}
+
+	minHits := envInt("ECHO_REFRESH_MIN_HITS", 1)
+	maxEntries := envInt("ECHO_REFRESH_MAX_ENTRIES", 50)
+	for _, entry := range timeSensitiveEntries() {
+		if run.Refreshed+run.Failed >= maxEntries || entry.HitCount < minHits {
+			break
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		answer, model, err := regenerateEntry(ctx, entry, Caller{Tenant: entry.Tenant})
+		cancel()
+		if err != nil {
+			log.Printf("Scheduled refresh of entry %s failed: %v", entry.ID, err)
+			run.Failed++
+			continue
+		}
+		if _, previous, found := replaceEntryAnswer(entry.ID, answer, model); found {
+			run.Refreshed++
+			recordAudit(AuditEvent{
+				Action:  "cache.scheduled_refresh",
+				EntryID: entry.ID,
+				Tenant:  entry.Tenant,
+				Actor:   "scheduler",
+				Details: map[string]string{"previousAnswer": redactContent(previous), "model": model},
+			})
+		}
+	}
+	log.Printf("Scheduled refresh: %d refreshed, %d failed", run.Refreshed, run.Failed)
+	return run
+}
+
+// handleRefreshSchedule shows the schedule and time-sensitive entries (GET),
+// replaces the question patterns (PUT) or runs a refresh now (POST).
+func handleRefreshSchedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut && r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		writeJSON(w, http.StatusOK, runScheduledRefresh())
+		return
+	case http.MethodPut:
+		var req TimeSensitivePatterns
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON payload"})
+			return
+		}
+		compiled, err := compilePatterns(req.Patterns)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		refreshMutex.Lock()
+		refreshPatterns = compiled
+		refreshMutex.Unlock()
+		recordAudit(AuditEvent{Action: "cache.time_sensitive_patterns", Actor: "admin"})
+	}
+
+	view := RefreshScheduleView{Patterns: make([]string, 0), TimeSensitive: make([]CacheEntryView, 0)}
+	for _, entry := range timeSensitiveEntries() {
+		view.TimeSensitive = append(view.TimeSensitive, entryView(entry))
+	}
+	refreshMutex.Lock()
+	view.Schedule = refreshScheduleRaw
+	view.NextRun = refreshNextRun
+	view.LastRun = refreshLastRun
+	for _, re := range refreshPatterns {
+		view.Patterns = append(view.Patterns, re.String())
+	}
+	refreshMutex.Unlock()
+	writeJSON(w, http.StatusOK, view)
+}
+
+// handleTimeSensitive tags or untags one entry as time-sensitive.
+func handleTimeSensitive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	var req TimeSensitiveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON payload"})
+		return
+	}
+
+	id := r.PathValue("id")
+	dbMutex.Lock()
+	var updated *VectorEntry
+	for i := range MockVectorDB {
+		if MockVectorDB[i].ID == id {
+			MockVectorDB[i].TimeSensitive = req.TimeSensitive
+			updated = &MockVectorDB[i]
+			markCacheChanged()
+			recordCacheChange(changeUpdated, *updated)
+			break
+		}
+	}
+	var view CacheEntryView
+	if updated != nil {
+		view = entryView(*updated)
+	}
+	dbMutex.Unlock()
+
+	if updated == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "cache entry not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, view)
+}
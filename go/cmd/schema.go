@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// The persisted cache carries a schema version in its manifest; objects
+// without one are version 1. On read, entries are migrated one version at a
+// time as raw JSON, so migrations can rename or backfill fields. Migrations
+// must be idempotent: an older binary rewriting the object stamps its own,
+// lower version, and the same migrations then run again.
+//
+// Fields a newer version added are kept in VectorEntry.Extra and written back
+// unchanged, so older binaries sharing a bucket do not strip them. The binary
+// format carries them as raw JSON too; see binformat.go.
+
+const currentCacheSchema = 4
+
+type cacheMigration struct {
+	From        int
+	Description string
+	Apply       func(tenant string, fields map[string]json.RawMessage)
+}
+
+var cacheMigrations = []cacheMigration{
+	{
+		From:        1,
+		Description: "assign IDs to entries written before entries had one",
+		Apply: func(tenant string, fields map[string]json.RawMessage) {
+			if id, ok := fields["ID"]; !ok || string(id) == `""` || string(id) == "null" {
+				fields["ID"], _ = json.Marshal(legacyEntryID(tenant, fields))
+			}
+		},
+	},
+	{
+		From:        2,
+		Description: "record ECHO_LEGACY_EMBEDDING_MODEL on entries written without a model",
+		Apply: func(_ string, fields map[string]json.RawMessage) {
+			if model, ok := fields["EmbeddingModel"]; !ok || string(model) == `""` || string(model) == "null" {
+				fields["EmbeddingModel"], _ = json.Marshal(legacyEmbeddingModel())
+			}
+		},
+	},
+	{
+		From:        3,
+		Description: "detect the language of entries written without one",
+		Apply: func(_ string, fields map[string]json.RawMessage) {
+			if language, ok := fields["Language"]; ok && string(language) != `""` && string(language) != "null" {
+				return
+			}
+			var question string
+			if err := json.Unmarshal(fields["Question"], &question); err == nil {
+				fields["Language"], _ = json.Marshal(detectLanguage(question))
+			}
+		},
+	},
+}
+
+// legacyEntryID derives an ID for an entry written without one from its
+// tenant, owner and question, so every node and every read of the same object
+// assigns the same ID. It has the 24 hex digits of pre-ULID IDs.
+func legacyEntryID(tenant string, fields map[string]json.RawMessage) string {
+	var owner, question string
+	json.Unmarshal(fields["Owner"], &owner)
+	json.Unmarshal(fields["Question"], &question)
+	sum := sha256.Sum256([]byte(entryKey(tenant, owner, question)))
+	return hex.EncodeToString(sum[:12])
+}
+
+var newerSchemaLogged sync.Map
+
+// migrateEntries upgrades raw entries of tenant written with schema version
+// from. Entries that are not JSON objects are left for the integrity checks.
+func migrateEntries(source, tenant string, raw []json.RawMessage, from int) []json.RawMessage {
+	if from <= 0 {
+		from = 1
+	}
+	if from > currentCacheSchema {
+		if _, seen := newerSchemaLogged.LoadOrStore(source, true); !seen {
+			log.Printf("%s uses cache schema %d, newer than %d; unknown fields are preserved", source, from, currentCacheSchema)
+		}
+		return raw
+	}
+	if from == currentCacheSchema {
+		return raw
+	}
+
+	for i, data := range raw {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			continue
+		}
+		for _, migration := range cacheMigrations {
+			if migration.From >= from {
+				migration.Apply(tenant, fields)
+			}
+		}
+		if migrated, err := json.Marshal(fields); err == nil {
+			raw[i] = migrated
+		}
+	}
+	return raw
+}
+
+// vectorEntryJSON has VectorEntry's fields without its JSON methods.
+type vectorEntryJSON VectorEntry
+
+// vectorEntryFields maps the JSON names of VectorEntry's fields to their
+// index. None of them is renamed by a tag.
+var vectorEntryFields = func() map[string]int {
+	fields := make(map[string]int)
+	t := reflect.TypeOf(vectorEntryJSON{})
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("json") != "-" {
+			fields[t.Field(i).Name] = i
+		}
+	}
+	return fields
+}()
+
+// entryFieldIndex finds the field a JSON name decodes into, matching case
+// insensitively like encoding/json does.
+func entryFieldIndex(name string) (int, bool) {
+	if i, ok := vectorEntryFields[name]; ok {
+		return i, true
+	}
+	for known, i := range vectorEntryFields {
+		if strings.EqualFold(known, name) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// UnmarshalJSON splits the object into its fields once, decoding known ones
+// in place and keeping the rest in Extra.
+func (e *VectorEntry) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	var plain vectorEntryJSON
+	value := reflect.ValueOf(&plain).Elem()
+	for name, raw := range fields {
+		i, known := entryFieldIndex(name)
+		if !known {
+			if plain.Extra == nil {
+				plain.Extra = make(map[string]json.RawMessage)
+			}
+			plain.Extra[name] = raw
+			continue
+		}
+		if err := json.Unmarshal(raw, value.Field(i).Addr().Interface()); err != nil {
+			return err
+		}
+	}
+	*e = VectorEntry(plain)
+	return nil
+}
+
+func (e VectorEntry) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(vectorEntryJSON(e))
+	if err != nil || len(e.Extra) == 0 {
+		return data, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for name, value := range e.Extra {
+		if _, exists := fields[name]; !exists {
+			fields[name] = value
+		}
+	}
+	return json.Marshal(fields)
+}
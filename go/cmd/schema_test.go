@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestLegacyEntryIDsAreStable(t *testing.T) {
+	migrate := func(tenant string) string {
+		raw := []json.RawMessage{json.RawMessage(`{"Question":"q","Owner":""}`)}
+		var entry VectorEntry
+		if err := json.Unmarshal(migrateEntries("test", tenant, raw, 1)[0], &entry); err != nil {
+			t.Fatal(err)
+		}
+		return entry.ID
+	}
+	first := migrate("acme")
+	if first == "" || migrate("acme") != first {
+		t.Fatalf("migrating the same entry twice gave different IDs")
+	}
+	if migrate("globex") == first {
+		t.Error("entries of different tenants got the same ID")
+	}
+}
+
+func TestUnmarshalKeepsUnknownFields(t *testing.T) {
+	var entry VectorEntry
+	data := `{"id":"a","Question":"q","Helpful":2,"Rating":{"stars":5}}`
+	if err := json.Unmarshal([]byte(data), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.ID != "a" || entry.Question != "q" || entry.Helpful != 2 {
+		t.Errorf("known fields not decoded: %+v", entry)
+	}
+	if len(entry.Extra) != 1 || string(entry.Extra["Rating"]) != `{"stars":5}` {
+		t.Errorf("extra fields %v; want only Rating", entry.Extra)
+	}
+}
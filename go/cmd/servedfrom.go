@@ -0,0 +1,50 @@
+package main
+
+import "time"
+
+// ServedFrom tells a frontend where an answer came from, so it can show the
+// answer's provenance without a second call to the stats endpoints.
+type ServedFrom struct {
+	// Source is CACHE, CLOUD or SUGGESTION, as in Response.Source.
+	Source string `json:"source"`
+	// Origin is where a cached entry was learned: LOCAL, S3, PEER, STORE or
+	// FAQ. Tier is SHARED or PRIVATE: the tier of the cached entry, or the
+	// one a fresh answer was cached in.
+	Origin string `json:"origin,omitempty"`
+	Tier   string `json:"tier,omitempty"`
+	// CreatedAt and AgeSeconds date the answer; a fresh answer is 0s old.
+	CreatedAt  time.Time `json:"createdAt"`
+	AgeSeconds int64     `json:"ageSeconds"`
+	// Similarity is that of the cached entry to the question, or of the
+	// closest miss for a fresh answer.
+	Similarity float64 `json:"similarity"`
+	Confidence float64 `json:"confidence,omitempty"`
+	// Model is the chat model that generated the answer. It is empty for FAQ
+	// entries and for entries cached before the model was recorded.
+	Model string `json:"model,omitempty"`
+	// License is the cached entry's license tag; see provenance.go.
+	License string `json:"license,omitempty"`
+}
+
+// entryServedFrom describes an answer served from entry.
+func entryServedFrom(source string, entry VectorEntry, confidence float64, now time.Time) *ServedFrom {
+	origin := entry.Source
+	if origin == "" {
+		origin = cacheSourceLocal
+	}
+	age := int64(0)
+	if !entry.CreatedAt.IsZero() {
+		age = int64(now.Sub(entry.CreatedAt).Seconds())
+	}
+	return &ServedFrom{
+		Source:     source,
+		Origin:     origin,
+		Tier:       entryTier(entry),
+		CreatedAt:  entry.CreatedAt,
+		AgeSeconds: age,
+		Similarity: entry.Similarity,
+		Confidence: confidence,
+		Model:      entry.Model,
+		License:    entry.License,
+	}
+}
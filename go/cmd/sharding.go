@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// Sharding partitions the cache across echo nodes for caches too large for
+// one. ECHO_SHARD_NODES lists every member's replication address
+// (ECHO_GOSSIP_ADDR) and ECHO_SHARD_SELF names this node's entry in it
+// (default ECHO_GOSSIP_ADDR). Entries are placed on a consistent-hash ring
+// with ECHO_SHARD_VNODES (default 64) points per node, keyed by tenant plus
+// either a locality-sensitive bucket of the vector (ECHO_SHARD_KEY=vector,
+// the default: the signs of ECHO_SHARD_HASH_BITS random projections, so
+// similar questions usually land together) or the normalized question text
+// (ECHO_SHARD_KEY=question, exact repeats only).
+//
+// /chat lookups and new entries go to the owning node over the replication
+// gRPC service. Members are pinged every ECHO_SHARD_PROBE_INTERVAL (default
+// 5s); when one goes down or comes back the ring is rebuilt and every node
+// hands the entries it no longer owns to their new owner. Since no node holds
+// the whole cache, each one uploads the entries it owns to S3 under its own
+// key per tenant (see shardObjectKey) and reads every member's, keeping only
+// owned entries; after a member goes down the others read S3 again, so the
+// entries it held come back from its last upload.
+
+const (
+	shardLookupMethod = "/echo.Replication/Lookup"
+	shardStoreMethod  = "/echo.Replication/Store"
+	shardPingMethod   = "/echo.Replication/Ping"
+	shardBatchSize    = 500
+)
+
+type ShardLookupRequest struct {
+	Caller Caller     `json:"caller"`
+	Query  cacheQuery `json:"query"`
+}
+
+type ShardLookupResponse struct {
+	Entry VectorEntry `json:"entry"`
+	Found bool        `json:"found"`
+}
+
+type ShardStoreRequest struct {
+	Entries []VectorEntry `json:"entries"`
+}
+
+type ShardStoreResponse struct {
+	Stored int `json:"stored"`
+}
+
+type ShardPing struct {
+	Node string `json:"node"`
+}
+
+type ShardStatus struct {
+	Self    string         `json:"self"`
+	Key     string         `json:"key"`
+	Nodes   []string       `json:"nodes"`
+	Live    []string       `json:"live"`
+	Entries int            `json:"entries"`
+	Moved   map[string]int `json:"moved,omitempty"`
+}
+
+type shardRing struct {
+	points []uint32
+	nodes  []string
+}
+
+var (
+	// shardMutex guards the fields below.
+	shardMutex  sync.RWMutex
+	shardSelf   string
+	shardNodes  []string
+	shardLive   []string
+	ring        *shardRing
+	shardConns  = make(map[string]*grpc.ClientConn)
+	shardPlanes = make(map[int][][]float32)
+	shardMoved  = make(map[string]int)
+)
+
+// localShard returns this node's ring address and whether sharding is on.
+func localShard() (string, bool) {
+	shardMutex.RLock()
+	defer shardMutex.RUnlock()
+	return shardSelf, ring != nil
+}
+
+// shardLeader reports whether this node is the lowest live member, or true
+// when not sharding.
+func shardLeader() bool {
+	shardMutex.RLock()
+	defer shardMutex.RUnlock()
+	if ring == nil {
+		return true
+	}
+	return len(shardLive) > 0 && slices.Min(shardLive) == shardSelf
+}
+
+// shardMembers returns every configured member, live or not, or nil when not
+// sharding.
+func shardMembers() []string {
+	shardMutex.RLock()
+	defer shardMutex.RUnlock()
+	if ring == nil {
+		return nil
+	}
+	return shardNodes
+}
+
+// shardObjectKey is where node uploads its share of tenant's cache: beside
+// tenantObjectKey, under shards/ and a hash of the node's address.
+func shardObjectKey(tenant, node string) string {
+	dir, file := path.Split(tenantObjectKey(tenant))
+	return dir + "shards/" + strconv.FormatUint(uint64(hash32(node)), 16) + "/" + file
+}
+
+func shardingEnabled() bool {
+	shardMutex.RLock()
+	defer shardMutex.RUnlock()
+	return ring != nil
+}
+
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func newShardRing(nodes []string, vnodes int) *shardRing {
+	r := &shardRing{}
+	type point struct {
+		hash uint32
+		node string
+	}
+	var points []point
+	for _, node := range nodes {
+		for i := range vnodes {
+			points = append(points, point{hash32(node + "#" + strconv.Itoa(i)), node})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	for _, p := range points {
+		r.points = append(r.points, p.hash)
+		r.nodes = append(r.nodes, p.node)
+	}
+	return r
+}
+
+func (r *shardRing) owner(key string) string {
+	h := hash32(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.nodes[i]
+}
+
+// shardPlanesLocked returns the random hyperplanes for vectors of dims
+// dimensions. They are seeded by dims alone, so every node draws the same
+// ones. The caller holds shardMutex for writing.
+func shardPlanesLocked(dims int) [][]float32 {
+	if planes, ok := shardPlanes[dims]; ok {
+		return planes
+	}
+	rng := rand.New(rand.NewPCG(uint64(dims), 0x6563686f))
+	planes := make([][]float32, envInt("ECHO_SHARD_HASH_BITS", 4))
+	for i := range planes {
+		planes[i] = make([]float32, dims)
+		for j := range planes[i] {
+			planes[i][j] = float32(rng.NormFloat64())
+		}
+	}
+	shardPlanes[dims] = planes
+	return planes
+}
+
+func shardKey(tenant, question string, vector []float32) string {
+	if envString("ECHO_SHARD_KEY", "vector") == "question" {
+		return tenant + "\x00" + strings.ToLower(strings.Join(strings.Fields(question), " "))
+	}
+	shardMutex.Lock()
+	planes := shardPlanesLocked(len(vector))
+	shardMutex.Unlock()
+	var bucket uint64
+	for i, plane := range planes {
+		var dot float32
+		for j, v := range vector {
+			dot += v * plane[j]
+		}
+		if dot >= 0 {
+			bucket |= 1 << i
+		}
+	}
+	return tenant + "\x00" + strconv.FormatUint(bucket, 16)
+}
+
+// shardOwner returns the node owning a question, and whether that is another
+// node.
+func shardOwner(tenant, question string, vector []float32) (string, bool) {
+	shardMutex.RLock()
+	current, self := ring, shardSelf
+	shardMutex.RUnlock()
+	if current == nil {
+		return self, false
+	}
+	node := current.owner(shardKey(tenant, question, vector))
+	return node, node != self
+}
+
+// ownedEntries keeps the entries this node owns, for merges from S3 and
+// gossip. FAQ pack entries are small and kept on every node.
+func ownedEntries(entries []VectorEntry) []VectorEntry {
+	if !shardingEnabled() {
+		return entries
+	}
+	owned := entries[:0:0]
+	for _, entry := range entries {
+		if _, remote := shardOwner(entry.Tenant, entry.Question, entry.Vector); entry.Authoritative || !remote {
+			owned = append(owned, entry)
+		}
+	}
+	return owned
+}
+
+func shardConn(node string) (*grpc.ClientConn, error) {
+	shardMutex.Lock()
+	defer shardMutex.Unlock()
+	if conn, ok := shardConns[node]; ok {
+		return conn, nil
+	}
+	conn, err := dialPeer(node)
+	if err != nil {
+		return nil, err
+	}
+	shardConns[node] = conn
+	return conn, nil
+}
+
+func invokeShard(ctx context.Context, node, method string, req, resp any) error {
+	conn, err := shardConn(node)
+	if err != nil {
+		return err
+	}
+	return conn.Invoke(ctx, method, req, resp, grpc.ForceCodec(jsonCodec{}))
+}
+
+// remoteLookup searches the owning node's cache. A failed call is a miss, so
+// the provider still answers.
+func remoteLookup(ctx context.Context, node string, caller Caller, query cacheQuery) (VectorEntry, bool, error) {
+	var resp ShardLookupResponse
+	err := invokeShard(ctx, node, shardLookupMethod, &ShardLookupRequest{Caller: caller, Query: query}, &resp)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return VectorEntry{}, false, ctxErr
+		}
+		log.Printf("Shard lookup on %s failed: %v", node, err)
+		return VectorEntry{}, false, nil
+	}
+	return resp.Entry, resp.Found, nil
+}
+
+// storeOnShard hands a new entry to its owner, keeping it here if the owner
+// cannot be reached; the next rebalance moves it.
+func storeOnShard(node string, entry VectorEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var resp ShardStoreResponse
+	if err := invokeShard(ctx, node, shardStoreMethod, &ShardStoreRequest{Entries: []VectorEntry{entry}}, &resp); err != nil {
+		log.Printf("Shard store on %s failed, keeping entry %s here: %v", node, entry.ID, err)
+		enqueueWrite(pendingWrite{entry: &entry})
+	}
+}
+
+func (replicationNode) Lookup(ctx context.Context, req *ShardLookupRequest) (*ShardLookupResponse, error) {
+	entry, found, err := lookupLocal(ctx, req.Caller, req.Query)
+	if err != nil {
+		return nil, err
+	}
+	return &ShardLookupResponse{Entry: entry, Found: found}, nil
+}
+
+func (replicationNode) Store(_ context.Context, req *ShardStoreRequest) (*ShardStoreResponse, error) {
+	return &ShardStoreResponse{Stored: mergeEntries(req.Entries, cacheSourcePeer)}, nil
+}
+
+func (replicationNode) Ping(_ context.Context, _ *ShardPing) (*ShardPing, error) {
+	return &ShardPing{Node: nodeID}, nil
+}
+
+// unaryMethod adapts a replicationNode method to a grpc.MethodDesc handler.
+func unaryMethod[Req, Resp any](method string, call func(replicationNode, context.Context, *Req) (*Resp, error)) func(any, context.Context, func(any) error, grpc.UnaryServerInterceptor) (any, error) {
+	return func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+		req := new(Req)
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		node := srv.(replicationNode)
+		if interceptor == nil {
+			return call(node, ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: method}
+		return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+			return call(node, ctx, req.(*Req))
+		})
+	}
+}
+
+// initSharding builds the ring from the configured members, all assumed up
+// until probed, and starts probing them.
+func initSharding(nodes []string, self string) error {
+	if self == "" {
+		return errors.New("ECHO_SHARD_SELF or ECHO_GOSSIP_ADDR must name this node")
+	}
+	if !slices.Contains(nodes, self) {
+		return errors.New("ECHO_SHARD_SELF " + self + " is not listed in ECHO_SHARD_NODES")
+	}
+
+	shardMutex.Lock()
+	shardSelf, shardNodes, shardLive = self, nodes, slices.Clone(nodes)
+	ring = newShardRing(shardLive, envInt("ECHO_SHARD_VNODES", 64))
+	shardMutex.Unlock()
+	log.Printf("Sharding: node %s of %d; uploading to %s", self, len(nodes), shardObjectKey(defaultTenant, self))
+
+	ticker := time.NewTicker(envDuration("ECHO_SHARD_PROBE_INTERVAL", 5*time.Second))
+	go func() {
+		defer ticker.Stop()
+		for range ticker.C {
+			probeShards()
+		}
+	}()
+	return nil
+}
+
+// probeShards pings every member and, when the live set changed, rebuilds
+// the ring and rebalances.
+func probeShards() {
+	shardMutex.RLock()
+	nodes, self, previous := shardNodes, shardSelf, shardLive
+	shardMutex.RUnlock()
+
+	var live []string
+	for _, node := range nodes {
+		if node == self {
+			live = append(live, node)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err := invokeShard(ctx, node, shardPingMethod, &ShardPing{Node: nodeID}, &ShardPing{})
+		cancel()
+		if err == nil {
+			live = append(live, node)
+		}
+	}
+	if slices.Equal(live, previous) {
+		return
+	}
+
+	log.Printf("Sharding: membership changed from %v to %v; rebalancing", previous, live)
+	shardMutex.Lock()
+	shardLive = live
+	ring = newShardRing(live, envInt("ECHO_SHARD_VNODES", 64))
+	shardMutex.Unlock()
+	rebalanceShards()
+	if len(live) < len(previous) {
+		// Adopt what the departed members last uploaded.
+		if _, err := downloadAndMergeFromS3(); err != nil {
+			log.Printf("Sharding: reading departed members' entries from S3 failed: %v", err)
+		}
+	}
+}
+
+// rebalanceShards sends entries this node no longer owns to their owners and
+// drops them here once accepted.
+func rebalanceShards() {
+	moves := make(map[string][]VectorEntry)
+	dbMutex.RLock()
+	for _, entry := range MockVectorDB {
+		if entry.Authoritative {
+			continue
+		}
+		if node, remote := shardOwner(entry.Tenant, entry.Question, entry.Vector); remote {
+			moves[node] = append(moves[node], entry)
+		}
+	}
+	dbMutex.RUnlock()
+
+	for node, entries := range moves {
+		moved := make(map[string]struct{}, len(entries))
+		for start := 0; start < len(entries); start += shardBatchSize {
+			batch := entries[start:min(start+shardBatchSize, len(entries))]
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			err := invokeShard(ctx, node, shardStoreMethod, &ShardStoreRequest{Entries: batch}, &ShardStoreResponse{})
+			cancel()
+			if err != nil {
+				log.Printf("Sharding: moving entries to %s failed: %v", node, err)
+				break
+			}
+			for _, entry := range batch {
+				moved[entry.ID] = struct{}{}
+			}
+		}
+		if len(moved) == 0 {
+			continue
+		}
+		dbMutex.Lock()
+		removeEntriesLocked(func(entry VectorEntry) bool {
+			_, ok := moved[entry.ID]
+			return ok
+		})
+		dbMutex.Unlock()
+		shardMutex.Lock()
+		shardMoved[node] += len(moved)
+		shardMutex.Unlock()
+		log.Printf("Sharding: moved %d entries to %s", len(moved), node)
+	}
+}
+
+// handleShards reports this node's view of the ring.
+func handleShards(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if !shardingEnabled() {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "sharding is not enabled"})
+		return
+	}
+
+	dbMutex.RLock()
+	entries := len(MockVectorDB)
+	dbMutex.RUnlock()
+
+	shardMutex.RLock()
+	status := ShardStatus{
+		Self:    shardSelf,
+		Key:     envString("ECHO_SHARD_KEY", "vector"),
+		Nodes:   shardNodes,
+		Live:    shardLive,
+		Entries: entries,
+		Moved:   maps.Clone(shardMoved),
+	}
+	shardMutex.RUnlock()
+	writeJSON(w, http.StatusOK, status)
+}
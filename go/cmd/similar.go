@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// GET /cache/{id}/similar?k=... lists the k cached questions (default 5, at
+// most 20) nearest to an entry's, among the entries the caller may be
+// served, so a UI can show related answers beneath a response. Only entries
+// embedded by the same model are comparable; ?min= drops those less similar
+// than a cosine similarity.
+
+const (
+	defaultSimilarCount = 5
+	maxSimilarCount     = 20
+)
+
+type SimilarQuestion struct {
+	EntryID    string  `json:"entryId"`
+	Question   string  `json:"question"`
+	Similarity float64 `json:"similarity"`
+}
+
+// similarQuestions returns the k entries of candidates nearest to entry.
+func similarQuestions(entry VectorEntry, candidates []VectorEntry, k int, minSimilarity float64) []SimilarQuestion {
+	vector, model := scoringVector(entry.Vector), entryEmbeddingModel(entry)
+	similar := make([]SimilarQuestion, 0, k)
+	for _, candidate := range candidates {
+		if candidate.ID == entry.ID || entryEmbeddingModel(candidate) != model {
+			continue
+		}
+		similarity := cosineSimilarity(vector, scoringVector(candidate.Vector))
+		if similarity < minSimilarity {
+			continue
+		}
+		similar = append(similar, SimilarQuestion{EntryID: candidate.ID, Question: candidate.Question, Similarity: similarity})
+	}
+	sort.Slice(similar, func(i, j int) bool { return similar[i].Similarity > similar[j].Similarity })
+	return similar[:min(len(similar), k)]
+}
+
+func handleSimilar(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if rejectAnonymous(w, caller, "similar questions") {
+		return
+	}
+
+	k := defaultSimilarCount
+	if raw := r.URL.Query().Get("k"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 || parsed > maxSimilarCount {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "k must be between 1 and 20"})
+			return
+		}
+		k = parsed
+	}
+	minSimilarity := 0.0
+	if raw := r.URL.Query().Get("min"); raw != "" {
+		parsed, err := strconv.ParseFloat(raw, 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "min must be in [0, 1]"})
+			return
+		}
+		minSimilarity = parsed
+	}
+
+	candidates := servableEntries(caller)
+	id := r.PathValue("id")
+	for _, entry := range candidates {
+		if entry.ID == id {
+			writeJSON(w, http.StatusOK, similarQuestions(entry, candidates, k, minSimilarity))
+			return
+		}
+	}
+	writeJSON(w, http.StatusNotFound, map[string]string{"error": "cache entry not found"})
+}
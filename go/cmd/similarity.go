@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// The similarity histogram records the best-match score of every lookup,
+// hit or miss, so operators can see where real traffic falls relative to the
+// threshold before changing it. It covers every tenant, so only admins may
+// read it.
+
+const similarityBuckets = 50
+
+type SimilarityBucket struct {
+	Lower  float64 `json:"lower"`
+	Upper  float64 `json:"upper"`
+	Hits   int     `json:"hits"`
+	Misses int     `json:"misses"`
+}
+
+type SimilarityStats struct {
+	Threshold float64 `json:"threshold"`
+	Lookups   int     `json:"lookups"`
+	// BloomSkips counts lookups the Bloom filter answered without a search.
+	BloomSkips int64              `json:"bloomSkips"`
+	Hits       int                `json:"hits"`
+	Mean       float64            `json:"mean"`
+	Min        float64            `json:"min"`
+	Max        float64            `json:"max"`
+	P50        float64            `json:"p50"`
+	P90        float64            `json:"p90"`
+	P99        float64            `json:"p99"`
+	Buckets    []SimilarityBucket `json:"buckets"`
+}
+
+var (
+	similarityMutex  sync.Mutex
+	similarityHits   [similarityBuckets]int
+	similarityMisses [similarityBuckets]int
+	similaritySum    float64
+	similarityMin    = 1.0
+	similarityMax    float64
+	similarityCount  int
+)
+
+func similarityBucket(score float64) int {
+	idx := int(score * similarityBuckets)
+	return min(max(idx, 0), similarityBuckets-1)
+}
+
+func recordSimilarity(score float64, hit bool) {
+	score = min(max(score, 0), 1)
+	observeLookup(score, hit)
+
+	similarityMutex.Lock()
+	defer similarityMutex.Unlock()
+
+	idx := similarityBucket(score)
+	if hit {
+		similarityHits[idx]++
+	} else {
+		similarityMisses[idx]++
+	}
+	similarityCount++
+	similaritySum += score
+	similarityMin = min(similarityMin, score)
+	similarityMax = max(similarityMax, score)
+}
+
+func currentSimilarityStats() SimilarityStats {
+	similarityMutex.Lock()
+	defer similarityMutex.Unlock()
+
+	stats := SimilarityStats{
+		Threshold:  similarityThreshold,
+		Lookups:    similarityCount,
+		BloomSkips: bloomSkips.Load(),
+		Buckets:    make([]SimilarityBucket, similarityBuckets),
+	}
+	if similarityCount > 0 {
+		stats.Mean = similaritySum / float64(similarityCount)
+		stats.Min = similarityMin
+		stats.Max = similarityMax
+	}
+
+	width := 1.0 / similarityBuckets
+	for i := range stats.Buckets {
+		stats.Buckets[i] = SimilarityBucket{
+			Lower:  float64(i) * width,
+			Upper:  float64(i+1) * width,
+			Hits:   similarityHits[i],
+			Misses: similarityMisses[i],
+		}
+		stats.Hits += similarityHits[i]
+	}
+
+	stats.P50 = similarityQuantileLocked(0.50)
+	stats.P90 = similarityQuantileLocked(0.90)
+	stats.P99 = similarityQuantileLocked(0.99)
+	return stats
+}
+
+// similarityQuantileLocked estimates a quantile as the upper edge of the
+// bucket containing it. Callers must hold similarityMutex.
+func similarityQuantileLocked(q float64) float64 {
+	if similarityCount == 0 {
+		return 0
+	}
+	rank := int(q * float64(similarityCount))
+	seen := 0
+	for i := 0; i < similarityBuckets; i++ {
+		seen += similarityHits[i] + similarityMisses[i]
+		if seen > rank {
+			return float64(i+1) / similarityBuckets
+		}
+	}
+	return 1
+}
+
+func handleSimilarityStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, currentSimilarityStats())
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Admin operations that replace or drop cached entries in bulk (FAQ pack
+// imports and deletions, duplicate merges, snapshot restores) first write the
+// tenant's whole cache, hot and cold, to a timestamped snapshot object. The
+// audit event of the operation names the snapshot, and restoring it puts the
+// tenant's cache back as it was. If the snapshot cannot be written the
+// operation is refused; without S3 there is nowhere to write it and
+// operations go ahead unprotected.
+
+type Snapshot struct {
+	ID        string        `json:"id"`
+	CreatedAt time.Time     `json:"createdAt"`
+	Tenant    string        `json:"tenant"`
+	Action    string        `json:"action"`
+	Entries   []VectorEntry `json:"entries"`
+}
+
+type SnapshotSummary struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	Bytes     int64     `json:"bytes"`
+}
+
+const snapshotObjectDir = "snapshots/"
+
+var errSnapshotNotFound = errors.New("snapshot not found")
+
+func snapshotPrefix(tenant string) string {
+	if tenant == defaultTenant {
+		return snapshotObjectDir
+	}
+	return tenantKeyPrefix + tenant + "/" + snapshotObjectDir
+}
+
+func snapshotKey(tenant, id string) string {
+	return snapshotPrefix(tenant) + id + ".json"
+}
+
+// tenantEntries returns the tenant's hot and cold entries.
+func tenantEntries(tenant string) ([]VectorEntry, error) {
+	var entries []VectorEntry
+	dbMutex.RLock()
+	for _, entry := range MockVectorDB {
+		if entry.Tenant == tenant {
+			entries = append(entries, entry)
+		}
+	}
+	dbMutex.RUnlock()
+
+	if tieringEnabled() {
+		coldEntries, err := readColdEntries()
+		if err != nil {
+			return nil, fmt.Errorf("read cold tier: %w", err)
+		}
+		for _, entry := range coldEntries {
+			if entry.Tenant == tenant {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// takeSnapshot writes the tenant's cache to S3 ahead of action and returns
+// the snapshot's ID, or "" when S3 is not configured.
+func takeSnapshot(tenant, action string) (string, error) {
+	target := activeS3Target()
+	if target == nil {
+		log.Printf("S3 is not configured; %s runs without a snapshot", action)
+		return "", nil
+	}
+	entries, err := tenantEntries(tenant)
+	if err != nil {
+		return "", err
+	}
+	snapshot := Snapshot{ID: newID(), CreatedAt: time.Now().UTC(), Tenant: tenant, Action: action, Entries: entries}
+	body, err := json.Marshal(snapshot)
+	if err != nil {
+		return "", err
+	}
+	if err := putObject(target, snapshotKey(tenant, snapshot.ID), body, "application/json", tenantKMSKey(tenant)); err != nil {
+		return "", err
+	}
+	log.Printf("Snapshot %s: %d entries of tenant %q before %s", snapshot.ID, len(entries), tenant, action)
+	return snapshot.ID, nil
+}
+
+// snapshotBefore takes a snapshot for a handler, answering 503 and returning
+// false when it fails.
+func snapshotBefore(w http.ResponseWriter, tenant, action string) (string, bool) {
+	id, err := takeSnapshot(tenant, action)
+	if err != nil {
+		log.Printf("Snapshot before %s failed: %v", action, err)
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "could not snapshot the cache; nothing was changed"})
+		return "", false
+	}
+	return id, true
+}
+
+// withSnapshot adds the snapshot ID to audit details.
+func withSnapshot(details map[string]string, snapshotID string) map[string]string {
+	if snapshotID == "" {
+		return details
+	}
+	if details == nil {
+		details = make(map[string]string, 1)
+	}
+	details["snapshot"] = snapshotID
+	return details
+}
+
+func listSnapshots(target *s3Target, tenant string) ([]SnapshotSummary, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	summaries := make([]SnapshotSummary, 0)
+	paginator := s3.NewListObjectsV2Paginator(target.client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(target.Bucket),
+		Prefix:    aws.String(snapshotPrefix(tenant)),
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			id := strings.TrimSuffix(strings.TrimPrefix(aws.ToString(object.Key), snapshotPrefix(tenant)), ".json")
+			createdAt, ok := idTime(id)
+			if !ok {
+				createdAt = aws.ToTime(object.LastModified)
+			}
+			summaries = append(summaries, SnapshotSummary{ID: id, CreatedAt: createdAt, Bytes: aws.ToInt64(object.Size)})
+		}
+	}
+	// IDs are ULIDs, so they sort by creation time.
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].ID > summaries[j].ID })
+	return summaries, nil
+}
+
+func fetchSnapshot(target *s3Target, tenant, id string) (Snapshot, error) {
+	body, err := getObject(target, snapshotKey(tenant, id))
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if body == nil {
+		return Snapshot{}, errSnapshotNotFound
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(body, &snapshot); err != nil {
+		return Snapshot{}, fmt.Errorf("decode snapshot %s: %w", id, err)
+	}
+	return snapshot, nil
+}
+
+// replaceTenantEntries drops the tenant's hot and cold entries and brings
+// entries back as hot entries, leaving the hot tier limit to demote any
+// overflow.
+func replaceTenantEntries(tenant string, entries []VectorEntry) (int, error) {
+	current, err := tenantEntries(tenant)
+	if err != nil {
+		return 0, err
+	}
+	questions := make(map[string]struct{}, len(current))
+	for _, entry := range current {
+		questions[entryKey(entry.Tenant, entry.Owner, entry.Question)] = struct{}{}
+	}
+	removed := removeEntriesByQuestion(questions)
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	for _, entry := range entries {
+		cacheSeq++
+		entry.Seq = cacheSeq
+		entry.Tenant = tenant
+		MockVectorDB = append(MockVectorDB, entry)
+		indexAppendLocked(len(MockVectorDB) - 1)
+		recordCacheChange(changeCreated, entry)
+	}
+	markCacheChanged()
+	enforceHotTierLocked()
+	return removed, nil
+}
+
+// handleSnapshots lists the tenant's snapshots, newest first.
+func handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	tenant, err := resolveTenant(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	target := activeS3Target()
+	if target == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "S3 is not configured"})
+		return
+	}
+	summaries, err := listSnapshots(target, tenant)
+	if err != nil {
+		log.Printf("List snapshots failed: %v", err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "failed to list snapshots"})
+		return
+	}
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+// handleRestoreSnapshot puts the tenant's cache back to a snapshot. The
+// current cache is snapshotted first, so a restore can be undone too.
+func handleRestoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	tenant, err := resolveTenant(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	target := activeS3Target()
+	if target == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "S3 is not configured"})
+		return
+	}
+
+	id := r.PathValue("id")
+	snapshot, err := fetchSnapshot(target, tenant, id)
+	if errors.Is(err, errSnapshotNotFound) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "snapshot not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Fetch snapshot %s failed: %v", id, err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "failed to read snapshot"})
+		return
+	}
+
+	previous, ok := snapshotBefore(w, tenant, "snapshot.restore")
+	if !ok {
+		return
+	}
+	removed, err := replaceTenantEntries(tenant, snapshot.Entries)
+	if err != nil {
+		log.Printf("Restore snapshot %s failed: %v", id, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to restore snapshot"})
+		return
+	}
+	recordAudit(AuditEvent{
+		Action: "snapshot.restore",
+		Tenant: tenant,
+		Actor:  "admin",
+		Details: withSnapshot(map[string]string{
+			"restored": id,
+			"entries":  strconv.Itoa(len(snapshot.Entries)),
+			"removed":  strconv.Itoa(removed),
+		}, previous),
+	})
+	writeJSON(w, http.StatusOK, map[string]any{"restored": len(snapshot.Entries), "removed": removed, "snapshot": previous})
+}
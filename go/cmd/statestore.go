@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stateless mode keeps everything that matters in Redis, so replicas can be
+// added and removed freely behind a load balancer with no session affinity.
+// It is enabled by ECHO_STATE_STORE=redis://[:password@]host:port[/db].
+//
+// New cache entries and history items are appended to two Redis streams as
+// they are written, and audit events to a third (see audit.go). Every
+// replica loads the streams at startup and then tails them every
+// ECHO_STATE_REFRESH (default 1s), so what it holds in memory is a replica
+// of the store that can be dropped at any time. Savings, quota usage and
+// budget spend are kept as Redis counters: a replica increments them on
+// every request and adopts the totals Redis returns, and refreshes the
+// totals other replicas have added on the same interval. The local savings
+// file is not used. The history stream is capped at
+// ECHO_STATE_HISTORY_LIMIT items (default 100000).
+//
+// Edits to existing entries (refreshes, feedback, pins, annotations,
+// deletions) still reach other replicas through S3 sync and gossip, not the
+// store.
+
+const cacheSourceStore = "STORE"
+
+var (
+	stateStore *redisClient
+	// storeWriter identifies this process in the streams; it changes on
+	// restart, so a restarted replica reloads what it wrote before.
+	storeWriter string
+
+	// storeMutex guards the stream cursors.
+	storeMutex         sync.Mutex
+	storeEntryCursor   string
+	storeHistoryCursor string
+	storeAuditCursor   string
+)
+
+type storeRecord struct {
+	Writer  string       `json:"writer"`
+	Entry   *VectorEntry `json:"entry,omitempty"`
+	History *HistoryItem `json:"history,omitempty"`
+	Audit   *AuditEvent  `json:"audit,omitempty"`
+}
+
+func stateStoreConfigured() bool {
+	return envString("ECHO_STATE_STORE", "") != ""
+}
+
+func stateless() bool {
+	return stateStore != nil
+}
+
+func storeKey(parts ...string) string {
+	return envString("ECHO_STATE_PREFIX", "echo:") + strings.Join(parts, ":")
+}
+
+// initStateStore connects to the store, loads its contents and starts
+// tailing it.
+func initStateStore() error {
+	client, err := newRedisClient(envString("ECHO_STATE_STORE", ""), envDuration("ECHO_STATE_STORE_TIMEOUT", 2*time.Second))
+	if err != nil {
+		return err
+	}
+	if _, err := client.do("PING"); err != nil {
+		return err
+	}
+	stateStore = client
+	storeWriter = nodeID + "-" + strconv.FormatInt(nodeEpoch, 36)
+
+	entries, history := pullStore()
+	refreshStoreCounters()
+	log.Printf("State store: loaded %d entries and %d history items from %s", entries, history, client.addr)
+
+	ticker := time.NewTicker(envDuration("ECHO_STATE_REFRESH", time.Second))
+	go func() {
+		defer ticker.Stop()
+		for range ticker.C {
+			pullStore()
+			refreshStoreCounters()
+		}
+	}()
+	return nil
+}
+
+// storeAppend adds records to a stream. It runs on the write queue's
+// goroutine, after the records are applied locally.
+func storeAppend(stream string, records []storeRecord, maxLen int) {
+	for _, record := range records {
+		record.Writer = storeWriter
+		data, err := json.Marshal(record)
+		if err != nil {
+			continue
+		}
+		args := []string{"XADD", storeKey(stream)}
+		if maxLen > 0 {
+			args = append(args, "MAXLEN", "~", strconv.Itoa(maxLen))
+		}
+		if _, err := stateStore.do(append(args, "*", "record", string(data))...); err != nil {
+			log.Printf("State store: append to %s failed: %v", stream, err)
+			return
+		}
+	}
+}
+
+// storeWrites publishes entries and history items just written locally, and
+// adds the items to the savings counters.
+func storeWrites(entries []VectorEntry, history []HistoryItem) {
+	records := make([]storeRecord, 0, len(entries))
+	for i := range entries {
+		records = append(records, storeRecord{Entry: &entries[i]})
+	}
+	storeAppend("entries", records, 0)
+
+	records = records[:0]
+	for i := range history {
+		records = append(records, storeRecord{History: &history[i]})
+	}
+	storeAppend("history", records, envInt("ECHO_STATE_HISTORY_LIMIT", 100000))
+
+	for _, item := range history {
+		storeSavings(item)
+	}
+}
+
+// readStream returns the records after cursor written by other processes,
+// and the new cursor.
+func readStream(stream, cursor string) ([]storeRecord, string, error) {
+	var records []storeRecord
+	for {
+		start := "-"
+		if cursor != "" {
+			start = "(" + cursor
+		}
+		reply, err := stateStore.do("XRANGE", storeKey(stream), start, "+", "COUNT", "500")
+		if err != nil {
+			return records, cursor, err
+		}
+		items, _ := reply.([]any)
+		for _, item := range items {
+			pair, _ := item.([]any)
+			if len(pair) != 2 {
+				continue
+			}
+			cursor, _ = pair[0].(string)
+			fields, _ := redisStrings(pair[1], nil)
+			for i := 0; i+1 < len(fields); i += 2 {
+				var record storeRecord
+				if fields[i] != "record" || json.Unmarshal([]byte(fields[i+1]), &record) != nil {
+					continue
+				}
+				if record.Writer != storeWriter {
+					records = append(records, record)
+				}
+			}
+		}
+		if len(items) < 500 {
+			return records, cursor, nil
+		}
+	}
+}
+
+// pullStore applies what other replicas have written since the last pull and
+// returns how many entries and history items it applied.
+func pullStore() (int, int) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	entryRecords, cursor, err := readStream("entries", storeEntryCursor)
+	if err != nil {
+		log.Printf("State store: read entries failed: %v", err)
+	}
+	storeEntryCursor = cursor
+	var entries []VectorEntry
+	for _, record := range entryRecords {
+		if record.Entry != nil {
+			entries = append(entries, *record.Entry)
+		}
+	}
+	merged := 0
+	if len(entries) > 0 {
+		merged = mergeEntries(entries, cacheSourceStore)
+	}
+
+	historyRecords, cursor, err := readStream("history", storeHistoryCursor)
+	if err != nil {
+		log.Printf("State store: read history failed: %v", err)
+	}
+	storeHistoryCursor = cursor
+	export := false
+	added := 0
+	dbMutex.Lock()
+	for _, record := range historyRecords {
+		if record.History != nil {
+			ChatHistory = append(ChatHistory, *record.History)
+			added++
+		}
+	}
+	if added > 0 {
+		export = trimHistoryLocked(time.Now())
+	}
+	dbMutex.Unlock()
+	if export {
+		go trimExportedHistory()
+	}
+
+	auditRecords, cursor, err := readStream("audit", storeAuditCursor)
+	if err != nil {
+		log.Printf("State store: read audit trail failed: %v", err)
+	}
+	storeAuditCursor = cursor
+	auditMutex.Lock()
+	for _, record := range auditRecords {
+		if record.Audit != nil {
+			appendAuditLocked(*record.Audit)
+		}
+	}
+	auditMutex.Unlock()
+	return merged, added
+}
+
+func storeSavings(item HistoryItem) {
+	key := storeKey("savings", item.Tenant)
+	commands := [][]string{
+		{"SADD", storeKey("savings-tenants"), item.Tenant},
+		{"HINCRBY", key, "requests", "1"},
+	}
+	if item.Saved {
+		usd := float64(item.Tokens) / 1000.0 * usdPer1KTokens(item.Model)
+		commands = append(commands,
+			[]string{"HINCRBY", key, "cacheHits", "1"},
+			[]string{"HINCRBY", key, "tokensSaved", strconv.Itoa(item.Tokens)},
+			[]string{"HINCRBYFLOAT", key, "energySavedWh", strconv.FormatFloat(item.EnergyWh, 'g', -1, 64)},
+			[]string{"HINCRBYFLOAT", key, "co2SavedG", strconv.FormatFloat(item.CO2g, 'g', -1, 64)},
+			[]string{"HINCRBYFLOAT", key, "usdSaved", strconv.FormatFloat(usd, 'g', -1, 64)},
+			[]string{"HINCRBY", key, "latencySavedMs", strconv.FormatInt(item.LatencySavedMs, 10)},
+		)
+	}
+	for _, command := range commands {
+		if _, err := stateStore.do(command...); err != nil {
+			log.Printf("State store: savings update failed: %v", err)
+			return
+		}
+	}
+}
+
+func usageKeys(now time.Time) (string, string) {
+	return storeKey("usage", now.UTC().Format("2006-01-02")), storeKey("usage", now.UTC().Format("2006-01"))
+}
+
+// storeUsage adds requests and cloud tokens to subject's stored usage and
+// returns the resulting totals; ok is false when the store could not be
+// updated.
+func storeUsage(subject string, now time.Time, requests, cloudTokens int, spentUSD float64) (usage UsageCounters, ok bool) {
+	dayKey, monthKey := usageKeys(now)
+	commands := [][]string{
+		{"HINCRBY", dayKey, subject + ":requests", strconv.Itoa(requests)},
+		{"HINCRBY", dayKey, subject + ":tokens", strconv.Itoa(cloudTokens)},
+		{"HINCRBY", monthKey, subject + ":requests", strconv.Itoa(requests)},
+		{"HINCRBY", monthKey, subject + ":tokens", strconv.Itoa(cloudTokens)},
+		{"HINCRBYFLOAT", monthKey, subject + ":spentUsd", strconv.FormatFloat(spentUSD, 'g', -1, 64)},
+	}
+	totals := make([]float64, len(commands))
+	for i, command := range commands {
+		total, err := redisFloat(stateStore.do(command...))
+		if err != nil {
+			log.Printf("State store: usage update failed: %v", err)
+			return usage, false
+		}
+		totals[i] = total
+	}
+	usage = UsageCounters{
+		Day:             now.UTC().Format("2006-01-02"),
+		DailyRequests:   int(totals[0]),
+		DailyTokens:     int(totals[1]),
+		Month:           now.UTC().Format("2006-01"),
+		MonthlyRequests: int(totals[2]),
+		MonthlyTokens:   int(totals[3]),
+		MonthlySpentUSD: totals[4],
+	}
+	stateStore.do("EXPIRE", dayKey, strconv.Itoa(int((48 * time.Hour).Seconds())))
+	stateStore.do("EXPIRE", monthKey, strconv.Itoa(int((62 * 24 * time.Hour).Seconds())))
+	return usage, true
+}
+
+// storeSpend adds usd to the tenant's stored spend for the billing period and
+// returns the total.
+func storeSpend(tenant string, now time.Time, usd float64) (float64, bool) {
+	total, err := redisFloat(stateStore.do("HINCRBYFLOAT", storeKey("spend", billingPeriod(now)), tenant, strconv.FormatFloat(usd, 'g', -1, 64)))
+	if err != nil {
+		log.Printf("State store: spend update failed: %v", err)
+		return 0, false
+	}
+	return total, true
+}
+
+// claimBudgetNotice reports whether this replica is the first to see the
+// tenant cross limit this period, so only one of them notifies.
+func claimBudgetNotice(tenant, limit string, now time.Time) bool {
+	key := storeKey("budget-notice", billingPeriod(now), limit, tenant)
+	reply, err := stateStore.do("SET", key, storeWriter, "NX", "EX", strconv.Itoa(int((62 * 24 * time.Hour).Seconds())))
+	if err != nil {
+		return true
+	}
+	return reply != nil
+}
+
+// claimJobRun reports whether this replica runs the current interval of a
+// background job: the first replica to claim it in the store or, without a
+// store, the shard leader. A store error skips the run.
+func claimJobRun(job string, interval time.Duration) bool {
+	if !stateless() {
+		return shardLeader()
+	}
+	ttl := max(interval*9/10, time.Second)
+	reply, err := stateStore.do("SET", storeKey("job", job), storeWriter, "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		log.Printf("State store: claim %s failed: %v", job, err)
+		return false
+	}
+	return reply != nil
+}
+
+// refreshStoreCounters adopts the savings, usage and spend totals in the
+// store, which include other replicas' requests.
+func refreshStoreCounters() {
+	now := time.Now()
+	if err := refreshSavings(); err != nil {
+		log.Printf("State store: read savings failed: %v", err)
+	}
+
+	dayKey, monthKey := usageKeys(now)
+	daily, err := redisHash(stateStore.do("HGETALL", dayKey))
+	if err != nil {
+		log.Printf("State store: read usage failed: %v", err)
+		return
+	}
+	monthly, err := redisHash(stateStore.do("HGETALL", monthKey))
+	if err != nil {
+		log.Printf("State store: read usage failed: %v", err)
+		return
+	}
+	subjects := make(map[string]struct{})
+	for field := range daily {
+		subjects[field[:strings.LastIndex(field, ":")]] = struct{}{}
+	}
+	for field := range monthly {
+		subjects[field[:strings.LastIndex(field, ":")]] = struct{}{}
+	}
+	usageMutex.Lock()
+	for subject := range subjects {
+		usage := usageLocked(subject, now)
+		usage.DailyRequests, _ = strconv.Atoi(daily[subject+":requests"])
+		usage.DailyTokens, _ = strconv.Atoi(daily[subject+":tokens"])
+		usage.MonthlyRequests, _ = strconv.Atoi(monthly[subject+":requests"])
+		usage.MonthlyTokens, _ = strconv.Atoi(monthly[subject+":tokens"])
+		usage.MonthlySpentUSD, _ = strconv.ParseFloat(monthly[subject+":spentUsd"], 64)
+	}
+	usageMutex.Unlock()
+
+	spend, err := redisHash(stateStore.do("HGETALL", storeKey("spend", billingPeriod(now))))
+	if err != nil {
+		log.Printf("State store: read spend failed: %v", err)
+		return
+	}
+	budgetMutex.Lock()
+	for tenant, raw := range spend {
+		if total, err := strconv.ParseFloat(raw, 64); err == nil {
+			spendLocked(tenant, now).spentUSD = total
+		}
+	}
+	budgetMutex.Unlock()
+}
+
+func refreshSavings() error {
+	tenants, err := redisStrings(stateStore.do("SMEMBERS", storeKey("savings-tenants")))
+	if err != nil {
+		return err
+	}
+	for _, tenant := range tenants {
+		fields, err := redisHash(stateStore.do("HGETALL", storeKey("savings", tenant)))
+		if err != nil {
+			return fmt.Errorf("tenant %q: %w", tenant, err)
+		}
+		stored := SavingsSummary{}
+		stored.Requests, _ = strconv.Atoi(fields["requests"])
+		stored.CacheHits, _ = strconv.Atoi(fields["cacheHits"])
+		stored.TokensSaved, _ = strconv.Atoi(fields["tokensSaved"])
+		stored.EnergySavedWh, _ = strconv.ParseFloat(fields["energySavedWh"], 64)
+		stored.CO2SavedG, _ = strconv.ParseFloat(fields["co2SavedG"], 64)
+		stored.USDSaved, _ = strconv.ParseFloat(fields["usdSaved"], 64)
+		latencySavedMs, _ := strconv.ParseInt(fields["latencySavedMs"], 10, 64)
+		stored.LatencySavedHours = msToHours(latencySavedMs)
+		if stored.Requests > 0 {
+			stored.HitRate = float64(stored.CacheHits) / float64(stored.Requests)
+		}
+
+		savingsMutex.Lock()
+		if summary, ok := savingsByTenant[tenant]; ok {
+			// Streak is per replica; it is not meaningful across them.
+			stored.Streak = summary.Streak
+		}
+		savingsByTenant[tenant] = &stored
+		savingsMutex.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+)
+
+// OrgUsage aggregates one slice of a tenant's history: the whole tenant, a
+// single user, or a single API key.
+type OrgUsage struct {
+	User              string  `json:"user,omitempty"`
+	APIKey            string  `json:"apiKey,omitempty"`
+	Requests          int     `json:"requests"`
+	CacheHits         int     `json:"cacheHits"`
+	HitRate           float64 `json:"hitRate"`
+	TokensSaved       int     `json:"tokensSaved"`
+	EnergySavedWh     float64 `json:"energySavedWh"`
+	CO2SavedG         float64 `json:"co2SavedG"`
+	LatencySavedHours float64 `json:"latencySavedHours"`
+}
+
+type OrgStatsResponse struct {
+	Tenant  string     `json:"tenant"`
+	Totals  OrgUsage   `json:"totals"`
+	Users   []OrgUsage `json:"users"`
+	APIKeys []OrgUsage `json:"apiKeys"`
+}
+
+func (u *OrgUsage) add(item HistoryItem) {
+	u.Requests++
+	if item.Saved {
+		u.CacheHits++
+		u.TokensSaved += item.Tokens
+		u.EnergySavedWh += item.EnergyWh
+		u.CO2SavedG += item.CO2g
+		u.LatencySavedHours += msToHours(item.LatencySavedMs)
+	}
+	u.HitRate = float64(u.CacheHits) / float64(u.Requests)
+}
+
+func sortedUsage(byKey map[string]*OrgUsage) []OrgUsage {
+	usage := make([]OrgUsage, 0, len(byKey))
+	for _, u := range byKey {
+		usage = append(usage, *u)
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Requests != usage[j].Requests {
+			return usage[i].Requests > usage[j].Requests
+		}
+		return usage[i].User+usage[i].APIKey < usage[j].User+usage[j].APIKey
+	})
+	return usage
+}
+
+// handleOrgStats aggregates savings and hit rates across every user and API
+// key of the caller's tenant, for team-level dashboards.
+func handleOrgStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if rejectAnonymous(w, caller, "org stats") {
+		return
+	}
+
+	resp := OrgStatsResponse{Tenant: caller.Tenant}
+	byUser := make(map[string]*OrgUsage)
+	byKey := make(map[string]*OrgUsage)
+
+	dbMutex.RLock()
+	for _, item := range ChatHistory {
+		if item.Tenant != caller.Tenant {
+			continue
+		}
+		resp.Totals.add(item)
+
+		if item.User != "" {
+			u, ok := byUser[item.User]
+			if !ok {
+				u = &OrgUsage{User: item.User}
+				byUser[item.User] = u
+			}
+			u.add(item)
+		}
+		if item.APIKey != "" {
+			k, ok := byKey[item.APIKey]
+			if !ok {
+				k = &OrgUsage{APIKey: item.APIKey}
+				byKey[item.APIKey] = k
+			}
+			k.add(item)
+		}
+	}
+	dbMutex.RUnlock()
+
+	resp.Users = sortedUsage(byUser)
+	resp.APIKeys = sortedUsage(byKey)
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,43 @@
+package main
+
+import "strings"
+
+// Answers come in styles with separate cache slots, so a request for a
+// concise answer is never served a cached essay and vice versa. Entries
+// written before styles existed are full answers.
+
+const (
+	answerStyleFull    = "full"
+	answerStyleConcise = "concise"
+	answerStyleBullet  = "bullet"
+)
+
+var styleInstructions = map[string]string{
+	answerStyleFull:    "",
+	answerStyleConcise: "Answer concisely, in at most three sentences.",
+	answerStyleBullet:  "Answer as a short bulleted list.",
+}
+
+func normalizeStyle(raw string) (string, bool) {
+	style := strings.ToLower(strings.TrimSpace(raw))
+	if style == "" {
+		return answerStyleFull, true
+	}
+	_, ok := styleInstructions[style]
+	return style, ok
+}
+
+func entryStyle(entry VectorEntry) string {
+	if entry.Style == "" {
+		return answerStyleFull
+	}
+	return entry.Style
+}
+
+// styledPrompt prefixes prompt with the instruction for style.
+func styledPrompt(prompt, style string) string {
+	if instruction := styleInstructions[style]; instruction != "" {
+		return instruction + "\n\n" + prompt
+	}
+	return prompt
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// Matches between ECHO_SUGGESTION_THRESHOLD and the hit threshold, and hits
+// demoted for low confidence, are near misses: close enough to be worth
+// showing, not close enough to serve as the answer. The suggestion policy,
+// per request or ECHO_SUGGESTION_POLICY, decides what to do with one:
+// "generate" (default) calls the provider and returns the cached answer as a
+// suggestion alongside, "ask" returns only the suggestion so the user can be
+// asked "did you mean...?", and "off" ignores near misses.
+
+const (
+	suggestionPolicyGenerate = "generate"
+	suggestionPolicyAsk      = "ask"
+	suggestionPolicyOff      = "off"
+)
+
+type Suggestion struct {
+	EntryID    string  `json:"entryId"`
+	Question   string  `json:"question"`
+	Answer     string  `json:"answer"`
+	Similarity float64 `json:"similarity"`
+}
+
+func normalizeSuggestionPolicy(raw string) (string, bool) {
+	policy := strings.ToLower(strings.TrimSpace(raw))
+	if policy == "" {
+		policy = strings.ToLower(envString("ECHO_SUGGESTION_POLICY", suggestionPolicyGenerate))
+	}
+	switch policy {
+	case suggestionPolicyGenerate, suggestionPolicyAsk, suggestionPolicyOff:
+		return policy, true
+	}
+	return policy, false
+}
+
+func suggestionThreshold() float64 {
+	return envFloat("ECHO_SUGGESTION_THRESHOLD", 0.8)
+}
+
+// nearMiss returns the entry to suggest after a miss, or nil. missed is what
+// the lookup returned: a match demoted for low confidence is suggested as
+// is; otherwise only its similarity is known, and the caller's closest
+// hot-tier entry is looked up again when that similarity is high enough.
+func nearMiss(ctx context.Context, caller Caller, query cacheQuery, missed VectorEntry) *Suggestion {
+	if missed.ID == "" {
+		if missed.Similarity < suggestionThreshold() {
+			return nil
+		}
+		var best VectorEntry
+		dbMutex.RLock()
+		for _, partition := range callerPartitions(caller) {
+			pos, score, err := searchIndex(ctx, partition[0], partition[1], query)
+			if err != nil {
+				break
+			}
+			if pos >= 0 && score >= suggestionThreshold() && score > best.Similarity {
+				best = MockVectorDB[pos]
+				best.Similarity = score
+			}
+		}
+		dbMutex.RUnlock()
+		if best.ID == "" {
+			return nil
+		}
+		missed = best
+	}
+
+	return &Suggestion{
+		EntryID:    missed.ID,
+		Question:   missed.Question,
+		Answer:     entryAnswer(missed),
+		Similarity: missed.Similarity,
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// SavingsSummary is a tenant's running savings total. It is kept as counters
+// updated on every request, so reading it is O(1) and does not depend on how
+// much history is retained.
+type SavingsSummary struct {
+	Requests      int     `json:"requests"`
+	CacheHits     int     `json:"cacheHits"`
+	HitRate       float64 `json:"hitRate"`
+	TokensSaved   int     `json:"tokensSaved"`
+	EnergySavedWh float64 `json:"energySavedWh"`
+	CO2SavedG     float64 `json:"co2SavedG"`
+	USDSaved      float64 `json:"usdSaved"`
+	// LatencySavedHours is the provider wait cache hits avoided.
+	LatencySavedHours float64 `json:"latencySavedHours"`
+	// Streak counts consecutive cache hits up to the latest request.
+	Streak int `json:"streak"`
+}
+
+var (
+	savingsMutex    sync.Mutex
+	savingsByTenant = make(map[string]*SavingsSummary)
+	// savingsDirty counts the updates to each tenant's counters not yet
+	// persisted.
+	savingsDirty = make(map[string]int)
+)
+
+// Without a state store, each tenant's counters are persisted to
+// savings.json beside its cache object in S3, so cumulative totals survive
+// restarts and history trimming.
+func savingsObjectKey(tenant string) string {
+	dir, _ := path.Split(tenantObjectKey(tenant))
+	return dir + "savings.json"
+}
+
+// validSavings reports whether a persisted summary can be adopted.
+func validSavings(summary *SavingsSummary) bool {
+	return summary != nil && summary.Requests >= 0 && summary.CacheHits >= 0 && summary.CacheHits <= summary.Requests && summary.TokensSaved >= 0
+}
+
+func loadSavings() {
+	target := activeS3Target()
+	if target == nil {
+		return
+	}
+	tenants, err := listTenants(target)
+	if err != nil {
+		log.Printf("Load savings counters failed: %v", err)
+		return
+	}
+
+	loaded := 0
+	for _, tenant := range tenants {
+		data, err := getObject(target, savingsObjectKey(tenant))
+		if err != nil {
+			log.Printf("Load savings counters for %q failed: %v", tenantName(tenant), err)
+			continue
+		}
+		if data == nil {
+			continue
+		}
+		var summary *SavingsSummary
+		if err := json.Unmarshal(data, &summary); err != nil || !validSavings(summary) {
+			log.Printf("Ignoring invalid savings counters for %q", tenantName(tenant))
+			continue
+		}
+		if summary.Requests > 0 {
+			summary.HitRate = float64(summary.CacheHits) / float64(summary.Requests)
+		}
+		savingsMutex.Lock()
+		savingsByTenant[tenant] = summary
+		savingsMutex.Unlock()
+		loaded++
+	}
+	log.Printf("Loaded savings counters for %d tenants", loaded)
+}
+
+// saveSavings writes the counters of every tenant updated since they were
+// last written. A tenant stays dirty until its write succeeds and no update
+// arrived meanwhile.
+func saveSavings() error {
+	target := activeS3Target()
+	if target == nil {
+		return nil
+	}
+
+	savingsMutex.Lock()
+	pending := make(map[string]SavingsSummary, len(savingsDirty))
+	updates := make(map[string]int, len(savingsDirty))
+	for tenant, count := range savingsDirty {
+		if summary, ok := savingsByTenant[tenant]; ok {
+			pending[tenant] = *summary
+			updates[tenant] = count
+		}
+	}
+	savingsMutex.Unlock()
+
+	var errs []error
+	for tenant, summary := range pending {
+		data, err := json.Marshal(summary)
+		if err == nil {
+			err = putObject(target, savingsObjectKey(tenant), data, "application/json", tenantKMSKey(tenant))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", tenantName(tenant), err))
+			continue
+		}
+		savingsMutex.Lock()
+		if savingsDirty[tenant] == updates[tenant] {
+			delete(savingsDirty, tenant)
+		}
+		savingsMutex.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+func startSavingsPersistence(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := saveSavings(); err != nil {
+				log.Printf("Save savings counters failed: %v", err)
+			}
+			if err := saveUsage(); err != nil {
+				log.Printf("Save usage counters failed: %v", err)
+			}
+		}
+	}()
+}
+
+func recordSavings(tenant string, item HistoryItem) {
+	savingsMutex.Lock()
+	defer savingsMutex.Unlock()
+
+	summary, ok := savingsByTenant[tenant]
+	if !ok {
+		summary = &SavingsSummary{}
+		savingsByTenant[tenant] = summary
+	}
+	summary.Requests++
+	if item.Saved {
+		summary.CacheHits++
+		summary.TokensSaved += item.Tokens
+		summary.EnergySavedWh += item.EnergyWh
+		summary.CO2SavedG += item.CO2g
+		summary.USDSaved += float64(item.Tokens) / 1000.0 * usdPer1KTokens(item.Model)
+		summary.LatencySavedHours += msToHours(item.LatencySavedMs)
+		summary.Streak++
+	} else {
+		summary.Streak = 0
+	}
+	summary.HitRate = float64(summary.CacheHits) / float64(summary.Requests)
+	savingsDirty[tenant]++
+}
+
+func tenantSavings(tenant string) SavingsSummary {
+	savingsMutex.Lock()
+	defer savingsMutex.Unlock()
+	if summary, ok := savingsByTenant[tenant]; ok {
+		return *summary
+	}
+	return SavingsSummary{}
+}
+
+// handleSavingsSummary serves GET /stats/summary, cheap enough for widgets to
+// poll every few seconds.
+func handleSavingsSummary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if rejectAnonymous(w, caller, "the savings summary") {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "max-age=2")
+	writeJSON(w, http.StatusOK, tenantSavings(caller.Tenant))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Stale-while-revalidate: a hit on an entry older than ECHO_SOFT_TTL is still
+// served immediately, marked stale, while the answer is regenerated in the
+// background, so the cache converges to fresh content without making anyone
+// wait. Entries without a creation time are never considered stale.
+
+// revalidating holds the IDs of entries being regenerated, so a popular stale
+// entry is regenerated once rather than once per hit.
+var revalidating sync.Map
+
+func softTTL() time.Duration {
+	return envDuration("ECHO_SOFT_TTL", 0)
+}
+
+func isStale(entry VectorEntry, now time.Time) bool {
+	ttl := softTTL()
+	return ttl > 0 && !entry.CreatedAt.IsZero() && now.Sub(entry.CreatedAt) > ttl
+}
+
+// revalidateAsync regenerates entry in the background on behalf of caller.
+func revalidateAsync(caller Caller, entry VectorEntry) {
+	if currentMaintenance().Enabled || !checkTokenQuota(caller) {
+		return
+	}
+	if _, running := revalidating.LoadOrStore(entry.ID, struct{}{}); running {
+		return
+	}
+
+	go func() {
+		defer revalidating.Delete(entry.ID)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		answer, model, err := regenerateEntry(ctx, entry, Caller{Tenant: entry.Tenant})
+		if err != nil {
+			log.Printf("Revalidate entry %s failed: %v", entry.ID, err)
+			return
+		}
+		if _, previous, found := replaceEntryAnswer(entry.ID, answer, model); found {
+			recordAudit(AuditEvent{
+				Action:  "cache.revalidate",
+				EntryID: entry.ID,
+				Tenant:  entry.Tenant,
+				Actor:   callerActor(caller),
+				Details: map[string]string{"previousAnswer": redactContent(previous), "model": model},
+			})
+		}
+	}()
+}
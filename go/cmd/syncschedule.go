@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// With ECHO_SYNC_ADAPTIVE=true the sync interval follows the rate of change
+// instead of ticking every ECHO_SYNC_INTERVAL. Once
+// ECHO_SYNC_CHANGE_THRESHOLD changes (default 100, counted as for
+// markCacheChanged) have accumulated, a cycle runs as soon as
+// ECHO_SYNC_MIN_INTERVAL (default 30s) has passed since the last one, and the
+// interval halves. A cycle that comes due with nothing changed doubles the
+// interval, up to ECHO_SYNC_MAX_INTERVAL (default 30m), and one that comes
+// due with a few changes resets it to ECHO_SYNC_INTERVAL. Idle instances thus
+// poll S3 less, and busy ones leave less unsynced work at risk.
+
+// adaptiveSyncPoll is how often the change count is checked.
+const adaptiveSyncPoll = 5 * time.Second
+
+func adaptiveSyncEnabled() bool {
+	return envString("ECHO_SYNC_ADAPTIVE", "false") == "true"
+}
+
+// adaptiveSyncBounds returns the minimum and maximum sync intervals.
+func adaptiveSyncBounds() (time.Duration, time.Duration) {
+	minInterval := envDuration("ECHO_SYNC_MIN_INTERVAL", 30*time.Second)
+	return minInterval, max(envDuration("ECHO_SYNC_MAX_INTERVAL", 30*time.Minute), minInterval)
+}
+
+func setSyncSchedule(interval time.Duration, next time.Time) {
+	syncMutex.Lock()
+	syncStats.IntervalMs = interval.Milliseconds()
+	syncStats.NextCycleAt = &next
+	syncMutex.Unlock()
+}
+
+// runAdaptiveSync runs sync cycles at an interval that starts at base and
+// adapts to the rate of change.
+func runAdaptiveSync(base, maxDuration time.Duration) {
+	minInterval, maxInterval := adaptiveSyncBounds()
+	threshold := uint64(max(envInt("ECHO_SYNC_CHANGE_THRESHOLD", 100), 1))
+	base = min(max(base, minInterval), maxInterval)
+
+	interval := base
+	last := time.Now()
+	synced := cacheGeneration.Load()
+	setSyncSchedule(interval, last.Add(interval))
+	for {
+		time.Sleep(min(adaptiveSyncPoll, minInterval))
+		elapsed := time.Since(last)
+		generation := cacheGeneration.Load()
+		changes := generation - synced
+		previous := interval
+		switch {
+		case changes >= threshold && elapsed >= minInterval:
+			interval = max(interval/2, minInterval)
+		case elapsed < interval:
+			continue
+		case changes == 0:
+			interval = min(interval*2, maxInterval)
+		default:
+			interval = base
+		}
+
+		if interval != previous {
+			log.Printf("Sync interval now %v after %d changes in %v", interval, changes, elapsed.Round(time.Second))
+		}
+		last, synced = time.Now(), generation
+		setSyncSchedule(interval, last.Add(interval))
+		go runSyncCycle(maxDuration)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Sync traffic is metered so cache growth and S3 bandwidth can be tracked
+// over time. getObject and putObject count every byte and object moved,
+// sync counts the entries it downloads and uploads, and each tenant's last
+// uploaded cache object size is kept as a gauge. Each sync cycle reports its
+// duration, per-step durations and what moved while it ran; a cycle's bytes
+// include any other S3 traffic at the same time, such as snapshots. The
+// totals are on /metrics, and /admin/sync-status adds the last
+// ECHO_SYNC_HISTORY (default 48) cycles.
+
+const (
+	directionDownload = "download"
+	directionUpload   = "upload"
+)
+
+var syncDurationBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+var (
+	s3BytesTotal     = newCounter("echo_s3_bytes", "Bytes transferred to and from S3, by direction.")
+	s3ObjectsTotal   = newCounter("echo_s3_objects", "Objects transferred to and from S3, by direction.")
+	syncEntriesTotal = newCounter("echo_sync_entries", "Cache entries downloaded from and uploaded to S3 by sync, by direction.")
+	cacheObjectBytes = newGauge("echo_cache_object_bytes", "Size of each tenant's last uploaded cache object.")
+	syncCycleSeconds = newHistogram("echo_sync_cycle_duration_seconds", "Duration of a sync cycle.", syncDurationBuckets)
+	syncStepSeconds  = newHistogram("echo_sync_step_duration_seconds", "Duration of a sync cycle step, by step.", syncDurationBuckets)
+)
+
+type SyncCycleReport struct {
+	StartedAt         time.Time        `json:"startedAt"`
+	DurationMs        int64            `json:"durationMs"`
+	StepsMs           map[string]int64 `json:"stepsMs"`
+	SkippedSteps      []string         `json:"skippedSteps,omitempty"`
+	BytesDownloaded   int64            `json:"bytesDownloaded"`
+	BytesUploaded     int64            `json:"bytesUploaded"`
+	ObjectsUploaded   int64            `json:"objectsUploaded"`
+	EntriesDownloaded int64            `json:"entriesDownloaded"`
+	EntriesUploaded   int64            `json:"entriesUploaded"`
+}
+
+type SyncTransferTotals struct {
+	BytesDownloaded   int64 `json:"bytesDownloaded"`
+	BytesUploaded     int64 `json:"bytesUploaded"`
+	ObjectsDownloaded int64 `json:"objectsDownloaded"`
+	ObjectsUploaded   int64 `json:"objectsUploaded"`
+	EntriesDownloaded int64 `json:"entriesDownloaded"`
+	EntriesUploaded   int64 `json:"entriesUploaded"`
+}
+
+type SyncStatusResponse struct {
+	Sync   SyncStats          `json:"sync"`
+	Target *SyncTargetView    `json:"target,omitempty"`
+	Totals SyncTransferTotals `json:"totals"`
+	// ObjectBytes maps each tenant to the size of its last uploaded cache
+	// object.
+	ObjectBytes map[string]int64  `json:"objectBytes"`
+	Cycles      []SyncCycleReport `json:"cycles"`
+}
+
+var (
+	// syncReportMutex guards the fields below.
+	syncReportMutex sync.Mutex
+	// syncReports holds the recent cycles, oldest first.
+	syncReports []SyncCycleReport
+	objectBytes = make(map[string]int64)
+)
+
+func directionLabels(direction string) string {
+	return metricLabels("direction", direction)
+}
+
+// recordS3Transfer counts one object of size bytes moved in direction.
+func recordS3Transfer(direction string, size int) {
+	s3BytesTotal.add(directionLabels(direction), float64(size))
+	s3ObjectsTotal.add(directionLabels(direction), 1)
+}
+
+func recordSyncEntries(direction string, count int) {
+	syncEntriesTotal.add(directionLabels(direction), float64(count))
+}
+
+func recordCacheObjectSize(tenant string, size int) {
+	cacheObjectBytes.set(metricLabels("tenant", tenant), float64(size))
+	syncReportMutex.Lock()
+	objectBytes[tenant] = int64(size)
+	syncReportMutex.Unlock()
+}
+
+func syncTransferTotals() SyncTransferTotals {
+	down, up := directionLabels(directionDownload), directionLabels(directionUpload)
+	return SyncTransferTotals{
+		BytesDownloaded:   int64(s3BytesTotal.value(down)),
+		BytesUploaded:     int64(s3BytesTotal.value(up)),
+		ObjectsDownloaded: int64(s3ObjectsTotal.value(down)),
+		ObjectsUploaded:   int64(s3ObjectsTotal.value(up)),
+		EntriesDownloaded: int64(syncEntriesTotal.value(down)),
+		EntriesUploaded:   int64(syncEntriesTotal.value(up)),
+	}
+}
+
+// syncCycleRecorder collects one cycle's report.
+type syncCycleRecorder struct {
+	report SyncCycleReport
+	before SyncTransferTotals
+}
+
+func newSyncCycleRecorder(start time.Time) *syncCycleRecorder {
+	return &syncCycleRecorder{
+		report: SyncCycleReport{StartedAt: start, StepsMs: make(map[string]int64)},
+		before: syncTransferTotals(),
+	}
+}
+
+func (c *syncCycleRecorder) step(name string, elapsed time.Duration) {
+	c.report.StepsMs[name] = elapsed.Milliseconds()
+	syncStepSeconds.observe(metricLabels("step", name), elapsed.Seconds(), "")
+}
+
+func (c *syncCycleRecorder) skip(name string) {
+	c.report.SkippedSteps = append(c.report.SkippedSteps, name)
+}
+
+func (c *syncCycleRecorder) finish(elapsed time.Duration) {
+	after := syncTransferTotals()
+	report := c.report
+	report.DurationMs = elapsed.Milliseconds()
+	report.BytesDownloaded = after.BytesDownloaded - c.before.BytesDownloaded
+	report.BytesUploaded = after.BytesUploaded - c.before.BytesUploaded
+	report.ObjectsUploaded = after.ObjectsUploaded - c.before.ObjectsUploaded
+	report.EntriesDownloaded = after.EntriesDownloaded - c.before.EntriesDownloaded
+	report.EntriesUploaded = after.EntriesUploaded - c.before.EntriesUploaded
+	syncCycleSeconds.observe("", elapsed.Seconds(), "")
+	recordEvent(Event{
+		Type:              eventSyncCycle,
+		LatencyMs:         report.DurationMs,
+		BytesDownloaded:   report.BytesDownloaded,
+		BytesUploaded:     report.BytesUploaded,
+		EntriesDownloaded: report.EntriesDownloaded,
+		EntriesUploaded:   report.EntriesUploaded,
+	})
+
+	syncReportMutex.Lock()
+	defer syncReportMutex.Unlock()
+	syncReports = append(syncReports, report)
+	if keep := envInt("ECHO_SYNC_HISTORY", 48); len(syncReports) > keep {
+		syncReports = append([]SyncCycleReport(nil), syncReports[len(syncReports)-keep:]...)
+	}
+}
+
+// handleSyncStatus reports sync state, transfer totals and recent cycles,
+// newest first.
+func handleSyncStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	resp := SyncStatusResponse{
+		Sync:        currentSyncStats(),
+		Target:      currentSyncTarget(),
+		Totals:      syncTransferTotals(),
+		ObjectBytes: make(map[string]int64),
+	}
+	syncReportMutex.Lock()
+	maps.Copy(resp.ObjectBytes, objectBytes)
+	resp.Cycles = make([]SyncCycleReport, 0, len(syncReports))
+	for i := len(syncReports) - 1; i >= 0; i-- {
+		resp.Cycles = append(resp.Cycles, syncReports[i])
+	}
+	syncReportMutex.Unlock()
+	writeJSON(w, http.StatusOK, resp)
+}
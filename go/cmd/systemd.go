@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// systemd integration for bare-metal deployments. Under socket activation
+// (an echo.socket unit, see deploy/systemd) echo serves on the socket systemd
+// passes in instead of binding :8080 itself. systemd keeps the socket open
+// across restarts, so connections arriving while echo restarts queue in the
+// kernel instead of being refused. With Type=notify, echo reports its
+// startup steps as STATUS= and sends READY=1 only once it is ready, the same
+// moment /readyz turns 200, and pings the watchdog when WatchdogSec is set.
+
+// listenFdsStart is the first file descriptor systemd passes,
+// SD_LISTEN_FDS_START.
+const listenFdsStart = 3
+
+// systemdListener returns the first socket passed by systemd, or nil when
+// echo was not socket-activated.
+func systemdListener() (net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+	if count > 1 {
+		log.Printf("systemd passed %d sockets; serving on the first", count)
+	}
+	file := os.NewFile(uintptr(listenFdsStart), "systemd-socket")
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("inherit systemd socket: %w", err)
+	}
+	return listener, nil
+}
+
+// sdNotify sends state to the service manager; it does nothing when echo
+// does not run under systemd with Type=notify.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		// Abstract namespace.
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("sd_notify failed: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("sd_notify failed: %v", err)
+	}
+}
+
+// startWatchdog pings the systemd watchdog at half its timeout.
+func startWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	go func() {
+		defer ticker.Stop()
+		for range ticker.C {
+			sdNotify("WATCHDOG=1")
+		}
+	}()
+}
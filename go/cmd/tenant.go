@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Tenants isolate caches inside one deployment. The tenant travels in the
+// X-Tenant-ID header; requests without it use the default tenant, whose cache
+// keeps living at the legacy cache.json key. Once API keys are configured the
+// header only selects the tenant a key is bound to; see authenticate.
+
+const (
+	defaultTenant   = ""
+	tenantKeyPrefix = "tenants/"
+)
+
+var tenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// defaultTenantName names the default tenant wherever a tenant has to be
+// spelled out: in export object keys and in per-tenant settings. The '@'
+// keeps it apart from every tenant id tenantIDPattern accepts, including one
+// called "default".
+const defaultTenantName = "@default"
+
+// tenantName returns the name tenant goes by in object keys and settings.
+func tenantName(tenant string) string {
+	if tenant == defaultTenant {
+		return defaultTenantName
+	}
+	return tenant
+}
+
+// tenantFromName reverses tenantName.
+func tenantFromName(name string) string {
+	if name == defaultTenantName {
+		return defaultTenant
+	}
+	return name
+}
+
+var errInvalidTenant = errors.New("invalid tenant id")
+
+func resolveTenant(r *http.Request) (string, error) {
+	tenant := strings.TrimSpace(r.Header.Get("X-Tenant-ID"))
+	if tenant == "" {
+		return defaultTenant, nil
+	}
+	if !tenantIDPattern.MatchString(tenant) {
+		return "", errInvalidTenant
+	}
+	return tenant, nil
+}
+
+// entryKey identifies an entry for de-duplication. Keys never collide across
+// tenants or owners, so merges cannot drop or overwrite another tenant's (or
+// user's private) entry.
+func entryKey(tenant, owner, question string) string {
+	return tenant + "\x00" + owner + "\x00" + strings.TrimSpace(question)
+}
+
+func tenantObjectKey(tenant string) string {
+	if tenant == defaultTenant {
+		return cacheObjectKey
+	}
+	return tenantKeyPrefix + tenant + "/" + cacheObjectKey
+}
+
+// tenantKMSKey returns the KMS key configured for tenant in
+// S3_TENANT_KMS_KEYS ("tenant=keyId,..."), if any.
+func tenantKMSKey(tenant string) string {
+	for _, pair := range envList("S3_TENANT_KMS_KEYS") {
+		name, key, ok := strings.Cut(pair, "=")
+		if ok && strings.TrimSpace(name) == tenant {
+			return strings.TrimSpace(key)
+		}
+	}
+	return ""
+}
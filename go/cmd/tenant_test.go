@@ -0,0 +1,243 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTenantObjectKeysAreDisjoint(t *testing.T) {
+	seen := make(map[string]string)
+	for _, tenant := range []string{defaultTenant, "acme", "globex"} {
+		for _, key := range []string{tenantObjectKey(tenant), tenantArchiveKey(tenant), tenantBinaryObjectKey(tenant), tenantRAGObjectKey(tenant), coldIndexKey(tenant), savingsObjectKey(tenant)} {
+			if other, ok := seen[key]; ok {
+				t.Fatalf("key %q is shared by tenants %q and %q", key, other, tenant)
+			}
+			seen[key] = tenant
+			if tenant != defaultTenant && !strings.HasPrefix(key, tenantKeyPrefix+tenant+"/") {
+				t.Errorf("key %q for tenant %q is outside its prefix", key, tenant)
+			}
+		}
+	}
+}
+
+func TestEntryKeyIsolatesTenants(t *testing.T) {
+	if entryKey("acme", sharedOwner, "q") == entryKey("globex", sharedOwner, "q") {
+		t.Fatal("entry keys collide across tenants")
+	}
+	if entryKey("acme", sharedOwner, "q") == entryKey("acme", "alice", "q") {
+		t.Fatal("entry keys collide across owners")
+	}
+}
+
+func TestSplitArchiveRestoresOnlyTheTenant(t *testing.T) {
+	archived := []VectorEntry{
+		{Tenant: "acme", Question: "shared question"},
+		{Tenant: "globex", Question: "shared question"},
+		{Tenant: "acme", Question: "other question"},
+	}
+
+	restore, keep := splitArchive(archived, "acme", nil)
+	if len(restore) != 2 || len(keep) != 1 {
+		t.Fatalf("restore all: got %d restored, %d kept; want 2, 1", len(restore), len(keep))
+	}
+	for _, entry := range restore {
+		if entry.Tenant != "acme" {
+			t.Errorf("restored an entry of tenant %q", entry.Tenant)
+		}
+	}
+
+	wanted := map[string]struct{}{entryKey("acme", sharedOwner, "shared question"): {}}
+	restore, keep = splitArchive(archived, "acme", wanted)
+	if len(restore) != 1 || restore[0].Tenant != "acme" || len(keep) != 2 {
+		t.Fatalf("restore one: got %+v restored, %d kept", restore, len(keep))
+	}
+}
+
+func TestAuthenticateTenantBinding(t *testing.T) {
+	t.Setenv("ECHO_API_KEYS", "open:open-secret,bound:bound-secret:acme")
+
+	tests := []struct {
+		name       string
+		key        string
+		tenant     string
+		wantStatus int
+		wantTenant string
+	}{
+		{name: "unbound key, no header", key: "open-secret", wantTenant: defaultTenant},
+		{name: "unbound key picks a tenant", key: "open-secret", tenant: "acme", wantStatus: http.StatusForbidden},
+		{name: "bound key, no header", key: "bound-secret", wantTenant: "acme"},
+		{name: "bound key, own tenant", key: "bound-secret", tenant: "acme", wantTenant: "acme"},
+		{name: "bound key, other tenant", key: "bound-secret", tenant: "globex", wantStatus: http.StatusForbidden},
+		{name: "no key", tenant: "acme", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/chat", nil)
+			if tt.key != "" {
+				r.Header.Set("X-API-Key", tt.key)
+			}
+			if tt.tenant != "" {
+				r.Header.Set("X-Tenant-ID", tt.tenant)
+			}
+			w := httptest.NewRecorder()
+
+			caller, ok := authenticate(w, r)
+			if tt.wantStatus != 0 {
+				if ok || w.Code != tt.wantStatus {
+					t.Fatalf("got ok=%v status %d; want status %d", ok, w.Code, tt.wantStatus)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("rejected with status %d", w.Code)
+			}
+			if caller.Tenant != tt.wantTenant {
+				t.Errorf("tenant %q; want %q", caller.Tenant, tt.wantTenant)
+			}
+		})
+	}
+}
+
+func TestResolveTenant(t *testing.T) {
+	tests := []struct {
+		header  string
+		want    string
+		wantErr bool
+	}{
+		{header: "", want: defaultTenant},
+		{header: " acme ", want: "acme"},
+		{header: "../globex", wantErr: true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/chat", nil)
+		r.Header.Set("X-Tenant-ID", tt.header)
+		got, err := resolveTenant(r)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("resolveTenant(%q) = %q, %v; want %q, error %v", tt.header, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestAuthenticateUserHeaderNeedsTrustedProxy(t *testing.T) {
+	for _, trust := range []string{"false", "true"} {
+		t.Run("trust="+trust, func(t *testing.T) {
+			t.Setenv("ECHO_TRUST_USER_HEADER", trust)
+			r := httptest.NewRequest(http.MethodPost, "/chat", nil)
+			r.Header.Set("X-User-ID", "alice")
+
+			caller, ok := authenticate(httptest.NewRecorder(), r)
+			if !ok {
+				t.Fatal("rejected")
+			}
+			want := ""
+			if trust == "true" {
+				want = "alice"
+			}
+			if caller.User != want {
+				t.Errorf("user %q; want %q", caller.User, want)
+			}
+		})
+	}
+}
+
+func TestPublicEntriesNeedBothTenantsToShare(t *testing.T) {
+	entry := VectorEntry{Tenant: "acme", Owner: sharedOwner, Access: entryAccessPublic}
+	tests := []struct {
+		shared string
+		caller string
+		want   bool
+	}{
+		{shared: "", caller: "acme", want: true},
+		{shared: "", caller: "globex", want: false},
+		{shared: "acme", caller: "globex", want: false},
+		{shared: "globex", caller: "globex", want: false},
+		{shared: "acme,globex", caller: "globex", want: true},
+	}
+	for _, tt := range tests {
+		t.Setenv("ECHO_PUBLIC_ENTRY_TENANTS", tt.shared)
+		if got := entryVisible(entry, Caller{Tenant: tt.caller}); got != tt.want {
+			t.Errorf("shared %q, caller %q: visible %v; want %v", tt.shared, tt.caller, got, tt.want)
+		}
+		partition, _ := indexPartition(entry)
+		if wantPublic := strings.Contains(tt.shared, "acme"); (partition == publicIndexTenant) != wantPublic {
+			t.Errorf("shared %q: indexed under %q", tt.shared, partition)
+		}
+	}
+}
+
+func TestHistoryVisibleWithoutUser(t *testing.T) {
+	shared := HistoryItem{Tenant: "acme"}
+	private := HistoryItem{Tenant: "acme", User: "alice"}
+	tests := []struct {
+		name   string
+		item   HistoryItem
+		caller Caller
+		want   bool
+	}{
+		{name: "no user, shared item", item: shared, caller: Caller{Tenant: "acme"}, want: true},
+		{name: "no user, private item", item: private, caller: Caller{Tenant: "acme"}, want: false},
+		{name: "owner", item: private, caller: Caller{Tenant: "acme", User: "alice"}, want: true},
+		{name: "other user", item: private, caller: Caller{Tenant: "acme", User: "bob"}, want: false},
+		{name: "other tenant", item: shared, caller: Caller{Tenant: "globex"}, want: false},
+	}
+	for _, tt := range tests {
+		if got := historyVisible(tt.item, tt.caller); got != tt.want {
+			t.Errorf("%s: visible %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDemoCallersCannotReadHistory(t *testing.T) {
+	t.Setenv("ECHO_DEMO_MODE", "true")
+	r := httptest.NewRequest(http.MethodGet, "/history", nil)
+	caller, ok := authenticate(httptest.NewRecorder(), r)
+	if !ok || !caller.Anonymous {
+		t.Fatalf("demo request not admitted as anonymous: %+v", caller)
+	}
+	if historyVisible(HistoryItem{Tenant: caller.Tenant}, caller) {
+		t.Error("demo caller sees the tenant's history")
+	}
+
+	w := httptest.NewRecorder()
+	handleHistory(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("GET /history in demo mode: status %d; want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestShardObjectKeysStayInTheTenant(t *testing.T) {
+	for _, tenant := range []string{defaultTenant, "acme"} {
+		a, b := shardObjectKey(tenant, "10.0.0.1:7946"), shardObjectKey(tenant, "10.0.0.2:7946")
+		if a == b || a == tenantObjectKey(tenant) {
+			t.Fatalf("tenant %q: shard keys %q and %q are not distinct", tenant, a, b)
+		}
+		if tenant != defaultTenant && !strings.HasPrefix(a, tenantKeyPrefix+tenant+"/") {
+			t.Errorf("shard key %q for tenant %q is outside its prefix", a, tenant)
+		}
+	}
+}
+
+func TestDeletingADocumentWithdrawsOnlyTheTenantsCitingEntries(t *testing.T) {
+	cites := []Citation{{DocumentID: "doc1"}}
+	withCache(t, []VectorEntry{
+		{ID: "a", Tenant: "acme", Question: "cites", Citations: cites},
+		{ID: "b", Tenant: "acme", Question: "plain"},
+		{ID: "c", Tenant: "globex", Question: "cites", Citations: cites},
+	}, nil)
+
+	if n := withdrawCitingEntries("acme", "doc1"); n != 1 {
+		t.Fatalf("withdrew %d entries; want 1", n)
+	}
+	var left []string
+	for _, entry := range MockVectorDB {
+		left = append(left, entry.ID)
+	}
+	if strings.Join(left, ",") != "b,c" {
+		t.Errorf("entries left %v; want [b c]", left)
+	}
+	if !isWithdrawn(entryKey("acme", "", "cites")) {
+		t.Error("a sync could bring the withdrawn entry back")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Threads group history items by the session id clients send with /chat, so
+// the UI can render a conversation list. A thread's title is its first
+// question unless ECHO_LLM_THREAD_TITLES=true, in which case a short summary
+// is generated once in the background and billed to the caller. Titles are
+// kept per tenant, user and thread for the newest maxThreadTitles threads;
+// older threads fall back to their first question.
+
+const (
+	maxThreadTitleRunes = 80
+	maxThreadTitles     = 10000
+)
+
+type ThreadSummary struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	Items     int       `json:"items"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type ThreadResponse struct {
+	ThreadSummary
+	History []HistoryItem `json:"history"`
+}
+
+var (
+	// threadMutex guards threadTitles and threadTitleOrder.
+	threadMutex  sync.Mutex
+	threadTitles = make(map[string]string)
+	// threadTitleOrder holds the keys of threadTitles, oldest first.
+	threadTitleOrder []string
+)
+
+func threadKey(caller Caller, sessionID string) string {
+	return caller.Tenant + "\x00" + caller.User + "\x00" + sessionID
+}
+
+func truncateTitle(question string) string {
+	title := strings.Join(strings.Fields(question), " ")
+	runes := []rune(title)
+	if len(runes) <= maxThreadTitleRunes {
+		return title
+	}
+	return strings.TrimSpace(string(runes[:maxThreadTitleRunes-1])) + "…"
+}
+
+// noteThreadActivity generates an LLM title the first time a thread is seen.
+// Anonymous callers cannot list threads, and callers out of token quota keep
+// the first-question title.
+func noteThreadActivity(caller Caller, sessionID, question string) {
+	if sessionID == "" || caller.Anonymous || envString("ECHO_LLM_THREAD_TITLES", "false") != "true" {
+		return
+	}
+
+	key := threadKey(caller, sessionID)
+	threadMutex.Lock()
+	if _, exists := threadTitles[key]; exists {
+		threadMutex.Unlock()
+		return
+	}
+	storeThreadTitleLocked(key, "")
+	threadMutex.Unlock()
+	if !checkTokenQuota(caller) {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+
+		model := cheapestModel()
+		prompt := "Write a title of at most six words for a conversation that starts with the question below. Reply with the title only.\n\n" + question
+		title, err := generateAnswer(ctx, prompt, model)
+		if err != nil {
+			log.Printf("Thread title generation failed: %v", err)
+			return
+		}
+		recordUsage(caller, model, "CLOUD", estimateTokens(prompt)+estimateTokens(title), 0)
+
+		threadMutex.Lock()
+		if _, exists := threadTitles[key]; exists {
+			threadTitles[key] = truncateTitle(strings.Trim(title, "\"' "))
+		}
+		threadMutex.Unlock()
+	}()
+}
+
+// storeThreadTitleLocked records a new title, forgetting the oldest once
+// there are more than maxThreadTitles. The caller holds threadMutex.
+func storeThreadTitleLocked(key, title string) {
+	threadTitles[key] = title
+	threadTitleOrder = append(threadTitleOrder, key)
+	for len(threadTitleOrder) > maxThreadTitles {
+		delete(threadTitles, threadTitleOrder[0])
+		threadTitleOrder = threadTitleOrder[1:]
+	}
+}
+
+func threadTitle(caller Caller, sessionID, firstQuestion string) string {
+	threadMutex.Lock()
+	title := threadTitles[threadKey(caller, sessionID)]
+	threadMutex.Unlock()
+	if title != "" {
+		return title
+	}
+	return truncateTitle(firstQuestion)
+}
+
+// callerThreads groups the caller's visible history by session, oldest item
+// first within each thread.
+func callerThreads(caller Caller) map[string][]HistoryItem {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	threads := make(map[string][]HistoryItem)
+	for _, item := range ChatHistory {
+		if item.SessionID == "" || !historyVisible(item, caller) {
+			continue
+		}
+		threads[item.SessionID] = append(threads[item.SessionID], item)
+	}
+	return threads
+}
+
+func summarizeThread(caller Caller, id string, items []HistoryItem) ThreadSummary {
+	return ThreadSummary{
+		ID:        id,
+		Title:     threadTitle(caller, id, items[0].Question),
+		Items:     len(items),
+		CreatedAt: items[0].Timestamp,
+		UpdatedAt: items[len(items)-1].Timestamp,
+	}
+}
+
+// handleThreads lists the caller's threads (GET) or mints a session id for a
+// new one (POST); the thread appears once a /chat request uses the id.
+func handleThreads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if rejectAnonymous(w, caller, "history") {
+		return
+	}
+	if r.Method == http.MethodPost {
+		writeJSON(w, http.StatusCreated, map[string]string{"id": newID()})
+		return
+	}
+
+	summaries := make([]ThreadSummary, 0)
+	for id, items := range callerThreads(caller) {
+		summaries = append(summaries, summarizeThread(caller, id, items))
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].UpdatedAt.After(summaries[j].UpdatedAt)
+	})
+
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+func handleThread(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	caller, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if rejectAnonymous(w, caller, "history") {
+		return
+	}
+
+	id := r.PathValue("id")
+	items := callerThreads(caller)[id]
+	if len(items) == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "thread not found"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ThreadResponse{
+		ThreadSummary: summarizeThread(caller, id, items),
+		History:       items,
+	})
+}
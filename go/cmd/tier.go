@@ -0,0 +1,728 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Tiering keeps only the hottest entries in MockVectorDB. Colder entries are
+// spilled to the cold tier in S3: each demotion writes a tenant's entries as
+// one JSON-lines segment under the tenant's cold/ prefix, and cold/index.json
+// beside them lists the entries of each segment that are still cold. Only
+// the entries' metadata and vectors stay in memory, grouped by index
+// partition, so a hot miss searches the cold tier without touching S3; a cold
+// hit fetches the entry's segment and promotes it back into RAM.
+//
+// Demoted entries are held in memory until their segment is written, and the
+// index objects are rewritten in the background every ECHO_COLD_TIER_FLUSH
+// (10s), so neither demotion nor promotion waits on S3 under dbMutex.
+// Segments no longer listed in their tenant's index are deleted once the
+// index is written.
+
+type TierStats struct {
+	HotCapacity int   `json:"hotCapacity"`
+	HotEntries  int   `json:"hotEntries"`
+	HotBytes    int64 `json:"hotBytes"`
+	ColdEntries int   `json:"coldEntries"`
+	HotHits     int   `json:"hotHits"`
+	ColdHits    int   `json:"coldHits"`
+	ColdLookups int   `json:"coldLookups"`
+	Promotions  int   `json:"promotions"`
+	Demotions   int   `json:"demotions"`
+}
+
+// coldRef is a cold entry as kept in memory.
+type coldRef struct {
+	// stub is the entry without its answer, for searching.
+	stub VectorEntry
+	// segment is the object holding the full entry, empty until written.
+	segment string
+	// pending holds the full entry until its segment is written.
+	pending *VectorEntry
+}
+
+// coldIndexObject is the content of a tenant's cold/index.json.
+type coldIndexObject struct {
+	// Segments maps each segment's key to the IDs still cold in it.
+	Segments map[string][]string `json:"segments"`
+}
+
+var (
+	hotTierSize int
+
+	// coldMutex guards the fields below. When both locks are needed, dbMutex
+	// is always taken first.
+	coldMutex sync.Mutex
+	// coldPartitions holds cold entries by index partition, then by ID.
+	coldPartitions = make(map[string]map[string]*coldRef)
+	coldQuestions  = make(map[string]struct{})
+	// coldDirty holds tenants whose index object is behind coldPartitions.
+	coldDirty = make(map[string]bool)
+	// coldSegments holds the segments each tenant's index object last listed.
+	coldSegments = make(map[string]map[string]bool)
+
+	// coldFlushMutex serializes flushColdTier.
+	coldFlushMutex sync.Mutex
+
+	tierMutex sync.Mutex
+	tierStats TierStats
+)
+
+func initTiering() {
+	hotTierSize = envInt("ECHO_HOT_TIER_SIZE", 0)
+	if hotTierSize <= 0 {
+		hotTierSize = 0
+	}
+}
+
+func tieringEnabled() bool {
+	return hotTierSize > 0
+}
+
+// disableTiering turns tiering off when the cold tier has nowhere to live.
+func disableTiering(reason string) {
+	if tieringEnabled() {
+		log.Printf("Tiering disabled: %s", reason)
+		hotTierSize = 0
+	}
+}
+
+// coldKeyPrefix is where tenant's cold tier lives: beside tenantObjectKey,
+// under cold/.
+func coldKeyPrefix(tenant string) string {
+	dir, _ := path.Split(tenantObjectKey(tenant))
+	return dir + "cold/"
+}
+
+func coldIndexKey(tenant string) string {
+	return coldKeyPrefix(tenant) + "index.json"
+}
+
+func coldSegmentKey(tenant string) string {
+	return coldKeyPrefix(tenant) + newID() + ".jsonl"
+}
+
+func coldStub(entry VectorEntry) VectorEntry {
+	entry.Answer = ""
+	entry.CompressedAnswer = nil
+	return entry
+}
+
+func addColdLocked(ref *coldRef) {
+	partition, _ := indexPartition(ref.stub)
+	refs, ok := coldPartitions[partition]
+	if !ok {
+		refs = make(map[string]*coldRef)
+		coldPartitions[partition] = refs
+	}
+	refs[ref.stub.ID] = ref
+	coldQuestions[entryKey(ref.stub.Tenant, ref.stub.Owner, ref.stub.Question)] = struct{}{}
+	coldDirty[ref.stub.Tenant] = true
+}
+
+func removeColdLocked(ref *coldRef) {
+	partition, _ := indexPartition(ref.stub)
+	delete(coldPartitions[partition], ref.stub.ID)
+	delete(coldQuestions, entryKey(ref.stub.Tenant, ref.stub.Owner, ref.stub.Question))
+	coldDirty[ref.stub.Tenant] = true
+}
+
+func coldRefsLocked() []*coldRef {
+	var refs []*coldRef
+	for _, partition := range coldPartitions {
+		for _, ref := range partition {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// loadColdTier reads every tenant's cold index and the segments it lists,
+// running the integrity checks over them, and starts flushing the cold tier
+// in the background.
+func loadColdTier() {
+	if !tieringEnabled() {
+		return
+	}
+	target := activeS3Target()
+	if target == nil {
+		disableTiering("S3 is not configured")
+		return
+	}
+	tenants, err := listTenants(target)
+	if err != nil {
+		log.Printf("Read cold tier failed: %v", err)
+	}
+
+	loaded := 0
+	for _, tenant := range tenants {
+		body, err := getObject(target, coldIndexKey(tenant))
+		if err != nil || body == nil {
+			if err != nil {
+				log.Printf("Read cold index for %q failed: %v", tenantName(tenant), err)
+			}
+			continue
+		}
+		var index coldIndexObject
+		if err := json.Unmarshal(body, &index); err != nil {
+			log.Printf("Cold index for %q is invalid: %v", tenantName(tenant), err)
+			continue
+		}
+		written := make(map[string]bool, len(index.Segments))
+		for segment, ids := range index.Segments {
+			written[segment] = true
+			entries, err := readColdSegment(target, segment)
+			if err != nil {
+				log.Printf("Read cold segment %s failed: %v", segment, err)
+				continue
+			}
+			live := make(map[string]bool, len(ids))
+			for _, id := range ids {
+				live[id] = true
+			}
+			coldMutex.Lock()
+			for _, entry := range entries {
+				if live[entry.ID] && entry.Tenant == tenant {
+					addColdLocked(&coldRef{stub: coldStub(entry), segment: segment})
+					loaded++
+				}
+			}
+			coldMutex.Unlock()
+		}
+		coldMutex.Lock()
+		coldSegments[tenant] = written
+		delete(coldDirty, tenant)
+		coldMutex.Unlock()
+	}
+	log.Printf("Tiering: hot capacity %d, %d cold entries", hotTierSize, loaded)
+
+	ticker := time.NewTicker(envDuration("ECHO_COLD_TIER_FLUSH", 10*time.Second))
+	go func() {
+		defer ticker.Stop()
+		for range ticker.C {
+			flushColdTier()
+		}
+	}()
+}
+
+// readColdSegment downloads a segment and runs the integrity checks over it,
+// quarantining lines that fail them.
+func readColdSegment(target *s3Target, key string) ([]VectorEntry, error) {
+	body, err := getObject(target, key)
+	if err != nil {
+		return nil, err
+	}
+	var raw []json.RawMessage
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) > 0 {
+			raw = append(raw, json.RawMessage(line))
+		}
+	}
+	entries, quarantined := verifyEntries("cold:"+key, raw)
+	if len(quarantined) > 0 {
+		quarantineToS3(target, key, quarantined)
+	}
+	return entries, nil
+}
+
+func encodeColdSegment(entries []VectorEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// flushColdTier writes a segment for each tenant's pending entries, then the
+// index of every tenant whose cold tier changed, then deletes the segments
+// the new indexes no longer list. Failures are retried on the next flush.
+func flushColdTier() {
+	target := activeS3Target()
+	if target == nil {
+		return
+	}
+	coldFlushMutex.Lock()
+	defer coldFlushMutex.Unlock()
+
+	coldMutex.Lock()
+	pending := make(map[string][]VectorEntry)
+	for _, ref := range coldRefsLocked() {
+		if ref.pending != nil {
+			pending[ref.stub.Tenant] = append(pending[ref.stub.Tenant], *ref.pending)
+		}
+	}
+	coldMutex.Unlock()
+
+	for tenant, entries := range pending {
+		key := coldSegmentKey(tenant)
+		body, err := encodeColdSegment(entries)
+		if err == nil {
+			err = putObject(target, key, body, "application/x-ndjson", tenantKMSKey(tenant))
+		}
+		if err != nil {
+			log.Printf("Write cold segment for %q failed: %v", tenantName(tenant), err)
+			continue
+		}
+		coldMutex.Lock()
+		for _, entry := range entries {
+			partition, _ := indexPartition(entry)
+			if ref, ok := coldPartitions[partition][entry.ID]; ok && ref.pending != nil {
+				ref.segment, ref.pending = key, nil
+			}
+		}
+		// Recorded as listed so that it is deleted even if all its entries
+		// are promoted before an index lists it.
+		if coldSegments[tenant] == nil {
+			coldSegments[tenant] = make(map[string]bool)
+		}
+		coldSegments[tenant][key] = true
+		coldDirty[tenant] = true
+		coldMutex.Unlock()
+	}
+
+	coldMutex.Lock()
+	indexes := make(map[string]coldIndexObject, len(coldDirty))
+	for tenant := range coldDirty {
+		indexes[tenant] = coldIndexObject{Segments: make(map[string][]string)}
+	}
+	for _, ref := range coldRefsLocked() {
+		if index, ok := indexes[ref.stub.Tenant]; ok && ref.segment != "" {
+			index.Segments[ref.segment] = append(index.Segments[ref.segment], ref.stub.ID)
+		}
+	}
+	clear(coldDirty)
+	coldMutex.Unlock()
+
+	for tenant, index := range indexes {
+		body, err := json.Marshal(index)
+		if err == nil {
+			err = putObject(target, coldIndexKey(tenant), body, "application/json", tenantKMSKey(tenant))
+		}
+		if err != nil {
+			log.Printf("Write cold index for %q failed: %v", tenantName(tenant), err)
+			coldMutex.Lock()
+			coldDirty[tenant] = true
+			coldMutex.Unlock()
+			continue
+		}
+
+		coldMutex.Lock()
+		previous := coldSegments[tenant]
+		written := make(map[string]bool, len(index.Segments))
+		for segment := range index.Segments {
+			written[segment] = true
+		}
+		coldSegments[tenant] = written
+		coldMutex.Unlock()
+		for segment := range previous {
+			if !written[segment] {
+				if err := deleteObject(target, segment); err != nil {
+					log.Printf("Delete cold segment %s failed: %v", segment, err)
+				}
+			}
+		}
+	}
+}
+
+func isColdQuestion(questionKey string) bool {
+	if !tieringEnabled() {
+		return false
+	}
+	coldMutex.Lock()
+	defer coldMutex.Unlock()
+	_, ok := coldQuestions[questionKey]
+	return ok
+}
+
+// lookupForCaller searches the caller's private entries before the shared
+// cache of their tenant. Like findBestMatch, a miss reports the best
+// similarity seen across every tier searched.
+func lookupForCaller(ctx context.Context, caller Caller, query cacheQuery) (VectorEntry, bool, error) {
+	if node, remote := shardOwner(caller.Tenant, query.Text, query.Vector); remote {
+		return remoteLookup(ctx, node, caller, query)
+	}
+	return lookupLocal(ctx, caller, query)
+}
+
+// lookupLocal is lookupForCaller against this node's cache only.
+func lookupLocal(ctx context.Context, caller Caller, query cacheQuery) (VectorEntry, bool, error) {
+	if !bloomMayMatch(caller.Tenant, query.Text) {
+		return VectorEntry{}, false, nil
+	}
+	bestMiss := 0.0
+	if caller.User != "" {
+		match, ok, err := lookupCache(ctx, caller.Tenant, caller.User, query)
+		if err != nil || ok {
+			return match, ok, err
+		}
+		bestMiss = match.Similarity
+	}
+	match, ok, err := lookupCache(ctx, caller.Tenant, sharedOwner, query)
+	if err == nil && !ok {
+		match.Similarity = max(match.Similarity, bestMiss)
+	}
+	return match, ok, err
+}
+
+// lookupCache searches the hot tier, then the cold tier, recording hit counts
+// and recency so demotion can pick the least valuable entries.
+func lookupCache(ctx context.Context, tenant, owner string, query cacheQuery) (VectorEntry, bool, error) {
+	match, ok, err := findBestMatch(ctx, tenant, owner, query)
+	if err != nil {
+		return VectorEntry{}, false, err
+	}
+	if ok {
+		touchEntry(match.Seq)
+		updateTierStats(func(s *TierStats) { s.HotHits++ })
+		return match, true, nil
+	}
+	if !tieringEnabled() {
+		return match, false, nil
+	}
+
+	updateTierStats(func(s *TierStats) { s.ColdLookups++ })
+	hotMiss := match.Similarity
+	match, ok, err = promoteColdMatch(ctx, tenant, owner, query)
+	if err != nil {
+		return VectorEntry{}, false, err
+	}
+	if !ok {
+		return VectorEntry{Similarity: max(hotMiss, match.Similarity)}, false, nil
+	}
+	updateTierStats(func(s *TierStats) {
+		s.ColdHits++
+		s.Promotions++
+	})
+	return match, true, nil
+}
+
+func touchEntry(seq uint64) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	for i := range MockVectorDB {
+		if MockVectorDB[i].Seq == seq {
+			MockVectorDB[i].HitCount++
+			MockVectorDB[i].LastHitAt = time.Now()
+			return
+		}
+	}
+}
+
+func updateTierStats(update func(*TierStats)) {
+	tierMutex.Lock()
+	defer tierMutex.Unlock()
+	update(&tierStats)
+}
+
+// entryHeat is when entry was last hit, or created if it never was. Demotion
+// ranks entries by hit count first and uses heat as the tie breaker.
+func entryHeat(entry VectorEntry) time.Time {
+	if entry.LastHitAt.After(entry.CreatedAt) {
+		return entry.LastHitAt
+	}
+	return entry.CreatedAt
+}
+
+// hotTierLowWater is what enforceHotTierLocked demotes down to. Demoting a
+// tenth of the capacity at once keeps it from ranking the whole hot tier on
+// every insert.
+func hotTierLowWater() int {
+	return hotTierSize - hotTierSize/10
+}
+
+// enforceHotTierLocked demotes the least hit entries, least recently hit
+// first among equals, once MockVectorDB exceeds the hot capacity. Pinned
+// entries are never demoted. Callers must hold dbMutex for writing.
+func enforceHotTierLocked() {
+	if !tieringEnabled() || len(MockVectorDB) <= hotTierSize {
+		return
+	}
+
+	ranked := make([]int, 0, len(MockVectorDB))
+	for i, entry := range MockVectorDB {
+		if !entry.Pinned {
+			ranked = append(ranked, i)
+		}
+	}
+	sort.SliceStable(ranked, func(a, b int) bool {
+		ea, eb := MockVectorDB[ranked[a]], MockVectorDB[ranked[b]]
+		if ea.HitCount != eb.HitCount {
+			return ea.HitCount < eb.HitCount
+		}
+		return entryHeat(ea).Before(entryHeat(eb))
+	})
+
+	excess := min(len(MockVectorDB)-hotTierLowWater(), len(ranked))
+	demote := make(map[int]struct{}, excess)
+	for _, idx := range ranked[:excess] {
+		demote[idx] = struct{}{}
+	}
+
+	kept := make([]VectorEntry, 0, len(MockVectorDB)-excess)
+	demoted := make([]VectorEntry, 0, len(demote))
+	for i, entry := range MockVectorDB {
+		if _, ok := demote[i]; ok {
+			demoted = append(demoted, entry)
+			continue
+		}
+		kept = append(kept, entry)
+	}
+
+	if err := appendColdEntries(demoted); err != nil {
+		log.Printf("Demote to cold tier failed: %v", err)
+		return
+	}
+	MockVectorDB = kept
+	invalidateIndexLocked()
+	for _, entry := range demoted {
+		recordEvent(Event{Type: eventCacheEvict, Tenant: entry.Tenant, EntryID: entry.ID, Reason: "demoted"})
+	}
+	updateTierStats(func(s *TierStats) { s.Demotions += len(demoted) })
+}
+
+// appendColdEntries moves entries to the cold tier. They are searchable
+// right away and written to S3 by the next flush, which it starts.
+func appendColdEntries(entries []VectorEntry) error {
+	if activeS3Target() == nil {
+		return fmt.Errorf("S3 is not configured")
+	}
+	coldMutex.Lock()
+	for _, entry := range entries {
+		full := entry
+		addColdLocked(&coldRef{stub: coldStub(entry), pending: &full})
+	}
+	coldMutex.Unlock()
+	go flushColdTier()
+	return nil
+}
+
+// fetchColdEntries returns the full entries behind refs, reading each
+// segment once.
+func fetchColdEntries(refs []coldRef) ([]VectorEntry, error) {
+	var entries []VectorEntry
+	wanted := make(map[string]map[string]bool)
+	for _, ref := range refs {
+		if ref.pending != nil {
+			entries = append(entries, *ref.pending)
+			continue
+		}
+		if wanted[ref.segment] == nil {
+			wanted[ref.segment] = make(map[string]bool)
+		}
+		wanted[ref.segment][ref.stub.ID] = true
+	}
+	if len(wanted) == 0 {
+		return entries, nil
+	}
+
+	target := activeS3Target()
+	if target == nil {
+		return entries, fmt.Errorf("S3 is not configured")
+	}
+	for segment, ids := range wanted {
+		segmentEntries, err := readColdSegment(target, segment)
+		if err != nil {
+			return entries, fmt.Errorf("read %s: %w", segment, err)
+		}
+		for _, entry := range segmentEntries {
+			if ids[entry.ID] {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// readColdEntries returns every cold entry in full, which reads the cold
+// tier from S3.
+func readColdEntries() ([]VectorEntry, error) {
+	coldMutex.Lock()
+	refs := make([]coldRef, 0, len(coldQuestions))
+	for _, ref := range coldRefsLocked() {
+		refs = append(refs, *ref)
+	}
+	coldMutex.Unlock()
+	return fetchColdEntries(refs)
+}
+
+// coldStubs returns every cold entry without its answer.
+func coldStubs() []VectorEntry {
+	coldMutex.Lock()
+	defer coldMutex.Unlock()
+	stubs := make([]VectorEntry, 0, len(coldQuestions))
+	for _, ref := range coldRefsLocked() {
+		stubs = append(stubs, ref.stub)
+	}
+	return stubs
+}
+
+// takeColdEntries removes the cold entries match selects and returns them in
+// full. Entries whose segment cannot be read stay cold.
+func takeColdEntries(match func(VectorEntry) bool) ([]VectorEntry, error) {
+	coldMutex.Lock()
+	var refs []coldRef
+	for _, ref := range coldRefsLocked() {
+		if match(ref.stub) {
+			refs = append(refs, *ref)
+		}
+	}
+	coldMutex.Unlock()
+
+	entries, err := fetchColdEntries(refs)
+	taken := entries[:0]
+	coldMutex.Lock()
+	for _, entry := range entries {
+		partition, _ := indexPartition(entry)
+		if ref, ok := coldPartitions[partition][entry.ID]; ok {
+			removeColdLocked(ref)
+			taken = append(taken, entry)
+		}
+	}
+	coldMutex.Unlock()
+	return taken, err
+}
+
+// bestColdRefLocked finds tenant's best cold match for query among owner's
+// entries, and the public entries tenant may search. Callers must hold
+// coldMutex.
+func bestColdRefLocked(ctx context.Context, tenant, owner string, query cacheQuery) (*coldRef, float64, error) {
+	partitions := []string{tenant}
+	if sharesPublicEntries(tenant) {
+		partitions = append(partitions, publicIndexTenant)
+	}
+
+	var refs []*coldRef
+	scanned := 0
+	same := languageCandidate{pos: -1}
+	other := languageCandidate{pos: -1}
+	for _, partition := range partitions {
+		for _, ref := range coldPartitions[partition] {
+			if scanned%cancelCheckInterval == 0 && ctx.Err() != nil {
+				return nil, 0, ctx.Err()
+			}
+			scanned++
+			entry := ref.stub
+			if !inLookupTier(entry, tenant, owner) || !query.partitionMatches(entry) {
+				continue
+			}
+			refs = append(refs, ref)
+			best := &other
+			if sameLanguage(query.Language, entryLanguage(entry)) {
+				best = &same
+			}
+			if score := cosineSimilarity(query.Vector, scoringVector(entry.Vector)); score > best.score {
+				*best = languageCandidate{pos: len(refs) - 1, score: score}
+			}
+		}
+	}
+	match := pickLanguageMatch(same, other, query.threshold())
+	if match.pos < 0 {
+		return nil, match.score, nil
+	}
+	return refs[match.pos], match.score, nil
+}
+
+// peekColdMatch finds the best cold-tier match without promoting it. The
+// match carries no answer.
+func peekColdMatch(ctx context.Context, tenant, owner string, query cacheQuery) (VectorEntry, bool, error) {
+	coldMutex.Lock()
+	ref, bestScore, err := bestColdRefLocked(ctx, tenant, owner, query)
+	coldMutex.Unlock()
+	if err != nil || ref == nil {
+		return VectorEntry{}, false, err
+	}
+	match := ref.stub
+	match.Similarity = bestScore
+	return match, bestScore >= query.threshold(), nil
+}
+
+// promoteColdMatch searches the cold tier for the best match and, on a hit,
+// fetches the entry and moves it back into the hot tier.
+func promoteColdMatch(ctx context.Context, tenant, owner string, query cacheQuery) (VectorEntry, bool, error) {
+	coldMutex.Lock()
+	ref, bestScore, err := bestColdRefLocked(ctx, tenant, owner, query)
+	var found coldRef
+	if ref != nil {
+		found = *ref
+	}
+	coldMutex.Unlock()
+	if err != nil {
+		return VectorEntry{}, false, err
+	}
+	if ref == nil || bestScore < query.threshold() {
+		return VectorEntry{Similarity: bestScore}, false, nil
+	}
+
+	// The entry stays indexed while it is fetched, so a flush cannot delete
+	// its segment; it leaves the cold tier only once it is in hand.
+	entries, err := fetchColdEntries([]coldRef{found})
+	if err != nil || len(entries) == 0 {
+		log.Printf("Read cold entry %s failed: %v", found.stub.ID, err)
+		return VectorEntry{Similarity: bestScore}, false, nil
+	}
+	match := entries[0]
+	coldMutex.Lock()
+	partition, _ := indexPartition(found.stub)
+	ref, ok := coldPartitions[partition][found.stub.ID]
+	if ok {
+		removeColdLocked(ref)
+	}
+	coldMutex.Unlock()
+	if !ok {
+		// Promoted or removed meanwhile.
+		return VectorEntry{Similarity: bestScore}, false, nil
+	}
+
+	match.HitCount++
+	match.LastHitAt = time.Now()
+	match.Vector = reduceVector(match.Vector)
+
+	dbMutex.Lock()
+	cacheSeq++
+	match.Seq = cacheSeq
+	MockVectorDB = append(MockVectorDB, match)
+	indexAppendLocked(len(MockVectorDB) - 1)
+	enforceHotTierLocked()
+	dbMutex.Unlock()
+
+	match.Similarity = bestScore
+	return match, true, nil
+}
+
+func currentTierStats() *TierStats {
+	if !tieringEnabled() {
+		return nil
+	}
+
+	dbMutex.RLock()
+	hotEntries := len(MockVectorDB)
+	var hotBytes int64
+	for _, entry := range MockVectorDB {
+		hotBytes += int64(len(entry.Vector)*4 + len(entry.Question) + len(entry.Answer) + len(entry.CompressedAnswer))
+	}
+	dbMutex.RUnlock()
+
+	coldMutex.Lock()
+	coldEntries := len(coldQuestions)
+	coldMutex.Unlock()
+
+	tierMutex.Lock()
+	stats := tierStats
+	tierMutex.Unlock()
+
+	stats.HotCapacity = hotTierSize
+	stats.HotEntries = hotEntries
+	stats.HotBytes = hotBytes
+	stats.ColdEntries = coldEntries
+	return &stats
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// The token guard checks a prompt against the model's context window before
+// the provider sees it, instead of letting the provider fail opaquely.
+// ECHO_MAX_PROMPT_TOKENS lowers the window further, e.g. to cap cost.
+// ECHO_PROMPT_OVERFLOW picks what happens to an overlong prompt: reject
+// (default) answers 413, truncate keeps its beginning and end, and summarize
+// has the model condense it piece by piece. The action taken is returned to
+// the client and recorded in history. Tokens are estimated as in
+// estimateTokens.
+
+const (
+	overflowReject    = "reject"
+	overflowTruncate  = "truncate"
+	overflowSummarize = "summarize"
+
+	promptTruncated  = "truncated"
+	promptSummarized = "summarized"
+
+	// defaultContextTokens applies to models missing from
+	// modelContextTokens.
+	defaultContextTokens = 32768
+	truncationMarker     = "\n\n[... truncated ...]\n\n"
+)
+
+// modelContextTokens is each model's input token limit.
+var modelContextTokens = map[string]int{
+	"gemini-2.5-flash":      1048576,
+	"gemini-2.5-flash-lite": 1048576,
+}
+
+type promptTooLongError struct {
+	Tokens int
+	Limit  int
+	Model  string
+}
+
+func (e *promptTooLongError) Error() string {
+	return fmt.Sprintf("prompt is about %d tokens; %s accepts at most %d", e.Tokens, e.Model, e.Limit)
+}
+
+func promptTokenLimit(model string) int {
+	limit, ok := modelContextTokens[model]
+	if !ok {
+		limit = defaultContextTokens
+	}
+	if configured := envInt("ECHO_MAX_PROMPT_TOKENS", 0); configured > 0 && configured < limit {
+		limit = configured
+	}
+	return limit
+}
+
+func promptOverflowPolicy() string {
+	return strings.ToLower(envString("ECHO_PROMPT_OVERFLOW", overflowReject))
+}
+
+// guardPrompt fits prompt into model's window per ECHO_PROMPT_OVERFLOW. It
+// returns the prompt to send and the action taken, "" when the prompt fit.
+// Rejections are *promptTooLongError.
+func guardPrompt(ctx context.Context, caller Caller, prompt, model string) (string, string, error) {
+	limit := promptTokenLimit(model)
+	tokens := estimateTokens(prompt)
+	if tokens <= limit {
+		return prompt, "", nil
+	}
+
+	switch promptOverflowPolicy() {
+	case overflowTruncate:
+		return truncatePrompt(prompt, limit), promptTruncated, nil
+	case overflowSummarize:
+		summary, err := summarizePrompt(ctx, caller, prompt, model, limit)
+		if err != nil {
+			return "", "", err
+		}
+		return summary, promptSummarized, nil
+	default:
+		return "", "", &promptTooLongError{Tokens: tokens, Limit: limit, Model: model}
+	}
+}
+
+// truncatePrompt cuts the middle out of prompt, keeping the instructions at
+// its start and the question at its end.
+func truncatePrompt(prompt string, limit int) string {
+	runes := []rune(prompt)
+	keep := limit*4 - len([]rune(truncationMarker))
+	if keep <= 0 {
+		return string(runes[:limit*4])
+	}
+	head := keep / 2
+	return string(runes[:head]) + truncationMarker + string(runes[len(runes)-(keep-head):])
+}
+
+// summarizePrompt condenses prompt in pieces of half the window each, then
+// truncates the joined summaries if they still do not fit.
+func summarizePrompt(ctx context.Context, caller Caller, prompt, model string, limit int) (string, error) {
+	runes := []rune(prompt)
+	pieceRunes := max(limit*4/2, 1)
+	var summaries []string
+	for start := 0; start < len(runes); start += pieceRunes {
+		piece := string(runes[start:min(start+pieceRunes, len(runes))])
+		request := "Condense the following part of a longer request. Keep every question, instruction and fact needed to answer it.\n\n" + piece
+		summary, err := generateAnswer(ctx, request, model)
+		if err != nil {
+			return "", fmt.Errorf("summarize prompt: %w", err)
+		}
+		recordUsage(caller, model, "CLOUD", estimateTokens(request)+estimateTokens(summary), 0)
+		summaries = append(summaries, summary)
+	}
+	summary := strings.Join(summaries, "\n\n")
+	if estimateTokens(summary) > limit {
+		summary = truncatePrompt(summary, limit)
+	}
+	return summary, nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Deleting a cache entry moves it to the trash, where it stays restorable for
+// ECHO_TRASH_RETENTION (default 7 days) before it is purged for good. With S3
+// configured the trash is kept in trash.json so it survives restarts, and
+// trashed questions are not merged back in from S3 or peers meanwhile.
+
+const trashObjectKey = "trash.json"
+
+type TrashedEntry struct {
+	Entry     VectorEntry `json:"entry"`
+	DeletedAt time.Time   `json:"deletedAt"`
+	DeletedBy string      `json:"deletedBy"`
+}
+
+type TrashedEntryView struct {
+	CacheEntryView
+	DeletedAt time.Time `json:"deletedAt"`
+	DeletedBy string    `json:"deletedBy"`
+	PurgeAt   time.Time `json:"purgeAt"`
+}
+
+var (
+	// trashMutex guards trash and is taken after dbMutex or coldMutex when
+	// both are held.
+	trashMutex       sync.Mutex
+	trash            []TrashedEntry
+	trashPersistLock sync.Mutex
+)
+
+func trashRetention() time.Duration {
+	return envDuration("ECHO_TRASH_RETENTION", 7*24*time.Hour)
+}
+
+// purgeTrashLocked drops entries past the retention window. Callers hold
+// trashMutex.
+func purgeTrashLocked(now time.Time) int {
+	cutoff := now.Add(-trashRetention())
+	kept := trash[:0]
+	for _, trashed := range trash {
+		if trashed.DeletedAt.After(cutoff) {
+			kept = append(kept, trashed)
+		}
+	}
+	purged := len(trash) - len(kept)
+	trash = kept
+	return purged
+}
+
+// isTrashedQuestion reports whether a trashed entry holds questionKey.
+func isTrashedQuestion(questionKey string) bool {
+	trashMutex.Lock()
+	defer trashMutex.Unlock()
+	for _, trashed := range trash {
+		if entryKey(trashed.Entry.Tenant, trashed.Entry.Owner, trashed.Entry.Question) == questionKey {
+			return true
+		}
+	}
+	return false
+}
+
+// trashEntry moves the entry with id in tenant from the hot or cold tier to
+// the trash.
+func trashEntry(tenant, id, actor string) (VectorEntry, bool) {
+	dbMutex.Lock()
+	for i, entry := range MockVectorDB {
+		if entry.ID != id || entry.Tenant != tenant {
+			continue
+		}
+		MockVectorDB = append(MockVectorDB[:i], MockVectorDB[i+1:]...)
+		invalidateIndexLocked()
+		addToTrash(entry, actor)
+		dbMutex.Unlock()
+		return entry, true
+	}
+	dbMutex.Unlock()
+
+	if !tieringEnabled() {
+		return VectorEntry{}, false
+	}
+	taken, err := takeColdEntries(func(entry VectorEntry) bool {
+		return entry.ID == id && entry.Tenant == tenant
+	})
+	if err != nil {
+		log.Printf("Read cold tier failed: %v", err)
+	}
+	if len(taken) == 0 {
+		return VectorEntry{}, false
+	}
+	addToTrash(taken[0], actor)
+	return taken[0], true
+}
+
+func addToTrash(entry VectorEntry, actor string) {
+	markCacheChanged()
+	recordCacheChange(changeDeleted, entry)
+	trashMutex.Lock()
+	defer trashMutex.Unlock()
+	now := time.Now()
+	purgeTrashLocked(now)
+	entry.Similarity = 0
+	trash = append(trash, TrashedEntry{Entry: entry, DeletedAt: now, DeletedBy: actor})
+}
+
+// restoreEntry moves a trashed entry back into the hot tier. It fails with
+// 404 when the entry is not in the trash and 409 when its question has been
+// cached again since.
+func restoreEntry(tenant, id string) (VectorEntry, int) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	trashMutex.Lock()
+	defer trashMutex.Unlock()
+	purgeTrashLocked(time.Now())
+
+	pos := -1
+	for i, trashed := range trash {
+		if trashed.Entry.ID == id && trashed.Entry.Tenant == tenant {
+			pos = i
+			break
+		}
+	}
+	if pos < 0 {
+		return VectorEntry{}, http.StatusNotFound
+	}
+	entry := trash[pos].Entry
+	questionKey := entryKey(entry.Tenant, entry.Owner, entry.Question)
+	for _, existing := range MockVectorDB {
+		if entryKey(existing.Tenant, existing.Owner, existing.Question) == questionKey {
+			return VectorEntry{}, http.StatusConflict
+		}
+	}
+	if isColdQuestion(questionKey) {
+		return VectorEntry{}, http.StatusConflict
+	}
+
+	trash = append(trash[:pos], trash[pos+1:]...)
+	cacheSeq++
+	entry.Seq = cacheSeq
+	MockVectorDB = append(MockVectorDB, entry)
+	indexAppendLocked(len(MockVectorDB) - 1)
+	markCacheChanged()
+	recordCacheChange(changeCreated, entry)
+	enforceHotTierLocked()
+	return entry, http.StatusOK
+}
+
+func loadTrash() {
+	target := activeS3Target()
+	if target == nil {
+		return
+	}
+	body, err := getObject(target, trashObjectKey)
+	if err != nil || body == nil {
+		if err != nil {
+			log.Printf("Load trash failed: %v", err)
+		}
+		return
+	}
+	var loaded []TrashedEntry
+	if err := json.Unmarshal(body, &loaded); err != nil {
+		log.Printf("Decode %s failed: %v", trashObjectKey, err)
+		return
+	}
+
+	trashMutex.Lock()
+	trash = append(trash, loaded...)
+	purgeTrashLocked(time.Now())
+	trashMutex.Unlock()
+}
+
+func persistTrash() {
+	target := activeS3Target()
+	if target == nil {
+		return
+	}
+	trashPersistLock.Lock()
+	defer trashPersistLock.Unlock()
+
+	trashMutex.Lock()
+	body, err := json.Marshal(trash)
+	trashMutex.Unlock()
+	if err != nil {
+		log.Printf("Encode trash failed: %v", err)
+		return
+	}
+	if err := putObject(target, trashObjectKey, body, "application/json", ""); err != nil {
+		log.Printf("Persist trash failed: %v", err)
+	}
+}
+
+// handleDeleteEntry moves a cache entry of the request's tenant to the trash.
+func handleDeleteEntry(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	tenant, err := resolveTenant(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	entry, found := trashEntry(tenant, r.PathValue("id"), "admin")
+	if !found {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "cache entry not found"})
+		return
+	}
+	go persistTrash()
+	recordAudit(AuditEvent{Action: "cache.delete", EntryID: entry.ID, Tenant: entry.Tenant, Actor: "admin"})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRestoreEntry moves a trashed entry back into the cache.
+func handleRestoreEntry(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	tenant, err := resolveTenant(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	entry, status := restoreEntry(tenant, r.PathValue("id"))
+	switch status {
+	case http.StatusNotFound:
+		writeJSON(w, status, map[string]string{"error": "entry is not in the trash"})
+		return
+	case http.StatusConflict:
+		writeJSON(w, status, map[string]string{"error": "the question has been cached again since it was deleted"})
+		return
+	}
+	go persistTrash()
+	recordAudit(AuditEvent{Action: "cache.restore", EntryID: entry.ID, Tenant: entry.Tenant, Actor: "admin"})
+	writeJSON(w, http.StatusOK, entryView(entry))
+}
+
+// handleTrash lists the tenant's trashed entries, most recently deleted first.
+func handleTrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	tenant, err := resolveTenant(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	retention := trashRetention()
+	views := make([]TrashedEntryView, 0)
+	trashMutex.Lock()
+	purgeTrashLocked(time.Now())
+	for _, trashed := range trash {
+		if trashed.Entry.Tenant != tenant {
+			continue
+		}
+		views = append(views, TrashedEntryView{
+			CacheEntryView: entryView(trashed.Entry),
+			DeletedAt:      trashed.DeletedAt,
+			DeletedBy:      trashed.DeletedBy,
+			PurgeAt:        trashed.DeletedAt.Add(retention),
+		})
+	}
+	trashMutex.Unlock()
+	sort.Slice(views, func(i, j int) bool { return views[i].DeletedAt.After(views[j].DeletedAt) })
+	writeJSON(w, http.StatusOK, views)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"regexp"
+	"strings"
+)
+
+// A cache entry can hold answer variants per locale. When a hit is served to
+// a request whose locale differs from the answer's language, the variant is
+// produced once by the provider and kept on the entry, so later requests in
+// that locale are served from cache. ECHO_VARIANT_MODE picks how:
+//
+//	translate   translate the cached answer (default)
+//	regenerate  ask the provider the question again in the target locale
+
+const (
+	variantModeTranslate  = "translate"
+	variantModeRegenerate = "regenerate"
+)
+
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+func variantMode() string {
+	if envString("ECHO_VARIANT_MODE", variantModeTranslate) == variantModeRegenerate {
+		return variantModeRegenerate
+	}
+	return variantModeTranslate
+}
+
+// normalizeLocale canonicalizes a BCP 47 style tag such as "pt_br" to
+// "pt-BR".
+func normalizeLocale(raw string) (string, bool) {
+	raw = strings.ReplaceAll(strings.TrimSpace(raw), "_", "-")
+	if raw == "" {
+		return "", true
+	}
+	if !localePattern.MatchString(raw) {
+		return "", false
+	}
+	parts := strings.Split(raw, "-")
+	parts[0] = strings.ToLower(parts[0])
+	for i := 1; i < len(parts); i++ {
+		if len(parts[i]) == 2 {
+			parts[i] = strings.ToUpper(parts[i])
+		}
+	}
+	return strings.Join(parts, "-"), true
+}
+
+func localeLanguage(locale string) string {
+	language, _, _ := strings.Cut(locale, "-")
+	return language
+}
+
+func variantPrompt(entry VectorEntry, locale string) string {
+	if variantMode() == variantModeRegenerate {
+		return fmt.Sprintf("Answer in the language of locale %s.\n\n%s", locale, styledPrompt(entry.Question, entryStyle(entry)))
+	}
+	return fmt.Sprintf("Translate the following answer into the language of locale %s. Reply with the translation only.\n\n%s", locale, entryAnswer(entry))
+}
+
+// answerForLocale returns the answer to serve from entry for locale and the
+// provider tokens spent producing it. The original answer is served when
+// locale is empty or already matches it, and whenever a variant cannot be
+// produced.
+func answerForLocale(ctx context.Context, caller Caller, entry VectorEntry, locale, model string) (string, int) {
+	original := entryAnswer(entry)
+	if locale == "" {
+		return original, 0
+	}
+	answerLanguage := entryLanguage(entry)
+	if answerLanguage == languageUnknown {
+		answerLanguage = detectLanguage(original)
+	}
+	if answerLanguage == languageUnknown || answerLanguage == localeLanguage(locale) {
+		return original, 0
+	}
+	if variant, ok := entry.Variants[locale]; ok {
+		return variant, 0
+	}
+	if variant, ok := entry.Variants[localeLanguage(locale)]; ok {
+		return variant, 0
+	}
+	if caller.Anonymous || !checkTokenQuota(caller) {
+		return original, 0
+	}
+
+	prompt := variantPrompt(entry, locale)
+	variant, err := generateAnswer(ctx, prompt, model)
+	if err != nil {
+		fmt.Printf("Variant for %s failed, serving original answer: %v\n", locale, err)
+		return original, 0
+	}
+	setEntryVariant(entry.ID, locale, variant)
+	return variant, estimateTokens(prompt) + estimateTokens(variant)
+}
+
+// setEntryVariant stores a locale variant on the hot-tier entry with id. The
+// map is replaced rather than modified, since copies of the entry share it.
+func setEntryVariant(id, locale, answer string) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	for i := range MockVectorDB {
+		if MockVectorDB[i].ID != id {
+			continue
+		}
+		variants := maps.Clone(MockVectorDB[i].Variants)
+		if variants == nil {
+			variants = make(map[string]string, 1)
+		}
+		variants[locale] = answer
+		MockVectorDB[i].Variants = variants
+		markCacheChanged()
+		recordCacheChange(changeUpdated, MockVectorDB[i])
+		return
+	}
+}
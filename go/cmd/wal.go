@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Entries cached by this instance live only in RAM until the next S3 upload.
+// The write-ahead log closes that gap: the writer goroutine appends each
+// batch of new entries to ECHO_WAL_PATH and fsyncs it before the entries
+// become visible, and startup replays the log, so a crash minutes before a
+// sync loses nothing. A successful upload drops the records it covered.
+// The log only runs alongside S3 sync, the thing it is waiting on, and not in
+// stateless mode, where the state store holds new entries instead; set
+// ECHO_WAL_PATH=off to disable it.
+
+var (
+	// walMutex guards the fields below and the file's contents.
+	walMutex sync.Mutex
+	walFile  *os.File
+	walPath  string
+	// Positions in the log are logical: walBase counts the bytes truncated
+	// away, so a position stays valid across truncations.
+	walBase int64
+
+	// walApplied is the position up to which every logged entry is in
+	// MockVectorDB. dbMutex guards it, so it is read consistently with a
+	// snapshot of the cache.
+	walApplied int64
+)
+
+// initWAL replays the log into the cache and opens it for appending.
+func initWAL() {
+	path := envString("ECHO_WAL_PATH", filepath.Join(os.TempDir(), "echo-wal.jsonl"))
+	if path == "off" || stateless() {
+		return
+	}
+
+	entries, err := readWAL(path)
+	if err != nil {
+		log.Printf("Read write-ahead log failed: %v", err)
+	}
+	if len(entries) > 0 {
+		log.Printf("Write-ahead log: replayed %d of %d entries", mergeEntries(entries, cacheSourceLocal), len(entries))
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("Write-ahead log disabled: %v", err)
+		return
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		log.Printf("Write-ahead log disabled: %v", err)
+		return
+	}
+
+	walMutex.Lock()
+	walFile, walPath = file, path
+	walMutex.Unlock()
+	dbMutex.Lock()
+	walApplied = info.Size()
+	dbMutex.Unlock()
+}
+
+// readWAL decodes the log at path. A torn final record, left by a crash
+// mid-write, is skipped.
+func readWAL(path string) ([]VectorEntry, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []VectorEntry
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var entry VectorEntry
+			if jsonErr := json.Unmarshal(line, &entry); jsonErr != nil {
+				log.Printf("Write-ahead log: skipping unreadable record: %v", jsonErr)
+			} else {
+				entries = append(entries, entry)
+			}
+		}
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, err
+		}
+	}
+}
+
+// appendWAL durably logs entries and returns the position after them, or -1
+// when nothing was logged.
+func appendWAL(entries []VectorEntry) int64 {
+	if len(entries) == 0 {
+		return -1
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			log.Printf("Write-ahead log: encode entry %s failed: %v", entry.ID, err)
+			return -1
+		}
+	}
+
+	walMutex.Lock()
+	defer walMutex.Unlock()
+	if walFile == nil {
+		return -1
+	}
+	if _, err := walFile.Write(buf.Bytes()); err != nil {
+		log.Printf("Write-ahead log append failed: %v", err)
+		return -1
+	}
+	if err := walFile.Sync(); err != nil {
+		log.Printf("Write-ahead log sync failed: %v", err)
+	}
+	info, err := walFile.Stat()
+	if err != nil {
+		return -1
+	}
+	return walBase + info.Size()
+}
+
+// truncateWAL drops the log up to position upTo, whose entries a successful
+// upload has made durable in S3, keeping anything logged since.
+func truncateWAL(upTo int64) {
+	walMutex.Lock()
+	defer walMutex.Unlock()
+	cut := upTo - walBase
+	if walFile == nil || cut <= 0 {
+		return
+	}
+
+	rest, err := os.ReadFile(walPath)
+	if err != nil {
+		log.Printf("Write-ahead log truncate failed: %v", err)
+		return
+	}
+	if int64(len(rest)) < cut {
+		return
+	}
+	rest = rest[cut:]
+
+	tmpPath := walPath + ".tmp"
+	if err := os.WriteFile(tmpPath, rest, 0o600); err != nil {
+		log.Printf("Write-ahead log truncate failed: %v", err)
+		return
+	}
+	if err := os.Rename(tmpPath, walPath); err != nil {
+		log.Printf("Write-ahead log truncate failed: %v", err)
+		return
+	}
+	file, err := os.OpenFile(walPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("Write-ahead log reopen failed: %v", err)
+		return
+	}
+	walFile.Close()
+	walFile = file
+	walBase = upTo
+}
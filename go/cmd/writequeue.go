@@ -0,0 +1,112 @@
+package main
+
+import "time"
+
+// Cache inserts and history appends go through a buffered queue drained by a
+// single writer goroutine, which applies everything queued under one hold of
+// dbMutex, so under load a miss costs a fraction of a lock acquisition
+// instead of two. The caller still waits for its batch to be applied: an ID
+// returned to a client can be looked up right away, and nothing acknowledged
+// is lost if the process stops. ECHO_WRITE_QUEUE sets the queue length; 0
+// writes inline.
+
+const maxWriteBatch = 256
+
+type pendingWrite struct {
+	entry   *VectorEntry
+	history *HistoryItem
+	// flushed is closed once this write and every earlier one is applied.
+	flushed chan struct{}
+}
+
+var writeQueue chan pendingWrite
+
+func startWriteQueue() {
+	size := envInt("ECHO_WRITE_QUEUE", 1024)
+	if size <= 0 {
+		return
+	}
+	writeQueue = make(chan pendingWrite, size)
+	go func() {
+		for write := range writeQueue {
+			batch := []pendingWrite{write}
+		drain:
+			for len(batch) < maxWriteBatch {
+				select {
+				case write := <-writeQueue:
+					batch = append(batch, write)
+				default:
+					break drain
+				}
+			}
+			applyWrites(batch)
+		}
+	}()
+}
+
+// enqueueWrite queues write and returns once it is applied.
+func enqueueWrite(write pendingWrite) {
+	if writeQueue == nil {
+		applyWrites([]pendingWrite{write})
+		return
+	}
+	write.flushed = make(chan struct{})
+	writeQueue <- write
+	<-write.flushed
+}
+
+// flushWrites waits until every write queued so far is applied.
+func flushWrites() {
+	enqueueWrite(pendingWrite{})
+}
+
+func applyWrites(batch []pendingWrite) {
+	var entries []VectorEntry
+	for _, write := range batch {
+		if write.entry != nil {
+			entries = append(entries, *write.entry)
+		}
+	}
+	logged := appendWAL(entries)
+
+	var added []HistoryItem
+	dbMutex.Lock()
+	for _, write := range batch {
+		if write.entry != nil {
+			cacheSeq++
+			write.entry.Seq = cacheSeq
+			MockVectorDB = append(MockVectorDB, *write.entry)
+			indexAppendLocked(len(MockVectorDB) - 1)
+			markCacheChanged()
+			recordCacheChange(changeCreated, *write.entry)
+		}
+		if write.history != nil {
+			ChatHistory = append(ChatHistory, *write.history)
+			added = append(added, *write.history)
+		}
+	}
+	if logged >= 0 {
+		walApplied = logged
+	}
+	enforceHotTierLocked()
+	export := false
+	if len(added) > 0 {
+		export = trimHistoryLocked(time.Now())
+	}
+	dbMutex.Unlock()
+
+	for _, item := range added {
+		recordSavings(item.Tenant, item)
+	}
+	if stateless() && len(entries)+len(added) > 0 {
+		storeWrites(entries, added)
+	}
+	if export {
+		go trimExportedHistory()
+	}
+	for _, write := range batch {
+		if write.flushed != nil {
+			close(write.flushed)
+		}
+	}
+}